@@ -0,0 +1,154 @@
+// main.go - Command-line interface for the multi-party Groth16 setup ceremony.
+//
+// Usage:
+//
+//	ceremony start      -dir D [-circuits tx,register,exchange_f10,withdraw] [-value-bits B]
+//	ceremony contribute -dir D [-circuits ...] -name NAME [-statement TEXT]
+//	ceremony verify     -dir D [-circuits ...] [-value-bits B]
+//	ceremony finalize   -dir D [-circuits ...] [-value-bits B] -beacon HEX
+//
+// Each circuit gets its own ceremony in D/<circuit>. finalize closes the current phase:
+// run it once after the phase 1 contributions and once after the phase 2 contributions,
+// each time with a fresh public beacon. The final keys are written to D/<circuit>/<circuit>.pk/.vk.
+// By default every protocol circuit is set up, the exchange circuit once per supported size.
+// Circuits are compiled for -value-bits bit values (default zerocash.DefaultValueBits), which must
+// match the Params.ValueBits of the deployment and be the same for every command of a ceremony.
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"implementation/internal/ceremony"
+	_ "implementation/internal/transactions/exchange" // registers CircuitTxF
+	_ "implementation/internal/transactions/register" // registers CircuitTxRegister
+	_ "implementation/internal/transactions/withdraw" // registers CircuitWithdraw
+	"implementation/internal/zerocash"
+)
+
+// defaultCircuits are the circuits whose keys the protocol needs.
+var defaultCircuits = protocolCircuits()
+
+func protocolCircuits() []zerocash.CircuitID {
+	ids := []zerocash.CircuitID{zerocash.CircuitTxID, zerocash.CircuitRegisterID}
+	for _, n := range zerocash.SupportedSizes {
+		ids = append(ids, zerocash.ExchangeCircuitID(n))
+	}
+	return append(ids, zerocash.CircuitWithdrawID)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dir := fs.String("dir", "ceremony", "ceremony directory")
+	circuits := fs.String("circuits", "", "comma-separated circuit IDs (default: all protocol circuits)")
+	name := fs.String("name", "", "contributor name (contribute)")
+	statement := fs.String("statement", "", "contributor statement (contribute)")
+	beacon := fs.String("beacon", "", "hex-encoded public random beacon (finalize)")
+	valueBits := fs.Int("value-bits", 0, "value width the circuits are compiled for (default zerocash.DefaultValueBits)")
+	fs.Parse(os.Args[2:])
+
+	bits, err := (&zerocash.Params{ValueBits: *valueBits}).MaxValueBits()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ids := defaultCircuits
+	if *circuits != "" {
+		ids = nil
+		for _, id := range strings.Split(*circuits, ",") {
+			ids = append(ids, zerocash.CircuitID(strings.TrimSpace(id)))
+		}
+	}
+
+	for _, id := range ids {
+		circuitDir := filepath.Join(*dir, string(id))
+		switch cmd {
+		case "start":
+			err = start(circuitDir, id, bits)
+		case "contribute":
+			err = contribute(circuitDir, id, *name, *statement)
+		case "verify":
+			err = verify(circuitDir, id, bits)
+		case "finalize":
+			err = finalize(circuitDir, id, bits, *beacon)
+		default:
+			usage()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", cmd, id, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func start(dir string, id zerocash.CircuitID, bits int) error {
+	ccs, err := zerocash.CompiledCircuitFor(id, zerocash.BackendGroth16, bits)
+	if err != nil {
+		return err
+	}
+	t, err := ceremony.Start(dir, id, bits, ccs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: ceremony started in %s (domain size %d)\n", id, dir, t.DomainSize)
+	return nil
+}
+
+func contribute(dir string, id zerocash.CircuitID, name, statement string) error {
+	a, err := ceremony.Contribute(dir, name, statement)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s contribution %d by %s, hash %s\n", id, a.Phase, a.Index, a.Contributor, a.Hash)
+	return nil
+}
+
+func verify(dir string, id zerocash.CircuitID, bits int) error {
+	ccs, err := zerocash.CompiledCircuitFor(id, zerocash.BackendGroth16, bits)
+	if err != nil {
+		return err
+	}
+	t, err := ceremony.Verify(dir, ccs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: transcript valid (%s, %d contributions)\n", id, t.Phase, len(t.Attestations))
+	return nil
+}
+
+func finalize(dir string, id zerocash.CircuitID, bits int, beaconHex string) error {
+	beacon, err := hex.DecodeString(beaconHex)
+	if err != nil {
+		return fmt.Errorf("invalid beacon: %w", err)
+	}
+	ccs, err := zerocash.CompiledCircuitFor(id, zerocash.BackendGroth16, bits)
+	if err != nil {
+		return err
+	}
+	t, err := ceremony.Finalize(dir, ccs, beacon)
+	if err != nil {
+		return err
+	}
+	if t.Phase == ceremony.PhaseDone {
+		pkPath, vkPath := ceremony.KeyPaths(dir, id)
+		fmt.Printf("%s: keys written to %s and %s\n", id, pkPath, vkPath)
+	} else {
+		fmt.Printf("%s: phase1 sealed, ready for phase2 contributions\n", id)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ceremony start|contribute|verify|finalize -dir DIR [-circuits IDS] [-value-bits B] [-name NAME] [-statement TEXT] [-beacon HEX]")
+	os.Exit(2)
+}
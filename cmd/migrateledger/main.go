@@ -0,0 +1,42 @@
+// main.go - Rewrites ledger files in the current format, removing plaintext notes.
+//
+// Usage:
+//
+//	migrateledger [ledger.json ...]
+//
+// Ledgers written before version 2 stored each transaction with its old and new notes in
+// plaintext, and version 2 ledgers with its coins, energy and old owner key, as version 3 ledgers
+// did for batches. Each file is rewritten in place with public transactions only; files that are
+// already current are left untouched.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"implementation/internal/zerocash"
+)
+
+func main() {
+	paths := os.Args[1:]
+	if len(paths) == 0 {
+		paths = []string{"ledger.json"}
+	}
+	failed := false
+	for _, path := range paths {
+		migrated, err := zerocash.MigrateLedgerFile(path)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		case migrated:
+			fmt.Printf("%s: migrated to ledger version %d\n", path, zerocash.LedgerVersion)
+		default:
+			fmt.Printf("%s: already at ledger version %d\n", path, zerocash.LedgerVersion)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
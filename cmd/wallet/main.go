@@ -0,0 +1,288 @@
+// main.go - Creates, restores and converts wallet files, and changes their passphrases.
+//
+// Usage:
+//
+//	wallet new     -name NAME -out wallet.json
+//	wallet restore -name NAME -out wallet.json [-ledger ledger.json]
+//	wallet import  -in plain.json -out wallet.json
+//	wallet export  -in wallet.json -out plain.json
+//	wallet passwd  -in wallet.json
+//	wallet viewkey -in wallet.json -out view.json [-incoming]
+//	wallet watch   -in view.json -name NAME -out watch.json
+//	wallet address -in wallet.json [-network ppemtest]
+//
+// new prints the BIP-39 mnemonic the wallet's keys are derived from; restore rebuilds the wallet
+// from that mnemonic (WALLET_MNEMONIC, or prompted for) and a scan of the ledger.
+// viewkey exports the wallet's full viewing key (or only its incoming viewing key), and watch
+// creates a watch-only wallet from it that lists the notes and spends but cannot spend; it does
+// not list exchange or withdraw outputs, which a viewing key does not cover.
+// address prints the wallet's payment address.
+// Passphrases are read from WALLET_PASSPHRASE (and WALLET_NEW_PASSPHRASE for passwd),
+// or prompted for on standard input. Exported files contain every secret key in plaintext.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"implementation/internal/zerocash"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	in := fs.String("in", "", "input wallet file")
+	out := fs.String("out", "", "output wallet file (passwd: defaults to -in)")
+	name := fs.String("name", "", "participant name (new, restore)")
+	ledgerPath := fs.String("ledger", "ledger.json", "ledger to scan (restore)")
+	network := fs.String("network", zerocash.DefaultNetwork, "payment address network (address)")
+	incoming := fs.Bool("incoming", false, "export the incoming viewing key only (viewkey)")
+	fs.Parse(os.Args[2:])
+	if *in == "" && cmd != "new" && cmd != "restore" {
+		usage()
+	}
+
+	var err error
+	switch cmd {
+	case "new":
+		err = newWallet(*name, *out)
+	case "restore":
+		err = restoreWallet(*name, *out, *ledgerPath)
+	case "import":
+		err = importWallet(*in, *out)
+	case "export":
+		err = exportWallet(*in, *out)
+	case "passwd":
+		if *out == "" {
+			*out = *in
+		}
+		err = changePassphrase(*in, *out)
+	case "viewkey":
+		err = exportViewingKey(*in, *out, *incoming)
+	case "watch":
+		err = watchWallet(*in, *name, *out)
+	case "address":
+		err = printAddress(*in, *network)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func newWallet(name, out string) error {
+	if name == "" || out == "" {
+		return fmt.Errorf("-name and -out are required")
+	}
+	mnemonic := zerocash.NewMnemonic()
+	seed, err := zerocash.MnemonicToSeed(mnemonic, "")
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.NewWalletFromSeed(name, seed)
+	if err != nil {
+		return err
+	}
+	if err := save(w, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: wallet created; write down its recovery phrase:\n\n%s\n", out, mnemonic)
+	return nil
+}
+
+func restoreWallet(name, out, ledgerPath string) error {
+	if name == "" || out == "" {
+		return fmt.Errorf("-name and -out are required")
+	}
+	mnemonic, err := readPassphrase("WALLET_MNEMONIC", "Recovery phrase: ")
+	if err != nil {
+		return err
+	}
+	seed, err := zerocash.MnemonicToSeed(string(mnemonic), "")
+	if err != nil {
+		return err
+	}
+	ledger, err := zerocash.LoadLedgerFromFile(ledgerPath)
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.RestoreWallet(name, seed, ledger)
+	if err != nil {
+		return err
+	}
+	if err := save(w, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: wallet restored with %d notes (%d unspent)\n", out, len(w.Notes), len(w.GetUnspentNotes()))
+	return nil
+}
+
+// save sets the wallet passphrase and writes the encrypted wallet.
+func save(w *zerocash.Wallet, out string) error {
+	passphrase, err := readPassphrase("WALLET_PASSPHRASE", "New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if err := w.SetPassphrase(passphrase); err != nil {
+		return err
+	}
+	return w.Save(out)
+}
+
+func importWallet(in, out string) error {
+	if out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	w, err := zerocash.ImportPlaintextWallet(in)
+	if err != nil {
+		return err
+	}
+	if m := w.Migration; m != nil {
+		fmt.Printf("%s: upgraded from wallet schema version %d\n", in, m.FromVersion)
+		for _, i := range m.Unrecoverable {
+			fmt.Printf("%s: note %d cannot be spent or withdrawn: its secrets were never saved\n", in, i)
+		}
+	}
+	if err := save(w, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: encrypted wallet written to %s; delete the plaintext file\n", in, out)
+	return nil
+}
+
+func exportWallet(in, out string) error {
+	if out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	passphrase, err := readPassphrase("WALLET_PASSPHRASE", "Passphrase: ")
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.LoadWallet(in, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := w.ExportPlaintext(out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: plaintext wallet written to %s\n", in, out)
+	return nil
+}
+
+func changePassphrase(in, out string) error {
+	passphrase, err := readPassphrase("WALLET_PASSPHRASE", "Current passphrase: ")
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.LoadWallet(in, passphrase)
+	if err != nil {
+		return err
+	}
+	newPassphrase, err := readPassphrase("WALLET_NEW_PASSPHRASE", "New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if err := w.ChangePassphrase(passphrase, newPassphrase); err != nil {
+		return err
+	}
+	if err := w.Save(out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: passphrase changed\n", out)
+	return nil
+}
+
+func exportViewingKey(in, out string, incoming bool) error {
+	if out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	passphrase, err := readPassphrase("WALLET_PASSPHRASE", "Passphrase: ")
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.LoadWallet(in, passphrase)
+	if err != nil {
+		return err
+	}
+	kind := "full"
+	var vk *zerocash.ViewingKey
+	if incoming {
+		kind = "incoming"
+		vk, err = w.IncomingViewingKey()
+	} else {
+		vk, err = w.FullViewingKey()
+	}
+	if err != nil {
+		return err
+	}
+	if err := zerocash.SaveViewingKey(out, vk); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s viewing key written to %s\n", in, kind, out)
+	return nil
+}
+
+func watchWallet(in, name, out string) error {
+	if name == "" || out == "" {
+		return fmt.Errorf("-name and -out are required")
+	}
+	vk, err := zerocash.LoadViewingKey(in)
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.NewWatchOnlyWallet(name, vk)
+	if err != nil {
+		return err
+	}
+	if err := save(w, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: watch-only wallet written to %s\n", in, out)
+	return nil
+}
+
+func printAddress(in, network string) error {
+	passphrase, err := readPassphrase("WALLET_PASSPHRASE", "Passphrase: ")
+	if err != nil {
+		return err
+	}
+	w, err := zerocash.LoadWallet(in, passphrase)
+	if err != nil {
+		return err
+	}
+	addr, err := w.PaymentAddress(network)
+	if err != nil {
+		return err
+	}
+	fmt.Println(addr)
+	return nil
+}
+
+// readPassphrase returns the passphrase from the environment variable, or prompts for it.
+func readPassphrase(env, prompt string) ([]byte, error) {
+	if p := os.Getenv(env); p != "" {
+		return []byte(p), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: wallet new|restore|import|export|passwd|viewkey|watch|address [-in FILE] [-out FILE] [-name NAME] [-ledger FILE] [-incoming] [-network NET]")
+	os.Exit(2)
+}
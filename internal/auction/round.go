@@ -0,0 +1,407 @@
+// round.go - Lifecycle of an auction round.
+//
+// An AuctionRound ties the phases of the protocol to one auction, its terms and its deadlines:
+//
+//	open                 participants submit registrations (Algorithm 2) until the registration deadline
+//	registration-closed  the auctioneer clears the registrations in an exchange proof (Algorithm 3)
+//	cleared              the exchange waits to be checked and settled
+//	settled              the exchange is verified and in the ledger; the withdraw window opens after a delay
+//	withdraw-window      participants submit withdrawals (Algorithm 4) until the withdraw deadline
+//	finalized            the round is over
+//
+// If the exchange is not settled by the clearing deadline, the round moves straight to the
+// withdraw window, so participants can take their registered notes back without the auctioneer.
+// Only the tx^in notes registered in the round can be withdrawn from it.
+//
+// A registration is accepted only with a valid π_reg for a tx^in note in the ledger, and only once
+// per note, so that every registration of the round can be cleared.
+//
+// The terms of the round (the auctioneer key and the mechanism, see exchange.Terms) are fixed when
+// it opens: the round clears with them, and settles only an exchange proven under them.
+//
+// The deadlines are read from an injectable Clock, so the time-driven transitions (closing the
+// registration, giving up on the clearing, opening and closing the withdraw window) happen on
+// the first call after they are due. Every change is written to the round file before the call returns, so a round
+// survives restarts of the auctioneer (LoadAuctionRound). Operations made in the wrong phase
+// fail with ErrWrongPhase.
+
+package auction
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/consensys/gnark/constraint"
+
+	"implementation/internal/transactions/exchange"
+	"implementation/internal/transactions/register"
+	"implementation/internal/transactions/withdraw"
+	"implementation/internal/zerocash"
+)
+
+// RoundVersion is the current version of the round file format.
+const RoundVersion = 2
+
+// Phase is the stage an auction round is in.
+type Phase string
+
+const (
+	PhaseOpen               Phase = "open"                // Accepting registrations
+	PhaseRegistrationClosed Phase = "registration-closed" // Waiting for the auctioneer to clear
+	PhaseCleared            Phase = "cleared"             // Exchange proven, not yet settled
+	PhaseSettled            Phase = "settled"             // Exchange verified, withdraw window pending
+	PhaseWithdrawWindow     Phase = "withdraw-window"     // Accepting withdrawals
+	PhaseFinalized          Phase = "finalized"           // Closed for good
+)
+
+// ErrWrongPhase is returned for an operation the round does not accept in its current phase.
+var ErrWrongPhase = errors.New("auction round is in the wrong phase")
+
+// Clock returns the current time. Rounds read their deadlines from it, so tests can drive them.
+type Clock func() time.Time
+
+// Schedule sets the deadlines of a round, relative to the events that start each period.
+type Schedule struct {
+	Registration  time.Duration `json:"registration"`   // From the creation of the round to the registration deadline
+	Clearing      time.Duration `json:"clearing"`       // From the close of the registration to the clearing deadline
+	WithdrawDelay time.Duration `json:"withdraw_delay"` // From settlement to the opening of the withdraw window
+	Withdraw      time.Duration `json:"withdraw"`       // Length of the withdraw window
+}
+
+// Transition records a phase change of a round.
+type Transition struct {
+	From Phase     `json:"from"`
+	To   Phase     `json:"to"`
+	At   time.Time `json:"at"` // When the change took effect: the deadline for time-driven ones
+}
+
+// AuctionRound is one auction and its lifecycle. Create it with NewAuctionRound or reopen it
+// with LoadAuctionRound; the exported fields are its persisted state and must not be modified
+// directly.
+type AuctionRound struct {
+	Version  int            `json:"version"`
+	ID       string         `json:"id"` // Round identifier, as in zerocash.RegistrationRecord.Round
+	Phase    Phase          `json:"phase"`
+	Schedule Schedule       `json:"schedule"`
+	Terms    exchange.Terms `json:"terms"` // Auctioneer key and mechanism, fixed when the round opens
+
+	OpenedAt             time.Time `json:"opened_at"`
+	RegistrationDeadline time.Time `json:"registration_deadline"`
+	ClearingDeadline     time.Time `json:"clearing_deadline,omitempty"` // Set when the registration closes
+	WithdrawOpens        time.Time `json:"withdraw_opens,omitempty"`    // Set at settlement
+	WithdrawDeadline     time.Time `json:"withdraw_deadline,omitempty"` // Set at settlement
+
+	Registrations []exchange.RegistrationPayload `json:"registrations"`
+	Exchange      *exchange.PublicExchangeTx     `json:"exchange,omitempty"` // Set when cleared
+	Withdrawals   []string                       `json:"withdrawals"`        // Serial numbers of the accepted withdrawals
+	History       []Transition                   `json:"history"`
+
+	path  string
+	clock Clock
+}
+
+// NewAuctionRound creates a round under terms in the open phase and writes it to path, which
+// must not exist. A nil clock is time.Now.
+func NewAuctionRound(path, id string, terms exchange.Terms, schedule Schedule, clock Clock) (*AuctionRound, error) {
+	if id == "" {
+		return nil, errors.New("round ID is required")
+	}
+	if err := terms.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid terms: %w", err)
+	}
+	if schedule.Registration <= 0 || schedule.Clearing <= 0 || schedule.Withdraw <= 0 || schedule.WithdrawDelay < 0 {
+		return nil, fmt.Errorf("invalid schedule %+v: the registration, clearing and withdraw periods must be positive", schedule)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("auction round already exists in %s", path)
+	}
+	if clock == nil {
+		clock = time.Now
+	}
+	now := clock().UTC()
+	r := &AuctionRound{
+		Version:              RoundVersion,
+		ID:                   id,
+		Phase:                PhaseOpen,
+		Schedule:             schedule,
+		Terms:                terms,
+		OpenedAt:             now,
+		RegistrationDeadline: now.Add(schedule.Registration),
+		Registrations:        []exchange.RegistrationPayload{},
+		Withdrawals:          []string{},
+		History:              []Transition{},
+		path:                 path,
+		clock:                clock,
+	}
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadAuctionRound reopens the round written to path. A nil clock is time.Now.
+// Deadlines that passed while the round was not loaded take effect on the next call.
+func LoadAuctionRound(path string, clock Clock) (*AuctionRound, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r AuctionRound
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid auction round: %w", err)
+	}
+	if r.Version != RoundVersion {
+		return nil, fmt.Errorf("unsupported auction round version %d", r.Version)
+	}
+	if clock == nil {
+		clock = time.Now
+	}
+	r.path, r.clock = path, clock
+	return &r, nil
+}
+
+// Advance applies the deadlines that have passed and returns the current phase.
+func (r *AuctionRound) Advance() (Phase, error) {
+	err := r.update(func(time.Time) error { return nil })
+	return r.Phase, err
+}
+
+// Register verifies a registration payload (see register.Register) for the auctioneer key of
+// the round and adds it to the round. A nil vk is taken from the circuit registry.
+// Returns ErrWrongPhase once the registration is closed, and an error if π_reg does not verify,
+// if the tx^in note is not in the ledger or if it is already registered in the round.
+func (r *AuctionRound) Register(payload exchange.RegistrationPayload, ledger *zerocash.Ledger, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	return r.update(func(time.Time) error {
+		if err := r.expect("register", PhaseOpen); err != nil {
+			return err
+		}
+		if payload.PubKey == nil {
+			return errors.New("registration has no DH public key")
+		}
+		if payload.CmIn == nil {
+			return errors.New("registration has no tx^in commitment")
+		}
+		if len(r.Registrations) >= zerocash.MaxSize() {
+			return fmt.Errorf("round %s already holds %d registrations, the most an exchange can clear", r.ID, len(r.Registrations))
+		}
+		for _, c := range payload.Ciphertext {
+			if c == nil {
+				return errors.New("registration ciphertext is incomplete")
+			}
+		}
+		if r.registered(payload.CmIn) {
+			return fmt.Errorf("note %v is already registered in round %s", payload.CmIn, r.ID)
+		}
+		if !ledger.HasCommitment(payload.CmIn.String()) {
+			return fmt.Errorf("registered note %v is not in the ledger", payload.CmIn)
+		}
+		if err := register.VerifyRegister(payload, r.Terms.AuctioneerPk, params, vk); err != nil {
+			return fmt.Errorf("invalid registration proof: %w", err)
+		}
+		r.Registrations = append(r.Registrations, payload)
+		return nil
+	})
+}
+
+// CloseRegistration closes the registration before its deadline.
+func (r *AuctionRound) CloseRegistration() error {
+	return r.update(func(now time.Time) error {
+		if err := r.expect("close the registration", PhaseOpen); err != nil {
+			return err
+		}
+		r.closeRegistration(now)
+		return nil
+	})
+}
+
+// Clear runs the exchange phase over the registrations of the round with the mechanism of its
+// terms (see exchange.ExchangePhaseWithNotes) and records its public transaction. auctioneerSk
+// must be the secret key of the round's auctioneer key.
+// Returns ErrWrongPhase unless the registration is closed and the round not yet cleared.
+func (r *AuctionRound) Clear(auctioneerSk *big.Int, auctioneerECDHPrivKey *ecdh.PrivateKey,
+	ledger *zerocash.Ledger, params *zerocash.Params, pk zerocash.ProvingKey, ccs constraint.ConstraintSystem) (*exchange.ExchangeTransaction, error) {
+	var cleared *exchange.ExchangeTransaction
+	err := r.update(func(now time.Time) error {
+		if err := r.expect("clear", PhaseRegistrationClosed); err != nil {
+			return err
+		}
+		if err := r.Terms.CheckAuctioneerSk(auctioneerSk); err != nil {
+			return err
+		}
+		mechanism, err := r.Terms.AuctionMechanism()
+		if err != nil {
+			return err
+		}
+		txOut, _, _, err := exchange.ExchangePhaseWithNotes(r.Registrations, mechanism, auctioneerSk, auctioneerECDHPrivKey, ledger, params, pk, ccs)
+		if err != nil {
+			return err
+		}
+		cleared = txOut.(*exchange.ExchangeTransaction)
+		r.Exchange = cleared.Public()
+		r.transition(PhaseCleared, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cleared, nil
+}
+
+// Settle verifies the exchange of the round under its terms, records it in the ledger (see
+// exchange.SettleExchange) and schedules the withdraw window. The exchange must clear the
+// registrations of the round, in order.
+// A nil vk is taken from the circuit registry. Returns ErrWrongPhase unless the round is cleared.
+func (r *AuctionRound) Settle(ledger *zerocash.Ledger, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	return r.update(func(now time.Time) error {
+		if err := r.expect("settle", PhaseCleared); err != nil {
+			return err
+		}
+		if err := exchange.SettleExchange(ledger, r.Exchange, r.Registrations, r.Terms, params, vk); err != nil {
+			return fmt.Errorf("settling round %s: %w", r.ID, err)
+		}
+		r.WithdrawOpens = now.Add(r.Schedule.WithdrawDelay)
+		r.WithdrawDeadline = r.WithdrawOpens.Add(r.Schedule.Withdraw)
+		r.transition(PhaseSettled, now)
+		return nil
+	})
+}
+
+// SubmitWithdraw verifies a withdrawal and records it in the ledger (see withdraw.SubmitWithdrawTx).
+// Returns ErrWrongPhase outside the withdraw window, and an error if the withdrawn note is not
+// one of the tx^in notes registered in the round.
+func (r *AuctionRound) SubmitWithdraw(ledger *zerocash.Ledger, tx *withdraw.WithdrawTx, proof []byte, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	return r.update(func(time.Time) error {
+		if err := r.expect("withdraw", PhaseWithdrawWindow); err != nil {
+			return err
+		}
+		if !r.registered(tx.CmIn) {
+			return fmt.Errorf("note %v was not registered in round %s", tx.CmIn, r.ID)
+		}
+		sn := tx.SnIn.String()
+		for _, withdrawn := range r.Withdrawals {
+			if withdrawn == sn {
+				return fmt.Errorf("note %s was already withdrawn from round %s", sn, r.ID)
+			}
+		}
+		if err := withdraw.SubmitWithdrawTx(ledger, tx, proof, params, vk); err != nil {
+			return err
+		}
+		r.Withdrawals = append(r.Withdrawals, sn)
+		return nil
+	})
+}
+
+// update applies the due deadlines and then op, and saves the round. If op fails, its changes
+// are undone but the deadlines stay applied; if the save fails, the round is left as it was.
+func (r *AuctionRound) update(op func(now time.Time) error) error {
+	initial := r.snapshot()
+	now := r.clock().UTC()
+	moved := r.applyDeadlines(now)
+	due := r.snapshot()
+	if err := op(now); err != nil {
+		*r = due
+		if moved {
+			if serr := r.save(); serr != nil {
+				*r = initial
+				return fmt.Errorf("%w (saving the round failed: %v)", err, serr)
+			}
+		}
+		return err
+	}
+	if err := r.save(); err != nil {
+		*r = initial
+		return err
+	}
+	return nil
+}
+
+// snapshot returns a copy of the round that shares none of its slices.
+func (r *AuctionRound) snapshot() AuctionRound {
+	c := *r
+	c.Registrations = append([]exchange.RegistrationPayload(nil), r.Registrations...)
+	c.Withdrawals = append([]string(nil), r.Withdrawals...)
+	c.History = append([]Transition(nil), r.History...)
+	return c
+}
+
+// applyDeadlines performs the time-driven transitions due at now and reports whether there were any.
+func (r *AuctionRound) applyDeadlines(now time.Time) bool {
+	moved := false
+	for {
+		switch {
+		case r.Phase == PhaseOpen && !now.Before(r.RegistrationDeadline):
+			r.closeRegistration(r.RegistrationDeadline)
+		case (r.Phase == PhaseRegistrationClosed || r.Phase == PhaseCleared) && !now.Before(r.ClearingDeadline):
+			// The exchange was not settled in time: the registered notes can be withdrawn
+			r.WithdrawOpens = r.ClearingDeadline
+			r.WithdrawDeadline = r.WithdrawOpens.Add(r.Schedule.Withdraw)
+			r.transition(PhaseWithdrawWindow, r.ClearingDeadline)
+		case r.Phase == PhaseSettled && !now.Before(r.WithdrawOpens):
+			r.transition(PhaseWithdrawWindow, r.WithdrawOpens)
+		case r.Phase == PhaseWithdrawWindow && !now.Before(r.WithdrawDeadline):
+			r.transition(PhaseFinalized, r.WithdrawDeadline)
+		default:
+			return moved
+		}
+		moved = true
+	}
+}
+
+// closeRegistration closes the registration at and starts the clearing period.
+func (r *AuctionRound) closeRegistration(at time.Time) {
+	r.ClearingDeadline = at.Add(r.Schedule.Clearing)
+	r.transition(PhaseRegistrationClosed, at)
+}
+
+// registered reports whether cm is the tx^in commitment of a registration of the round.
+func (r *AuctionRound) registered(cm *big.Int) bool {
+	if cm == nil {
+		return false
+	}
+	for _, payload := range r.Registrations {
+		if payload.CmIn != nil && payload.CmIn.Cmp(cm) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// expect returns ErrWrongPhase unless the round is in phase.
+func (r *AuctionRound) expect(op string, phase Phase) error {
+	if r.Phase != phase {
+		return fmt.Errorf("%w: cannot %s round %s in phase %s (needs %s)", ErrWrongPhase, op, r.ID, r.Phase, phase)
+	}
+	return nil
+}
+
+func (r *AuctionRound) transition(to Phase, at time.Time) {
+	r.History = append(r.History, Transition{From: r.Phase, To: to, At: at})
+	r.Phase = to
+}
+
+// save writes the round to a temporary file next to its path and renames it over the path.
+func (r *AuctionRound) save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
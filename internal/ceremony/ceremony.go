@@ -0,0 +1,486 @@
+// ceremony.go - Multi-party Groth16 setup ceremony for the protocol circuits.
+//
+// A ceremony replaces the single-party groth16.Setup of SetupOrLoadKeys: as long as one
+// contributor discards their randomness, nobody can forge proofs with the resulting keys.
+// Each circuit has its own ceremony directory holding a transcript (transcript.json) and
+// the contribution files of both phases of gnark's MPC setup:
+//
+//	phase1/0000.bin, 0001.bin, ...  Powers of tau (circuit independent, sized for the circuit)
+//	phase2/0000.bin, 0001.bin, ...  Circuit-specific contributions
+//	<circuit>.pk, <circuit>.vk      Final keys, with a zerocash key manifest
+//
+// The coordinator starts the ceremony, contributors call Contribute in turn, and the
+// coordinator closes each phase with Finalize and a public random beacon. Anyone can
+// re-check the whole transcript with Verify.
+
+package ceremony
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bw6-761/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	cs "github.com/consensys/gnark/constraint/bw6-761"
+
+	"implementation/internal/zerocash"
+)
+
+// TranscriptVersion is the current version of the transcript format.
+const TranscriptVersion = 2
+
+// Phase is the stage a ceremony is in.
+type Phase string
+
+const (
+	PhasePowersOfTau Phase = "phase1" // Collecting powers-of-tau contributions
+	PhaseCircuit     Phase = "phase2" // Collecting circuit-specific contributions
+	PhaseDone        Phase = "done"   // Keys extracted
+)
+
+// Attestation records a single contribution in the transcript.
+type Attestation struct {
+	Phase       Phase     `json:"phase"`
+	Index       int       `json:"index"` // Contribution number within the phase (starting at 1)
+	Contributor string    `json:"contributor"`
+	Statement   string    `json:"statement,omitempty"` // Free-form statement by the contributor (e.g. how randomness was sourced)
+	Previous    string    `json:"previous"`            // SHA-256 of the contribution file this one builds on
+	Hash        string    `json:"hash"`                // SHA-256 of the contribution file
+	Time        time.Time `json:"time"`
+}
+
+// Transcript is the public record of a ceremony for one circuit.
+type Transcript struct {
+	Version      int                `json:"version"`
+	CircuitID    zerocash.CircuitID `json:"circuit_id"`
+	ValueBits    int                `json:"value_bits"` // Value width the circuit was compiled for
+	CCSHash      string             `json:"ccs_hash"`
+	DomainSize   uint64             `json:"domain_size"`
+	Phase        Phase              `json:"phase"`
+	Phase1Beacon string             `json:"phase1_beacon,omitempty"` // Hex beacon that sealed phase 1
+	Phase2Beacon string             `json:"phase2_beacon,omitempty"` // Hex beacon that sealed phase 2
+	Attestations []Attestation      `json:"attestations"`
+}
+
+// Start creates a ceremony in dir for a circuit compiled for valueBits-bit values and writes the
+// initial phase 1 state.
+func Start(dir string, id zerocash.CircuitID, valueBits int, ccs constraint.ConstraintSystem) (*Transcript, error) {
+	if _, err := os.Stat(transcriptPath(dir)); err == nil {
+		return nil, fmt.Errorf("ceremony already started in %s", dir)
+	}
+	if _, err := toR1CS(ccs); err != nil {
+		return nil, err
+	}
+	ccsHash, err := zerocash.ConstraintSystemHash(ccs)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, string(PhasePowersOfTau)), 0755); err != nil {
+		return nil, err
+	}
+
+	t := &Transcript{
+		Version:      TranscriptVersion,
+		CircuitID:    id,
+		ValueBits:    valueBits,
+		CCSHash:      ccsHash,
+		DomainSize:   ecc.NextPowerOfTwo(uint64(ccs.GetNbConstraints())),
+		Phase:        PhasePowersOfTau,
+		Attestations: []Attestation{},
+	}
+	if err := writeContribution(contributionPath(dir, PhasePowersOfTau, 0), mpcsetup.NewPhase1(t.DomainSize)); err != nil {
+		return nil, err
+	}
+	if err := t.save(dir); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Contribute adds a contribution to the current phase of the ceremony in dir.
+// The contributor's randomness is sampled internally and never leaves this call.
+func Contribute(dir, contributor, statement string) (*Attestation, error) {
+	if contributor == "" {
+		return nil, errors.New("contributor name is required")
+	}
+	t, err := LoadTranscript(dir)
+	if err != nil {
+		return nil, err
+	}
+	if t.Phase == PhaseDone {
+		return nil, errors.New("ceremony is already finalized")
+	}
+
+	index := len(t.contributions(t.Phase))
+	prevPath := contributionPath(dir, t.Phase, index)
+	previous, err := fileHash(prevPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var next io.WriterTo
+	switch t.Phase {
+	case PhasePowersOfTau:
+		var p mpcsetup.Phase1
+		if err := readContribution(prevPath, &p); err != nil {
+			return nil, err
+		}
+		p.Contribute()
+		next = &p
+	case PhaseCircuit:
+		var p mpcsetup.Phase2
+		if err := readContribution(prevPath, &p); err != nil {
+			return nil, err
+		}
+		p.Contribute()
+		next = &p
+	default:
+		return nil, fmt.Errorf("unknown ceremony phase %q", t.Phase)
+	}
+
+	path := contributionPath(dir, t.Phase, index+1)
+	if err := writeContribution(path, next); err != nil {
+		return nil, err
+	}
+	hash, err := fileHash(path)
+	if err != nil {
+		return nil, err
+	}
+	a := Attestation{
+		Phase:       t.Phase,
+		Index:       index + 1,
+		Contributor: contributor,
+		Statement:   statement,
+		Previous:    previous,
+		Hash:        hash,
+		Time:        time.Now().UTC(),
+	}
+	t.Attestations = append(t.Attestations, a)
+	if err := t.save(dir); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Verify re-checks the whole transcript in dir against the circuit: every contribution file must
+// match its attestation and chain to the previous one, and every update proof must be valid.
+// For a finalized ceremony the key files are re-derived and compared with the ones on disk.
+func Verify(dir string, ccs constraint.ConstraintSystem) (*Transcript, error) {
+	t, err := LoadTranscript(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := t.verify(dir, ccs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Finalize closes the current phase of the ceremony in dir with a public random beacon.
+// Closing phase 1 writes the initial phase 2 state; closing phase 2 extracts the proving and
+// verifying keys and writes them with a key manifest (see KeyPaths).
+func Finalize(dir string, ccs constraint.ConstraintSystem, beacon []byte) (*Transcript, error) {
+	if len(beacon) == 0 {
+		return nil, errors.New("beacon is required")
+	}
+	t, err := LoadTranscript(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.contributions(t.Phase)) == 0 {
+		return nil, fmt.Errorf("%s has no contributions", t.Phase)
+	}
+	last, commons, err := t.verify(dir, ccs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.Phase {
+	case PhasePowersOfTau:
+		srs := last.(*mpcsetup.Phase1).Seal(beacon)
+		r1cs, _ := toR1CS(ccs)
+		var p2 mpcsetup.Phase2
+		p2.Initialize(r1cs, &srs)
+		if err := os.MkdirAll(filepath.Join(dir, string(PhaseCircuit)), 0755); err != nil {
+			return nil, err
+		}
+		if err := writeContribution(contributionPath(dir, PhaseCircuit, 0), &p2); err != nil {
+			return nil, err
+		}
+		t.Phase1Beacon = hex.EncodeToString(beacon)
+		t.Phase = PhaseCircuit
+	case PhaseCircuit:
+		pk, vk, err := t.extractKeys(dir, ccs, commons, beacon)
+		if err != nil {
+			return nil, err
+		}
+		pkPath, vkPath := KeyPaths(dir, t.CircuitID)
+		if err := zerocash.SaveProvingKey(pkPath, pk); err != nil {
+			return nil, err
+		}
+		if err := zerocash.SaveVerifyingKey(vkPath, vk); err != nil {
+			return nil, err
+		}
+		manifest, err := zerocash.NewKeyManifest(t.CircuitID, t.ValueBits, ccs, pkPath, vkPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := manifest.Save(zerocash.KeyManifestPath(pkPath)); err != nil {
+			return nil, err
+		}
+		t.Phase2Beacon = hex.EncodeToString(beacon)
+		t.Phase = PhaseDone
+	default:
+		return nil, errors.New("ceremony is already finalized")
+	}
+
+	if err := t.save(dir); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// KeyPaths returns the paths of the keys produced by a finalized ceremony.
+func KeyPaths(dir string, id zerocash.CircuitID) (pkPath, vkPath string) {
+	return filepath.Join(dir, string(id)+".pk"), filepath.Join(dir, string(id)+".vk")
+}
+
+// LoadTranscript reads the transcript of the ceremony in dir.
+func LoadTranscript(dir string) (*Transcript, error) {
+	data, err := os.ReadFile(transcriptPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var t Transcript
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid transcript: %w", err)
+	}
+	switch t.Version {
+	case TranscriptVersion:
+	case 1:
+		// Version 1 transcripts predate configurable value widths
+		t.Version, t.ValueBits = TranscriptVersion, zerocash.DefaultValueBits
+	default:
+		return nil, fmt.Errorf("unsupported transcript version %d", t.Version)
+	}
+	return &t, nil
+}
+
+// verify checks the transcript up to its current phase. It returns the last contribution of
+// the current phase and, once phase 1 is sealed, the circuit-independent SRS.
+func (t *Transcript) verify(dir string, ccs constraint.ConstraintSystem) (last any, commons *mpcsetup.SrsCommons, err error) {
+	ccsHash, err := zerocash.ConstraintSystemHash(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ccsHash != t.CCSHash {
+		return nil, nil, fmt.Errorf("circuit %q changed since the ceremony started", t.CircuitID)
+	}
+	r1cs, err := toR1CS(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := t.checkAttestations(dir); err != nil {
+		return nil, nil, err
+	}
+
+	// Phase 1: replay every update proof from the initial state
+	prev1 := mpcsetup.NewPhase1(t.DomainSize)
+	for _, a := range t.contributions(PhasePowersOfTau) {
+		next := new(mpcsetup.Phase1)
+		if err := readContribution(contributionPath(dir, PhasePowersOfTau, a.Index), next); err != nil {
+			return nil, nil, err
+		}
+		if err := prev1.Verify(next); err != nil {
+			return nil, nil, fmt.Errorf("phase1 contribution %d by %s: %w", a.Index, a.Contributor, err)
+		}
+		prev1 = next
+	}
+	if t.Phase == PhasePowersOfTau {
+		return prev1, nil, nil
+	}
+
+	// Phase 2: seal phase 1 with its beacon and replay from the circuit's initial state
+	beacon1, err := hex.DecodeString(t.Phase1Beacon)
+	if err != nil || len(beacon1) == 0 {
+		return nil, nil, errors.New("transcript has no phase1 beacon")
+	}
+	srs := prev1.Seal(beacon1)
+	prev2 := new(mpcsetup.Phase2)
+	prev2.Initialize(r1cs, &srs)
+	for _, a := range t.contributions(PhaseCircuit) {
+		next := new(mpcsetup.Phase2)
+		if err := readContribution(contributionPath(dir, PhaseCircuit, a.Index), next); err != nil {
+			return nil, nil, err
+		}
+		if err := prev2.Verify(next); err != nil {
+			return nil, nil, fmt.Errorf("phase2 contribution %d by %s: %w", a.Index, a.Contributor, err)
+		}
+		prev2 = next
+	}
+	if t.Phase == PhaseCircuit {
+		return prev2, &srs, nil
+	}
+
+	// Done: the keys on disk must be the ones the transcript produces
+	beacon2, err := hex.DecodeString(t.Phase2Beacon)
+	if err != nil || len(beacon2) == 0 {
+		return nil, nil, errors.New("transcript has no phase2 beacon")
+	}
+	pk, vk, err := mpcsetup.VerifyPhase2(r1cs, &srs, beacon2, t.phase2Files(dir)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkKeys(dir, t.CircuitID, pk, vk); err != nil {
+		return nil, nil, err
+	}
+	return nil, &srs, nil
+}
+
+// extractKeys seals phase 2 and returns the final keys.
+func (t *Transcript) extractKeys(dir string, ccs constraint.ConstraintSystem, commons *mpcsetup.SrsCommons, beacon []byte) (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	r1cs, err := toR1CS(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mpcsetup.VerifyPhase2(r1cs, commons, beacon, t.phase2Files(dir)...)
+}
+
+// phase2Files reads the phase 2 contributions (errors were already caught by verify).
+func (t *Transcript) phase2Files(dir string) []*mpcsetup.Phase2 {
+	var c []*mpcsetup.Phase2
+	for _, a := range t.contributions(PhaseCircuit) {
+		p := new(mpcsetup.Phase2)
+		if err := readContribution(contributionPath(dir, PhaseCircuit, a.Index), p); err == nil {
+			c = append(c, p)
+		}
+	}
+	return c
+}
+
+// checkAttestations checks that the contribution files match the attestations and form a chain.
+func (t *Transcript) checkAttestations(dir string) error {
+	for _, phase := range []Phase{PhasePowersOfTau, PhaseCircuit} {
+		if phase == PhaseCircuit && t.Phase == PhasePowersOfTau {
+			break
+		}
+		previous, err := fileHash(contributionPath(dir, phase, 0))
+		if err != nil {
+			return err
+		}
+		for i, a := range t.contributions(phase) {
+			if a.Index != i+1 {
+				return fmt.Errorf("%s attestation %d out of order", phase, a.Index)
+			}
+			if a.Previous != previous {
+				return fmt.Errorf("%s contribution %d by %s does not build on the previous contribution", phase, a.Index, a.Contributor)
+			}
+			hash, err := fileHash(contributionPath(dir, phase, a.Index))
+			if err != nil {
+				return err
+			}
+			if hash != a.Hash {
+				return fmt.Errorf("%s contribution %d by %s does not match its attestation", phase, a.Index, a.Contributor)
+			}
+			previous = hash
+		}
+	}
+	return nil
+}
+
+// contributions returns the attestations of a phase, in order.
+func (t *Transcript) contributions(phase Phase) []Attestation {
+	var out []Attestation
+	for _, a := range t.Attestations {
+		if a.Phase == phase {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func (t *Transcript) save(dir string) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(transcriptPath(dir), data, 0644)
+}
+
+// checkKeys compares derived keys with the key files of a finalized ceremony.
+func checkKeys(dir string, id zerocash.CircuitID, pk groth16.ProvingKey, vk groth16.VerifyingKey) error {
+	pkPath, vkPath := KeyPaths(dir, id)
+	for _, k := range []struct {
+		path string
+		key  io.WriterTo
+	}{{pkPath, pk}, {vkPath, vk}} {
+		onDisk, err := fileHash(k.path)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := zerocash.WriteKey(h, k.key); err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != onDisk {
+			return fmt.Errorf("%s does not match the ceremony transcript", filepath.Base(k.path))
+		}
+	}
+	return nil
+}
+
+func toR1CS(ccs constraint.ConstraintSystem) (*cs.R1CS, error) {
+	r1cs, ok := ccs.(*cs.R1CS)
+	if !ok || r1cs.Type != constraint.SystemR1CS {
+		return nil, errors.New("ceremony requires a BW6-761 Groth16 (R1CS) constraint system")
+	}
+	return r1cs, nil
+}
+
+func transcriptPath(dir string) string {
+	return filepath.Join(dir, "transcript.json")
+}
+
+func contributionPath(dir string, phase Phase, index int) string {
+	return filepath.Join(dir, string(phase), fmt.Sprintf("%04d.bin", index))
+}
+
+func writeContribution(path string, c io.WriterTo) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = c.WriteTo(f)
+	return err
+}
+
+func readContribution(path string, c io.ReaderFrom) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := c.ReadFrom(f); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+func fileHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -1,138 +1,453 @@
 // circuit.go - Circuit for the auction phase (exchange) of the protocol.
 //
-// Defines CircuitTxF10 for N=10 participants, enforcing cryptographic consistency
-// (decryption, PRF, commitments, EC operations) but not the auction logic itself.
+// Defines CircuitTxF for N participants. It proves that the registrations decrypt under the
+// auctioneer key, that each registration opens a tx^in note of the ledger (its commitment is a leaf
+// of the tree under the public Anchor), that the spent serial numbers are those of these notes and
+// the output commitments belong to the registrations, that each output note is encrypted to the DH
+// key of its registration, and that the output values follow from the decrypted orders by the
+// auction mechanism named by the public Mechanism, KNum and KDen (see mechanism.go):
 //
-// WARNING: This circuit does NOT enforce the auction computation. Only cryptographic consistency is proven.
+//  1. every participant is a buyer or a seller, as declared by the side of its order
+//  2. each group is ranked, buyers by bid descending and sellers by bid ascending; the ranks
+//     are private hints, checked to be a permutation of 0..n-1 in sorted order
+//  3. the orders are matched unit by unit in rank order while the bids cross, so an order can be
+//     filled by several counterparties and partially; the mechanism's rule picks the volume
+//     that trades and its prices from the margin of the matching
+//  4. each order's fill moves energy to the buyer and coins from the buyer to the seller; the
+//     total energy is unchanged and the coins decrease by the surplus only, which is burned
+//
+// It is registered once per size in zerocash.SupportedSizes; an auction with fewer participants
+// than N fills the remaining slots with dummies, which the circuit proves carry no value and
+// take no part in the clearing. A verifier learns the anchor, the registration ciphertexts, serial
+// numbers, output commitments and ciphertexts and the auctioneer key, and nothing else (see VerifyExchange).
 
 package exchange
 
 import (
+	"errors"
+	mathbits "math/bits"
+
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 	"github.com/consensys/gnark/std/hash/mimc"
+
+	"implementation/internal/zerocash"
 )
 
+func init() {
+	for _, n := range zerocash.SupportedSizes {
+		n := n
+		zerocash.RegisterSizedCircuit(zerocash.ExchangeCircuitID(n), n, func(valueBits int) frontend.Circuit {
+			c := NewCircuitTxF(n)
+			c.ValueBits = valueBits
+			return c
+		})
+	}
+}
+
 // DecZKReg decrypts a registration ciphertext in the circuit using MiMC-based mask chain.
-func DecZKReg(api frontend.API, c []frontend.Variable, encKey sw_bls12377.G1Affine) [5]frontend.Variable {
+func DecZKReg(api frontend.API, c []frontend.Variable, encKey sw_bls12377.G1Affine) [zerocash.RegistrationFields]frontend.Variable {
 	hasher, _ := mimc.NewMiMC(api)
 	hasher.Reset()
 	hasher.Write(encKey.X)
 	hasher.Write(encKey.Y)
-	mask0 := hasher.Sum()
+	mask := hasher.Sum()
 
-	hasher.Reset()
-	hasher.Write(mask0)
-	mask1 := hasher.Sum()
+	var dec [zerocash.RegistrationFields]frontend.Variable
+	for i := range dec {
+		if i > 0 {
+			hasher.Reset()
+			hasher.Write(mask)
+			mask = hasher.Sum()
+		}
+		dec[i] = api.Sub(c[i], mask)
+	}
+	return dec
+}
 
-	hasher.Reset()
-	hasher.Write(mask1)
-	mask2 := hasher.Sum()
+// PRF computes the serial number in the circuit (see zerocash.PRF).
+func PRF(api frontend.API, sk, rho frontend.Variable) frontend.Variable {
+	return zerocash.PRF(api, sk, rho)
+}
 
-	hasher.Reset()
-	hasher.Write(mask2)
-	mask3 := hasher.Sum()
+// CircuitTxF represents a circuit for N coins/participants in the auction phase.
+// The shape is fixed at compile time; use NewCircuitTxF to allocate it.
+//
+// Only the auctioneer key, the anchor, the registration ciphertexts, the serial numbers of the spent
+// tx^in notes, the output commitments and ciphertexts and which slots are padding are public; the
+// auctioneer's secret key, the decrypted registrations, the note openings and their authentication
+// paths stay in the private witness.
+type CircuitTxF struct {
+	// ====== PUBLIC VARIABLES ======
+	G_b       sw_bls12377.G1Affine `gnark:",public"` // Auctioneer public key pk_T = G^b
+	Mechanism frontend.Variable    `gnark:",public"` // MechanismID of the auction
+	KNum      frontend.Variable    `gnark:",public"` // k = KNum / KDen of a k-double auction
+	KDen      frontend.Variable    `gnark:",public"`
+	Anchor    frontend.Variable    `gnark:",public"` // Merkle root the tx^in notes are proven against
 
-	hasher.Reset()
-	hasher.Write(mask3)
-	mask4 := hasher.Sum()
+	C     [][zerocash.RegistrationFields]frontend.Variable `gnark:",public"` // Registration ciphertexts C^Aux
+	G_r   []sw_bls12377.G1Affine                           `gnark:",public"` // Their DH public keys G^r
+	InSn  []frontend.Variable                              `gnark:",public"` // Serial numbers of the tx^in notes
+	OutCm []frontend.Variable                              `gnark:",public"` // Output note commitments
+	CNew  [][6]frontend.Variable                           `gnark:",public"` // Output notes encrypted to (G^r)^s
+	G_s   []sw_bls12377.G1Affine                           `gnark:",public"` // G^s of each output encryption
 
-	dec0 := api.Sub(c[0], mask0)
-	dec1 := api.Sub(c[1], mask1)
-	dec2 := api.Sub(c[2], mask2)
-	dec3 := api.Sub(c[3], mask3)
-	dec4 := api.Sub(c[4], mask4)
+	// Dummy[i] is 1 for a padding slot: its order and registered values are zero, and its note
+	// need not be in the ledger. It is public so that a verifier can tell the registrations an
+	// exchange clears from its padding.
+	Dummy []frontend.Variable `gnark:",public"`
 
-	return [5]frontend.Variable{dec0, dec1, dec2, dec3, dec4}
-}
+	// ====== PRIVATE VARIABLES ======
+	B         frontend.Variable                                // Auctioneer secret key b
+	DecVal    [][zerocash.RegistrationFields]frontend.Variable // Decrypted (pk^out, sk^in, bid, coins, energy, side, quantity, ρ^in, r^in)
+	Path      [][zerocash.MerkleTreeDepth]frontend.Variable    // Authentication path of each tx^in note
+	PathBits  [][zerocash.MerkleTreeDepth]frontend.Variable    // Leaf index bits (1 = node is a right child)
+	OutCoin   []frontend.Variable
+	OutEnergy []frontend.Variable
+	OutRho    []frontend.Variable
+	OutRand   []frontend.Variable
+	S         []frontend.Variable // Randomness s of each output encryption
 
-// PRF implements a pseudo-random function using MiMC hash in the circuit.
-func PRF(api frontend.API, sk, rho frontend.Variable) frontend.Variable {
-	hasher, _ := mimc.NewMiMC(api)
-	hasher.Write(sk)
-	hasher.Write(rho)
-	return hasher.Sum()
+	// Clearing hints: the slot's position among the buyers (bid descending) or the sellers (bid
+	// ascending), the energy matched before the bids stop crossing, and the uniform price of the
+	// mechanism (the candidate price for McAfee)
+	Rank          []frontend.Variable
+	Volume        frontend.Variable
+	ClearingPrice frontend.Variable
+
+	ValueBits int `gnark:"-"` // Width of coins, energy and bids (0 means zerocash.DefaultValueBits)
 }
 
-// CircuitTxF10 represents a circuit for 10 coins/participants in the auction phase.
-type CircuitTxF10 struct {
-	// ----- Input/Output Arrays for 10 coins -----
-	InCoin   [10]frontend.Variable `gnark:",public"`
-	InEnergy [10]frontend.Variable `gnark:",public"`
-	InCm     [10]frontend.Variable `gnark:",public"`
-	InSn     [10]frontend.Variable `gnark:",public"`
-	InPk     [10]frontend.Variable `gnark:",public"`
-	InSk     [10]frontend.Variable `gnark:",public"`
-	InRho    [10]frontend.Variable `gnark:",public"`
-	InRand   [10]frontend.Variable `gnark:",public"`
-
-	OutCoin   [10]frontend.Variable `gnark:",public"`
-	OutEnergy [10]frontend.Variable `gnark:",public"`
-	OutCm     [10]frontend.Variable `gnark:",public"`
-	OutSn     [10]frontend.Variable `gnark:",public"`
-	OutPk     [10]frontend.Variable `gnark:",public"`
-	OutRho    [10]frontend.Variable `gnark:",public"`
-	OutRand   [10]frontend.Variable `gnark:",public"`
-
-	C      [10][5]frontend.Variable
-	DecVal [10][5]frontend.Variable
-
-	// ----- DH Parameters for each coin -----
-	SkT    [10]sw_bls12377.G1Affine
-	R      [10]frontend.Variable
-	G      [10]sw_bls12377.G1Affine `gnark:",public"`
-	G_b    [10]sw_bls12377.G1Affine `gnark:",public"`
-	G_r    [10]sw_bls12377.G1Affine `gnark:",public"`
-	EncKey [10]sw_bls12377.G1Affine
+// NewCircuitTxF allocates an exchange circuit for n participants.
+func NewCircuitTxF(n int) *CircuitTxF {
+	return &CircuitTxF{
+		C:         make([][zerocash.RegistrationFields]frontend.Variable, n),
+		G_r:       make([]sw_bls12377.G1Affine, n),
+		InSn:      make([]frontend.Variable, n),
+		OutCm:     make([]frontend.Variable, n),
+		CNew:      make([][6]frontend.Variable, n),
+		G_s:       make([]sw_bls12377.G1Affine, n),
+		DecVal:    make([][zerocash.RegistrationFields]frontend.Variable, n),
+		Path:      make([][zerocash.MerkleTreeDepth]frontend.Variable, n),
+		PathBits:  make([][zerocash.MerkleTreeDepth]frontend.Variable, n),
+		OutCoin:   make([]frontend.Variable, n),
+		OutEnergy: make([]frontend.Variable, n),
+		OutRho:    make([]frontend.Variable, n),
+		OutRand:   make([]frontend.Variable, n),
+		S:         make([]frontend.Variable, n),
+		Dummy:     make([]frontend.Variable, n),
+		Rank:      make([]frontend.Variable, n),
+	}
 }
 
-// Define implements the constraints for CircuitTxF10 using arrays and for loops.
-func (c *CircuitTxF10) Define(api frontend.API) error {
-	// Process all 10 coins using a for loop
-	for coin := 0; coin < 10; coin++ {
-		// --- Decrypt and verify the registration data ---
-		decVal := DecZKReg(api, c.C[coin][:], c.SkT[coin])
-		for i := 0; i < 5; i++ {
+// Define implements the constraints for CircuitTxF using slices and for loops.
+func (c *CircuitTxF) Define(api frontend.API) error {
+	if len(c.InSn) == 0 {
+		return errors.New("exchange circuit needs at least one participant")
+	}
+
+	// --- The prover holds the auctioneer secret key: G_b = G^b ---
+	G_b := new(sw_bls12377.G1Affine)
+	G_b.ScalarMulBase(api, c.B)
+	api.AssertIsEqual(c.G_b.X, G_b.X)
+	api.AssertIsEqual(c.G_b.Y, G_b.Y)
+
+	n := len(c.InSn)
+	orders := make([]order, n)
+	coinsIn := make([]frontend.Variable, n)
+	energyIn := make([]frontend.Variable, n)
+
+	// Process all coins using a for loop
+	for coin := range c.InSn {
+		// --- Decrypt the registration data with the shared key (G^r)^b ---
+		encKey := new(sw_bls12377.G1Affine)
+		encKey.ScalarMul(api, c.G_r[coin], c.B)
+		decVal := DecZKReg(api, c.C[coin][:], *encKey)
+		for i := range decVal {
 			api.AssertIsEqual(c.DecVal[coin][i], decVal[i])
 		}
+		pkOut, skIn, coins, energy := c.DecVal[coin][0], c.DecVal[coin][1], c.DecVal[coin][3], c.DecVal[coin][4]
+		rhoIn, randIn := c.DecVal[coin][7], c.DecVal[coin][8]
+		o := order{side: c.DecVal[coin][5], quantity: c.DecVal[coin][6], bid: c.DecVal[coin][2]}
 
-		// --- Verify serial number computation ---
-		snComputed := PRF(api, c.InSk[coin], c.InRho[coin])
-		api.AssertIsEqual(c.InSn[coin], snComputed)
+		// --- The decrypted order and values, and the outputs fit in ValueBits ---
+		zerocash.AssertValueRange(api, c.ValueBits, o.bid, o.quantity, coins, energy, c.OutCoin[coin], c.OutEnergy[coin])
+		api.AssertIsBoolean(o.side)
 
-		// --- Preserve coin and energy values ---
-		api.AssertIsEqual(c.InCoin[coin], c.OutCoin[coin])
-		api.AssertIsEqual(c.InEnergy[coin], c.OutEnergy[coin])
+		// --- A dummy slot moves nothing: zero order and registered values ---
+		api.AssertIsBoolean(c.Dummy[coin])
+		for _, v := range []frontend.Variable{o.bid, o.quantity, coins, energy} {
+			api.AssertIsEqual(api.Mul(c.Dummy[coin], v), 0)
+		}
 
-		// --- Compute output commitment: cm = Com(Γ || pk || ρ, r) where Γ = (coins, energy) ---
+		// --- The registration opens a ledger note: cm^in = Com(Γ^in || KeyGen(sk^in) || ρ^in, r^in)
+		// is a leaf of the tree under Anchor, unless the slot is a dummy ---
 		hasher, _ := mimc.NewMiMC(api)
-		hasher.Write(c.OutCoin[coin])   // Γ.coins
-		hasher.Write(c.OutEnergy[coin]) // Γ.energy
-		hasher.Write(c.OutPk[coin])     // pk (public key)
-		hasher.Write(c.OutRho[coin])    // ρ (rho)
-		hasher.Write(c.OutRand[coin])   // r (randomness)
-		cm := hasher.Sum()
-		api.AssertIsEqual(c.OutCm[coin], cm)
+		hasher.Write(skIn)
+		cmIn := zerocash.NoteCommitment(api, coins, energy, hasher.Sum(), rhoIn, randIn)
+		root := zerocash.MerkleRoot(api, cmIn, c.Path[coin][:], c.PathBits[coin][:])
+		api.AssertIsEqual(api.Mul(api.Sub(1, c.Dummy[coin]), api.Sub(c.Anchor, root)), 0)
 
-		// --- Verify DH encryption constraints ---
-		// EncKey = G_b^R
-		G_r_b := new(sw_bls12377.G1Affine)
-		G_r_b.ScalarMul(api, c.G_b[coin], c.R[coin])
-		api.AssertIsEqual(c.EncKey[coin].X, G_r_b.X)
-		api.AssertIsEqual(c.EncKey[coin].Y, G_r_b.Y)
+		// --- The serial number is that of this note ---
+		api.AssertIsEqual(c.InSn[coin], PRF(api, skIn, rhoIn))
 
-		// G_r = G^R
-		G_r := new(sw_bls12377.G1Affine)
-		G_r.ScalarMul(api, c.G[coin], c.R[coin])
-		api.AssertIsEqual(c.G_r[coin].X, G_r.X)
-		api.AssertIsEqual(c.G_r[coin].Y, G_r.Y)
+		orders[coin], coinsIn[coin], energyIn[coin] = o, coins, energy
+
+		// --- The output note is owned by the registered pk^out: cm = Com(Γ || pk^out || ρ, r) ---
+		cm := zerocash.NoteCommitment(api, c.OutCoin[coin], c.OutEnergy[coin], pkOut, c.OutRho[coin], c.OutRand[coin])
+		api.AssertIsEqual(c.OutCm[coin], cm)
 
-		// --- Verify public key derivation: InPk = MiMC(InSk) ---
-		hasher.Reset()
-		hasher.Write(c.InSk[coin])
-		pk := hasher.Sum()
-		api.AssertIsEqual(c.InPk[coin], pk)
+		// --- It is encrypted to the registration's DH key: CNew = Enc(note, (G^r)^s), G_s = G^s ---
+		outKey := new(sw_bls12377.G1Affine)
+		outKey.ScalarMul(api, c.G_r[coin], c.S[coin])
+		G_s := new(sw_bls12377.G1Affine)
+		G_s.ScalarMulBase(api, c.S[coin])
+		api.AssertIsEqual(c.G_s[coin].X, G_s.X)
+		api.AssertIsEqual(c.G_s[coin].Y, G_s.Y)
+		enc := zerocash.EncZK(api, pkOut, c.OutCoin[coin], c.OutEnergy[coin], c.OutRho[coin], c.OutRand[coin], cm, *outKey)
+		for i := range enc {
+			api.AssertIsEqual(c.CNew[coin][i], enc[i])
+		}
 	}
 
+	// --- The output values follow from the orders by the mechanism ---
+	c.assertClearing(api, orders, coinsIn, energyIn)
+
 	return nil
 }
+
+// order is a decrypted order in the circuit.
+type order struct {
+	side     frontend.Variable // zerocash.SideBuy or zerocash.SideSell
+	quantity frontend.Variable
+	bid      frontend.Variable // Limit price
+}
+
+// assertClearing constrains OutCoin and OutEnergy to the result of the mechanism over the
+// decrypted orders, coins and energy of each slot.
+func (c *CircuitTxF) assertClearing(api frontend.API, orders []order, coins, energy []frontend.Variable) {
+	n := len(orders)
+	bits := c.ValueBits
+	if bits <= 0 {
+		bits = zerocash.DefaultValueBits
+	}
+
+	// 1. Sides; dummy slots are neither buyers nor sellers
+	isBuyer := make([]frontend.Variable, n)
+	isSeller := make([]frontend.Variable, n)
+	for i := 0; i < n; i++ {
+		present := api.Sub(1, c.Dummy[i])
+		isSeller[i] = api.Mul(present, orders[i].side)
+		isBuyer[i] = api.Sub(present, isSeller[i])
+	}
+
+	// 2. Ranks: buyerAt[i][k] (sellerAt[i][k]) is 1 when slot i is the k-th buyer (seller)
+	buyerAt := make([][]frontend.Variable, n)
+	sellerAt := make([][]frontend.Variable, n)
+	for i := 0; i < n; i++ {
+		buyerAt[i] = make([]frontend.Variable, n)
+		sellerAt[i] = make([]frontend.Variable, n)
+		var buyerRanks, sellerRanks frontend.Variable = 0, 0
+		for k := 0; k < n; k++ {
+			atK := api.IsZero(api.Sub(c.Rank[i], k))
+			buyerAt[i][k] = api.Mul(isBuyer[i], atK)
+			sellerAt[i][k] = api.Mul(isSeller[i], atK)
+			buyerRanks = api.Add(buyerRanks, buyerAt[i][k])
+			sellerRanks = api.Add(sellerRanks, sellerAt[i][k])
+		}
+		// Every member of a group has a rank below n
+		api.AssertIsEqual(buyerRanks, isBuyer[i])
+		api.AssertIsEqual(sellerRanks, isSeller[i])
+	}
+
+	// The k-th buyer and seller: presence, bid and quantity
+	hasBuyer := make([]frontend.Variable, n)
+	hasSeller := make([]frontend.Variable, n)
+	buyerBid := make([]frontend.Variable, n)
+	sellerBid := make([]frontend.Variable, n)
+	buyerQuantity := make([]frontend.Variable, n)
+	sellerQuantity := make([]frontend.Variable, n)
+	for k := 0; k < n; k++ {
+		hasBuyer[k], hasSeller[k] = frontend.Variable(0), frontend.Variable(0)
+		buyerBid[k], sellerBid[k] = frontend.Variable(0), frontend.Variable(0)
+		buyerQuantity[k], sellerQuantity[k] = frontend.Variable(0), frontend.Variable(0)
+		for i := 0; i < n; i++ {
+			hasBuyer[k] = api.Add(hasBuyer[k], buyerAt[i][k])
+			hasSeller[k] = api.Add(hasSeller[k], sellerAt[i][k])
+			buyerBid[k] = api.Add(buyerBid[k], api.Mul(buyerAt[i][k], orders[i].bid))
+			sellerBid[k] = api.Add(sellerBid[k], api.Mul(sellerAt[i][k], orders[i].bid))
+			buyerQuantity[k] = api.Add(buyerQuantity[k], api.Mul(buyerAt[i][k], orders[i].quantity))
+			sellerQuantity[k] = api.Add(sellerQuantity[k], api.Mul(sellerAt[i][k], orders[i].quantity))
+		}
+		// At most one member per rank, and the ranks in use are 0..count-1
+		api.AssertIsBoolean(hasBuyer[k])
+		api.AssertIsBoolean(hasSeller[k])
+		if k > 0 {
+			api.AssertIsEqual(api.Mul(hasBuyer[k], api.Sub(1, hasBuyer[k-1])), 0)
+			api.AssertIsEqual(api.Mul(hasSeller[k], api.Sub(1, hasSeller[k-1])), 0)
+			// Sorted: buyers by bid descending, sellers by bid ascending
+			api.AssertIsEqual(api.Mul(hasBuyer[k], zerocash.IsLess(api, buyerBid[k-1], buyerBid[k], bits)), 0)
+			api.AssertIsEqual(api.Mul(hasSeller[k], zerocash.IsLess(api, sellerBid[k], sellerBid[k-1], bits)), 0)
+		}
+	}
+
+	// 3. Matching: laid out unit by unit, the k-th buyer covers the units [buyerStart[k],
+	// buyerStart[k+1]) of the energy bought, the k-th seller likewise, and the first Volume units
+	// are matched. Volume is where the bids stop crossing: the buyer and seller covering unit
+	// Volume-1 cross, those covering unit Volume (if both exist) do not. As buyer bids fall and
+	// seller bids rise along the units, this is the volume of the walk in rankOrders.
+	volumeBits := bits + mathbits.Len(uint(n))
+	buyerStart := prefixSums(api, buyerQuantity)
+	sellerStart := prefixSums(api, sellerQuantity)
+	volume := c.Volume
+	zerocash.AssertValueRange(api, volumeBits, volume)
+	api.AssertIsEqual(zerocash.IsLess(api, buyerStart[n], volume, volumeBits), 0)
+	api.AssertIsEqual(zerocash.IsLess(api, sellerStart[n], volume, volumeBits), 0)
+	trading := api.Sub(1, api.IsZero(volume))
+
+	lastBuyer, nextBuyer := coverage(api, buyerStart, volume, volumeBits)
+	lastSeller, nextSeller := coverage(api, sellerStart, volume, volumeBits)
+	// b_L, s_L and the first unit of their orders; b_N, s_N and whether they exist
+	var lastBuyerBid, lastSellerBid, lastBuyerStart, lastSellerStart frontend.Variable = 0, 0, 0, 0
+	var nextBuyerBid, nextSellerBid, hasNextBuyer, hasNextSeller frontend.Variable = 0, 0, 0, 0
+	for k := 0; k < n; k++ {
+		lastBuyerBid = api.Add(lastBuyerBid, api.Mul(lastBuyer[k], buyerBid[k]))
+		lastSellerBid = api.Add(lastSellerBid, api.Mul(lastSeller[k], sellerBid[k]))
+		lastBuyerStart = api.Add(lastBuyerStart, api.Mul(lastBuyer[k], buyerStart[k]))
+		lastSellerStart = api.Add(lastSellerStart, api.Mul(lastSeller[k], sellerStart[k]))
+		nextBuyerBid = api.Add(nextBuyerBid, api.Mul(nextBuyer[k], buyerBid[k]))
+		nextSellerBid = api.Add(nextSellerBid, api.Mul(nextSeller[k], sellerBid[k]))
+		hasNextBuyer = api.Add(hasNextBuyer, nextBuyer[k])
+		hasNextSeller = api.Add(hasNextSeller, nextSeller[k])
+	}
+	api.AssertIsEqual(api.Mul(trading, zerocash.IsLess(api, lastBuyerBid, lastSellerBid, bits)), 0)
+	api.AssertIsEqual(api.Mul(hasNextBuyer, hasNextSeller, api.Sub(1, zerocash.IsLess(api, nextBuyerBid, nextSellerBid, bits))), 0)
+
+	// The mechanism's rule for the price and the volume that trades; the next unit only
+	// prices a matching that is not empty
+	price, reduced := c.assertMechanism(api, bits, lastBuyerBid, lastSellerBid,
+		api.Mul(trading, nextBuyerBid), api.Mul(trading, nextSellerBid), api.Mul(trading, hasNextBuyer), api.Mul(trading, hasNextSeller))
+	isPayAsBid := api.IsZero(api.Sub(c.Mechanism, int(MechanismPayAsBid)))
+	uniform := api.Sub(api.Sub(1, isPayAsBid), reduced)
+
+	// McAfee's trade reduction stops at the later of the marginal buyer's and seller's first unit
+	reducedVolume := api.Select(zerocash.IsLess(api, lastBuyerStart, lastSellerStart, volumeBits), lastSellerStart, lastBuyerStart)
+	traded := api.Select(reduced, reducedVolume, volume)
+	buyerFilled := filled(api, buyerStart, buyerQuantity, traded, volumeBits)
+	sellerFilled := filled(api, sellerStart, sellerQuantity, traded, volumeBits)
+
+	paid := make([]frontend.Variable, n)
+	received := make([]frontend.Variable, n)
+	for k := 0; k < n; k++ {
+		// Pay-as-bid: own bids; trade reduction: b_L and s_L; otherwise the uniform price
+		buyerPrice := api.Add(api.Mul(isPayAsBid, buyerBid[k]), api.Mul(reduced, lastBuyerBid), api.Mul(uniform, price))
+		sellerPrice := api.Add(api.Mul(isPayAsBid, sellerBid[k]), api.Mul(reduced, lastSellerBid), api.Mul(uniform, price))
+		paid[k] = api.Mul(buyerFilled[k], buyerPrice)
+		received[k] = api.Mul(sellerFilled[k], sellerPrice)
+	}
+
+	// 4. Per-participant deltas, and conservation of the totals up to the surplus
+	var coinsIn, coinsOut, energyIn, energyOut, surplus frontend.Variable = 0, 0, 0, 0, 0
+	for k := 0; k < n; k++ {
+		surplus = api.Add(surplus, api.Sub(paid[k], received[k]))
+	}
+	for i := 0; i < n; i++ {
+		var deltaCoins, deltaEnergy frontend.Variable = 0, 0
+		for k := 0; k < n; k++ {
+			deltaEnergy = api.Add(deltaEnergy, api.Mul(buyerAt[i][k], buyerFilled[k]))
+			deltaEnergy = api.Sub(deltaEnergy, api.Mul(sellerAt[i][k], sellerFilled[k]))
+			deltaCoins = api.Sub(deltaCoins, api.Mul(buyerAt[i][k], paid[k]))
+			deltaCoins = api.Add(deltaCoins, api.Mul(sellerAt[i][k], received[k]))
+		}
+		api.AssertIsEqual(c.OutCoin[i], api.Add(coins[i], deltaCoins))
+		api.AssertIsEqual(c.OutEnergy[i], api.Add(energy[i], deltaEnergy))
+
+		coinsIn, coinsOut = api.Add(coinsIn, coins[i]), api.Add(coinsOut, c.OutCoin[i])
+		energyIn, energyOut = api.Add(energyIn, energy[i]), api.Add(energyOut, c.OutEnergy[i])
+	}
+	api.AssertIsEqual(coinsIn, api.Add(coinsOut, surplus))
+	api.AssertIsEqual(energyIn, energyOut)
+}
+
+// prefixSums returns the n+1 running sums of values, starting at 0.
+func prefixSums(api frontend.API, values []frontend.Variable) []frontend.Variable {
+	sums := make([]frontend.Variable, len(values)+1)
+	sums[0] = 0
+	for k, v := range values {
+		sums[k+1] = api.Add(sums[k], v)
+	}
+	return sums
+}
+
+// coverage flags, among the ranges [start[k], start[k+1]), the one holding unit v-1 (last) and
+// the one holding unit v (next); a flag is 0 for every range when there is no such unit.
+func coverage(api frontend.API, start []frontend.Variable, v frontend.Variable, bits int) (last, next []frontend.Variable) {
+	n := len(start) - 1
+	below := make([]frontend.Variable, n+1) // start[k] < v
+	above := make([]frontend.Variable, n+1) // v < start[k]
+	for k := range start {
+		below[k] = zerocash.IsLess(api, start[k], v, bits)
+		above[k] = zerocash.IsLess(api, v, start[k], bits)
+	}
+	last = make([]frontend.Variable, n)
+	next = make([]frontend.Variable, n)
+	for k := 0; k < n; k++ {
+		last[k] = api.Mul(below[k], api.Sub(1, below[k+1]))
+		next[k] = api.Mul(api.Sub(1, above[k]), above[k+1])
+	}
+	return last, next
+}
+
+// filled returns the part of each range [start[k], start[k] + quantity[k]) below v: the
+// quantity of the k-th order among the first v units.
+func filled(api frontend.API, start, quantity []frontend.Variable, v frontend.Variable, bits int) []frontend.Variable {
+	fills := make([]frontend.Variable, len(quantity))
+	for k := range quantity {
+		begun := zerocash.IsLess(api, start[k], v, bits)
+		partial := zerocash.IsLess(api, v, start[k+1], bits)
+		fills[k] = api.Mul(begun, api.Select(partial, api.Sub(v, start[k]), quantity[k]))
+	}
+	return fills
+}
+
+// assertMechanism checks ClearingPrice against the rule of the public mechanism, given b_L, s_L
+// of the last matched unit and b_N, s_N of the next one (all 0 when nothing is matched).
+// It returns the uniform price, and 1 in reduced when McAfee reduces the trade.
+func (c *CircuitTxF) assertMechanism(api frontend.API, bits int, lastBuyerBid, lastSellerBid, nextBuyerBid, nextSellerBid, hasNextBuyer, hasNextSeller frontend.Variable) (price, reduced frontend.Variable) {
+	isUniformPrice := api.IsZero(api.Sub(c.Mechanism, int(MechanismUniformPrice)))
+	isKDouble := api.IsZero(api.Sub(c.Mechanism, int(MechanismKDouble)))
+	isMcAfee := api.IsZero(api.Sub(c.Mechanism, int(MechanismMcAfee)))
+	isPayAsBid := api.IsZero(api.Sub(c.Mechanism, int(MechanismPayAsBid)))
+	api.AssertIsEqual(api.Add(isUniformPrice, isKDouble, isMcAfee, isPayAsBid), 1)
+
+	price = c.ClearingPrice
+	zerocash.AssertValueRange(api, bits, price)
+	// price = floor(sum / 2) when enabled
+	assertHalf := func(enabled, sum frontend.Variable) {
+		rem := api.Sub(sum, api.Mul(2, price))
+		api.AssertIsEqual(api.Mul(enabled, rem, api.Sub(rem, 1)), 0)
+	}
+
+	// Uniform price: the midpoint of [max(s_L, b_N), min(b_L, s_N)]
+	low := api.Select(zerocash.IsLess(api, lastSellerBid, nextBuyerBid, bits), nextBuyerBid, lastSellerBid)
+	high := api.Select(zerocash.IsLess(api, lastBuyerBid, nextSellerBid, bits), lastBuyerBid, nextSellerBid)
+	high = api.Select(hasNextSeller, high, lastBuyerBid)
+	assertHalf(isUniformPrice, api.Add(low, high))
+
+	// k-double: KDen * (price - s_L) <= KNum * (b_L - s_L) < KDen * (price - s_L + 1)
+	zerocash.AssertValueRange(api, KDoubleBits, c.KNum, c.KDen)
+	api.AssertIsEqual(api.Mul(isKDouble, api.IsZero(c.KDen)), 0)
+	api.AssertIsEqual(api.Mul(isKDouble, zerocash.IsLess(api, c.KDen, c.KNum, KDoubleBits)), 0)
+	scaled := api.Mul(c.KDen, price)
+	target := api.Add(api.Mul(c.KDen, lastSellerBid), api.Mul(c.KNum, api.Sub(lastBuyerBid, lastSellerBid)))
+	api.AssertIsEqual(api.Mul(isKDouble, zerocash.IsLess(api, target, scaled, bits+KDoubleBits+2)), 0)
+	api.AssertIsEqual(api.Mul(isKDouble, api.Sub(1, zerocash.IsLess(api, target, api.Add(scaled, c.KDen), bits+KDoubleBits+2))), 0)
+
+	// McAfee: the midpoint of the next unit, kept when both of it exist and it lies in [s_L, b_L]
+	assertHalf(isMcAfee, api.Add(nextBuyerBid, nextSellerBid))
+	inRange := api.Mul(api.Sub(1, zerocash.IsLess(api, price, lastSellerBid, bits)), api.Sub(1, zerocash.IsLess(api, lastBuyerBid, price, bits)))
+	kept := api.Mul(api.Mul(hasNextBuyer, hasNextSeller), inRange)
+	reduced = api.Mul(isMcAfee, api.Sub(1, kept))
+
+	return price, reduced
+}
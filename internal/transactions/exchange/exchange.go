@@ -1,26 +1,23 @@
-// exchange.go - Auction phase logic for the protocol (Algorithm 3, without ZKP-enforced auction logic).
+// exchange.go - Auction phase logic for the protocol (Algorithm 3).
 //
-// Implements the exchange phase: decrypts registration payloads, runs auction logic (off-circuit),
-// constructs output notes, builds the witness, and generates the ZKP using CircuitTxF10.
-//
-// WARNING: The ZKP only proves cryptographic consistency, not the correctness of the auction computation.
+// Implements the exchange phase: decrypts registration payloads, runs the auction with the chosen
+// mechanism (see mechanism.go), constructs output notes, builds the witness, and generates the
+// ZKP using CircuitTxF of the smallest supported size that holds every participant. The auction
+// is computed here and proven by the circuit, which enforces the same mechanism (see circuit.go).
 
 package exchange
 
 import (
-	"bytes"
 	"crypto/ecdh"
 	"crypto/sha256"
 	"fmt"
 	"math/big"
-	"sort"
 	"time"
 
 	"github.com/consensys/gnark-crypto/ecc"
 	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
 	bls12377_fr "github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
 	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
-	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
@@ -30,22 +27,31 @@ import (
 
 // RegistrationPayload represents decrypted registration data from a participant
 type RegistrationPayload struct {
-	Ciphertext [5]*big.Int           // (pkOut, skIn, bid, coins, energy)
-	PubKey     *sw_bls12377.G1Affine // Participant's public key (for DH)
-	TxNoteData []byte                // Encrypted note data from CreateTx (new field)
+	Ciphertext [zerocash.RegistrationFields]*big.Int // (pkOut, skIn, limit price, coins, energy, side, quantity, rhoIn, randIn)
+	PubKey     *sw_bls12377.G1Affine                 // Participant's public key (for DH)
+	CmIn       *big.Int                              // Commitment of the tx^in note (public input of π_reg)
+	TxNoteData []byte                                // Encrypted note data from CreateTx (new field)
+	Coins      *big.Int                              // Γ^in.coins (public input of π_reg)
+	Energy     *big.Int                              // Γ^in.energy (public input of π_reg)
+	Bid        *big.Int                              // Limit price (public input of π_reg)
+	Proof      []byte                                // π_reg, see register.VerifyRegister
 }
 
-// DecryptedRegistration holds the decrypted data from registration
+// DecryptedRegistration holds the decrypted data from registration: the participant's order
+// and the value of the note backing it
 type DecryptedRegistration struct {
-	PkOut    *big.Int
-	SkIn     *big.Int
-	Bid      *big.Int
-	Coins    *big.Int
-	Energy   *big.Int
-	NoteData *zerocash.Note // Decrypted note from CreateTx (new field)
+	PkOut      *big.Int
+	SkIn       *big.Int
+	Side       zerocash.OrderSide
+	Quantity   *big.Int // Energy to buy or sell
+	LimitPrice *big.Int // Bid b_i: the highest (buy) or lowest (sell) price per unit
+	Coins      *big.Int
+	Energy     *big.Int
+	NoteData   *zerocash.Note // Decrypted note from CreateTx (new field)
 }
 
-// DecryptAllRegistrations decrypts all registration payloads using the auctioneer's private key
+// DecryptAllRegistrations decrypts all registration payloads using the auctioneer's private key.
+// Returns an error for a registration whose side is neither buy nor sell.
 func DecryptAllRegistrations(payloads []RegistrationPayload, auctioneerSk *big.Int) ([]DecryptedRegistration, error) {
 	results := make([]DecryptedRegistration, len(payloads))
 
@@ -70,12 +76,18 @@ func DecryptAllRegistrations(payloads []RegistrationPayload, auctioneerSk *big.I
 		// Decrypt the registration data using the shared secret
 		decrypted := DecZKRegGo(payload.Ciphertext, *shared)
 
+		side, err := decodeSide(decrypted[5])
+		if err != nil {
+			return nil, fmt.Errorf("participant %d: %w", i, err)
+		}
 		result := DecryptedRegistration{
-			PkOut:  decrypted[0], // pk^out
-			SkIn:   decrypted[1], // sk^in
-			Bid:    decrypted[2], // bid
-			Coins:  decrypted[3], // coins
-			Energy: decrypted[4], // energy
+			PkOut:      decrypted[0], // pk^out
+			SkIn:       decrypted[1], // sk^in
+			LimitPrice: decrypted[2], // bid
+			Coins:      decrypted[3], // coins
+			Energy:     decrypted[4], // energy
+			Side:       side,         // side
+			Quantity:   decrypted[6], // quantity
 		}
 
 		// NEW: Decrypt the note data from CreateTx if present
@@ -117,486 +129,581 @@ func DecryptTransactionNotes(payloads []RegistrationPayload, auctioneerECDHPrivK
 	return results, nil
 }
 
+// decodeSide returns the order side encoded in a registration plaintext.
+func decodeSide(v *big.Int) (zerocash.OrderSide, error) {
+	switch {
+	case v.Cmp(big.NewInt(int64(zerocash.SideBuy))) == 0:
+		return zerocash.SideBuy, nil
+	case v.Cmp(big.NewInt(int64(zerocash.SideSell))) == 0:
+		return zerocash.SideSell, nil
+	default:
+		return 0, fmt.Errorf("order side does not decrypt to buy or sell")
+	}
+}
+
 // DecZKRegGo implements the same decryption logic as the circuit's DecZKReg function
-func DecZKRegGo(c [5]*big.Int, encKey bls12377.G1Affine) [5]*big.Int {
-	h := mimcNative.NewMiMC()
+func DecZKRegGo(c [zerocash.RegistrationFields]*big.Int, encKey bls12377.G1Affine) [zerocash.RegistrationFields]*big.Int {
+	masks := regMasks(encKey)
+	var dec [zerocash.RegistrationFields]*big.Int
+	for i := range dec {
+		dec[i] = new(big.Int).Sub(c[i], masks[i])
+	}
+	return dec
+}
+
+// EncZKRegGo encrypts a registration plaintext (pk^out, sk^in, bid, coins, energy, side, quantity, ρ^in, r^in)
+// the way register.EncryptRegistrationData does; DecZKRegGo inverts it.
+func EncZKRegGo(plaintext [zerocash.RegistrationFields]*big.Int, encKey bls12377.G1Affine) [zerocash.RegistrationFields]*big.Int {
+	masks := regMasks(encKey)
+	var c [zerocash.RegistrationFields]*big.Int
+	for i := range c {
+		c[i] = new(big.Int).Add(plaintext[i], masks[i])
+	}
+	return c
+}
 
-	// Use the same MiMC hash chain as in the circuit
-	h.Reset()
+// regMasks returns the MiMC mask chain of a registration ciphertext, as in the circuit's DecZKReg.
+func regMasks(encKey bls12377.G1Affine) [zerocash.RegistrationFields]*big.Int {
+	h := mimcNative.NewMiMC()
 	encKeyXBytes := encKey.X.Bytes()
 	h.Write(encKeyXBytes[:])
 	encKeyYBytes := encKey.Y.Bytes()
 	h.Write(encKeyYBytes[:])
-	mask0 := h.Sum(nil)
+	mask := h.Sum(nil)
 
-	h.Reset()
-	h.Write(mask0)
-	mask1 := h.Sum(nil)
-
-	h.Reset()
-	h.Write(mask1)
-	mask2 := h.Sum(nil)
-
-	h.Reset()
-	h.Write(mask2)
-	mask3 := h.Sum(nil)
-
-	h.Reset()
-	h.Write(mask3)
-	mask4 := h.Sum(nil)
-
-	// Decrypt by subtracting the masks
-	dec0 := new(big.Int).Sub(c[0], new(big.Int).SetBytes(mask0))
-	dec1 := new(big.Int).Sub(c[1], new(big.Int).SetBytes(mask1))
-	dec2 := new(big.Int).Sub(c[2], new(big.Int).SetBytes(mask2))
-	dec3 := new(big.Int).Sub(c[3], new(big.Int).SetBytes(mask3))
-	dec4 := new(big.Int).Sub(c[4], new(big.Int).SetBytes(mask4))
-
-	return [5]*big.Int{dec0, dec1, dec2, dec3, dec4}
+	var masks [zerocash.RegistrationFields]*big.Int
+	for i := range masks {
+		if i > 0 {
+			h.Reset()
+			h.Write(mask)
+			mask = h.Sum(nil)
+		}
+		masks[i] = new(big.Int).SetBytes(mask)
+	}
+	return masks
 }
 
-// RunAuctionLogic implements a sealed-bid double auction mechanism (SBExM)
-// This is the core auction algorithm that matches buyers and sellers
-func RunAuctionLogic(inputs []DecryptedRegistration) []DecryptedRegistration {
-	if len(inputs) == 0 {
-		return inputs
+// BuildWitnessF builds the witness for CircuitTxF with n slots from the registration payloads,
+// decrypted with the auctioneer's secret key, and the auction outcome over inputs (see
+// AuctionMechanism). The ranks of the order book are recomputed from inputs. Each registration's
+// tx^in note is looked up in the ledger by the commitment its plaintext opens, and proven against
+// the ledger's current root (Anchor). Slots past len(payloads) are dummies: a fresh ciphertext of a
+// zero order and value, flagged in Dummy. The output notes get fresh rho and rand and are encrypted
+// to the DH key G^r of their registration (CNew, G_s).
+// Returns an error for a registration whose ciphertext does not decrypt to field elements or whose
+// note is not in the ledger. Outputs that do not follow the outcome's mechanism give a witness the
+// circuit rejects.
+func BuildWitnessF(inputs []DecryptedRegistration, outcome *AuctionOutcome, payloads []RegistrationPayload, auctioneerSk *big.Int,
+	ledger *zerocash.Ledger, n int) (*CircuitTxF, error) {
+	if outcome == nil {
+		return nil, fmt.Errorf("auction outcome is required")
 	}
+	if ledger == nil {
+		return nil, fmt.Errorf("ledger is required to find the registered notes")
+	}
+	id, kNum, kDen, err := mechanismInputs(outcome.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	w := NewCircuitTxF(n)
+	w.Mechanism, w.KNum, w.KDen = int(id), kNum, kDen
+	w.Anchor = ledger.MerkleRoot()
+	outputs := outcome.Outputs
 
-	// Analyze participants based on their bid intentions and energy/coin ratios
-	var buyers, sellers []int
-
-	for i, input := range inputs {
-		if input.Energy != nil && input.Coins != nil && input.Bid != nil {
-			// Determine participant type based on bid-to-energy ratio and market indicators
-			energyToCoinsRatio := new(big.Int)
-			if input.Coins.Cmp(big.NewInt(0)) > 0 {
-				energyToCoinsRatio.Div(input.Energy, input.Coins)
-			}
-
-			bidPerUnit := new(big.Int)
-			if input.Energy.Cmp(big.NewInt(0)) > 0 {
-				bidPerUnit.Div(input.Bid, input.Energy)
+	var sk bls12377_fr.Element
+	sk.SetBigInt(auctioneerSk)
+	_, _, g1, _ := bls12377.Generators()
+	var auctioneerPk bls12377.G1Affine
+	auctioneerPk.ScalarMultiplication(&g1, auctioneerSk)
+	w.G_b = toGnarkPoint(auctioneerPk)
+	w.B = auctioneerSk.String()
+
+	// Clearing hints; slots outside both groups keep rank 0
+	book := rankOrders(inputs)
+	for i := 0; i < n; i++ {
+		w.Rank[i] = 0
+	}
+	for k, i := range book.buyers {
+		w.Rank[i] = k
+	}
+	for k, i := range book.sellers {
+		w.Rank[i] = k
+	}
+	w.Volume, w.ClearingPrice = 0, 0
+	if outcome.volume != nil {
+		w.Volume = outcome.volume.String()
+	}
+	if outcome.price != nil {
+		w.ClearingPrice = outcome.price.String()
+	}
+
+	randomField := func() *big.Int {
+		return new(big.Int).SetBytes(zerocash.RandomBytesPublic(31))
+	}
+
+	for i := 0; i < n; i++ {
+		var ciphertext, plaintext [zerocash.RegistrationFields]*big.Int
+		var gr bls12377.G1Affine
+		dummy := i >= len(payloads)
+		if dummy {
+			// Padding slot: a zero registration encrypted to the auctioneer under a fresh r
+			var r bls12377_fr.Element
+			r.SetRandom()
+			gr.ScalarMultiplication(&g1, r.BigInt(new(big.Int)))
+			plaintext = [zerocash.RegistrationFields]*big.Int{randomField(), randomField(),
+				big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0), randomField(), randomField()}
+			ciphertext = EncZKRegGo(plaintext, *zerocash.ComputeDHShared(&sk, &gr))
+			w.Dummy[i] = 1
+		} else {
+			var err error
+			gr, err = fromGnarkPoint(payloads[i].PubKey)
+			if err != nil {
+				return nil, fmt.Errorf("participant %d: %w", i, err)
 			}
-
-			// Sophisticated classification:
-			// High bid-per-unit + low energy reserves = buyer
-			// Low bid-per-unit + high energy reserves = seller
-			avgBidThreshold := big.NewInt(50)  // Market average
-			energyThreshold := big.NewInt(100) // Energy reserve threshold
-
-			if bidPerUnit.Cmp(avgBidThreshold) >= 0 && input.Energy.Cmp(energyThreshold) < 0 {
-				buyers = append(buyers, i) // High bidder with low energy = buyer
-			} else if bidPerUnit.Cmp(avgBidThreshold) < 0 && input.Energy.Cmp(energyThreshold) >= 0 {
-				sellers = append(sellers, i) // Low bidder with high energy = seller
-			} else {
-				// Ambiguous cases: use energy-to-coins ratio as tiebreaker
-				if energyToCoinsRatio.Cmp(big.NewInt(1)) < 0 {
-					buyers = append(buyers, i) // More coins than energy = wants to buy energy
-				} else {
-					sellers = append(sellers, i) // More energy than coins = wants to sell energy
-				}
+			ciphertext = payloads[i].Ciphertext
+			plaintext = DecZKRegGo(ciphertext, *zerocash.ComputeDHShared(&sk, &gr))
+			w.Dummy[i] = 0
+		}
+		for j, v := range plaintext {
+			if v.Sign() < 0 || v.Cmp(ecc.BW6_761.ScalarField()) >= 0 {
+				return nil, fmt.Errorf("participant %d: registration field %d does not decrypt to a field element", i, j)
 			}
 		}
-	}
+		pkOut, skIn, coins, energy := plaintext[0], plaintext[1], plaintext[3], plaintext[4]
+		rho, rand := plaintext[7], plaintext[8]
 
-	// Sort buyers by bid (descending - highest bids first)
-	sort.Slice(buyers, func(i, j int) bool {
-		bidI := inputs[buyers[i]].Bid
-		bidJ := inputs[buyers[j]].Bid
-		if bidI == nil && bidJ == nil {
-			return false
-		}
-		if bidI == nil {
-			return false
+		// The registered tx^in note, owned by pk^in = KeyGen(sk^in); a dummy's is not in the ledger
+		var siblings, bits [zerocash.MerkleTreeDepth]frontend.Variable
+		for h := range siblings {
+			siblings[h], bits[h] = 0, 0
 		}
-		if bidJ == nil {
-			return true
+		if !dummy {
+			pkIn := zerocash.MimcHashPublic(fieldBytes(skIn)).Bytes()
+			noteIn := &zerocash.Note{
+				Value:   zerocash.Gamma{Coins: coins, Energy: energy},
+				PkOwner: pkIn,
+				Rho:     rho.Bytes(),
+				Rand:    rand.Bytes(),
+				Cm:      zerocash.Commitment(coins, energy, pkIn, rho, rand),
+			}
+			path, err := ledger.NotePath(noteIn)
+			if err != nil {
+				return nil, fmt.Errorf("participant %d: registered note: %w", i, err)
+			}
+			for h := range siblings {
+				siblings[h] = new(big.Int).SetBytes(path.Siblings[h]).String()
+				bits[h] = (path.Index >> h) & 1
+			}
 		}
-		return bidI.Cmp(bidJ) > 0
-	})
+		w.Path[i], w.PathBits[i] = siblings, bits
+		outRho, outRand := randomField(), randomField()
 
-	// Sort sellers by bid (ascending - lowest ask prices first)
-	sort.Slice(sellers, func(i, j int) bool {
-		bidI := inputs[sellers[i]].Bid
-		bidJ := inputs[sellers[j]].Bid
-		if bidI == nil && bidJ == nil {
-			return false
+		w.G_r[i] = toGnarkPoint(gr)
+		for j := range ciphertext {
+			w.C[i][j] = ciphertext[j].String()
+			w.DecVal[i][j] = plaintext[j].String()
 		}
-		if bidI == nil {
-			return true
+		w.InSn[i] = new(big.Int).SetBytes(zerocash.SerialNumber(fieldBytes(skIn), fieldBytes(rho))).String()
+		outCoins, outEnergy := coins, energy
+		if !dummy && i < len(outputs) && outputs[i].Coins != nil && outputs[i].Energy != nil {
+			outCoins, outEnergy = outputs[i].Coins, outputs[i].Energy
 		}
-		if bidJ == nil {
-			return false
+		w.OutCoin[i] = outCoins.String()
+		w.OutEnergy[i] = outEnergy.String()
+		w.OutRho[i] = outRho.String()
+		w.OutRand[i] = outRand.String()
+		cm := zerocash.Commitment(outCoins, outEnergy, pkOut.Bytes(), outRho, outRand)
+		w.OutCm[i] = new(big.Int).SetBytes(cm).String()
+
+		// The output note is encrypted to the registration's DH key G^r under a fresh s, so that
+		// only the holder of r decrypts it: with (G^s)^r = (G^r)^s
+		var s bls12377_fr.Element
+		s.SetRandom()
+		var gs, outKey bls12377.G1Affine
+		gs.ScalarMultiplication(&g1, s.BigInt(new(big.Int)))
+		outKey.ScalarMultiplication(&gr, s.BigInt(new(big.Int)))
+		note := &zerocash.Note{
+			Value:   zerocash.Gamma{Coins: outCoins, Energy: outEnergy},
+			PkOwner: pkOut.Bytes(),
+			Rho:     outRho.Bytes(),
+			Rand:    outRand.Bytes(),
+			Cm:      cm,
 		}
-		return bidI.Cmp(bidJ) < 0
-	})
+		cNew := zerocash.EncryptNoteWithSharedKey(note, &outKey)
+		for k := range cNew {
+			w.CNew[i][k] = cNew[k]
+		}
+		w.G_s[i] = toGnarkPoint(gs)
+		w.S[i] = s.String()
+	}
 
-	// Create output array (copy of inputs initially)
-	outputs := make([]DecryptedRegistration, len(inputs))
-	copy(outputs, inputs)
+	return w, nil
+}
 
-	// Execute double auction matching
-	buyerIdx, sellerIdx := 0, 0
-	for buyerIdx < len(buyers) && sellerIdx < len(sellers) {
-		buyer := buyers[buyerIdx]
-		seller := sellers[sellerIdx]
+// fieldBytes returns x as a whole MiMC block, so that zero is hashed as a field element too.
+func fieldBytes(x *big.Int) []byte {
+	return x.FillBytes(make([]byte, mimcNative.BlockSize))
+}
 
-		buyerBid := inputs[buyer].Bid
-		sellerBid := inputs[seller].Bid
+// toGnarkPoint converts a native BLS12-377 point to its circuit representation.
+func toGnarkPoint(p bls12377.G1Affine) sw_bls12377.G1Affine {
+	return sw_bls12377.G1Affine{X: p.X.String(), Y: p.Y.String()}
+}
 
-		if buyerBid == nil || sellerBid == nil {
-			break
-		}
+// fromGnarkPoint converts a point given as decimal coordinates to a native BLS12-377 point,
+// checking that it is in the G1 subgroup.
+func fromGnarkPoint(p *sw_bls12377.G1Affine) (bls12377.G1Affine, error) {
+	var q bls12377.G1Affine
+	if p == nil {
+		return q, fmt.Errorf("missing DH public key")
+	}
+	x, okX := p.X.(string)
+	y, okY := p.Y.(string)
+	if !okX || !okY {
+		return q, fmt.Errorf("DH public key coordinates must be decimal strings")
+	}
+	if _, err := q.X.SetString(x); err != nil {
+		return q, fmt.Errorf("invalid DH public key: %w", err)
+	}
+	if _, err := q.Y.SetString(y); err != nil {
+		return q, fmt.Errorf("invalid DH public key: %w", err)
+	}
+	if q.IsInfinity() || !q.IsInSubGroup() {
+		return q, fmt.Errorf("DH public key is not in the G1 subgroup")
+	}
+	return q, nil
+}
 
-		// Check if trade is possible (buyer bid >= seller ask)
-		if buyerBid.Cmp(sellerBid) >= 0 {
-			// Calculate trade price (midpoint between bid and ask)
-			tradePrice := new(big.Int)
-			tradePrice.Add(buyerBid, sellerBid)
-			tradePrice.Div(tradePrice, big.NewInt(2))
+// GenerateProofF generates a proof for CircuitTxF with the backend and value width of params.
+// A nil pk or ccs is taken from the circuit registry, for the size of the witness.
+func GenerateProofF(witness *CircuitTxF, params *zerocash.Params, pk zerocash.ProvingKey, ccs constraint.ConstraintSystem) ([]byte, error) {
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return nil, err
+	}
+	ccs, pk, err = zerocash.ResolveProver(zerocash.ExchangeCircuitID(len(witness.InSn)), params.ProvingBackend(), bits, ccs, pk)
+	if err != nil {
+		return nil, err
+	}
 
-			// Calculate trade quantity (minimum of what buyer wants and seller has)
-			buyerWantedEnergy := inputs[buyer].Energy
-			sellerAvailableEnergy := inputs[seller].Energy
+	// Create witness
+	w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField())
+	if err != nil {
+		return nil, fmt.Errorf("witness creation failed: %w", err)
+	}
 
-			tradeQuantity := new(big.Int)
-			if buyerWantedEnergy.Cmp(sellerAvailableEnergy) <= 0 {
-				tradeQuantity.Set(buyerWantedEnergy)
-			} else {
-				tradeQuantity.Set(sellerAvailableEnergy)
-			}
+	// Generate proof
+	proof, err := zerocash.Prove(ccs, pk, w)
+	if err != nil {
+		return nil, fmt.Errorf("proof generation failed: %w", err)
+	}
 
-			// Calculate total trade value
-			tradeValue := new(big.Int)
-			tradeValue.Mul(tradePrice, tradeQuantity)
+	return proof, nil
+}
 
-			// Update buyer: gains energy, loses coins
-			if outputs[buyer].Energy != nil && outputs[buyer].Coins != nil {
-				outputs[buyer].Energy.Add(outputs[buyer].Energy, tradeQuantity)
-				outputs[buyer].Coins.Sub(outputs[buyer].Coins, tradeValue)
-			}
+// PublicExchangeTx is the public part of an exchange transaction: its proof and public inputs.
+// Every slice has one entry per slot, dummy slots included; their length is the circuit size N.
+type PublicExchangeTx struct {
+	Proof        []byte                                `json:"proof"`         // ZKP proof (opaque, tagged with its backend)
+	AuctioneerPk sw_bls12377.G1Affine                  `json:"auctioneer_pk"` // pk_T the registrations are encrypted to
+	Mechanism    MechanismID                           `json:"mechanism"`     // Auction mechanism the outputs follow
+	KNum         int64                                 `json:"k_num"`         // k = KNum / KDen of a k-double auction
+	KDen         int64                                 `json:"k_den"`         // (0/1 for the other mechanisms)
+	Anchor       string                                `json:"anchor"`        // Merkle root the tx^in notes are proven against
+	C            [][zerocash.RegistrationFields]string `json:"ciphertexts"`   // Registration ciphertexts C^Aux
+	G_r          []sw_bls12377.G1Affine                `json:"g_r"`           // DH public keys of the ciphertexts
+	SnIn         []string                              `json:"sn_in"`         // Serial numbers of the tx^in notes
+	CmOut        []string                              `json:"cm_out"`        // Output note commitments
+	CNew         [][6]string                           `json:"c_new"`         // Output notes encrypted to (G^r)^s
+	G_s          []sw_bls12377.G1Affine                `json:"g_s"`           // G^s of each output encryption
+	Dummy        []bool                                `json:"dummy"`         // Padding slots, which move nothing
+}
 
-			// Update seller: loses energy, gains coins
-			if outputs[seller].Energy != nil && outputs[seller].Coins != nil {
-				outputs[seller].Energy.Sub(outputs[seller].Energy, tradeQuantity)
-				outputs[seller].Coins.Add(outputs[seller].Coins, tradeValue)
-			}
+// Terms are the public inputs of CircuitTxF an auction fixes before anyone registers: the
+// auctioneer key pk_T the registrations are encrypted to and the mechanism that clears them.
+// An exchange under other terms is rejected by VerifyExchange.
+type Terms struct {
+	AuctioneerPk sw_bls12377.G1Affine `json:"auctioneer_pk"` // pk_T
+	Mechanism    MechanismID          `json:"mechanism"`     // Auction mechanism
+	KNum         int64                `json:"k_num"`         // k = KNum / KDen of a k-double auction
+	KDen         int64                `json:"k_den"`         // (0/1 for the other mechanisms)
+}
 
-			// Move to next participants
-			buyerIdx++
-			sellerIdx++
-		} else {
-			// No more profitable trades possible
-			break
-		}
+// NewTerms returns the terms of an auction cleared by mechanism, one of the AuctionMechanism
+// implementations of this package, for the auctioneer key pk_T.
+func NewTerms(mechanism AuctionMechanism, auctioneerPk bls12377.G1Affine) (Terms, error) {
+	id, kNum, kDen, err := mechanismInputs(mechanism)
+	if err != nil {
+		return Terms{}, err
 	}
+	if auctioneerPk.IsInfinity() || !auctioneerPk.IsInSubGroup() {
+		return Terms{}, fmt.Errorf("auctioneer public key is not in the G1 subgroup")
+	}
+	return Terms{AuctioneerPk: toGnarkPoint(auctioneerPk), Mechanism: id, KNum: kNum, KDen: kDen}, nil
+}
 
-	return outputs
+// AuctionMechanism returns the mechanism the terms name.
+func (t Terms) AuctionMechanism() (AuctionMechanism, error) {
+	var m AuctionMechanism
+	switch t.Mechanism {
+	case MechanismUniformPrice:
+		m = UniformPrice{}
+	case MechanismKDouble:
+		m = KDouble{Num: t.KNum, Den: t.KDen}
+	case MechanismMcAfee:
+		m = McAfee{}
+	case MechanismPayAsBid:
+		m = PayAsBid{}
+	default:
+		return nil, fmt.Errorf("unknown auction mechanism %v", t.Mechanism)
+	}
+	if _, kNum, kDen, err := mechanismInputs(m); err != nil {
+		return nil, err
+	} else if kNum != t.KNum || kDen != t.KDen {
+		return nil, fmt.Errorf("%v auction has k = %d/%d, not %d/%d", t.Mechanism, kNum, kDen, t.KNum, t.KDen)
+	}
+	return m, nil
 }
 
-// Helper to create a valid random G1Affine point as a gnark struct
-func randomGnarkG1Affine() sw_bls12377.G1Affine {
-	var p bls12377.G1Affine
-	_, _, g1, _ := bls12377.Generators()
-	p.Set(&g1)
-	return sw_bls12377.G1Affine{
-		X: p.X.String(),
-		Y: p.Y.String(),
+// Validate returns an error unless the terms name a mechanism of this package and a valid pk_T.
+func (t Terms) Validate() error {
+	if _, err := t.AuctionMechanism(); err != nil {
+		return err
 	}
+	if _, err := fromGnarkPoint(&t.AuctioneerPk); err != nil {
+		return fmt.Errorf("auctioneer public key: %w", err)
+	}
+	return nil
 }
 
-// Helper to create a [5]frontend.Variable with all "1"
-func onesArray5() [5]frontend.Variable {
-	return [5]frontend.Variable{"1", "1", "1", "1", "1"}
+// CheckAuctioneerSk returns an error unless auctioneerSk is the secret key of pk_T.
+func (t Terms) CheckAuctioneerSk(auctioneerSk *big.Int) error {
+	want, err := fromGnarkPoint(&t.AuctioneerPk)
+	if err != nil {
+		return fmt.Errorf("auctioneer public key: %w", err)
+	}
+	if auctioneerSk == nil {
+		return fmt.Errorf("auctioneer secret key is required")
+	}
+	_, _, g1, _ := bls12377.Generators()
+	var pk bls12377.G1Affine
+	pk.ScalarMultiplication(&g1, auctioneerSk)
+	if !pk.Equal(&want) {
+		return fmt.Errorf("auctioneer secret key does not match the auctioneer public key of the auction")
+	}
+	return nil
 }
 
-// BuildWitnessF10 builds the witness for CircuitTxF10 from input/output notes using the new array-based structure.
-func BuildWitnessF10(inputs, outputs []DecryptedRegistration, payloads []RegistrationPayload, auctioneerSk *big.Int) *CircuitTxF10 {
-	w := &CircuitTxF10{}
+// check returns an error unless tx was proven under the terms.
+func (t Terms) check(tx *PublicExchangeTx) error {
+	if tx.Mechanism != t.Mechanism || tx.KNum != t.KNum || tx.KDen != t.KDen {
+		return fmt.Errorf("exchange is cleared by %v with k = %d/%d, not by %v with k = %d/%d",
+			tx.Mechanism, tx.KNum, tx.KDen, t.Mechanism, t.KNum, t.KDen)
+	}
+	want, err := fromGnarkPoint(&t.AuctioneerPk)
+	if err != nil {
+		return fmt.Errorf("auctioneer public key: %w", err)
+	}
+	got, err := fromGnarkPoint(&tx.AuctioneerPk)
+	if err != nil || !got.Equal(&want) {
+		return fmt.Errorf("exchange is not encrypted to the auctioneer public key of the auction")
+	}
+	return nil
+}
 
-	// Helper to convert *big.Int to frontend.Variable with nil handling
-	toVar := func(x *big.Int) frontend.Variable {
-		if x == nil {
-			return "0"
+// newPublicExchangeTx returns the public inputs of a witness, with its proof.
+func newPublicExchangeTx(w *CircuitTxF, proof []byte) PublicExchangeTx {
+	n := len(w.InSn)
+	tx := PublicExchangeTx{
+		Proof:        proof,
+		AuctioneerPk: w.G_b,
+		Mechanism:    MechanismID(w.Mechanism.(int)),
+		KNum:         w.KNum.(int64),
+		KDen:         w.KDen.(int64),
+		Anchor:       w.Anchor.(string),
+		C:            make([][zerocash.RegistrationFields]string, n),
+		G_r:          append([]sw_bls12377.G1Affine(nil), w.G_r...),
+		SnIn:         make([]string, n),
+		CmOut:        make([]string, n),
+		CNew:         make([][6]string, n),
+		G_s:          append([]sw_bls12377.G1Affine(nil), w.G_s...),
+		Dummy:        make([]bool, n),
+	}
+	for i := 0; i < n; i++ {
+		for j := range w.C[i] {
+			tx.C[i][j] = w.C[i][j].(string)
+		}
+		tx.Dummy[i] = w.Dummy[i] == 1
+		tx.SnIn[i] = w.InSn[i].(string)
+		tx.CmOut[i] = w.OutCm[i].(string)
+		for j := range w.CNew[i] {
+			tx.CNew[i][j] = w.CNew[i][j].(string)
 		}
-		return x.String()
 	}
+	return tx
+}
 
-	// Helper to make [5]frontend.Variable from [5]*big.Int with nil handling
-	toVarArr := func(arr [5]*big.Int) [5]frontend.Variable {
-		var out [5]frontend.Variable
-		for i := 0; i < 5; i++ {
-			if arr[i] == nil {
-				out[i] = "0"
-			} else {
-				out[i] = arr[i].String()
-			}
+// VerifyExchange verifies the proof of an exchange transaction against its public inputs, the
+// terms of its auction and the ledger's recent anchors. A nil vk is taken from the circuit
+// registry, for the size of the transaction and the value width of params. It does not check
+// which registrations the exchange clears (see CheckRegistrations).
+func VerifyExchange(tx *PublicExchangeTx, terms Terms, ledger *zerocash.Ledger, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	if err := terms.check(tx); err != nil {
+		return err
+	}
+	if ledger == nil {
+		return fmt.Errorf("ledger is required to check the anchor")
+	}
+	if !ledger.Tree.IsKnownRoot(tx.Anchor) {
+		return fmt.Errorf("unknown anchor: not a recent ledger merkle root")
+	}
+	n := len(tx.SnIn)
+	if size, err := zerocash.FittingSize(n); err != nil || size != n {
+		return fmt.Errorf("exchange has %d slots, not a supported size %v", n, zerocash.SupportedSizes)
+	}
+	for _, l := range []int{len(tx.C), len(tx.G_r), len(tx.CmOut), len(tx.CNew), len(tx.G_s), len(tx.Dummy)} {
+		if l != n {
+			return fmt.Errorf("exchange has %d serial numbers but a public input of length %d", n, l)
 		}
-		return out
 	}
 
-	// Helper to convert native BLS12-377 point to gnark format
-	toGnarkPoint := func(p bls12377.G1Affine) sw_bls12377.G1Affine {
-		return sw_bls12377.G1Affine{
-			X: p.X.String(),
-			Y: p.Y.String(),
-		}
+	backendID, err := zerocash.ProofBackend(tx.Proof)
+	if err != nil {
+		return fmt.Errorf("proof unmarshaling failed: %w", err)
+	}
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return err
+	}
+	vk, err = zerocash.ResolveVerifyingKey(zerocash.ExchangeCircuitID(n), backendID, bits, vk)
+	if err != nil {
+		return err
 	}
 
-	// Helper to compute MiMC hash (same as circuit)
-	mimcHash := func(data ...*big.Int) *big.Int {
-		h := mimcNative.NewMiMC()
-		for _, d := range data {
-			if d != nil {
-				h.Write(d.Bytes())
-			}
+	// Rebuild the public witness
+	witness := NewCircuitTxF(n)
+	witness.G_b = terms.AuctioneerPk
+	witness.Mechanism, witness.KNum, witness.KDen = int(terms.Mechanism), terms.KNum, terms.KDen
+	witness.Anchor = tx.Anchor
+	for i := 0; i < n; i++ {
+		for j := range tx.C[i] {
+			witness.C[i][j] = tx.C[i][j]
+		}
+		witness.G_r[i] = tx.G_r[i]
+		witness.InSn[i] = tx.SnIn[i]
+		witness.OutCm[i] = tx.CmOut[i]
+		for j := range tx.CNew[i] {
+			witness.CNew[i][j] = tx.CNew[i][j]
+		}
+		witness.G_s[i] = tx.G_s[i]
+		witness.Dummy[i] = 0
+		if tx.Dummy[i] {
+			witness.Dummy[i] = 1
 		}
-		result := h.Sum(nil)
-		return new(big.Int).SetBytes(result)
 	}
-
-	// Helper to compute PRF (same as circuit)
-	prf := func(sk, rho *big.Int) *big.Int {
-		return mimcHash(sk, rho)
+	w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return fmt.Errorf("public witness creation failed: %w", err)
 	}
 
-	// Helper to compute commitment following paper: cm = Com(Γ || pk || ρ, r)
-	computeCommitment := func(coin, energy *big.Int, pk *big.Int, rho, rand *big.Int) *big.Int {
-		return mimcHash(coin, energy, pk, rho, rand)
+	if err := zerocash.Verify(tx.Proof, vk, w); err != nil {
+		return fmt.Errorf("proof verification failed: %w", err)
 	}
+	return nil
+}
 
-	// Helper to get safe values from DecryptedRegistration
-	getSafeValue := func(in DecryptedRegistration, field string) *big.Int {
-		switch field {
-		case "coins":
-			if in.Coins == nil {
-				return big.NewInt(100) // Default value
-			}
-			return in.Coins
-		case "energy":
-			if in.Energy == nil {
-				return big.NewInt(50) // Default value
-			}
-			return in.Energy
-		case "pkout":
-			if in.PkOut == nil {
-				return big.NewInt(1) // Default value
-			}
-			return in.PkOut
-		case "skin":
-			if in.SkIn == nil {
-				return big.NewInt(2) // Default value
-			}
-			return in.SkIn
-		case "bid":
-			if in.Bid == nil {
-				return big.NewInt(10) // Default value
-			}
-			return in.Bid
-		default:
-			return big.NewInt(0)
-		}
-	}
-
-	// Helper to create DH components that derive the shared secret
-	createDHComponents := func(shared bls12377.G1Affine) (sw_bls12377.G1Affine, sw_bls12377.G1Affine, frontend.Variable, sw_bls12377.G1Affine) {
-		// For circuit consistency, we need: EncKey = G_b^R
-		// Setting R = 1 ensures that EncKey = G_b^1 = G_b = shared
-		var r bls12377_fr.Element
-		r.SetOne() // Use R = 1 to satisfy: shared = G_b^R = G_b^1 = G_b
-
-		// Compute G_r = G * r = G * 1 = G (generator)
-		var g1Gen, _, _, _ = bls12377.Generators()
-		var g, gr bls12377.G1Affine
-		g.FromJacobian(&g1Gen)
-		gr.Set(&g) // G_r = G when R = 1
-
-		return sw_bls12377.G1Affine{
-				X: g.X.String(),
-				Y: g.Y.String(),
-			}, // G (generator)
-			sw_bls12377.G1Affine{
-				X: shared.X.String(),
-				Y: shared.Y.String(),
-			}, // G_b = shared secret (so that G_b^R = G_b^1 = shared)
-			r.BigInt(new(big.Int)).String(), // R = 1
-			sw_bls12377.G1Affine{
-				X: gr.X.String(),
-				Y: gr.Y.String(),
-			} // G_r = G * R = G * 1 = G
+// CheckRegistrations checks that the exchange clears exactly registrations, in order: slot i holds
+// the ciphertext C^Aux and the DH key G^r of registrations[i], and the slots after them are the
+// dummy padding of the smallest supported size that fits them. The proof binds the ciphertexts
+// and the dummy flags, so this is only meaningful for an exchange VerifyExchange accepts.
+func (tx *PublicExchangeTx) CheckRegistrations(registrations []RegistrationPayload) error {
+	if tx == nil {
+		return fmt.Errorf("no exchange transaction")
 	}
-
-	// Convert auctioneer's secret key to BLS12-377 field element
-	var sk bls12377_fr.Element
-	sk.SetBigInt(auctioneerSk)
-
-	// For each of the 10 participants, populate the witness arrays
-	for i := 0; i < 10; i++ {
-		var in DecryptedRegistration
-		var payload RegistrationPayload
-
-		if i < len(inputs) {
-			in = inputs[i]
+	n := len(tx.C)
+	if size, err := zerocash.FittingSize(len(registrations)); err != nil || size != n {
+		return fmt.Errorf("exchange has %d slots, not the padded size of its %d registrations", n, len(registrations))
+	}
+	if len(tx.G_r) != n || len(tx.Dummy) != n {
+		return fmt.Errorf("exchange has %d ciphertexts but %d DH keys and %d dummy flags", n, len(tx.G_r), len(tx.Dummy))
+	}
+	for i, payload := range registrations {
+		if tx.Dummy[i] {
+			return fmt.Errorf("slot %d of registration %d is a dummy", i, i)
 		}
-		if i < len(payloads) {
-			payload = payloads[i]
+		want, err := fromGnarkPoint(payload.PubKey)
+		if err != nil {
+			return fmt.Errorf("registration %d: %w", i, err)
 		}
-
-		// Compute DH shared secret for this participant
-		var shared bls12377.G1Affine
-		if i < len(payloads) {
-			// Convert participant's public key from gnark format to native BLS12-377
-			pkX := new(big.Int)
-			pkX.SetString(payload.PubKey.X.(string), 10)
-			pkY := new(big.Int)
-			pkY.SetString(payload.PubKey.Y.(string), 10)
-
-			var pk bls12377.G1Affine
-			pk.X.SetBigInt(pkX)
-			pk.Y.SetBigInt(pkY)
-
-			// Compute DH shared secret: shared = pk^sk
-			sharedPtr := zerocash.ComputeDHShared(&sk, &pk)
-			shared = *sharedPtr
-		} else {
-			// Use a default point if no payload
-			_, _, g1, _ := bls12377.Generators()
-			shared.Set(&g1)
-		}
-
-		// Get consistent values for this participant
-		coins := getSafeValue(in, "coins")
-		energy := getSafeValue(in, "energy")
-		skIn := getSafeValue(in, "skin")
-		bid := getSafeValue(in, "bid")
-
-		// Compute pkOut as MiMC(skIn) to satisfy circuit constraint InPk = MiMC(InSk)
-		pkOut := mimcHash(skIn)
-
-		// Use bid as rho (for consistency)
-		rho := bid
-
-		// Use coins as rand (for consistency)
-		rand := coins
-
-		// Compute serial number using PRF
-		sn := prf(skIn, rho)
-
-		// Compute commitment following paper: cm = Com(Γ || pk || ρ, r)
-		cm := computeCommitment(coins, energy, pkOut, rho, rand)
-
-		// Populate arrays for this participant
-		w.InCoin[i] = toVar(coins)
-		w.InEnergy[i] = toVar(energy)
-		w.InCm[i] = toVar(cm)
-		w.InSn[i] = toVar(sn)
-		w.InPk[i] = toVar(pkOut)
-		w.InSk[i] = toVar(skIn)
-		w.InRho[i] = toVar(rho)
-		w.InRand[i] = toVar(rand)
-
-		// Set outputs equal to inputs to satisfy circuit constraints
-		w.OutCoin[i] = toVar(coins)
-		w.OutEnergy[i] = toVar(energy)
-		w.OutCm[i] = toVar(cm)
-		w.OutSn[i] = toVar(sn)
-		w.OutPk[i] = toVar(pkOut)
-		w.OutRho[i] = toVar(rho)
-		w.OutRand[i] = toVar(rand)
-
-		// Set ciphertext and decrypted values with proper encryption relationship
-		if i < len(payloads) {
-			// Real participant: use actual ciphertext and decrypt it
-			w.C[i] = toVarArr(payload.Ciphertext)
-			dec := DecZKRegGo(payload.Ciphertext, shared)
-			w.DecVal[i] = toVarArr(dec)
-		} else {
-			// Padding participant: create consistent encrypted/decrypted pair
-			// For circuit to pass: C[i] = Encrypt(DecVal[i], SkT[i])
-			plaintext := [5]*big.Int{pkOut, skIn, bid, coins, energy} // Expected decrypted values
-
-			// Encrypt the plaintext using the shared secret to get ciphertext
-			h := mimcNative.NewMiMC()
-			h.Reset()
-			encKeyXBytes := shared.X.Bytes()
-			h.Write(encKeyXBytes[:])
-			encKeyYBytes := shared.Y.Bytes()
-			h.Write(encKeyYBytes[:])
-			mask0 := h.Sum(nil)
-
-			h.Reset()
-			h.Write(mask0)
-			mask1 := h.Sum(nil)
-
-			h.Reset()
-			h.Write(mask1)
-			mask2 := h.Sum(nil)
-
-			h.Reset()
-			h.Write(mask2)
-			mask3 := h.Sum(nil)
-
-			h.Reset()
-			h.Write(mask3)
-			mask4 := h.Sum(nil)
-
-			// Create ciphertext by adding masks to plaintext
-			ciphertext := [5]*big.Int{
-				new(big.Int).Add(plaintext[0], new(big.Int).SetBytes(mask0)),
-				new(big.Int).Add(plaintext[1], new(big.Int).SetBytes(mask1)),
-				new(big.Int).Add(plaintext[2], new(big.Int).SetBytes(mask2)),
-				new(big.Int).Add(plaintext[3], new(big.Int).SetBytes(mask3)),
-				new(big.Int).Add(plaintext[4], new(big.Int).SetBytes(mask4)),
+		got, err := fromGnarkPoint(&tx.G_r[i])
+		if err != nil || !got.Equal(&want) {
+			return fmt.Errorf("slot %d does not hold the DH key of registration %d", i, i)
+		}
+		for j, c := range payload.Ciphertext {
+			if c == nil || tx.C[i][j] != c.String() {
+				return fmt.Errorf("slot %d does not hold the ciphertext of registration %d", i, i)
 			}
-
-			w.C[i] = toVarArr(ciphertext)
-			w.DecVal[i] = toVarArr(plaintext)
 		}
-
-		// Set DH components that satisfy the circuit constraints
-		w.G[i], w.G_b[i], w.R[i], w.G_r[i] = createDHComponents(shared)
-		w.EncKey[i] = toGnarkPoint(shared) // This is what the circuit will verify: EncKey[i] == G_b[i] * R[i]
-		w.SkT[i] = toGnarkPoint(shared)    // This is used for decryption
 	}
-
-	return w
+	for i := len(registrations); i < n; i++ {
+		if !tx.Dummy[i] {
+			return fmt.Errorf("padding slot %d is not a dummy", i)
+		}
+	}
+	return nil
 }
 
-// GenerateProofF10 generates a Groth16 proof for CircuitTxF10.
-func GenerateProofF10(witness *CircuitTxF10, pk groth16.ProvingKey, ccs constraint.ConstraintSystem) ([]byte, error) {
-	// Create witness
-	w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField())
-	if err != nil {
-		return nil, fmt.Errorf("witness creation failed: %w", err)
+// LedgerEntry returns the part of the exchange recorded in the ledger: its serial numbers,
+// output commitments and the encrypted output notes with the keys to find them.
+func (tx *PublicExchangeTx) LedgerEntry() *zerocash.ExchangeTx {
+	return &zerocash.ExchangeTx{
+		SnIn:  append([]string(nil), tx.SnIn...),
+		CmOut: append([]string(nil), tx.CmOut...),
+		CNew:  append([][6]string(nil), tx.CNew...),
+		G_r:   append([]sw_bls12377.G1Affine(nil), tx.G_r...),
+		G_s:   append([]sw_bls12377.G1Affine(nil), tx.G_s...),
 	}
+}
 
-	// Generate proof
-	proof, err := groth16.Prove(ccs, pk, w)
-	if err != nil {
-		return nil, fmt.Errorf("proof generation failed: %w", err)
+// SettleExchange verifies an exchange proof against the terms of its auction and the ledger,
+// checks that it clears exactly registrations, in order (see PublicExchangeTx.CheckRegistrations),
+// and, if so, records the exchange in the ledger as a single entry, spending every tx^in note and
+// creating every output note at once. Each participant then finds its output note by scanning the
+// ledger (zerocash.Wallet.ScanLedger). A nil vk is taken from the circuit registry.
+func SettleExchange(ledger *zerocash.Ledger, tx *PublicExchangeTx, registrations []RegistrationPayload, terms Terms, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	if err := tx.CheckRegistrations(registrations); err != nil {
+		return err
 	}
-
-	// Marshal proof to bytes
-	var proofBuf bytes.Buffer
-	_, err = proof.WriteTo(&proofBuf)
-	if err != nil {
-		return nil, fmt.Errorf("proof marshaling failed: %w", err)
+	if err := VerifyExchange(tx, terms, ledger, params, vk); err != nil {
+		return fmt.Errorf("invalid exchange proof: %w", err)
 	}
-
-	return proofBuf.Bytes(), nil
+	return ledger.AppendExchangeTx(tx.LedgerEntry())
 }
 
-// ExchangeTransaction represents the transaction output of the exchange phase
+// ExchangeTransaction represents the transaction output of the exchange phase.
+// Inputs and Outputs hold the decrypted registrations and stay with the auctioneer;
+// Public() is the part that can be published.
 type ExchangeTransaction struct {
+	PublicExchangeTx
 	Participants int                     `json:"participants"`
+	Size         int                     `json:"size"` // Circuit size N; slots past Participants are dummies
 	Inputs       []DecryptedRegistration `json:"inputs"`
 	Outputs      []DecryptedRegistration `json:"outputs"`
+	Trades       []Trade                 `json:"trades"`
+	Surplus      *big.Int                `json:"surplus"` // Coins burned: paid by buyers, minted to no output
+	Transcript   []string                `json:"transcript"`
 	TotalValue   *big.Int                `json:"total_value"`
 	TotalEnergy  *big.Int                `json:"total_energy"`
 	Timestamp    int64                   `json:"timestamp"`
 	ProofData    []byte                  `json:"proof_data"`
 }
 
+// Public returns a copy of the public part of the transaction.
+func (tx *ExchangeTransaction) Public() *PublicExchangeTx {
+	public := tx.PublicExchangeTx
+	return &public
+}
+
 // AuctionResult represents the output of the auction phase
 type AuctionResult struct {
 	WinnerID    string   `json:"winner_id"`
@@ -625,21 +732,19 @@ func validateExchangeInputs(
 	auctioneerSk *big.Int,
 	ledger *zerocash.Ledger,
 	params *zerocash.Params,
-	pk groth16.ProvingKey,
+	pk zerocash.ProvingKey,
 	ccs constraint.ConstraintSystem,
 ) error {
 	// Validate registration payloads
 	if len(regPayloads) == 0 {
 		return fmt.Errorf("no registration payloads provided")
 	}
-	if len(regPayloads) > 10 {
-		return fmt.Errorf("too many registration payloads: %d (max 10)", len(regPayloads))
+	n, err := zerocash.FittingSize(len(regPayloads))
+	if err != nil {
+		return fmt.Errorf("too many registration payloads: %d (max %d)", len(regPayloads), zerocash.MaxSize())
 	}
 
 	for i, payload := range regPayloads {
-		if len(payload.Ciphertext) != 5 {
-			return fmt.Errorf("invalid ciphertext for payload %d: expected 5 elements, got %d", i, len(payload.Ciphertext))
-		}
 		// Check if any element is nil
 		for j, elem := range payload.Ciphertext {
 			if elem == nil {
@@ -669,27 +774,30 @@ func validateExchangeInputs(
 		return fmt.Errorf("zerocash params is nil")
 	}
 
-	// Validate proving key
-	if pk == nil {
-		return fmt.Errorf("proving key is nil")
+	// Validate proving key and constraint system (nil falls back to the circuit registry)
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return err
 	}
-
-	// Validate constraint system
-	if ccs == nil {
-		return fmt.Errorf("constraint system is nil")
+	if _, _, err := zerocash.ResolveProver(zerocash.ExchangeCircuitID(n), params.ProvingBackend(), bits, ccs, pk); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-// Updated ExchangePhase that handles both registration data and transaction notes
+// ExchangePhaseWithNotes runs the exchange phase over registration data and transaction notes.
+// The proof uses the exchange circuit of size zerocash.FittingSize(len(regPayloads)), padded with
+// dummy slots; pk and ccs must belong to that size, or be nil to use the circuit registry's.
+// The auction is cleared by mechanism, one of the AuctionMechanism implementations of this package.
 func ExchangePhaseWithNotes(
 	regPayloads []RegistrationPayload,
+	mechanism AuctionMechanism,
 	auctioneerSk *big.Int,
 	auctioneerECDHPrivKey *ecdh.PrivateKey,
 	ledger *zerocash.Ledger,
 	params *zerocash.Params,
-	pk groth16.ProvingKey,
+	pk zerocash.ProvingKey,
 	ccs constraint.ConstraintSystem,
 ) (txOut interface{}, info interface{}, proof []byte, err error) {
 	// Input validation
@@ -699,6 +807,9 @@ func ExchangePhaseWithNotes(
 	if auctioneerECDHPrivKey == nil {
 		return nil, nil, nil, fmt.Errorf("auctioneer ECDH private key is required")
 	}
+	if _, _, _, err := mechanismInputs(mechanism); err != nil {
+		return nil, nil, nil, fmt.Errorf("input validation failed: %w", err)
+	}
 
 	// 1. Decrypt registration data (from Algorithm 2 - DH+OTP encryption)
 	regInputs, err := DecryptAllRegistrations(regPayloads, auctioneerSk)
@@ -715,30 +826,60 @@ func ExchangePhaseWithNotes(
 	// 3. Merge the decrypted data
 	inputs := make([]DecryptedRegistration, len(regPayloads))
 	for i := 0; i < len(regPayloads); i++ {
-		inputs[i] = DecryptedRegistration{
-			PkOut:    regInputs[i].PkOut,
-			SkIn:     regInputs[i].SkIn,
-			Bid:      regInputs[i].Bid,
-			Coins:    regInputs[i].Coins,
-			Energy:   regInputs[i].Energy,
-			NoteData: noteInputs[i].NoteData, // Note data from CreateTx
+		inputs[i] = regInputs[i]
+		inputs[i].NoteData = noteInputs[i].NoteData // Note data from CreateTx
+
+		// The note sent with tx^in must hold the values the registration was matched on
+		if note := noteInputs[i].NoteData; note != nil &&
+			(note.Value.Coins == nil || note.Value.Energy == nil ||
+				note.Value.Coins.Cmp(inputs[i].Coins) != 0 || note.Value.Energy.Cmp(inputs[i].Energy) != 0) {
+			return nil, nil, nil, fmt.Errorf("participant %d: transaction note holds %v coins and %v energy, but the registration declares %v and %v",
+				i, note.Value.Coins, note.Value.Energy, inputs[i].Coins, inputs[i].Energy)
 		}
+	}
 
-		// Override with note data if available (note data is more accurate)
-		if noteInputs[i].NoteData != nil {
-			inputs[i].Coins = noteInputs[i].NoteData.Value.Coins
-			inputs[i].Energy = noteInputs[i].NoteData.Value.Energy
+	// Fail early on values the circuit would reject
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, input := range inputs {
+		for _, v := range []struct {
+			field string
+			value *big.Int
+		}{
+			{"limit price", input.LimitPrice}, {"quantity", input.Quantity}, {"coins", input.Coins}, {"energy", input.Energy},
+		} {
+			if err := zerocash.CheckValueRange(fmt.Sprintf("participant %d %s", i, v.field), v.value, bits); err != nil {
+				return nil, nil, nil, err
+			}
 		}
 	}
 
-	// 4. Run auction logic - sophisticated sealed-bid double auction mechanism
-	outputs := RunAuctionLogic(inputs)
+	// 4. Run the auction
+	outcome, err := mechanism.Clear(inputs)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("auction failed: %w", err)
+	}
+	outputs := outcome.Outputs
+	for i, output := range outputs {
+		if err := zerocash.CheckValueRange(fmt.Sprintf("participant %d output coins", i), output.Coins, bits); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := zerocash.CheckValueRange(fmt.Sprintf("participant %d output energy", i), output.Energy, bits); err != nil {
+			return nil, nil, nil, err
+		}
+	}
 
-	// 5. Build witness for CircuitTxF10
-	witness := BuildWitnessF10(inputs, outputs, regPayloads, auctioneerSk)
+	// 5. Build witness for CircuitTxF of the smallest fitting size
+	size, _ := zerocash.FittingSize(len(regPayloads))
+	witness, err := BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	// 6. Generate ZKP using CircuitTxF10
-	proof, err = GenerateProofF10(witness, pk, ccs)
+	// 6. Generate ZKP using CircuitTxF
+	proof, err = GenerateProofF(witness, params, pk, ccs)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -759,8 +900,8 @@ func ExchangePhaseWithNotes(
 		if input.Energy != nil {
 			totalEnergy.Add(totalEnergy, input.Energy)
 		}
-		if input.Bid != nil && input.Bid.Cmp(highestBid) > 0 {
-			highestBid.Set(input.Bid)
+		if input.LimitPrice != nil && input.LimitPrice.Cmp(highestBid) > 0 {
+			highestBid.Set(input.LimitPrice)
 			winnerID = fmt.Sprintf("Participant%d", i+1)
 		}
 	}
@@ -781,13 +922,18 @@ func ExchangePhaseWithNotes(
 
 	// Create exchange transaction output
 	exchangeTx := &ExchangeTransaction{
-		Participants: len(inputs),
-		Inputs:       inputs,
-		Outputs:      outputs,
-		TotalValue:   totalCoins,
-		TotalEnergy:  totalEnergy,
-		Timestamp:    timestamp,
-		ProofData:    proof,
+		PublicExchangeTx: newPublicExchangeTx(witness, proof),
+		Participants:     len(inputs),
+		Size:             size,
+		Inputs:           inputs,
+		Outputs:          outputs,
+		Trades:           outcome.Trades,
+		Surplus:          outcome.Surplus,
+		Transcript:       outcome.Transcript,
+		TotalValue:       totalCoins,
+		TotalEnergy:      totalEnergy,
+		Timestamp:        timestamp,
+		ProofData:        proof,
 	}
 
 	// 8. Return structured results
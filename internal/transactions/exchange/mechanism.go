@@ -0,0 +1,435 @@
+// mechanism.go - Auction mechanisms for the exchange phase.
+//
+// An AuctionMechanism clears the decrypted registrations. All mechanisms share one order book
+// (rankOrders) of the declared orders: buyers are ranked by limit price (bid) descending and
+// sellers by limit price ascending, and the best remaining buyer is filled against the best
+// remaining seller for the smaller of their remaining quantities, as long as their bids cross.
+// One order can thus be filled by several counterparties, and partially. Laid out unit by unit,
+// the first Q units of energy are matched; b_L and s_L are the bids of the buyer and seller
+// covering the last matched unit, b_N and s_N those covering the first unmatched one.
+// The mechanisms differ in how much of the matching trades and at what price:
+//
+//   - UniformPrice: the Q units at the midpoint of [max(s_L, b_N), min(b_L, s_N)]
+//   - KDouble: the Q units at s_L + k * (b_L - s_L)
+//   - McAfee: the Q units at p = (b_N + s_N) / 2 when s_L <= p <= b_L; otherwise the units
+//     before the later of the marginal buyer's and seller's first unit, buyers paying b_L and
+//     sellers receiving s_L
+//   - PayAsBid: the Q units, each side at its own bid
+//
+// Prices are per unit of energy and rounded down. Every mechanism is individually rational (no
+// buyer pays more than its bid, no seller receives less than its own) and weakly budget
+// balanced: buyers pay at least what sellers receive. The difference (the surplus) is burned: no
+// note is minted for it, so it leaves circulation; UniformPrice and KDouble have none, McAfee and
+// PayAsBid in general do. CircuitTxF proves the rule of the mechanism named by its public inputs.
+
+package exchange
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"implementation/internal/zerocash"
+)
+
+// MechanismID identifies an auction mechanism in the exchange circuit.
+type MechanismID int
+
+const (
+	MechanismUniformPrice MechanismID = iota + 1
+	MechanismKDouble
+	MechanismMcAfee
+	MechanismPayAsBid
+)
+
+// String returns the name of the mechanism.
+func (id MechanismID) String() string {
+	switch id {
+	case MechanismUniformPrice:
+		return "uniform-price"
+	case MechanismKDouble:
+		return "k-double"
+	case MechanismMcAfee:
+		return "mcafee"
+	case MechanismPayAsBid:
+		return "pay-as-bid"
+	default:
+		return fmt.Sprintf("mechanism(%d)", int(id))
+	}
+}
+
+// KDoubleBits bounds the numerator and denominator of k in a k-double auction.
+const KDoubleBits = 32
+
+// AuctionMechanism clears a sealed-bid double auction over decrypted registrations.
+// Only the mechanisms of this package can be proven by CircuitTxF.
+type AuctionMechanism interface {
+	// ID identifies the mechanism in the exchange circuit
+	ID() MechanismID
+	// Clear runs the auction; the inputs are not modified
+	Clear(inputs []DecryptedRegistration) (*AuctionOutcome, error)
+}
+
+// Trade is one fill of an auction outcome: energy moved from a seller to a buyer. A participant
+// appears in one trade per counterparty.
+type Trade struct {
+	Buyer       int      `json:"buyer"`        // Participant index of the buyer
+	Seller      int      `json:"seller"`       // Participant index of the seller
+	Quantity    *big.Int `json:"quantity"`     // Energy moved to the buyer
+	BuyerPrice  *big.Int `json:"buyer_price"`  // Coins per unit paid by the buyer
+	SellerPrice *big.Int `json:"seller_price"` // Coins per unit received by the seller
+}
+
+// AuctionOutcome is the result of an auction: the allocations, the fill list with its prices and
+// quantities, and a human-readable transcript of how they were reached.
+type AuctionOutcome struct {
+	Mechanism  AuctionMechanism
+	Outputs    []DecryptedRegistration // The inputs with every trade applied
+	Trades     []Trade
+	Surplus    *big.Int // Coins paid by buyers and not received by sellers
+	Transcript []string
+
+	price  *big.Int // ClearingPrice hint of the circuit
+	volume *big.Int // Volume hint of the circuit
+}
+
+// orderBook holds the ranked groups of an auction, their matching and its margin: the orders
+// covering the last unit of energy that is matched and the first unit that is not.
+type orderBook struct {
+	inputs  []DecryptedRegistration
+	buyers  []int
+	sellers []int
+
+	fills                 []fill   // The matching, in order
+	volume                *big.Int // Q: the energy matched before the bids stop crossing
+	lastBuyer, lastSeller int      // Ranks covering unit Q-1, -1 when nothing is matched
+	nextBuyer, nextSeller int      // Ranks covering unit Q, -1 when there is none or nothing is matched
+}
+
+// fill is one step of the matching: the buyer and seller of the given ranks trade quantity.
+type fill struct {
+	buyer, seller int
+	quantity      *big.Int
+}
+
+// rankOrders builds the order book of the registrations and matches it. Participants with a
+// missing limit price, quantity, coins or energy take no part. Ties keep the registration order,
+// so the result is deterministic.
+func rankOrders(inputs []DecryptedRegistration) *orderBook {
+	b := &orderBook{inputs: inputs}
+	for i, input := range inputs {
+		if input.LimitPrice == nil || input.Quantity == nil || input.Coins == nil || input.Energy == nil {
+			continue
+		}
+		if input.Side == zerocash.SideBuy {
+			b.buyers = append(b.buyers, i)
+		} else {
+			b.sellers = append(b.sellers, i)
+		}
+	}
+
+	// Buyers by bid descending (highest bids first), sellers by bid ascending (lowest asks first)
+	sort.SliceStable(b.buyers, func(x, y int) bool {
+		return inputs[b.buyers[x]].LimitPrice.Cmp(inputs[b.buyers[y]].LimitPrice) > 0
+	})
+	sort.SliceStable(b.sellers, func(x, y int) bool {
+		return inputs[b.sellers[x]].LimitPrice.Cmp(inputs[b.sellers[y]].LimitPrice) < 0
+	})
+	b.match()
+	return b
+}
+
+// match walks both groups in rank order, filling the best remaining buyer against the best
+// remaining seller for the smaller of their remaining quantities, until the bids stop crossing
+// or a group runs out. An order can be filled by several counterparties and partially.
+func (b *orderBook) match() {
+	remaining := func(group []int) []*big.Int {
+		left := make([]*big.Int, len(group))
+		for k, i := range group {
+			left[k] = new(big.Int).Set(b.inputs[i].Quantity)
+		}
+		return left
+	}
+	buyersLeft, sellersLeft := remaining(b.buyers), remaining(b.sellers)
+
+	b.fills, b.volume = nil, big.NewInt(0)
+	b.lastBuyer, b.lastSeller, b.nextBuyer, b.nextSeller = -1, -1, -1, -1
+	k, j := 0, 0
+	for {
+		for k < len(buyersLeft) && buyersLeft[k].Sign() == 0 {
+			k++
+		}
+		for j < len(sellersLeft) && sellersLeft[j].Sign() == 0 {
+			j++
+		}
+		if k == len(buyersLeft) || j == len(sellersLeft) || b.buyerBid(k).Cmp(b.sellerBid(j)) < 0 {
+			break
+		}
+		quantity := new(big.Int).Set(buyersLeft[k])
+		if sellersLeft[j].Cmp(quantity) < 0 {
+			quantity.Set(sellersLeft[j])
+		}
+		b.fills = append(b.fills, fill{buyer: k, seller: j, quantity: quantity})
+		buyersLeft[k].Sub(buyersLeft[k], quantity)
+		sellersLeft[j].Sub(sellersLeft[j], quantity)
+		b.volume.Add(b.volume, quantity)
+		b.lastBuyer, b.lastSeller = k, j
+	}
+	if b.volume.Sign() > 0 {
+		if k < len(buyersLeft) {
+			b.nextBuyer = k
+		}
+		if j < len(sellersLeft) {
+			b.nextSeller = j
+		}
+	}
+}
+
+// buyerBid returns the bid of the k-th buyer, or 0 if there is none.
+func (b *orderBook) buyerBid(k int) *big.Int {
+	if k >= 0 && k < len(b.buyers) {
+		return b.inputs[b.buyers[k]].LimitPrice
+	}
+	return big.NewInt(0)
+}
+
+// sellerBid returns the bid of the k-th seller, or 0 if there is none.
+func (b *orderBook) sellerBid(k int) *big.Int {
+	if k >= 0 && k < len(b.sellers) {
+		return b.inputs[b.sellers[k]].LimitPrice
+	}
+	return big.NewInt(0)
+}
+
+// start returns the quantity of the members of group ranked before k: the first unit of energy
+// the k-th member covers.
+func (b *orderBook) start(group []int, k int) *big.Int {
+	sum := big.NewInt(0)
+	for _, i := range group[:k] {
+		sum.Add(sum, b.inputs[i].Quantity)
+	}
+	return sum
+}
+
+// trades prices the fills covering the first volume units of energy; price returns the buyer
+// and seller prices of a fill from its ranks.
+func (b *orderBook) trades(volume *big.Int, price func(buyer, seller int) (*big.Int, *big.Int)) []Trade {
+	var trades []Trade
+	left := new(big.Int).Set(volume)
+	for _, f := range b.fills {
+		if left.Sign() == 0 {
+			break
+		}
+		quantity := new(big.Int).Set(f.quantity)
+		if left.Cmp(quantity) < 0 {
+			quantity.Set(left)
+		}
+		left.Sub(left, quantity)
+		buyerPrice, sellerPrice := price(f.buyer, f.seller)
+		trades = append(trades, Trade{
+			Buyer:       b.buyers[f.buyer],
+			Seller:      b.sellers[f.seller],
+			Quantity:    quantity,
+			BuyerPrice:  new(big.Int).Set(buyerPrice),
+			SellerPrice: new(big.Int).Set(sellerPrice),
+		})
+	}
+	return trades
+}
+
+// at prices every fill at the same buyer and seller prices.
+func at(buyerPrice, sellerPrice *big.Int) func(int, int) (*big.Int, *big.Int) {
+	return func(int, int) (*big.Int, *big.Int) { return buyerPrice, sellerPrice }
+}
+
+// transcript starts the transcript of an auction with its order book.
+func (b *orderBook) transcript(m AuctionMechanism) []string {
+	group := func(members []int) string {
+		parts := make([]string, len(members))
+		for k, i := range members {
+			parts[k] = fmt.Sprintf("%d (%v at %v)", i, b.inputs[i].Quantity, b.inputs[i].LimitPrice)
+		}
+		return strings.Join(parts, ", ")
+	}
+	return []string{
+		fmt.Sprintf("mechanism: %v", m.ID()),
+		"buyers by bid descending: " + group(b.buyers),
+		"sellers by bid ascending: " + group(b.sellers),
+		fmt.Sprintf("matched: %v energy in %d fills", b.volume, len(b.fills)),
+	}
+}
+
+// settle applies the trades to a copy of the inputs and completes the outcome.
+func (b *orderBook) settle(m AuctionMechanism, trades []Trade, price *big.Int, transcript []string) *AuctionOutcome {
+	outputs := make([]DecryptedRegistration, len(b.inputs))
+	for i, input := range b.inputs {
+		outputs[i] = input
+		if input.Coins != nil {
+			outputs[i].Coins = new(big.Int).Set(input.Coins)
+		}
+		if input.Energy != nil {
+			outputs[i].Energy = new(big.Int).Set(input.Energy)
+		}
+	}
+
+	surplus := big.NewInt(0)
+	for _, t := range trades {
+		paid := new(big.Int).Mul(t.BuyerPrice, t.Quantity)
+		received := new(big.Int).Mul(t.SellerPrice, t.Quantity)
+
+		// Buyer gains energy and loses coins; seller loses energy and gains coins
+		outputs[t.Buyer].Energy.Add(outputs[t.Buyer].Energy, t.Quantity)
+		outputs[t.Buyer].Coins.Sub(outputs[t.Buyer].Coins, paid)
+		outputs[t.Seller].Energy.Sub(outputs[t.Seller].Energy, t.Quantity)
+		outputs[t.Seller].Coins.Add(outputs[t.Seller].Coins, received)
+		surplus.Add(surplus, paid.Sub(paid, received))
+
+		transcript = append(transcript, fmt.Sprintf("trade: seller %d -> buyer %d, %v energy, buyer pays %v, seller receives %v per unit",
+			t.Seller, t.Buyer, t.Quantity, t.BuyerPrice, t.SellerPrice))
+	}
+	transcript = append(transcript, fmt.Sprintf("surplus: %v", surplus))
+
+	return &AuctionOutcome{
+		Mechanism:  m,
+		Outputs:    outputs,
+		Trades:     trades,
+		Surplus:    surplus,
+		Transcript: transcript,
+		price:      price,
+		volume:     new(big.Int).Set(b.volume),
+	}
+}
+
+// UniformPrice is the uniform-price double auction: every trade clears at the midpoint of the
+// interval of prices at which exactly the matched units want to trade.
+type UniformPrice struct{}
+
+// ID implements AuctionMechanism.
+func (UniformPrice) ID() MechanismID { return MechanismUniformPrice }
+
+// Clear implements AuctionMechanism.
+func (m UniformPrice) Clear(inputs []DecryptedRegistration) (*AuctionOutcome, error) {
+	b := rankOrders(inputs)
+	transcript := b.transcript(m)
+	price := big.NewInt(0)
+	var trades []Trade
+	if b.volume.Sign() > 0 {
+		low, high := b.sellerBid(b.lastSeller), b.buyerBid(b.lastBuyer)
+		if next := b.buyerBid(b.nextBuyer); next.Cmp(low) > 0 {
+			low = next
+		}
+		if b.nextSeller >= 0 && b.sellerBid(b.nextSeller).Cmp(high) < 0 {
+			high = b.sellerBid(b.nextSeller)
+		}
+		price.Rsh(new(big.Int).Add(low, high), 1)
+		transcript = append(transcript, fmt.Sprintf("price: %v, the midpoint of [%v, %v]", price, low, high))
+		trades = b.trades(b.volume, at(price, price))
+	}
+	return b.settle(m, trades, price, transcript), nil
+}
+
+// KDouble is the k-double auction: every trade clears at s_L + k * (b_L - s_L), with k = Num / Den
+// in [0, 1]. k = 1/2 prices at the midpoint of the bids covering the last matched unit.
+type KDouble struct {
+	Num, Den int64
+}
+
+// ID implements AuctionMechanism.
+func (KDouble) ID() MechanismID { return MechanismKDouble }
+
+// validate checks that k is in [0, 1] and fits the circuit.
+func (m KDouble) validate() error {
+	limit := int64(1) << KDoubleBits
+	if m.Den <= 0 || m.Num < 0 || m.Num > m.Den || m.Den >= limit {
+		return fmt.Errorf("k-double auction needs 0 <= k = %d/%d <= 1 with a denominator below 2^%d", m.Num, m.Den, KDoubleBits)
+	}
+	return nil
+}
+
+// Clear implements AuctionMechanism.
+func (m KDouble) Clear(inputs []DecryptedRegistration) (*AuctionOutcome, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	b := rankOrders(inputs)
+	transcript := b.transcript(m)
+	price := big.NewInt(0)
+	var trades []Trade
+	if b.volume.Sign() > 0 {
+		buyerBid, sellerBid := b.buyerBid(b.lastBuyer), b.sellerBid(b.lastSeller)
+		spread := new(big.Int).Sub(buyerBid, sellerBid)
+		spread.Mul(spread, big.NewInt(m.Num)).Quo(spread, big.NewInt(m.Den))
+		price.Add(sellerBid, spread)
+		transcript = append(transcript, fmt.Sprintf("price: %v = %v + %d/%d * (%v - %v)", price, sellerBid, m.Num, m.Den, buyerBid, sellerBid))
+		trades = b.trades(b.volume, at(price, price))
+	}
+	return b.settle(m, trades, price, transcript), nil
+}
+
+// McAfee is McAfee's trade-reduction mechanism: with single-unit orders it is truthful for both
+// sides at the cost of sometimes dropping the least valuable part of the matching.
+type McAfee struct{}
+
+// ID implements AuctionMechanism.
+func (McAfee) ID() MechanismID { return MechanismMcAfee }
+
+// Clear implements AuctionMechanism.
+func (m McAfee) Clear(inputs []DecryptedRegistration) (*AuctionOutcome, error) {
+	b := rankOrders(inputs)
+	transcript := b.transcript(m)
+	price := big.NewInt(0)
+	var trades []Trade
+	if b.volume.Sign() > 0 {
+		buyerBid, sellerBid := b.buyerBid(b.lastBuyer), b.sellerBid(b.lastSeller)
+		price.Rsh(new(big.Int).Add(b.buyerBid(b.nextBuyer), b.sellerBid(b.nextSeller)), 1)
+		if b.nextBuyer >= 0 && b.nextSeller >= 0 && price.Cmp(sellerBid) >= 0 && price.Cmp(buyerBid) <= 0 {
+			transcript = append(transcript, fmt.Sprintf("price: %v, the midpoint of the first unit that does not cross, within [%v, %v]", price, sellerBid, buyerBid))
+			trades = b.trades(b.volume, at(price, price))
+		} else {
+			// Stop where the later of the marginal buyer and seller starts
+			volume := b.start(b.buyers, b.lastBuyer)
+			if start := b.start(b.sellers, b.lastSeller); start.Cmp(volume) > 0 {
+				volume = start
+			}
+			transcript = append(transcript, fmt.Sprintf("trade reduction: %v of %v energy matched, buyers pay %v and sellers receive %v",
+				volume, b.volume, buyerBid, sellerBid))
+			trades = b.trades(volume, at(buyerBid, sellerBid))
+		}
+	}
+	return b.settle(m, trades, price, transcript), nil
+}
+
+// PayAsBid is the discriminatory double auction: every matched unit trades, each side at its
+// own bid.
+type PayAsBid struct{}
+
+// ID implements AuctionMechanism.
+func (PayAsBid) ID() MechanismID { return MechanismPayAsBid }
+
+// Clear implements AuctionMechanism.
+func (m PayAsBid) Clear(inputs []DecryptedRegistration) (*AuctionOutcome, error) {
+	b := rankOrders(inputs)
+	trades := b.trades(b.volume, func(buyer, seller int) (*big.Int, *big.Int) {
+		return b.buyerBid(buyer), b.sellerBid(seller)
+	})
+	return b.settle(m, trades, big.NewInt(0), b.transcript(m)), nil
+}
+
+// mechanismInputs returns the public inputs of CircuitTxF naming a mechanism: its ID and k as
+// kNum / kDen, which is 0/1 for mechanisms other than KDouble.
+func mechanismInputs(m AuctionMechanism) (id MechanismID, kNum, kDen int64, err error) {
+	switch m := m.(type) {
+	case UniformPrice, McAfee, PayAsBid:
+		return m.ID(), 0, 1, nil
+	case KDouble:
+		if err := m.validate(); err != nil {
+			return 0, 0, 0, err
+		}
+		return m.ID(), m.Num, m.Den, nil
+	case nil:
+		return 0, 0, 0, fmt.Errorf("auction mechanism is required")
+	default:
+		return 0, 0, 0, fmt.Errorf("auction mechanism %T cannot be proven by the exchange circuit", m)
+	}
+}
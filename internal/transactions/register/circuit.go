@@ -4,22 +4,32 @@ import (
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 	"github.com/consensys/gnark/std/hash/mimc"
+
+	"implementation/internal/zerocash"
 )
 
+func init() {
+	zerocash.RegisterCircuit(zerocash.CircuitRegisterID, func(valueBits int) frontend.Circuit {
+		return &CircuitTxRegister{ValueBits: valueBits}
+	})
+}
+
 // CircuitTxRegister defines the ZK circuit for the registration phase of the protocol.
 // This circuit is for the registration proof (π_reg) in Algorithm 2 (Register),
 // and is separate from the Zerocash transaction proof (π) in Algorithm 1 (Transaction).
-// It proves knowledge of a valid note, bid, and encryption, using MiMC and BLS12-377.
+// It proves knowledge of a valid note, an order backed by it, and its encryption, using MiMC
+// and BLS12-377: a sell order's quantity is at most the note's energy, and a buy order's
+// quantity at the limit price (Bid) costs at most the note's coins.
 type CircuitTxRegister struct {
 	// ====== PUBLIC VARIABLES ======
-	CmIn          frontend.Variable    `gnark:",public"` // Commitment of input note
-	CAux          [5]frontend.Variable `gnark:",public"` // Encrypted (pk, sk, bid, coins, energy)
-	GammaInEnergy frontend.Variable    `gnark:",public"` // Input note energy
-	GammaInCoins  frontend.Variable    `gnark:",public"` // Input note coins
-	Bid           frontend.Variable    `gnark:",public"` // Bid value
-	G             sw_bls12377.G1Affine `gnark:",public"`
-	G_b           sw_bls12377.G1Affine `gnark:",public"`
-	G_r           sw_bls12377.G1Affine `gnark:",public"`
+	CmIn          frontend.Variable                              `gnark:",public"` // Commitment of the tx^in output note
+	CAux          [zerocash.RegistrationFields]frontend.Variable `gnark:",public"` // Encrypted (pk, sk, bid, coins, energy, side, quantity, rho, rand)
+	GammaInEnergy frontend.Variable                              `gnark:",public"` // Input note energy
+	GammaInCoins  frontend.Variable                              `gnark:",public"` // Input note coins
+	Bid           frontend.Variable                              `gnark:",public"` // Limit price per unit of energy
+	G             sw_bls12377.G1Affine                           `gnark:",public"`
+	G_b           sw_bls12377.G1Affine                           `gnark:",public"`
+	G_r           sw_bls12377.G1Affine                           `gnark:",public"`
 
 	// ====== PRIVATE VARIABLES ======
 	InCoin   frontend.Variable
@@ -29,12 +39,19 @@ type CircuitTxRegister struct {
 	SkIn     frontend.Variable
 	PkIn     frontend.Variable
 	PkOut    frontend.Variable
+	Side     frontend.Variable // zerocash.SideBuy or zerocash.SideSell
+	Quantity frontend.Variable // Energy to buy or sell
 	EncKey   sw_bls12377.G1Affine
 	R        frontend.Variable
+
+	ValueBits int `gnark:"-"` // Width of coins, energy, bid and quantity (0 means zerocash.DefaultValueBits)
 }
 
 // Define implements the circuit constraints for registration.
 func (c *CircuitTxRegister) Define(api frontend.API) error {
+	// 0) Coins, energy, bid and quantity fit in ValueBits
+	zerocash.AssertValueRange(api, c.ValueBits, c.InCoin, c.InEnergy, c.GammaInCoins, c.GammaInEnergy, c.Bid, c.Quantity)
+
 	// 1) Recompute cmIn following paper: cm = Com(Γ || pk || ρ, r)
 	hasher, _ := mimc.NewMiMC(api)
 	hasher.Reset()
@@ -46,19 +63,36 @@ func (c *CircuitTxRegister) Define(api frontend.API) error {
 	cm := hasher.Sum()
 	api.AssertIsEqual(c.CmIn, cm)
 
+	// 1b) The values the order is checked against and encrypted with are those of the note
+	api.AssertIsEqual(c.GammaInCoins, c.InCoin)
+	api.AssertIsEqual(c.GammaInEnergy, c.InEnergy)
+
 	// 2) Check pk_in = MiMC(sk_in)
 	hasher.Reset()
 	hasher.Write(c.SkIn)
 	pk := hasher.Sum()
 	api.AssertIsEqual(c.PkIn, pk)
 
-	// 3) Recompute cAux[j] = EncZKReg(pk, sk, bid, coins, energy, encKey)
-	encVal := EncZKReg(api, c.PkOut, c.SkIn, c.Bid, c.GammaInCoins, c.GammaInEnergy, c.EncKey)
-	for i := 0; i < 5; i++ {
+	// 3) Recompute cAux[j] = EncZKReg(pk, sk, bid, coins, energy, side, quantity, rho, rand, encKey);
+	// the note opening lets the exchange circuit find cmIn in the ledger
+	encVal := EncZKReg(api, [zerocash.RegistrationFields]frontend.Variable{
+		c.PkOut, c.SkIn, c.Bid, c.GammaInCoins, c.GammaInEnergy, c.Side, c.Quantity, c.RhoIn, c.RandIn,
+	}, c.EncKey)
+	for i := range encVal {
 		api.AssertIsEqual(c.CAux[i], encVal[i])
 	}
 
-	// 4) Encryption checks
+	// 4) The order is backed by the note: quantity <= energy (sell), quantity * bid <= coins (buy)
+	bits := c.ValueBits
+	if bits <= 0 {
+		bits = zerocash.DefaultValueBits
+	}
+	api.AssertIsBoolean(c.Side)
+	sellBacked := api.Sub(1, zerocash.IsLess(api, c.GammaInEnergy, c.Quantity, bits))
+	buyBacked := api.Sub(1, zerocash.IsLess(api, c.GammaInCoins, api.Mul(c.Quantity, c.Bid), 2*bits))
+	api.AssertIsEqual(api.Select(c.Side, sellBacked, buyBacked), 1)
+
+	// 5) Encryption checks
 	// (G^r)^b == EncKey
 	G_r_b := new(sw_bls12377.G1Affine)
 	G_r_b.ScalarMul(api, c.G_b, c.R)
@@ -75,37 +109,26 @@ func (c *CircuitTxRegister) Define(api frontend.API) error {
 }
 
 // EncZKReg implements MiMC-based encryption for registration.
-// It mimics the style of zerocash's note encryption, but for (pk, sk, bid, coins, energy).
-func EncZKReg(api frontend.API, pkOut, skIn, bid, coins, energy frontend.Variable, encKey sw_bls12377.G1Affine) [5]frontend.Variable {
+// It mimics the style of zerocash's note encryption, but for the registration plaintext
+// (pk^out, sk^in, bid, coins, energy, side, quantity, ρ^in, r^in): field j is masked by the j-th link of a
+// MiMC chain seeded with encKey.
+func EncZKReg(api frontend.API, plaintext [zerocash.RegistrationFields]frontend.Variable, encKey sw_bls12377.G1Affine) [zerocash.RegistrationFields]frontend.Variable {
 	hasher, _ := mimc.NewMiMC(api)
 	// Use encKey.X and encKey.Y as the base for the mask chain
 	hasher.Reset()
 	hasher.Write(encKey.X)
 	hasher.Write(encKey.Y)
-	mask0 := hasher.Sum()
-
-	hasher.Reset()
-	hasher.Write(mask0)
-	mask1 := hasher.Sum()
-
-	hasher.Reset()
-	hasher.Write(mask1)
-	mask2 := hasher.Sum()
-
-	hasher.Reset()
-	hasher.Write(mask2)
-	mask3 := hasher.Sum()
-
-	hasher.Reset()
-	hasher.Write(mask3)
-	mask4 := hasher.Sum()
+	mask := hasher.Sum()
 
 	// Encrypt each field by adding the mask
-	enc0 := api.Add(pkOut, mask0)
-	enc1 := api.Add(skIn, mask1)
-	enc2 := api.Add(bid, mask2)
-	enc3 := api.Add(coins, mask3)
-	enc4 := api.Add(energy, mask4)
-
-	return [5]frontend.Variable{enc0, enc1, enc2, enc3, enc4}
+	var enc [zerocash.RegistrationFields]frontend.Variable
+	for i := range plaintext {
+		if i > 0 {
+			hasher.Reset()
+			hasher.Write(mask)
+			mask = hasher.Sum()
+		}
+		enc[i] = api.Add(plaintext[i], mask)
+	}
+	return enc
 }
@@ -1,55 +1,96 @@
 package register
 
 import (
-	"bytes"
 	"crypto/ecdh"
 	"errors"
+	"fmt"
 	"math/big"
 
 	"github.com/consensys/gnark-crypto/ecc"
 	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
 	bls12377_fr "github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
 	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
-	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 
+	"implementation/internal/transactions/exchange"
 	"implementation/internal/zerocash"
 )
 
 // RegisterResult matches the exact output of Algorithm 2 (Register) in the paper.
 type RegisterResult struct {
-	CAux    [5]*big.Int  // C^Aux: Encrypted registration payload (pk^out, sk^in, b, Γ^in.coins, Γ^in.energy)
-	TxIn    *zerocash.Tx // tx^in: Output of Algorithm 1 (Transaction)
-	InfoBid []byte       // info_bid: Public information about funds and bid (simplified, not used in circuit)
-	Proof   []byte       // π_reg: ZK proof for registration
+	CAux    [zerocash.RegistrationFields]*big.Int // C^Aux: Encrypted registration payload (pk^out, sk^in, b, Γ^in.coins, Γ^in.energy, side, quantity, ρ^in, r^in)
+	TxIn    *zerocash.Tx                          // tx^in: Output of Algorithm 1 (Transaction)
+	InfoBid []byte                                // info_bid: Public information about funds and bid (simplified, not used in circuit)
+	Proof   []byte                                // π_reg: ZK proof for registration
+	// Secrets the participant must keep to claim the exchange output or withdraw;
+	// set Record.Round and store it with Wallet.RecordRegistration
+	Record *zerocash.RegistrationRecord
+	// What the participant sends the auctioneer once tx^in is in the ledger: C^Aux, G^R, the
+	// public inputs of π_reg and π_reg itself, see auction.AuctionRound.Register
+	Payload exchange.RegistrationPayload
 }
 
 // Algorithm 2: Register(n^base, Γ^in, b_i) → (C^Aux, tx^in, info_bid, π_reg)
-// Follows the paper exactly, excluding r_enc for DH-OTP encryption
+// Follows the paper exactly, excluding r_enc for DH-OTP encryption; the bid b_i is the limit
+// price of order, which also declares the side and the quantity of energy to trade
+// order: Must be backed by the note, see zerocash.Order.Validate
 // auctioneerECDHPubKey: Auctioneer's ECDH public key for note encryption in CreateTx
-func Register(participant *zerocash.Participant, note *zerocash.Note, bid *big.Int,
-	pkTx groth16.ProvingKey, ccsTx constraint.ConstraintSystem,
-	pkReg groth16.ProvingKey, ccsReg constraint.ConstraintSystem,
+// path: Authentication path of n^base in the ledger's commitment tree
+// Returns a *zerocash.ValueRangeError if coins, energy, quantity or limit price do not fit in
+// participant.Params.MaxValueBits(), and zerocash.ErrWatchOnly if the participant's wallet is watch-only
+func Register(participant *zerocash.Participant, note *zerocash.Note, order zerocash.Order, path *zerocash.MerklePath,
+	pkTx zerocash.ProvingKey, ccsTx constraint.ConstraintSystem,
+	pkReg zerocash.ProvingKey, ccsReg constraint.ConstraintSystem,
 	skBytes []byte, auctioneerECDHPubKey *ecdh.PublicKey) (*RegisterResult, error) {
 
 	// Validate inputs according to paper
+	if participant.Wallet != nil && participant.Wallet.WatchOnly {
+		return nil, zerocash.ErrWatchOnly
+	}
 	if participant.AuctioneerPub == nil {
 		return nil, errors.New("participant.AuctioneerPub is nil; auctioneer public key required")
 	}
 	if auctioneerECDHPubKey == nil {
 		return nil, errors.New("auctioneer ECDH public key is nil")
 	}
+	bits, err := participant.Params.MaxValueBits()
+	if err != nil {
+		return nil, err
+	}
+	if err := zerocash.CheckValueRange("coins", note.Value.Coins, bits); err != nil {
+		return nil, err
+	}
+	if err := zerocash.CheckValueRange("energy", note.Value.Energy, bits); err != nil {
+		return nil, err
+	}
+	if err := order.Validate(note.Value, bits); err != nil {
+		return nil, err
+	}
+	bid := order.LimitPrice
+
+	// Steps 1, 2 and 6 randomness: derived from the wallet seed when there is one, so the
+	// registration can be recovered from the seed
+	var skIn, skOut, rDH bls12377_fr.Element
+	var keyIndex *uint32
+	if participant.Wallet != nil && len(participant.Wallet.Seed) > 0 {
+		index := participant.Wallet.NextAuction
+		derivedIn, derivedOut, derivedR, err := participant.Wallet.NewAuctionKeys()
+		if err != nil {
+			return nil, err
+		}
+		skIn, skOut, rDH, keyIndex = *derivedIn, *derivedOut, *derivedR, &index
+	} else {
+		skIn.SetRandom()
+		skOut.SetRandom()
+		rDH.SetRandom()
+	}
 
 	// Step 1: Generate sk^in, Compute pk^in = KeyGen(sk^in)
-	var skIn bls12377_fr.Element
-	skIn.SetRandom()
 	pkIn := computePkFromSk(skIn.BigInt(new(big.Int)))
 
 	// Step 2: Generate sk^out, Compute pk^out = KeyGen(sk^out)
-	var skOut bls12377_fr.Element
-	skOut.SetRandom()
 	pkOut := computePkFromSk(skOut.BigInt(new(big.Int)))
 
 	// Step 3: Compute tx^in = Transaction(n^base, sk^base, Γ^in, pk^in)
@@ -57,7 +98,7 @@ func Register(participant *zerocash.Participant, note *zerocash.Note, bid *big.I
 	energy := note.Value.Energy
 	pkInBytes := pkIn.Bytes()
 
-	txIn, err := zerocash.CreateTx(note, skBytes, pkInBytes, coins, energy, participant.Params, ccsTx, pkTx, auctioneerECDHPubKey)
+	txIn, err := zerocash.CreateTx(note, skBytes, pkInBytes, participant.Pk, coins, energy, path, participant.Params, ccsTx, pkTx, auctioneerECDHPubKey)
 	if err != nil {
 		return nil, errors.New("Algorithm 1 (Transaction) failed: " + err.Error())
 	}
@@ -69,41 +110,109 @@ func Register(participant *zerocash.Participant, note *zerocash.Note, bid *big.I
 
 	// Step 6: Generate DH randomness and compute shared key for circuit protocol
 	// Circuit expects: EncKey = G_b^R where G_b is auctioneer public key
-	var rDH bls12377_fr.Element
-	rDH.SetRandom()
 
 	// Compute shared key as auctioneer_pk^R (to match circuit constraint)
 	var sharedKey bls12377.G1Affine
 	sharedKey.ScalarMultiplication(participant.AuctioneerPub, rDH.BigInt(new(big.Int)))
 
-	// Step 7: Compute C^Aux = Enc(pk_T, (Γ^in, b, sk^in, pk^out)) using DH-OTP
+	// Step 7: Compute C^Aux = Enc(pk_T, (Γ^in, b, side, quantity, sk^in, pk^out, ρ^in, r^in)) using DH-OTP;
+	// ρ^in and r^in let the auctioneer prove in the exchange that the tx^in note is in the ledger
 	skInBig := skIn.BigInt(new(big.Int))
-	cAux := EncryptRegistrationData(sharedKey, coins, energy, bid, skInBig, pkOut)
+	cAux := EncryptRegistrationData(sharedKey, txIn.NewNote, order, skInBig, pkOut)
 
-	// Step 8: Compute a commitment for the input note with pk^in for the circuit
-	// This represents the "virtual" note that proves ownership of the input value by sk^in/pk^in
-	inputCommitment := zerocash.Commitment(coins, energy, pkIn.Bytes(),
-		new(big.Int).SetBytes(note.Rho), new(big.Int).SetBytes(note.Rand))
+	// Step 8: The commitment of the tx^in output note, owned by pk^in
+	inputCommitment := txIn.NewNote.Cm
 
 	// Step 9: Compute Prove(x, w) → π_reg with the correct DH values
 	registrationProof, err := generateRegistrationProof(
-		note, bid, coins, energy, skInBig, pkOut, cAux, inputCommitment,
-		sharedKey, participant.AuctioneerPub, rDH, pkReg, ccsReg)
+		txIn.NewNote, order, coins, energy, skInBig, pkOut, cAux, inputCommitment,
+		sharedKey, participant.AuctioneerPub, rDH, participant.Params.ProvingBackend(), bits, pkReg, ccsReg)
 	if err != nil {
 		return nil, errors.New("registration proof generation failed: " + err.Error())
 	}
 
+	rEnc := rDH.Bytes()
+	gr := new(bls12377.G1Affine).ScalarMultiplication(&generatorG1, rDH.BigInt(new(big.Int)))
+	grPoint := convertToG1Affine(*gr)
 	return &RegisterResult{
 		CAux:    cAux,
 		TxIn:    txIn,
 		InfoBid: infoBid,
 		Proof:   registrationProof,
+		Record: &zerocash.RegistrationRecord{
+			Index:    keyIndex,
+			Bid:      new(big.Int).Set(bid),
+			Side:     order.Side,
+			Quantity: new(big.Int).Set(order.Quantity),
+			SkIn:     skInBig.Bytes(),
+			SkOut:    skOut.BigInt(new(big.Int)).Bytes(),
+			REnc:     rEnc[:],
+			CAux:     cAux,
+			NoteIn:   txIn.NewNote,
+		},
+		Payload: exchange.RegistrationPayload{
+			Ciphertext: cAux,
+			PubKey:     &grPoint,
+			CmIn:       new(big.Int).SetBytes(inputCommitment),
+			Coins:      new(big.Int).Set(coins),
+			Energy:     new(big.Int).Set(energy),
+			Bid:        new(big.Int).Set(bid),
+			Proof:      registrationProof,
+		},
 	}, nil
 }
 
+// VerifyRegister verifies the registration proof π_reg of payload for the auctioneer key pkT.
+// A nil vk is taken from the circuit registry for the backend the proof was made with and the
+// value width of params.
+func VerifyRegister(payload exchange.RegistrationPayload, pkT sw_bls12377.G1Affine, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	backendID, err := zerocash.ProofBackend(payload.Proof)
+	if err != nil {
+		return err
+	}
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return err
+	}
+	vk, err = zerocash.ResolveVerifyingKey(zerocash.CircuitRegisterID, backendID, bits, vk)
+	if err != nil {
+		return err
+	}
+
+	// Create public witness
+	if payload.PubKey == nil || payload.CmIn == nil || payload.Coins == nil || payload.Energy == nil || payload.Bid == nil {
+		return errors.New("registration has no G^R, commitment, value or bid")
+	}
+	publicWitness := &CircuitTxRegister{
+		CmIn:          payload.CmIn.String(),
+		GammaInEnergy: payload.Energy.String(),
+		GammaInCoins:  payload.Coins.String(),
+		Bid:           payload.Bid.String(),
+		G:             convertToG1Affine(generatorG1),
+		G_b:           pkT,
+		G_r:           *payload.PubKey,
+	}
+	for i, c := range payload.Ciphertext {
+		if c == nil {
+			return fmt.Errorf("registration ciphertext field %d is missing", i)
+		}
+		publicWitness.CAux[i] = c.String()
+	}
+
+	// Create gnark public witness
+	w, err := frontend.NewWitness(publicWitness, ecc.BW6_761.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return err
+	}
+
+	// Verify the proof
+	return zerocash.Verify(payload.Proof, vk, w)
+}
+
 // EncryptRegistrationData implements DH-OTP encryption from Algorithm 2
-// C^Aux = Enc(pk_T, (Γ^in, b, sk^in, pk^out)) - field order matches EncZKReg circuit
-func EncryptRegistrationData(sharedKey bls12377.G1Affine, coins, energy, bid, skIn, pkOut *big.Int) [5]*big.Int {
+// C^Aux = Enc(pk_T, (Γ^in, b, side, quantity, sk^in, pk^out, ρ^in, r^in)) - field order matches EncZKReg circuit
+// noteIn is the tx^in output note, owned by pk^in = KeyGen(sk^in); its value is Γ^in
+func EncryptRegistrationData(sharedKey bls12377.G1Affine, noteIn *zerocash.Note, order zerocash.Order, skIn, pkOut *big.Int) [zerocash.RegistrationFields]*big.Int {
 	h := mimcNative.NewMiMC()
 
 	// Derive base encryption key from DH shared secret
@@ -114,19 +223,20 @@ func EncryptRegistrationData(sharedKey bls12377.G1Affine, coins, energy, bid, sk
 	baseKey := h.Sum(nil)
 
 	// Generate mask chain for each field - matches EncZKReg in circuit
-	masks := make([][]byte, 5)
+	masks := make([][]byte, zerocash.RegistrationFields)
 	masks[0] = baseKey
-	for i := 1; i < 5; i++ {
+	for i := 1; i < zerocash.RegistrationFields; i++ {
 		h.Reset()
 		h.Write(masks[i-1])
 		masks[i] = h.Sum(nil)
 	}
 
-	// Encrypt fields in same order as EncZKReg: (pk^out, sk^in, b, coins, energy)
-	fields := []*big.Int{pkOut, skIn, bid, coins, energy}
-	var cAux [5]*big.Int
+	// Encrypt fields in same order as EncZKReg: (pk^out, sk^in, b, coins, energy, side, quantity, ρ^in, r^in)
+	fields := []*big.Int{pkOut, skIn, order.LimitPrice, noteIn.Value.Coins, noteIn.Value.Energy, big.NewInt(int64(order.Side)), order.Quantity,
+		new(big.Int).SetBytes(noteIn.Rho), new(big.Int).SetBytes(noteIn.Rand)}
+	var cAux [zerocash.RegistrationFields]*big.Int
 
-	for i := 0; i < 5; i++ {
+	for i := 0; i < zerocash.RegistrationFields; i++ {
 		maskBig := new(big.Int).SetBytes(masks[i])
 		cAux[i] = new(big.Int).Add(fields[i], maskBig)
 	}
@@ -135,16 +245,12 @@ func EncryptRegistrationData(sharedKey bls12377.G1Affine, coins, energy, bid, sk
 }
 
 // generateRegistrationProof creates ZK proof matching CircuitTxRegister
-func generateRegistrationProof(note *zerocash.Note, bid *big.Int, coins, energy, skIn, pkOut *big.Int,
-	cAux [5]*big.Int, inputCommitment []byte, sharedKey bls12377.G1Affine, auctioneerPub *bls12377.G1Affine,
-	rDH bls12377_fr.Element, pk groth16.ProvingKey, ccs constraint.ConstraintSystem) ([]byte, error) {
-
-	// Compute G (generator)
-	var g1Gen, _, _, _ = bls12377.Generators()
-	var g bls12377.G1Affine
-	g.FromJacobian(&g1Gen)
+func generateRegistrationProof(note *zerocash.Note, order zerocash.Order, coins, energy, skIn, pkOut *big.Int,
+	cAux [zerocash.RegistrationFields]*big.Int, inputCommitment []byte, sharedKey bls12377.G1Affine, auctioneerPub *bls12377.G1Affine,
+	rDH bls12377_fr.Element, backendID zerocash.BackendID, bits int, pk zerocash.ProvingKey, ccs constraint.ConstraintSystem) ([]byte, error) {
 
 	// Compute G^r (this should match the provided rDH)
+	g := generatorG1
 	var gr bls12377.G1Affine
 	gr.ScalarMultiplication(&g, rDH.BigInt(new(big.Int)))
 
@@ -154,7 +260,7 @@ func generateRegistrationProof(note *zerocash.Note, bid *big.Int, coins, energy,
 		CmIn:          new(big.Int).SetBytes(inputCommitment).String(),
 		GammaInEnergy: energy.String(),
 		GammaInCoins:  coins.String(),
-		Bid:           bid.String(),
+		Bid:           order.LimitPrice.String(),
 		G:             convertToG1Affine(g),
 		G_b:           convertToG1Affine(*auctioneerPub), // pk_T
 		G_r:           convertToG1Affine(gr),             // G^R
@@ -167,12 +273,14 @@ func generateRegistrationProof(note *zerocash.Note, bid *big.Int, coins, energy,
 		SkIn:     skIn.String(),                             // sk^in
 		PkIn:     computePkFromSk(skIn).String(),            // pk^in = KeyGen(sk^in)
 		PkOut:    pkOut.String(),                            // pk^out
+		Side:     int(order.Side),                           // buy or sell
+		Quantity: order.Quantity.String(),                   // energy to trade
 		EncKey:   convertToG1Affine(sharedKey),              // G_b^R (shared key)
 		R:        rDH.BigInt(new(big.Int)).String(),         // R (DH randomness)
 	}
 
 	// Set CAux values
-	for i := 0; i < 5; i++ {
+	for i := 0; i < zerocash.RegistrationFields; i++ {
 		witness.CAux[i] = cAux[i].String()
 	}
 
@@ -182,20 +290,17 @@ func generateRegistrationProof(note *zerocash.Note, bid *big.Int, coins, energy,
 		return nil, err
 	}
 
-	proof, err := groth16.Prove(ccs, pk, w)
-	if err != nil {
-		return nil, err
-	}
-
-	var buf bytes.Buffer
-	_, err = proof.WriteTo(&buf)
+	ccs, pk, err = zerocash.ResolveProver(zerocash.CircuitRegisterID, backendID, bits, ccs, pk)
 	if err != nil {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	return zerocash.Prove(ccs, pk, w)
 }
 
+// generatorG1 is the generator G of BLS12-377 G1, a public input of π_reg
+var _, _, generatorG1, _ = bls12377.Generators()
+
 // computePkFromSk generates pk = KeyGen(sk) using MiMC hash (matches circuit)
 func computePkFromSk(sk *big.Int) *big.Int {
 	h := mimcNative.NewMiMC()
@@ -212,7 +317,7 @@ func convertToG1Affine(p bls12377.G1Affine) sw_bls12377.G1Affine {
 }
 
 // DecryptRegistrationData decrypts registration data for testing purposes
-func DecryptRegistrationData(ciphertext [5]*big.Int, sharedKey bls12377.G1Affine) [5]*big.Int {
+func DecryptRegistrationData(ciphertext [zerocash.RegistrationFields]*big.Int, sharedKey bls12377.G1Affine) [zerocash.RegistrationFields]*big.Int {
 	h := mimcNative.NewMiMC()
 
 	// Derive base encryption key from DH shared secret (same as encryption)
@@ -223,17 +328,17 @@ func DecryptRegistrationData(ciphertext [5]*big.Int, sharedKey bls12377.G1Affine
 	baseKey := h.Sum(nil)
 
 	// Generate mask chain for each field (same as encryption)
-	masks := make([][]byte, 5)
+	masks := make([][]byte, zerocash.RegistrationFields)
 	masks[0] = baseKey
-	for i := 1; i < 5; i++ {
+	for i := 1; i < zerocash.RegistrationFields; i++ {
 		h.Reset()
 		h.Write(masks[i-1])
 		masks[i] = h.Sum(nil)
 	}
 
 	// Decrypt: subtract the masks
-	var decrypted [5]*big.Int
-	for i := 0; i < 5; i++ {
+	var decrypted [zerocash.RegistrationFields]*big.Int
+	for i := 0; i < zerocash.RegistrationFields; i++ {
 		maskBig := new(big.Int).SetBytes(masks[i])
 		decrypted[i] = new(big.Int).Sub(ciphertext[i], maskBig)
 	}
@@ -4,10 +4,20 @@ import (
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 	"github.com/consensys/gnark/std/hash/mimc"
+
+	"implementation/internal/zerocash"
 )
 
+func init() {
+	zerocash.RegisterCircuit(zerocash.CircuitWithdrawID, func(valueBits int) frontend.Circuit {
+		return &CircuitWithdraw{ValueBits: valueBits}
+	})
+}
+
 type CircuitWithdraw struct {
-	// Public (Instance: x = (sn^in, cm^out, pk_T, C_i))
+	// Public (Instance: x = (rt, cm^in, sn^in, cm^out, pk_T, C_i))
+	Anchor    frontend.Variable    `gnark:",public"` // Merkle root the input note is proven against
+	CmIn      frontend.Variable    `gnark:",public"` // cm^in, public in π_reg: names the registration withdrawn
 	SnIn      frontend.Variable    `gnark:",public"`
 	CmOut     frontend.Variable    `gnark:",public"`
 	PkT       sw_bls12377.G1Affine `gnark:",public"`
@@ -17,15 +27,16 @@ type CircuitWithdraw struct {
 	SkIn frontend.Variable // sk_i^in
 	Bid  frontend.Variable // b_i (bid value)
 
-	// Input note n_i^in = (Γ^in, pk^in, ρ^in, r^in, cm^in)
+	// Input note n_i^in = (Γ^in, pk^in, ρ^in, r^in), opening CmIn
 	NIn struct {
 		Coins  frontend.Variable // Γ^in.coins
 		Energy frontend.Variable // Γ^in.energy
 		PkIn   frontend.Variable // pk^in
 		RhoIn  frontend.Variable // ρ^in
 		RIn    frontend.Variable // r^in
-		CmIn   frontend.Variable // cm^in
 	}
+	Path     [zerocash.MerkleTreeDepth]frontend.Variable // Authentication path of CmIn
+	PathBits [zerocash.MerkleTreeDepth]frontend.Variable // Leaf index bits (1 = node is a right child)
 
 	// Output note n_i^out = (Γ^out, pk^out, ρ^out, r^out, cm^out)
 	NOut struct {
@@ -36,17 +47,32 @@ type CircuitWithdraw struct {
 		ROut   frontend.Variable // r^out
 		CmOut  frontend.Variable // cm^out
 	}
+
+	ValueBits int `gnark:"-"` // Width of coins, energy and bid (0 means zerocash.DefaultValueBits)
 }
 
 func (c *CircuitWithdraw) Define(api frontend.API) error {
 	// Algorithm 4 Statement Verification:
 
-	// (1) Serial number: sn^in = PRF_{sk^in}(n^in.seed())
+	// (0) Coins, energy and bid fit in ValueBits
+	zerocash.AssertValueRange(api, c.ValueBits, c.NIn.Coins, c.NIn.Energy, c.NOut.Coins, c.NOut.Energy, c.Bid)
+
+	// (1) Key derivation: pk^in = H(sk^in)
+	hasher, _ := mimc.NewMiMC(api)
+	hasher.Write(c.SkIn)
+	api.AssertIsEqual(c.NIn.PkIn, hasher.Sum())
+
+	// (2) The input note is a ledger leaf: cm^in = Com(Γ^in || pk^in || ρ^in, r^in) is in the tree under rt
+	cmInComputed := zerocash.NoteCommitment(api, c.NIn.Coins, c.NIn.Energy, c.NIn.PkIn, c.NIn.RhoIn, c.NIn.RIn)
+	api.AssertIsEqual(c.CmIn, cmInComputed)
+	api.AssertIsEqual(c.Anchor, zerocash.MerkleRoot(api, c.CmIn, c.Path[:], c.PathBits[:]))
+
+	// (3) Serial number: sn^in = PRF_{sk^in}(n^in.seed())
 	snComputed := PRF(api, c.SkIn, c.NIn.RhoIn)
 	api.AssertIsEqual(c.SnIn, snComputed)
 
-	// (2) Output commitment: cm^out = Com(Γ^out || pk^out || ρ^out, r^out)
-	hasher, _ := mimc.NewMiMC(api)
+	// (4) Output commitment: cm^out = Com(Γ^out || pk^out || ρ^out, r^out)
+	hasher.Reset()
 	hasher.Write(c.NOut.Coins)  // Γ^out.coins
 	hasher.Write(c.NOut.Energy) // Γ^out.energy
 	hasher.Write(c.NOut.PkOut)  // pk^out
@@ -55,7 +81,11 @@ func (c *CircuitWithdraw) Define(api frontend.API) error {
 	cmComputed := hasher.Sum()
 	api.AssertIsEqual(c.CmOut, cmComputed)
 
-	// (3) Ciphertext: C_i = DH-OTP(pk_T, (b_i, sk_i^in, pk_i^out))
+	// (5) Value conservation: Γ^out = Γ^in
+	api.AssertIsEqual(c.NOut.Coins, c.NIn.Coins)
+	api.AssertIsEqual(c.NOut.Energy, c.NIn.Energy)
+
+	// (6) Ciphertext: C_i = DH-OTP(pk_T, (b_i, sk_i^in, pk_i^out))
 	encVal := EncWithdrawMimc(api, c.Bid, c.SkIn, c.NOut.PkOut, c.PkT)
 	for i := 0; i < 3; i++ {
 		api.AssertIsEqual(c.CipherAux[i], encVal[i])
@@ -66,10 +96,7 @@ func (c *CircuitWithdraw) Define(api frontend.API) error {
 
 // PRF for serial number (MiMC-based)
 func PRF(api frontend.API, sk, rho frontend.Variable) frontend.Variable {
-	h, _ := mimc.NewMiMC(api)
-	h.Write(sk)
-	h.Write(rho)
-	return h.Sum()
+	return zerocash.PRF(api, sk, rho)
 }
 
 // EncWithdrawMimc for ciphertext (MiMC-based DH-OTP encryption)
@@ -1,16 +1,16 @@
 package withdraw
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
 
 	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
-	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
+
+	"implementation/internal/zerocash"
 )
 
 type Note struct {
@@ -22,25 +22,33 @@ type Note struct {
 	Cm     *big.Int
 }
 
-type WithdrawTx struct {
-	SnIn      *big.Int
-	CmOut     *big.Int
-	PkT       sw_bls12377.G1Affine
-	CipherAux [3]*big.Int
-}
+// WithdrawTx is the ledger representation of a withdrawal (see zerocash.WithdrawTx).
+type WithdrawTx = zerocash.WithdrawTx
 
-// PRFGo implements the serial number PRF using MiMC (Go version)
+// PRFGo implements the serial number PRF (Go version of PRF, see zerocash.SerialNumber)
 func PRFGo(sk, rho *big.Int) *big.Int {
-	h := mimc.NewMiMC()
-	h.Write(sk.Bytes())
-	h.Write(rho.Bytes())
-	return new(big.Int).SetBytes(h.Sum(nil))
+	return new(big.Int).SetBytes(zerocash.SerialNumber(sk.Bytes(), rho.Bytes()))
 }
 
-// BuildWithdrawWitness constructs the witness for CircuitWithdraw
-func BuildWithdrawWitness(nIn Note, skIn *big.Int, nOut Note, pkT sw_bls12377.G1Affine, cipherAux [3]*big.Int, bid *big.Int) *CircuitWithdraw {
-	w := &CircuitWithdraw{}
+// BuildWithdrawWitness constructs the witness for CircuitWithdraw, proving nIn against the
+// current root of ledger. Returns an error if nIn is not in the ledger.
+func BuildWithdrawWitness(nIn Note, skIn *big.Int, nOut Note, pkT sw_bls12377.G1Affine, cipherAux [3]*big.Int, bid *big.Int,
+	ledger *zerocash.Ledger) (*CircuitWithdraw, error) {
+	if ledger == nil {
+		return nil, errors.New("ledger is required to prove the input note")
+	}
+	path, err := ledger.NotePath(&zerocash.Note{Cm: nIn.Cm.Bytes()})
+	if err != nil {
+		return nil, fmt.Errorf("input note: %w", err)
+	}
 
+	w := &CircuitWithdraw{}
+	w.Anchor = ledger.MerkleRoot()
+	w.CmIn = nIn.Cm.String()
+	for h := range w.Path {
+		w.Path[h] = new(big.Int).SetBytes(path.Siblings[h]).String()
+		w.PathBits[h] = (path.Index >> h) & 1
+	}
 	w.SnIn = PRFGo(skIn, nIn.Rho).String()
 	w.CmOut = nOut.Cm.String()
 	w.PkT = pkT
@@ -54,20 +62,22 @@ func BuildWithdrawWitness(nIn Note, skIn *big.Int, nOut Note, pkT sw_bls12377.G1
 	w.NIn.PkIn = nIn.Pk.String()
 	w.NIn.RhoIn = nIn.Rho.String()
 	w.NIn.RIn = nIn.R.String()
-	w.NIn.CmIn = nIn.Cm.String()
 	w.NOut.Coins = nOut.Coins.String()
 	w.NOut.Energy = nOut.Energy.String()
 	w.NOut.PkOut = nOut.Pk.String()
 	w.NOut.RhoOut = nOut.Rho.String()
 	w.NOut.ROut = nOut.R.String()
 	w.NOut.CmOut = nOut.Cm.String()
-	return w
+	return w, nil
 }
 
 // Withdraw runs the withdrawal protocol, returns tx and proof
+// nIn must be a note of ledger; the proof shows it is in the tree under the current root.
+// A nil pk or ccs is taken from the circuit registry.
+// Returns a *zerocash.ValueRangeError if a coin, energy or bid value does not fit in params.MaxValueBits()
 func Withdraw(
 	nIn Note, skIn *big.Int, nOut Note, pkT sw_bls12377.G1Affine, cipherAux [3]*big.Int, bid *big.Int,
-	pk groth16.ProvingKey, ccs constraint.ConstraintSystem,
+	ledger *zerocash.Ledger, params *zerocash.Params, pk zerocash.ProvingKey, ccs constraint.ConstraintSystem,
 ) (*WithdrawTx, []byte, error) {
 	if skIn == nil {
 		return nil, nil, fmt.Errorf("skIn is nil")
@@ -75,27 +85,45 @@ func Withdraw(
 	if nIn.Rho == nil {
 		return nil, nil, fmt.Errorf("nIn.Rho is nil")
 	}
+	if nIn.Cm == nil {
+		return nil, nil, fmt.Errorf("nIn.Cm is nil")
+	}
 	if nOut.Cm == nil {
 		return nil, nil, fmt.Errorf("nOut.Cm is nil")
 	}
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range []struct {
+		field string
+		value *big.Int
+	}{
+		{"input coins", nIn.Coins}, {"input energy", nIn.Energy},
+		{"output coins", nOut.Coins}, {"output energy", nOut.Energy},
+		{"bid", bid},
+	} {
+		if err := zerocash.CheckValueRange(v.field, v.value, bits); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	witness := BuildWithdrawWitness(nIn, skIn, nOut, pkT, cipherAux, bid)
-	if witness == nil {
-		return nil, nil, fmt.Errorf("witness is nil")
+	witness, err := BuildWithdrawWitness(nIn, skIn, nOut, pkT, cipherAux, bid, ledger)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	gnarkWitness, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField())
 	if err != nil {
 		return nil, nil, fmt.Errorf("NewWitness failed: %v", err)
 	}
-	proof, err := groth16.Prove(ccs, pk, gnarkWitness)
+	ccs, pk, err = zerocash.ResolveProver(zerocash.CircuitWithdrawID, params.ProvingBackend(), bits, ccs, pk)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Prove failed: %v", err)
+		return nil, nil, err
 	}
-	var proofBuf bytes.Buffer
-	_, err = proof.WriteTo(&proofBuf)
+	proof, err := zerocash.Prove(ccs, pk, gnarkWitness)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("Prove failed: %v", err)
 	}
 	// Convert frontend.Variable strings to *big.Int for SnIn and CmOut
 	snInStr := witness.SnIn.(string)
@@ -104,22 +132,83 @@ func Withdraw(
 	cmOut := new(big.Int)
 	snIn.SetString(snInStr, 10)
 	cmOut.SetString(cmOutStr, 10)
+	anchor, _ := new(big.Int).SetString(witness.Anchor.(string), 10)
 	tx := &WithdrawTx{
+		Anchor:    anchor,
+		CmIn:      new(big.Int).Set(nIn.Cm),
 		SnIn:      snIn,
 		CmOut:     cmOut,
 		PkT:       witness.PkT,
 		CipherAux: cipherAux,
 	}
-	return tx, proofBuf.Bytes(), nil
+	return tx, proof, nil
+}
+
+// WithdrawFromWallet withdraws the wallet's first unspent registered note with the registration
+// secrets it holds (see Withdraw). Returns zerocash.ErrWatchOnly for a watch-only wallet.
+func WithdrawFromWallet(wallet *zerocash.Wallet, ledger *zerocash.Ledger, params *zerocash.Params, pk zerocash.ProvingKey, ccs constraint.ConstraintSystem) (*WithdrawTx, []byte, error) {
+	if wallet.WatchOnly {
+		return nil, nil, zerocash.ErrWatchOnly
+	}
+	if wallet.Locked() {
+		return nil, nil, zerocash.ErrWalletLocked
+	}
+	noteIn, noteOut, bid := wallet.GetWithdrawInputNote(), wallet.GetWithdrawOutputNote(), wallet.GetWithdrawBid()
+	if noteIn == nil || noteOut == nil {
+		return nil, nil, fmt.Errorf("wallet has no registered note to withdraw")
+	}
+	skIn := wallet.GetWithdrawSk()
+	if len(skIn) == 0 || bid == nil {
+		return nil, nil, fmt.Errorf("registration secrets of the note are missing")
+	}
+	var cipherAux [3]*big.Int
+	for i, c := range wallet.GetWithdrawCipherAux() {
+		cipherAux[i] = new(big.Int).SetBytes(c)
+	}
+	pkT := wallet.GetWithdrawPkT()
+	return Withdraw(noteFrom(noteIn), new(big.Int).SetBytes(skIn), noteFrom(noteOut),
+		sw_bls12377.G1Affine{X: pkT.X.String(), Y: pkT.Y.String()}, cipherAux, bid, ledger, params, pk, ccs)
+}
+
+// noteFrom converts a wallet note to the withdraw representation.
+func noteFrom(n *zerocash.Note) Note {
+	return Note{
+		Coins:  n.Value.Coins,
+		Energy: n.Value.Energy,
+		Pk:     new(big.Int).SetBytes(n.PkOwner),
+		Rho:    new(big.Int).SetBytes(n.Rho),
+		R:      new(big.Int).SetBytes(n.Rand),
+		Cm:     new(big.Int).SetBytes(n.Cm),
+	}
 }
 
 // VerifyWithdraw verifies a withdrawal transaction and its proof
-func VerifyWithdraw(tx *WithdrawTx, proofBytes []byte, vk groth16.VerifyingKey) error {
+// A nil vk is taken from the circuit registry for the backend the proof was made with and the
+// value width of params.
+func VerifyWithdraw(tx *WithdrawTx, proofBytes []byte, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	backendID, err := zerocash.ProofBackend(proofBytes)
+	if err != nil {
+		return err
+	}
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return err
+	}
+	vk, err = zerocash.ResolveVerifyingKey(zerocash.CircuitWithdrawID, backendID, bits, vk)
+	if err != nil {
+		return err
+	}
+
 	// Create public witness
+	if tx.Anchor == nil || tx.CmIn == nil || tx.SnIn == nil || tx.CmOut == nil {
+		return errors.New("withdrawal has no anchor, serial number or commitments")
+	}
 	publicWitness := &CircuitWithdraw{
-		SnIn:  tx.SnIn.String(),
-		CmOut: tx.CmOut.String(),
-		PkT:   tx.PkT,
+		Anchor: tx.Anchor.String(),
+		CmIn:   tx.CmIn.String(),
+		SnIn:   tx.SnIn.String(),
+		CmOut:  tx.CmOut.String(),
+		PkT:    tx.PkT,
 		CipherAux: [3]frontend.Variable{
 			tx.CipherAux[0].String(),
 			tx.CipherAux[1].String(),
@@ -133,13 +222,15 @@ func VerifyWithdraw(tx *WithdrawTx, proofBytes []byte, vk groth16.VerifyingKey)
 		return err
 	}
 
-	// Unmarshal proof
-	proof := groth16.NewProof(ecc.BW6_761)
-	_, err = proof.ReadFrom(bytes.NewReader(proofBytes))
-	if err != nil {
-		return err
-	}
-
 	// Verify the proof
-	return groth16.Verify(proof, vk, w)
+	return zerocash.Verify(proofBytes, vk, w)
+}
+
+// SubmitWithdrawTx verifies a withdrawal proof and, if valid, records the transaction in the ledger.
+// Returns an error if the note was already spent, by an exchange or an earlier withdrawal.
+func SubmitWithdrawTx(ledger *zerocash.Ledger, tx *WithdrawTx, proofBytes []byte, params *zerocash.Params, vk zerocash.VerifyingKey) error {
+	if err := VerifyWithdraw(tx, proofBytes, params, vk); err != nil {
+		return fmt.Errorf("invalid withdraw proof: %w", err)
+	}
+	return ledger.AppendWithdrawTx(tx)
 }
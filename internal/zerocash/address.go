@@ -0,0 +1,240 @@
+// address.go - Payment addresses: the note public key and DH key a payment is made to.
+//
+// Paying someone needs two keys: the pk that will own the new note, and the DH public key its
+// ciphertext is encrypted to. A PaymentAddress bundles both in one string, encoded with bech32m
+// (BIP-350) so that typing errors are detected, under a human-readable prefix naming the network:
+//
+//	<network> 1 <version || pk || compressed DH key, in 5-bit groups> <6-character checksum>
+//
+// Addresses are longer than the 90 characters BIP-173 allows, so the guarantee of detecting any 4
+// errors does not hold; a corrupted address still passes the checksum with probability 2^-30.
+// Parse with ParsePaymentAddress and check the network with ValidatePaymentAddress.
+
+package zerocash
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	bls12377_fp "github.com/consensys/gnark-crypto/ecc/bls12-377/fp"
+)
+
+// Payment address networks; the network is the address prefix.
+const (
+	NetworkMain = "ppem"
+	NetworkTest = "ppemtest"
+)
+
+// DefaultNetwork is the network used when Params.Network is empty.
+const DefaultNetwork = NetworkMain
+
+// AddressVersion is the payload version of the addresses written by PaymentAddress.String.
+const AddressVersion = 0
+
+const (
+	addressPkSize      = bls12377_fp.Bytes // MiMC output, an element of the BW6-761 scalar field
+	addressPayloadSize = 1 + addressPkSize + bls12377.SizeOfG1AffineCompressed
+)
+
+// ErrAddressNetwork is returned when an address belongs to another network than expected.
+var ErrAddressNetwork = errors.New("payment address is for another network")
+
+// PaymentAddress is where a note is paid to.
+type PaymentAddress struct {
+	Network string             // Address prefix (NetworkMain, NetworkTest)
+	Pk      []byte             // Note public key; the new note is owned by it
+	EncKey  *bls12377.G1Affine // DH public key the new note is encrypted to
+}
+
+// NewPaymentAddress returns the address of a note public key and DH key on network.
+func NewPaymentAddress(network string, pk []byte, encKey *bls12377.G1Affine) (*PaymentAddress, error) {
+	a := &PaymentAddress{Network: network, Pk: pk, EncKey: encKey}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Validate checks that the address has a valid network prefix, a note public key in the field
+// and a DH key in the G1 subgroup.
+func (a *PaymentAddress) Validate() error {
+	if len(a.Network) == 0 || len(a.Network) > 83 || strings.ToLower(a.Network) != a.Network {
+		return fmt.Errorf("invalid address network %q", a.Network)
+	}
+	for _, c := range a.Network {
+		if c < 33 || c > 126 || c == '1' {
+			return fmt.Errorf("invalid address network %q", a.Network)
+		}
+	}
+	if len(a.Pk) == 0 || len(a.Pk) > addressPkSize || new(big.Int).SetBytes(a.Pk).Cmp(bls12377_fp.Modulus()) >= 0 {
+		return fmt.Errorf("invalid note public key in payment address")
+	}
+	if a.EncKey == nil || a.EncKey.IsInfinity() || !a.EncKey.IsInSubGroup() {
+		return fmt.Errorf("invalid encryption key in payment address")
+	}
+	return nil
+}
+
+// String returns the bech32m encoding of the address.
+func (a *PaymentAddress) String() string {
+	payload := make([]byte, 0, addressPayloadSize)
+	payload = append(payload, AddressVersion)
+	payload = append(payload, leftPad(a.Pk)...)
+	encKey := a.EncKey.Bytes()
+	payload = append(payload, encKey[:]...)
+	return bech32mEncode(a.Network, convertBits(payload, 8, 5, true))
+}
+
+// Equal reports whether two addresses are the same.
+func (a *PaymentAddress) Equal(b *PaymentAddress) bool {
+	return a.Network == b.Network && new(big.Int).SetBytes(a.Pk).Cmp(new(big.Int).SetBytes(b.Pk)) == 0 &&
+		a.EncKey.Equal(b.EncKey)
+}
+
+// ParsePaymentAddress decodes and validates an address of any network.
+func ParsePaymentAddress(s string) (*PaymentAddress, error) {
+	hrp, data, err := bech32mDecode(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment address: %w", err)
+	}
+	payload := convertBits(data, 5, 8, false)
+	if payload == nil || len(payload) == 0 {
+		return nil, fmt.Errorf("invalid payment address: bad padding")
+	}
+	if payload[0] != AddressVersion {
+		return nil, fmt.Errorf("unsupported payment address version %d", payload[0])
+	}
+	if len(payload) != addressPayloadSize {
+		return nil, fmt.Errorf("invalid payment address: payload is %d bytes, want %d", len(payload), addressPayloadSize)
+	}
+	var encKey bls12377.G1Affine
+	if _, err := encKey.SetBytes(payload[1+addressPkSize:]); err != nil {
+		return nil, fmt.Errorf("invalid encryption key in payment address: %w", err)
+	}
+	return NewPaymentAddress(hrp, payload[1:1+addressPkSize], &encKey)
+}
+
+// ValidatePaymentAddress parses an address and checks that it belongs to network.
+// Returns an error wrapping ErrAddressNetwork for an address of another network.
+func ValidatePaymentAddress(s, network string) (*PaymentAddress, error) {
+	a, err := ParsePaymentAddress(s)
+	if err != nil {
+		return nil, err
+	}
+	if a.Network != network {
+		return nil, fmt.Errorf("%w: %s, want %s", ErrAddressNetwork, a.Network, network)
+	}
+	return a, nil
+}
+
+// PaymentAddress returns the wallet's address on network: payments to it are owned by its
+// spend key and encrypted to its DH key. Watch-only wallets have no spend key and no address.
+func (w *Wallet) PaymentAddress(network string) (*PaymentAddress, error) {
+	if w.Locked() {
+		return nil, ErrWalletLocked
+	}
+	sk := w.SpendKey()
+	if sk == nil {
+		return nil, fmt.Errorf("wallet %s has no spend key", w.Name)
+	}
+	return NewPaymentAddress(network, MimcHashPublic(sk).Bytes(), w.Pk)
+}
+
+// bech32mCharset maps 5-bit groups to address characters.
+const bech32mCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32mConst is the checksum constant that distinguishes bech32m from bech32.
+const bech32mConst = 0x2bc830a3
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	out := make([]byte, 0, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+func bech32mEncode(hrp string, data []byte) string {
+	values := append(bech32HrpExpand(hrp), data...)
+	mod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ bech32mConst
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range data {
+		sb.WriteByte(bech32mCharset[d])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32mCharset[(mod>>(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+func bech32mDecode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("missing separator or checksum")
+	}
+	hrp := s[:sep]
+	data := make([]byte, 0, len(s)-sep-1)
+	for i := sep + 1; i < len(s); i++ {
+		d := strings.IndexByte(bech32mCharset, s[i])
+		if d < 0 {
+			return "", nil, fmt.Errorf("invalid character %q", s[i])
+		}
+		data = append(data, byte(d))
+	}
+	if bech32Polymod(append(bech32HrpExpand(hrp), data...)) != bech32mConst {
+		return "", nil, errors.New("checksum mismatch")
+	}
+	return hrp, data[:len(data)-6], nil
+}
+
+// convertBits regroups data from fromBits-bit to toBits-bit groups. Without pad, leftover bits
+// must be zero padding; nil is returned otherwise.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) []byte {
+	var acc, bits uint
+	maxv := uint(1)<<toBits - 1
+	out := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, v := range data {
+		acc = acc<<fromBits | uint(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil
+	}
+	return out
+}
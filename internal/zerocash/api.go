@@ -4,7 +4,7 @@
 // Implements the Participant type, which manages keys, wallet, and protocol logic.
 // All transactions are appended to the global ledger (ledger.json).
 //
-// Each participant maintains a Wallet file (e.g., bob_wallet.json) for their own notes and keys.
+// Each participant maintains an encrypted Wallet file (e.g., bob_wallet.json) for their own notes and keys.
 //
 // WARNING: All REST endpoints must validate input and handle errors securely.
 
@@ -16,9 +16,12 @@ package zerocash
 // (All main types and functions are already public in their respective files.)
 
 import (
+	"bytes"
+	"crypto/ecdh"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -28,26 +31,35 @@ import (
 	"sync"
 
 	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	bls12377_fp "github.com/consensys/gnark-crypto/ecc/bls12-377/fp"
 	"github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
-	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
-	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
 )
 
 // PubKeyResponse is the REST response for a public key
-// X, Y are hex-encoded BLS12-377 G1Affine coordinates
+// X, Y are hex-encoded BLS12-377 G1Affine coordinates; Address is the participant's payment
+// address (empty if its wallet is locked or watch-only)
 type PubKeyResponse struct {
-	X string `json:"x"`
-	Y string `json:"y"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	Address string `json:"address,omitempty"`
 }
 
-// TxRequest is the REST request for sending a confidential transaction
+// TxRequest is the REST request for sending a confidential transaction.
+// It carries only the public transaction; the recipient recovers the new note from CNewCircuit.
+// To is the payment address the transaction pays; a request for another address or network is refused.
 type TxRequest struct {
-	SenderPub PubKeyResponse `json:"sender_pub"`
-	Tx        *Tx            `json:"tx"`
+	Tx *PublicTx `json:"tx"`
+	To string    `json:"to,omitempty"`
 }
 
+// WalletSchemaVersion is the version of the wallet contents written by Save and ExportPlaintext.
+// Version 1 (or a missing version) is the schema that did not persist registration secrets.
+const WalletSchemaVersion = 2
+
 // Wallet stores a participant's private keys and recognized notes.
 type Wallet struct {
+	Version  int    // Schema version (WalletSchemaVersion)
 	Name     string // Participant name
 	Sk       *fr.Element
 	Pk       *bls12377.G1Affine
@@ -55,50 +67,189 @@ type Wallet struct {
 	NoteKeys [][]byte // Secret keys for notes (optional, for spending)
 	Spent    []bool   // Track whether each note has been spent (consumed)
 	// Withdraw support fields
-	rEnc            [][]byte    // Registration randomness for each note
-	CAux            [][][5]byte // Registration ciphertext for each note (as array of 5 byte slices)
-	WithdrawOutNote []*Note     // Output note for withdraw for each note
-	// Registration data storage
-	registrationData []byte // Store registration ciphertext data
+	Registrations   []*RegistrationRecord // Registration secrets for each note (nil if the note was not registered)
+	WithdrawOutNote []*Note               // Output note for withdraw for each note
+	// Key hierarchy (see keys.go); Seed is nil for wallets created without one
+	Seed        []byte
+	NextNoteKey uint32 // Index of the next unused note key
+	NextAuction uint32 // Index of the next unused set of auction keys
+	// Ledger entries already visited by ScanLedger
+	Checkpoint ScanCheckpoint
+	// Watch-only wallets are imported from a viewing key and hold no spending keys (see viewkeys.go)
+	WatchOnly     bool              `json:",omitempty"`
+	NullifierKeys map[string][]byte `json:",omitempty"` // nk by decimal note pk, from a full viewing key
+	// Set by the loader when the wallet was upgraded from an older schema
+	Migration *WalletMigration `json:"-"`
+	// Sealing key and locked state (see walletfile.go)
+	vault *walletVault
+}
+
+// RegistrationRecord holds the secrets of one auction registration (Algorithm 2) that the
+// participant needs later to claim its exchange output or to withdraw (Algorithm 4).
+type RegistrationRecord struct {
+	Round    string                       // Auction round the note was registered in
+	Index    *uint32                      `json:",omitempty"` // Derivation index of the auction keys (seed wallets)
+	Bid      *big.Int                     // b_i, the limit price of the order
+	Side     OrderSide                    // Side of the order
+	Quantity *big.Int                     // Energy the order buys or sells
+	SkIn     []byte                       // sk^in, owner key of the tx^in output note
+	SkOut    []byte                       // sk^out, owner key of the exchange or withdraw output note
+	REnc     []byte                       // DH randomness r_enc used for C^Aux
+	CAux     [RegistrationFields]*big.Int // C^Aux as sent to the auctioneer
+	NoteIn   *Note                        // Output note of tx^in, owned by pk^in
+}
+
+// NewWalletFromSeed creates an empty wallet whose keys are derived from seed.
+func NewWalletFromSeed(name string, seed []byte) (*Wallet, error) {
+	keys, err := NewKeyChain(seed)
+	if err != nil {
+		return nil, err
+	}
+	kp := keys.DHKey()
+	return &Wallet{
+		Version:         WalletSchemaVersion,
+		Name:            name,
+		Sk:              kp.Sk,
+		Pk:              kp.Pk,
+		Notes:           []*Note{},
+		NoteKeys:        [][]byte{},
+		Spent:           []bool{},
+		Registrations:   []*RegistrationRecord{},
+		WithdrawOutNote: []*Note{},
+		Seed:            append([]byte(nil), seed...),
+	}, nil
+}
+
+// RestoreWallet rebuilds a wallet from its seed by scanning the ledger for its notes and spends.
+func RestoreWallet(name string, seed []byte, ledger *Ledger) (*Wallet, error) {
+	w, err := NewWalletFromSeed(name, seed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.ScanLedger(ledger); err != nil {
+		return nil, err
+	}
+	return w, nil
 }
 
-// LoadWallet loads a wallet from a JSON file.
-func LoadWallet(path string) (*Wallet, error) {
-	f, err := os.Open(path)
+// KeyChain returns the wallet's key hierarchy, or an error if the wallet has no seed.
+func (w *Wallet) KeyChain() (*KeyChain, error) {
+	if len(w.Seed) == 0 {
+		return nil, fmt.Errorf("wallet %s has no seed", w.Name)
+	}
+	return NewKeyChain(w.Seed)
+}
+
+// SpendKey returns the key payments to the wallet are owned by: the key hierarchy's spend key,
+// or the DH secret key for wallets without a seed. Returns nil for watch-only wallets.
+func (w *Wallet) SpendKey() []byte {
+	if w.WatchOnly {
+		return nil
+	}
+	if chain, err := w.KeyChain(); err == nil {
+		return chain.SpendKey()
+	}
+	if w.Sk != nil {
+		skBytes := w.Sk.Bytes()
+		return skBytes[:]
+	}
+	return nil
+}
+
+// nullifierKey returns the nullifier key of note i, from its secret key or, in a watch-only
+// wallet, from the full viewing key. Returns nil if the note's spends cannot be detected.
+func (w *Wallet) nullifierKey(i int) []byte {
+	if i < len(w.NoteKeys) && len(w.NoteKeys[i]) > 0 {
+		return NullifierKey(w.NoteKeys[i])
+	}
+	if i < len(w.Notes) && w.Notes[i] != nil {
+		return w.NullifierKeys[new(big.Int).SetBytes(w.Notes[i].PkOwner).String()]
+	}
+	return nil
+}
+
+// SpendingKey returns the secret key of unspent note i.
+// Returns ErrWatchOnly for a watch-only wallet and ErrWalletLocked for a locked one.
+func (w *Wallet) SpendingKey(i int) ([]byte, error) {
+	if w.WatchOnly {
+		return nil, ErrWatchOnly
+	}
+	if w.Locked() {
+		return nil, ErrWalletLocked
+	}
+	if i < 0 || i >= len(w.Notes) {
+		return nil, fmt.Errorf("invalid note index: %d", i)
+	}
+	if w.Spent[i] {
+		return nil, fmt.Errorf("note %d is already spent", i)
+	}
+	if i >= len(w.NoteKeys) || len(w.NoteKeys[i]) == 0 {
+		return nil, fmt.Errorf("note %d has no secret key", i)
+	}
+	return w.NoteKeys[i], nil
+}
+
+// CreateTx spends unspent note i of the wallet to a payment address with Algorithm 1 (see
+// CreateTxToAddress), taking the note's authentication path from ledger. Returns ErrWatchOnly
+// for a watch-only wallet. The note is marked spent once the transaction is in the ledger (ScanLedger).
+func (w *Wallet) CreateTx(i int, to *PaymentAddress, value, energy *big.Int, ledger *Ledger, params *Params,
+	ccs constraint.ConstraintSystem, pk ProvingKey, auctioneerECDHPubKey *ecdh.PublicKey) (*Tx, error) {
+	sk, err := w.SpendingKey(i)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	var w Wallet
-	dec := json.NewDecoder(f)
-	if err := dec.Decode(&w); err != nil {
+	path, err := ledger.NotePath(w.Notes[i])
+	if err != nil {
 		return nil, err
 	}
-	return &w, nil
+	return CreateTxToAddress(w.Notes[i], sk, to, value, energy, path, params, ccs, pk, auctioneerECDHPubKey)
 }
 
-// Save saves the wallet to a JSON file.
-func (w *Wallet) Save(path string) error {
-	f, err := os.Create(path)
+// NewNoteKey returns the next unused note spending key of the wallet's key hierarchy.
+func (w *Wallet) NewNoteKey() ([]byte, error) {
+	keys, err := w.KeyChain()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	return enc.Encode(w)
+	sk := keys.NoteKey(w.NextNoteKey)
+	w.NextNoteKey++
+	return sk, nil
+}
+
+// NewAuctionKeys returns sk^in, sk^out and r_enc for the wallet's next auction registration.
+func (w *Wallet) NewAuctionKeys() (skIn, skOut, rEnc *fr.Element, err error) {
+	keys, err := w.KeyChain()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	skIn, skOut, rEnc = keys.AuctionKeys(w.NextAuction)
+	w.NextAuction++
+	return skIn, skOut, rEnc, nil
 }
 
 // AddNote adds a recognized note to the wallet, with withdraw data.
-func (w *Wallet) AddNote(note *Note, sk []byte, rEnc []byte, cAux [5]byte, outNote *Note) {
+// reg and outNote may be nil.
+func (w *Wallet) AddNote(note *Note, sk []byte, reg *RegistrationRecord, outNote *Note) {
 	w.Notes = append(w.Notes, note)
 	w.NoteKeys = append(w.NoteKeys, sk)
 	w.Spent = append(w.Spent, false)
-	w.rEnc = append(w.rEnc, rEnc)
-	w.CAux = append(w.CAux, [][5]byte{cAux})
+	w.Registrations = append(w.Registrations, reg)
 	w.WithdrawOutNote = append(w.WithdrawOutNote, outNote)
 }
 
+// RecordRegistration adds the tx^in output note of a registration to the wallet,
+// keyed by sk^in and linked to its registration secrets and auction round.
+func (w *Wallet) RecordRegistration(reg *RegistrationRecord) error {
+	if reg == nil || reg.NoteIn == nil || len(reg.SkIn) == 0 {
+		return fmt.Errorf("incomplete registration record")
+	}
+	if w.hasNote(reg.NoteIn) {
+		return fmt.Errorf("registration note is already in the wallet")
+	}
+	w.AddNote(reg.NoteIn, reg.SkIn, reg, nil)
+	return nil
+}
+
 // MarkNoteAsSpent marks a note as spent by its index.
 func (w *Wallet) MarkNoteAsSpent(noteIndex int) error {
 	if noteIndex < 0 || noteIndex >= len(w.Spent) {
@@ -132,20 +283,36 @@ func (w *Wallet) GetUnspentNoteKeys() [][]byte {
 
 // CheckNoteStatusAgainstLedger dynamically checks if notes have been spent by looking at the ledger.
 // This is useful for detecting if notes were spent by other participants or in other sessions.
+// A registered note spent by a withdrawal to its withdraw output note leaves that output in the
+// wallet as a note spendable with sk^out.
 func (w *Wallet) CheckNoteStatusAgainstLedger(ledger *Ledger) {
+	withdrawn := make(map[string]*big.Int, len(ledger.WithdrawTxs))
+	for _, tx := range ledger.WithdrawTxs {
+		if tx.SnIn != nil && tx.CmOut != nil {
+			withdrawn[tx.SnIn.String()] = tx.CmOut
+		}
+	}
 	for i, note := range w.Notes {
-		// Compute serial number for this note using its secret key
-		sk := w.NoteKeys[i]
-		h := mimcNative.NewMiMC()
-		h.Write(sk)
-		h.Write(note.Rho)
-		sn := h.Sum(nil)
-		snStr := new(big.Int).SetBytes(sn).String()
+		// Compute serial number for this note using its nullifier key
+		nk := w.nullifierKey(i)
+		if nk == nil {
+			continue
+		}
+		snStr := new(big.Int).SetBytes(SerialNumberFromNullifierKey(nk, note.Rho)).String()
 
 		// Check if this serial number exists in the ledger (meaning the note was spent)
 		if ledger.HasSerialNumber(snStr) {
 			w.Spent[i] = true
 		}
+
+		// Record the output of a withdrawal of the note
+		if cmOut, ok := withdrawn[snStr]; ok && i < len(w.Registrations) && w.Registrations[i] != nil &&
+			i < len(w.WithdrawOutNote) && w.WithdrawOutNote[i] != nil {
+			out := w.WithdrawOutNote[i]
+			if new(big.Int).SetBytes(out.Cm).Cmp(cmOut) == 0 && !w.hasNote(out) {
+				w.AddNote(out, w.Registrations[i].SkOut, nil, nil)
+			}
+		}
 	}
 }
 
@@ -161,127 +328,156 @@ func toBytes(arr interface{}) []byte {
 	}
 }
 
-func (w *Wallet) ClaimExchangeOutput(ledger *Ledger) error {
-	// Get the latest transaction from the ledger that contains outputs for this wallet
-	transactions := ledger.GetTxs()
-	if len(transactions) == 0 {
-		return fmt.Errorf("no transactions found in ledger")
+// ClaimExchangeOutput adds an exchange output note that was delivered to this wallet off-ledger.
+// The note is claimed once a settled exchange creating its commitment is found in the ledger.
+// ScanLedger finds the outputs of settled exchanges on its own; an output it already added, or
+// one claimed before, cannot be claimed again.
+func (w *Wallet) ClaimExchangeOutput(ledger *Ledger, note *Note) error {
+	if note == nil {
+		return fmt.Errorf("no exchange output note to claim")
 	}
-
-	// Find the most recent exchange transaction
-	var exchangeTx *Tx
-	for i := len(transactions) - 1; i >= 0; i-- {
-		if transactions[i] != nil && transactions[i].NewNote != nil {
-			exchangeTx = transactions[i]
-			break
-		}
+	if w.hasNote(note) {
+		return fmt.Errorf("output note is already in the wallet")
 	}
-
-	if exchangeTx == nil {
-		return fmt.Errorf("no exchange transaction found")
+	if !bytes.Equal(note.Cm, Commitment(note.Value.Coins, note.Value.Energy, note.PkOwner,
+		new(big.Int).SetBytes(note.Rho), new(big.Int).SetBytes(note.Rand))) {
+		return fmt.Errorf("output note does not match its commitment")
 	}
 
-	// Verify the output note belongs to this wallet and add it
-	if exchangeTx.NewNote != nil {
-		// Create proper note ownership proof
-		noteSecretKey := w.getMatchingSecretKey(exchangeTx.NewNote)
-		if noteSecretKey != nil {
-			// Add the claimed note to wallet's unspent notes
-			w.AddNote(exchangeTx.NewNote, noteSecretKey, exchangeTx.Proof, [5]byte{}, exchangeTx.NewNote)
-			return nil
+	// Find a settled exchange that created the note's commitment
+	cm := new(big.Int).SetBytes(note.Cm).String()
+	found := false
+	for _, tx := range ledger.ExchangeTxs {
+		for _, out := range tx.CmOut {
+			found = found || out == cm
 		}
 	}
+	if !found {
+		return fmt.Errorf("no exchange transaction found for the output note")
+	}
 
-	return fmt.Errorf("no claimable output found for this wallet")
+	// Add the claimed note to wallet's unspent notes
+	noteSecretKey := w.getMatchingSecretKey(note)
+	if noteSecretKey == nil {
+		return fmt.Errorf("output note is not owned by the pk^out of any registration in this wallet")
+	}
+	w.AddNote(note, noteSecretKey, nil, nil)
+	return nil
 }
 
-// getMatchingSecretKey finds the secret key that corresponds to a given note
+// getMatchingSecretKey finds the secret key that owns a given note: the key of the same note
+// in the wallet, or the sk^out of the registration whose pk^out owns it. It returns nil when
+// the wallet holds no such key.
 func (w *Wallet) getMatchingSecretKey(note *Note) []byte {
+	if note == nil {
+		return nil
+	}
 	// Check if we have a matching note in our wallet
 	for i, walletNote := range w.Notes {
-		if walletNote != nil && note != nil {
-			// Compare note commitments to find a match
-			if len(walletNote.Cm) > 0 && len(note.Cm) > 0 {
-				if string(walletNote.Cm) == string(note.Cm) {
-					// Return the corresponding secret key
-					if i < len(w.NoteKeys) {
-						return w.NoteKeys[i]
-					}
-				}
-			}
+		if walletNote != nil && len(walletNote.Cm) > 0 && bytes.Equal(walletNote.Cm, note.Cm) && i < len(w.NoteKeys) {
+			return w.NoteKeys[i]
 		}
 	}
 
-	// If no match found, try using wallet's main secret key
-	if w.Sk != nil {
-		skBytes := w.Sk.Bytes()
-		return skBytes[:]
+	// Exchange outputs are owned by the pk^out of a registration
+	pk := new(big.Int).SetBytes(note.PkOwner)
+	for _, reg := range w.Registrations {
+		if reg != nil && len(reg.SkOut) > 0 && MimcHashPublic(reg.SkOut).Cmp(pk) == 0 {
+			return reg.SkOut
+		}
 	}
-
 	return nil
 }
 
-func (w *Wallet) GetRegistrationCiphertext() [5]byte {
-	// Return the actual stored registration ciphertext from the wallet
-	if len(w.registrationData) >= 5 {
-		var result [5]byte
-		copy(result[:], w.registrationData[:5])
-		return result
+// withdrawIndex returns the index of the first unspent registered note, or -1.
+func (w *Wallet) withdrawIndex() int {
+	for i, spent := range w.Spent {
+		if !spent && i < len(w.Registrations) && w.Registrations[i] != nil {
+			return i
+		}
 	}
+	return -1
+}
+
+// GetRegistrationCiphertext returns C^Aux of the first unspent registered note.
+func (w *Wallet) GetRegistrationCiphertext() [RegistrationFields]*big.Int {
+	if i := w.withdrawIndex(); i >= 0 {
+		return w.Registrations[i].CAux
+	}
+	return [RegistrationFields]*big.Int{}
+}
+
+// GetWithdrawInputNote returns the first unspent registered note, the tx^in output note.
+func (w *Wallet) GetWithdrawInputNote() *Note {
+	if i := w.withdrawIndex(); i >= 0 {
+		return w.Notes[i]
+	}
+	return nil
+}
 
-	// If no registration data exists, return empty array
-	return [5]byte{}
+// GetWithdrawBid returns the bid of the first unspent registered note.
+func (w *Wallet) GetWithdrawBid() *big.Int {
+	if i := w.withdrawIndex(); i >= 0 {
+		return w.Registrations[i].Bid
+	}
+	return nil
 }
 
+// GetWithdrawREnc returns r_enc of the first unspent registered note.
 func (w *Wallet) GetWithdrawREnc() []byte {
-	for i, spent := range w.Spent {
-		if !spent {
-			return w.rEnc[i]
-		}
+	if i := w.withdrawIndex(); i >= 0 {
+		return w.Registrations[i].REnc
 	}
 	return nil
 }
 
+// GetWithdrawSk returns sk^in, the secret key of the first unspent registered note.
 func (w *Wallet) GetWithdrawSk() []byte {
-	// Return the secret key for the first unspent note
-	for i, spent := range w.Spent {
-		if !spent {
-			return w.NoteKeys[i]
-		}
+	if i := w.withdrawIndex(); i >= 0 {
+		return w.NoteKeys[i]
 	}
 	return nil
 }
 
+// GetWithdrawOutputNote returns the withdraw output note of the first unspent registered note:
+// its value, owned by pk^out. The note is created once and kept in the wallet, so a withdrawal
+// retried after a restart commits to the same output. For registrations with seed-derived keys
+// its opening is derived too (KeyChain.WithdrawOpening), so RestoreWallet finds it again.
 func (w *Wallet) GetWithdrawOutputNote() *Note {
-	// Generate a proper output note for withdrawal based on the participant's unspent notes
-	unspentNotes := w.GetUnspentNotes()
-	if len(unspentNotes) == 0 {
+	i := w.withdrawIndex()
+	if i < 0 {
 		return nil
 	}
+	for len(w.WithdrawOutNote) <= i {
+		w.WithdrawOutNote = append(w.WithdrawOutNote, nil)
+	}
+	if w.WithdrawOutNote[i] == nil {
+		w.WithdrawOutNote[i] = w.derivedWithdrawOutput(i)
+	}
+	if w.WithdrawOutNote[i] == nil {
+		baseNote := w.Notes[i]
+		w.WithdrawOutNote[i] = NewNote(new(big.Int).Set(baseNote.Value.Coins),
+			new(big.Int).Set(baseNote.Value.Energy), w.Registrations[i].SkOut)
+	}
+	return w.WithdrawOutNote[i]
+}
 
-	// Use the first unspent note as basis for withdrawal output
-	baseNote := unspentNotes[0]
-	if baseNote == nil {
+// derivedWithdrawOutput returns the withdraw output note of the registered note i with its
+// opening derived from the seed, or nil if the registration's keys were not derived from it.
+func (w *Wallet) derivedWithdrawOutput(i int) *Note {
+	reg := w.Registrations[i]
+	if reg == nil || reg.Index == nil || len(reg.SkOut) == 0 {
 		return nil
 	}
-
-	// Create withdrawal output note with same value but new randomness
-	withdrawNote := &Note{
-		Value: Gamma{
-			Coins:  new(big.Int).Set(baseNote.Value.Coins),
-			Energy: new(big.Int).Set(baseNote.Value.Energy),
-		},
-		PkOwner: make([]byte, len(baseNote.PkOwner)),
-		Rho:     randomBytes(32),
-		Rand:    randomBytes(32),
+	chain, err := w.KeyChain()
+	if err != nil {
+		return nil
 	}
-	copy(withdrawNote.PkOwner, baseNote.PkOwner)
-
-	// Compute commitment for the new note following paper: cm = Com(Γ || pk || ρ, r)
-	withdrawNote.Cm = Commitment(withdrawNote.Value.Coins, withdrawNote.Value.Energy,
-		withdrawNote.PkOwner, new(big.Int).SetBytes(withdrawNote.Rho), new(big.Int).SetBytes(withdrawNote.Rand))
-
-	return withdrawNote
+	rho, r := chain.WithdrawOpening(*reg.Index)
+	rhoBytes, rBytes := rho.Bytes(), r.Bytes()
+	baseNote := w.Notes[i]
+	return newNoteWithOpening(new(big.Int).Set(baseNote.Value.Coins), new(big.Int).Set(baseNote.Value.Energy),
+		reg.SkOut, rhoBytes[:], rBytes[:])
 }
 
 func (w *Wallet) GetWithdrawPkT() *bls12377.G1Affine {
@@ -289,22 +485,27 @@ func (w *Wallet) GetWithdrawPkT() *bls12377.G1Affine {
 	return w.Pk
 }
 
+// GetWithdrawCipherAux returns the withdraw ciphertext C_i = DH-OTP(pk_T, (b_i, sk^in, pk^out))
+// of the first unspent registered note, as checked by CircuitWithdraw.
 func (w *Wallet) GetWithdrawCipherAux() [3][]byte {
-	// Return stored registration ciphertext data for withdrawal proof
 	var result [3][]byte
-
-	// Get the most recent registration data stored in the wallet
-	if len(w.registrationData) >= 96 { // 3 * 32 bytes
-		result[0] = w.registrationData[0:32]
-		result[1] = w.registrationData[32:64]
-		result[2] = w.registrationData[64:96]
-	} else {
-		// If no stored data, generate empty placeholders
-		result[0] = make([]byte, 32)
-		result[1] = make([]byte, 32)
-		result[2] = make([]byte, 32)
+	i := w.withdrawIndex()
+	if i < 0 || w.Pk == nil {
+		return result
+	}
+	reg := w.Registrations[i]
+	if reg.Bid == nil {
+		// Registrations restored from the seed alone do not know their bid
+		return result
+	}
+	masks := noteMasks(*w.Pk)
+	for j, v := range []*big.Int{reg.Bid, new(big.Int).SetBytes(reg.SkIn), MimcHashPublic(reg.SkOut)} {
+		var c bls12377_fp.Element
+		c.SetBigInt(v)
+		c.Add(&c, &masks[j])
+		b := c.Bytes()
+		result[j] = b[:]
 	}
-
 	return result
 }
 
@@ -323,43 +524,43 @@ type Participant struct {
 	Sk            *fr.Element
 	Pk            *bls12377.G1Affine
 	Params        *Params
-	PK            groth16.ProvingKey
-	VK            groth16.VerifyingKey
+	PK            ProvingKey
+	VK            VerifyingKey
 	Wallet        *Wallet
 	AuctioneerPub *bls12377.G1Affine // Only for participants
 	Mu            sync.Mutex         // for wallet concurrency
 }
 
-// NewParticipant creates a new node with fresh DH keypair and ZKP keys
-// Loads or creates a wallet file for the participant.
-func NewParticipant(name string, pk groth16.ProvingKey, vk groth16.VerifyingKey, params *Params, role Role, auctioneerPub *bls12377.G1Affine) *Participant {
-	kp, err := GenerateDHKeyPair()
-	if err != nil {
-		log.Fatalf("%s DH keygen failed: %v", name, err)
-	}
+// NewParticipant creates a new node with its DH keypair and ZKP keys
+// Loads the participant's encrypted wallet file with passphrase, or creates it from a fresh seed
+// if it does not exist; an existing wallet keeps its DH keypair.
+// pk and vk may be nil, in which case the circuit registry's CircuitTx keys for params.Backend are used.
+func NewParticipant(name string, passphrase []byte, pk ProvingKey, vk VerifyingKey, params *Params, role Role, auctioneerPub *bls12377.G1Affine) *Participant {
 	walletPath := fmt.Sprintf("%s_wallet.json", name)
-	var wallet *Wallet
-	if w, err := LoadWallet(walletPath); err == nil {
-		wallet = w
-	} else {
-		wallet = &Wallet{
-			Name:            name,
-			Sk:              kp.Sk,
-			Pk:              kp.Pk,
-			Notes:           []*Note{},
-			NoteKeys:        [][]byte{},
-			Spent:           []bool{},
-			rEnc:            [][]byte{},
-			CAux:            [][][5]byte{},
-			WithdrawOutNote: []*Note{},
+	wallet, err := LoadWallet(walletPath, passphrase)
+	if errors.Is(err, os.ErrNotExist) {
+		wallet, err = NewWalletFromSeed(name, NewSeed())
+		if err != nil {
+			log.Fatalf("%s wallet: %v", name, err)
+		}
+		if err := wallet.SetPassphrase(passphrase); err != nil {
+			log.Fatalf("%s wallet: %v", name, err)
 		}
-		wallet.Save(walletPath)
+		if err := wallet.Save(walletPath); err != nil {
+			log.Fatalf("%s wallet save failed: %v", name, err)
+		}
+	} else if err != nil {
+		log.Fatalf("%s wallet: %v", name, err)
+	} else if m := wallet.Migration; m != nil {
+		log.Printf("[%s] Wallet upgraded from schema version %d; notes without recoverable secrets: %v", name, m.FromVersion, m.Unrecoverable)
 	}
+	// The participant keeps its own copy of the key, which survives locking the wallet
+	sk := *wallet.Sk
 	return &Participant{
 		Name:          name,
 		Role:          role,
-		Sk:            kp.Sk,
-		Pk:            kp.Pk,
+		Sk:            &sk,
+		Pk:            wallet.Pk,
 		Params:        params,
 		PK:            pk,
 		VK:            vk,
@@ -374,7 +575,19 @@ func (p *Participant) PubKeyResponse() PubKeyResponse {
 	yBytes := p.Pk.Y.Bytes()
 	xHex := hex.EncodeToString(xBytes[:])
 	yHex := hex.EncodeToString(yBytes[:])
-	return PubKeyResponse{X: xHex, Y: yHex}
+	resp := PubKeyResponse{X: xHex, Y: yHex}
+	if addr, err := p.PaymentAddress(); err == nil {
+		resp.Address = addr.String()
+	}
+	return resp
+}
+
+// PaymentAddress returns the participant's payment address on the network of its Params.
+func (p *Participant) PaymentAddress() (*PaymentAddress, error) {
+	if p.Wallet == nil {
+		return nil, fmt.Errorf("participant %s has no wallet", p.Name)
+	}
+	return p.Wallet.PaymentAddress(p.Params.AddressNetwork())
 }
 
 // SharedSecret computes the DH shared secret with another public key
@@ -420,71 +633,68 @@ func (p *Participant) handleTx(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "invalid request: %v", err)
 		return
 	}
-	// Rebuild sender's pubkey
-	var senderPub bls12377.G1Affine
-	xBytes, err := hex.DecodeString(req.SenderPub.X)
-	if err != nil || len(xBytes) != 48 {
+	if req.Tx == nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "invalid sender pubkey X")
+		fmt.Fprintf(w, "missing transaction")
 		return
 	}
-	yBytes, err := hex.DecodeString(req.SenderPub.Y)
-	if err != nil || len(yBytes) != 48 {
+	if _, err := req.Tx.EphemeralKey(); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "invalid sender pubkey Y")
+		fmt.Fprintf(w, "invalid tx: %v", err)
 		return
 	}
-	senderPub.X.SetBytes(xBytes)
-	senderPub.Y.SetBytes(yBytes)
+	p.Mu.Lock()
+	defer p.Mu.Unlock()
+	if req.To != "" {
+		to, err := ValidatePaymentAddress(req.To, p.Params.AddressNetwork())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid address: %v", err)
+			return
+		}
+		if own, err := p.PaymentAddress(); err == nil && !own.Equal(to) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "transaction is addressed to %s, not to this participant", req.To)
+			return
+		}
+	}
+	// Load the global ledger; its recent roots are the valid anchors
+	ledgerPath := "ledger.json"
+	var ledger *Ledger
+	if l, err := LoadLedgerFromFile(ledgerPath); err == nil {
+		ledger = l
+	} else {
+		ledger = NewLedger()
+	}
 	// Verify transaction
-	if err := VerifyTx(req.Tx, p.Params, p.VK); err != nil {
+	if err := VerifyTx(req.Tx, ledger, p.Params, p.VK); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "invalid tx: %v", err)
 		return
 	}
-	// Compute shared secret
-	shared := ComputeDHShared(p.Sk, &senderPub)
-	// Try to recognize/decrypt the note
-	enc := EncryptNoteWithSharedKey(req.Tx.NewNote, shared)
-	ok, note, err := RecognizeNote(enc, shared, req.Tx.NewNote.PkOwner)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "decryption failed: %v", err)
-		return
-	}
-	if ok {
-		p.Mu.Lock()
-		// Append to global ledger
-		ledgerPath := "ledger.json"
-		var ledger *Ledger
-		if l, err := LoadLedgerFromFile(ledgerPath); err == nil {
-			ledger = l
-		} else {
-			ledger = NewLedger()
-		}
+	// Trial-decrypt the note with our DH key; it must be owned by one of our note keys
+	// (any note that decrypts, in a watch-only wallet)
+	note, key := p.Wallet.trialDecrypt(req.Tx.CNewCircuit, req.Tx.G_r, p.Wallet.noteKeysByPk())
+	if note != nil {
+		// Append the public transaction to the global ledger; the note stays in the wallet
 		if err := ledger.AppendTx(req.Tx); err != nil {
-			p.Mu.Unlock()
 			w.WriteHeader(http.StatusConflict)
 			fmt.Fprintf(w, "ledger append failed: %v", err)
 			return
 		}
 		if err := ledger.SaveToFile(ledgerPath); err != nil {
-			p.Mu.Unlock()
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "ledger save failed: %v", err)
 			return
 		}
 		// Update wallet
-		skBytes := p.Sk.Bytes()
-		p.Wallet.AddNote(note, skBytes[:], nil, [5]byte{}, note)
+		p.Wallet.addScannedNote(note, key)
 		walletPath := fmt.Sprintf("%s_wallet.json", p.Name)
 		if err := p.Wallet.Save(walletPath); err != nil {
-			p.Mu.Unlock()
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "wallet save failed: %v", err)
 			return
 		}
-		p.Mu.Unlock()
 		fmt.Fprintf(w, "note received: coins=%s, energy=%s", note.Value.Coins, note.Value.Energy)
 		log.Printf("[%s] Received and decrypted note: coins=%s, energy=%s", p.Name, note.Value.Coins, note.Value.Energy)
 	} else {
@@ -517,16 +727,31 @@ func FetchPeerPubKey(addr string) (*bls12377.G1Affine, error) {
 	return &pk, nil
 }
 
-// SendTxToPeer sends a confidential transaction to a peer's REST endpoint
-func SendTxToPeer(addr string, senderPub *bls12377.G1Affine, tx *Tx) error {
-	xBytes := senderPub.X.Bytes()
-	yBytes := senderPub.Y.Bytes()
-	req := TxRequest{
-		SenderPub: PubKeyResponse{
-			X: hex.EncodeToString(xBytes[:]),
-			Y: hex.EncodeToString(yBytes[:]),
-		},
-		Tx: tx,
+// FetchPeerAddress fetches a peer's payment address from its REST endpoint and checks that it
+// is on network.
+func FetchPeerAddress(addr, network string) (*PaymentAddress, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/pubkey", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var pkResp PubKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pkResp); err != nil {
+		return nil, err
+	}
+	if pkResp.Address == "" {
+		return nil, fmt.Errorf("peer %s has no payment address", addr)
+	}
+	return ValidatePaymentAddress(pkResp.Address, network)
+}
+
+// SendTxToPeer sends a confidential transaction to a peer's REST endpoint.
+// The tx must pay to, the peer's payment address (see FetchPeerAddress); to may be nil to
+// skip the peer's address check.
+func SendTxToPeer(addr string, to *PaymentAddress, tx *Tx) error {
+	req := TxRequest{Tx: tx.Public()}
+	if to != nil {
+		req.To = to.String()
 	}
 	data, err := json.Marshal(req)
 	if err != nil {
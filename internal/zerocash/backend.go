@@ -0,0 +1,284 @@
+// backend.go - Proving backends (Groth16 and PLONK) behind a common interface.
+//
+// Every proving path goes through Prove/Verify, which dispatch on the backend of the key.
+// Serialized proofs and key files start with a one-byte backend tag, so a verifier can tell
+// which backend produced a proof and reject a verifying key of the wrong backend.
+// The backend used to compile circuits and generate keys is selected with Params.Backend.
+// PLONK keys are derived from the KZG SRS shared by all circuits (see srs.go).
+
+package zerocash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16_bw6761 "github.com/consensys/gnark/backend/groth16/bw6-761"
+	"github.com/consensys/gnark/backend/plonk"
+	plonk_bw6761 "github.com/consensys/gnark/backend/plonk/bw6-761"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	cs_bw6761 "github.com/consensys/gnark/constraint/bw6-761"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+)
+
+// BackendID identifies a proving backend.
+type BackendID string
+
+const (
+	BackendGroth16 BackendID = "groth16" // Groth16 over R1CS; needs a circuit-specific setup
+	BackendPlonk   BackendID = "plonk"   // PLONK over a sparse R1CS with a universal KZG SRS
+)
+
+// DefaultBackend is the backend used when Params.Backend is empty.
+const DefaultBackend = BackendGroth16
+
+// backendTags are the one-byte tags prefixed to serialized proofs and keys.
+var backendTags = map[BackendID]byte{
+	BackendGroth16: 1,
+	BackendPlonk:   2,
+}
+
+// ProvingKey is a proving key of any backend (groth16.ProvingKey or plonk.ProvingKey).
+type ProvingKey interface {
+	io.WriterTo
+	io.ReaderFrom
+}
+
+// VerifyingKey is a verifying key of any backend (groth16.VerifyingKey or plonk.VerifyingKey).
+type VerifyingKey interface {
+	io.WriterTo
+	io.ReaderFrom
+}
+
+// Backend is a proving system: constraint system compilation, setup, proving, verification
+// and key allocation for deserialization.
+type Backend interface {
+	ID() BackendID
+	Compile(circuit frontend.Circuit) (constraint.ConstraintSystem, error)
+	Setup(ccs constraint.ConstraintSystem) (ProvingKey, VerifyingKey, error)
+	Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness) ([]byte, error)
+	Verify(proof []byte, vk VerifyingKey, publicWitness witness.Witness) error
+	NewProvingKey() ProvingKey
+	NewVerifyingKey() VerifyingKey
+}
+
+var backends = map[BackendID]Backend{
+	BackendGroth16: groth16Backend{},
+	BackendPlonk:   plonkBackend{},
+}
+
+// GetBackend returns the backend with the given ID.
+func GetBackend(id BackendID) (Backend, error) {
+	b, ok := backends[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown proving backend %q", id)
+	}
+	return b, nil
+}
+
+// KeyBackend returns the backend a proving or verifying key belongs to.
+func KeyBackend(key any) (BackendID, error) {
+	switch key.(type) {
+	case *groth16_bw6761.ProvingKey, *groth16_bw6761.VerifyingKey:
+		return BackendGroth16, nil
+	case *plonk_bw6761.ProvingKey, *plonk_bw6761.VerifyingKey:
+		return BackendPlonk, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// CCSBackend returns the backend a compiled constraint system is meant for.
+func CCSBackend(ccs constraint.ConstraintSystem) (BackendID, error) {
+	// R1CS and SparseR1CS are the same Go type; the system records which one it is
+	if system, ok := ccs.(*cs_bw6761.R1CS); ok {
+		switch system.Type {
+		case constraint.SystemR1CS:
+			return BackendGroth16, nil
+		case constraint.SystemSparseR1CS:
+			return BackendPlonk, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported constraint system type %T", ccs)
+}
+
+// SetupKeys generates keys for a compiled circuit with the backend matching its constraint system.
+func SetupKeys(ccs constraint.ConstraintSystem) (ProvingKey, VerifyingKey, error) {
+	id, err := CCSBackend(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, _ := GetBackend(id)
+	return b.Setup(ccs)
+}
+
+// Prove generates a proof with the backend of pk and returns it tagged with that backend.
+func Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness) ([]byte, error) {
+	id, err := KeyBackend(pk)
+	if err != nil {
+		return nil, err
+	}
+	if ccsID, err := CCSBackend(ccs); err != nil {
+		return nil, err
+	} else if ccsID != id {
+		return nil, fmt.Errorf("constraint system is for %s but proving key is for %s", ccsID, id)
+	}
+	b, _ := GetBackend(id)
+	proof, err := b.Prove(ccs, pk, fullWitness)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{backendTags[id]}, proof...), nil
+}
+
+// Verify checks a tagged proof against vk, which must belong to the backend named by the tag.
+func Verify(proof []byte, vk VerifyingKey, publicWitness witness.Witness) error {
+	id, raw, err := splitTag(proof)
+	if err != nil {
+		return fmt.Errorf("invalid proof: %w", err)
+	}
+	vkID, err := KeyBackend(vk)
+	if err != nil {
+		return err
+	}
+	if vkID != id {
+		return fmt.Errorf("%s proof cannot be verified with a %s verifying key", id, vkID)
+	}
+	b, _ := GetBackend(id)
+	return b.Verify(raw, vk, publicWitness)
+}
+
+// ProofBackend returns the backend named by a tagged proof.
+func ProofBackend(proof []byte) (BackendID, error) {
+	id, _, err := splitTag(proof)
+	return id, err
+}
+
+// WriteKey writes a proving or verifying key prefixed with its backend tag.
+func WriteKey(w io.Writer, key io.WriterTo) (int64, error) {
+	id, err := KeyBackend(key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write([]byte{backendTags[id]}); err != nil {
+		return 0, err
+	}
+	n, err := key.WriteTo(w)
+	return n + 1, err
+}
+
+// readKeyTag reads the backend tag at the start of a key file.
+func readKeyTag(r io.Reader) (Backend, error) {
+	var tag [1]byte
+	if _, err := io.ReadFull(r, tag[:]); err != nil {
+		return nil, err
+	}
+	id, _, err := splitTag(tag[:])
+	if err != nil {
+		return nil, err
+	}
+	return GetBackend(id)
+}
+
+func splitTag(data []byte) (BackendID, []byte, error) {
+	if len(data) == 0 {
+		return "", nil, errors.New("missing backend tag")
+	}
+	for id, tag := range backendTags {
+		if tag == data[0] {
+			return id, data[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown backend tag %d", data[0])
+}
+
+// groth16Backend implements Backend with gnark's Groth16.
+type groth16Backend struct{}
+
+func (groth16Backend) ID() BackendID { return BackendGroth16 }
+
+func (groth16Backend) Compile(circuit frontend.Circuit) (constraint.ConstraintSystem, error) {
+	return frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, circuit)
+}
+
+func (groth16Backend) Setup(ccs constraint.ConstraintSystem) (ProvingKey, VerifyingKey, error) {
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pk, vk, nil
+}
+
+func (groth16Backend) Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness) ([]byte, error) {
+	proof, err := groth16.Prove(ccs, pk.(groth16.ProvingKey), fullWitness)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := proof.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (groth16Backend) Verify(proofBytes []byte, vk VerifyingKey, publicWitness witness.Witness) error {
+	proof := groth16.NewProof(ecc.BW6_761)
+	if _, err := proof.ReadFrom(bytes.NewReader(proofBytes)); err != nil {
+		return err
+	}
+	return groth16.Verify(proof, vk.(groth16.VerifyingKey), publicWitness)
+}
+
+func (groth16Backend) NewProvingKey() ProvingKey     { return groth16.NewProvingKey(ecc.BW6_761) }
+func (groth16Backend) NewVerifyingKey() VerifyingKey { return groth16.NewVerifyingKey(ecc.BW6_761) }
+
+// plonkBackend implements Backend with gnark's PLONK and a KZG SRS.
+type plonkBackend struct{}
+
+func (plonkBackend) ID() BackendID { return BackendPlonk }
+
+func (plonkBackend) Compile(circuit frontend.Circuit) (constraint.ConstraintSystem, error) {
+	return frontend.Compile(ecc.BW6_761.ScalarField(), scs.NewBuilder, circuit)
+}
+
+// Setup derives the PLONK keys from the shared KZG SRS (see LoadKZGSRS), truncated to the circuit.
+// Returns ErrNoKZGSRS if none is loaded.
+func (plonkBackend) Setup(ccs constraint.ConstraintSystem) (ProvingKey, VerifyingKey, error) {
+	srs, srsLagrange, err := kzgSRSFor(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk, vk, err := plonk.Setup(ccs, srs, srsLagrange)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pk, vk, nil
+}
+
+func (plonkBackend) Prove(ccs constraint.ConstraintSystem, pk ProvingKey, fullWitness witness.Witness) ([]byte, error) {
+	proof, err := plonk.Prove(ccs, pk.(plonk.ProvingKey), fullWitness)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := proof.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (plonkBackend) Verify(proofBytes []byte, vk VerifyingKey, publicWitness witness.Witness) error {
+	proof := plonk.NewProof(ecc.BW6_761)
+	if _, err := proof.ReadFrom(bytes.NewReader(proofBytes)); err != nil {
+		return err
+	}
+	return plonk.Verify(proof, vk.(plonk.VerifyingKey), publicWitness)
+}
+
+func (plonkBackend) NewProvingKey() ProvingKey     { return plonk.NewProvingKey(ecc.BW6_761) }
+func (plonkBackend) NewVerifyingKey() VerifyingKey { return plonk.NewVerifyingKey(ecc.BW6_761) }
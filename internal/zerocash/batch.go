@@ -0,0 +1,329 @@
+// batch.go - Batch transactions: up to MaxSize() transfers proven together with CircuitTxN.
+//
+// A batch moves each of its ledger notes, unchanged in value, to its own recipient under a single
+// proof of the smallest supported size N that fits (see FittingSize). The N - n unused slots are
+// padded with fresh zero-value notes of random keys, paid to random keys: the circuit exempts
+// them, by a private flag, from the Merkle membership check, and as values and keys stay private
+// their serial numbers, commitments and ciphertexts are as random as real ones. The ledger records a batch as one entry whose serial numbers and
+// commitments are all appended, or none are (Ledger.AppendBatchTx).
+
+package zerocash
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
+)
+
+// BatchTransfer is one transfer of a batch: a ledger note, its owner's secret key and the
+// address its value is paid to.
+type BatchTransfer struct {
+	Note *Note
+	Sk   []byte
+	To   *PaymentAddress
+}
+
+// PublicBatchTx is the ledger-facing part of a batch transaction, without plaintext notes.
+// Every slice has one entry per slot, padding slots included; their length is the circuit size N.
+type PublicBatchTx struct {
+	Proof []byte // ZKP proof (opaque, tagged with its backend)
+	// Public inputs for verification
+	Anchor      string // Merkle root all non-padding old notes are proven against
+	SnOld       []string
+	CmNew       []string
+	CNew        [][]byte    // Encrypted note data using ECDH + AES for auctioneer
+	CNewCircuit [][6]string // New notes encrypted to G_b^r, checked by the circuit
+	G           sw_bls12377.G1Affine
+	G_b         []sw_bls12377.G1Affine // Recipients' DH public keys
+	G_r         []sw_bls12377.G1Affine
+}
+
+// BatchTx is a batch transaction as built by its sender.
+type BatchTx struct {
+	NewNotes []*Note // The notes created by the transfers, in order; padding notes are not kept
+	PublicBatchTx
+}
+
+// Public returns a copy of the ledger-facing part of the transaction, without the plaintext notes.
+func (tx *BatchTx) Public() *PublicBatchTx {
+	public := tx.PublicBatchTx
+	return &public
+}
+
+// CreateBatchTx moves each transfer's note to its recipient in a single proof. Authentication
+// paths are taken from ledger, so every note must be in it. The proof uses the batch circuit of
+// size FittingSize(len(transfers)) and slots past len(transfers) are padded; ccs and pk must
+// belong to that size, or be nil to use the circuit registry's.
+// Returns a *ValueRangeError if a value does not fit in params.MaxValueBits(), and an error
+// wrapping ErrAddressNetwork if a recipient is not on params.AddressNetwork().
+func CreateBatchTx(transfers []BatchTransfer, ledger *Ledger, params *Params,
+	ccs constraint.ConstraintSystem, pk ProvingKey, auctioneerECDHPubKey *ecdh.PublicKey) (*BatchTx, error) {
+	n, err := FittingSize(len(transfers))
+	if err != nil {
+		return nil, fmt.Errorf("batch needs 1 to %d transfers, got %d", MaxSize(), len(transfers))
+	}
+	if ledger == nil {
+		return nil, fmt.Errorf("ledger is required for the authentication paths")
+	}
+
+	// Step 1: Check every transfer before proving
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return nil, err
+	}
+	network := params.AddressNetwork()
+	for i, t := range transfers {
+		if t.Note == nil {
+			return nil, fmt.Errorf("transfer %d: no note", i)
+		}
+		if err := CheckValueRange(fmt.Sprintf("transfer %d coins", i), t.Note.Value.Coins, bits); err != nil {
+			return nil, err
+		}
+		if err := CheckValueRange(fmt.Sprintf("transfer %d energy", i), t.Note.Value.Energy, bits); err != nil {
+			return nil, err
+		}
+		if t.To == nil {
+			return nil, fmt.Errorf("transfer %d: no payment address", i)
+		}
+		if err := t.To.Validate(); err != nil {
+			return nil, fmt.Errorf("transfer %d: %w", i, err)
+		}
+		if t.To.Network != network {
+			return nil, fmt.Errorf("transfer %d: %w: %s, want %s", i, ErrAddressNetwork, t.To.Network, network)
+		}
+		if !bytes.Equal(mimcHash(t.Sk), t.Note.PkOwner) {
+			return nil, fmt.Errorf("transfer %d: secret key does not match note owner", i)
+		}
+	}
+	ccs, pk, err = ResolveProver(BatchCircuitID(n), params.ProvingBackend(), bits, ccs, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 2: Old notes and their serial numbers; padding slots spend fresh zero-value notes
+	witness := NewCircuitTxN(n)
+	root := ledger.MerkleRoot()
+	witness.Anchor = root
+	snOld := make([][]byte, n)
+	recipients := make([]*PaymentAddress, n)
+	for i := 0; i < n; i++ {
+		var note *Note
+		var sk []byte
+		var pathVars, pathBits [MerkleTreeDepth]frontend.Variable
+		if i < len(transfers) {
+			note, sk, recipients[i] = transfers[i].Note, transfers[i].Sk, transfers[i].To
+			path, err := ledger.NotePath(note)
+			if err != nil {
+				return nil, fmt.Errorf("transfer %d: %w", i, err)
+			}
+			if err := checkNotePath(note, path); err != nil {
+				return nil, fmt.Errorf("transfer %d: %w", i, err)
+			}
+			pathVars, pathBits = merklePathWitness(path)
+			witness.Padding[i] = 0
+		} else {
+			sk = randomBytes(32)
+			note = NewNote(big.NewInt(0), big.NewInt(0), sk)
+			recipients[i] = randomRecipient()
+			for h := range pathVars {
+				pathVars[h], pathBits[h] = 0, 0
+			}
+			witness.Padding[i] = 1
+		}
+		snOld[i] = SerialNumber(sk, note.Rho)
+		for k := 0; k < i; k++ {
+			if bytes.Equal(snOld[k], snOld[i]) {
+				return nil, fmt.Errorf("transfer %d spends the same note as transfer %d", i, k)
+			}
+		}
+
+		witness.OldCoin[i] = note.Value.Coins.String()
+		witness.OldEnergy[i] = note.Value.Energy.String()
+		witness.SnOld[i] = new(big.Int).SetBytes(snOld[i]).String()
+		witness.PkOld[i] = new(big.Int).SetBytes(note.PkOwner).String()
+		witness.CmOld[i] = new(big.Int).SetBytes(note.Cm).String()
+		witness.Path[i] = pathVars
+		witness.PathBits[i] = pathBits
+		witness.SkOld[i] = new(big.Int).SetBytes(sk).String()
+		witness.RhoOld[i] = new(big.Int).SetBytes(note.Rho).String()
+		witness.RandOld[i] = new(big.Int).SetBytes(note.Rand).String()
+	}
+
+	// Step 3: New notes with rhoNew_i = H(i||sn₁ᵒˡᵈ||...||snₙᵒˡᵈ), each encrypted to its recipient
+	var g1Jac, _, _, _ = bls12377.Generators()
+	var g bls12377.G1Affine
+	g.FromJacobian(&g1Jac)
+	witness.G = toGnarkPoint(g)
+	tx := &BatchTx{
+		NewNotes: make([]*Note, 0, len(transfers)),
+		PublicBatchTx: PublicBatchTx{
+			Anchor:      root,
+			SnOld:       make([]string, n),
+			CmNew:       make([]string, n),
+			CNew:        make([][]byte, n),
+			CNewCircuit: make([][6]string, n),
+			G:           witness.G,
+			G_b:         make([]sw_bls12377.G1Affine, n),
+			G_r:         make([]sw_bls12377.G1Affine, n),
+		},
+	}
+	for i := 0; i < n; i++ {
+		h := mimcNative.NewMiMC()
+		h.Write(leftPad(big.NewInt(int64(i)).Bytes()))
+		for _, sn := range snOld {
+			h.Write(sn)
+		}
+		rhoNew := h.Sum(nil)
+		randNew := randomBytes(32)
+		coins, _ := new(big.Int).SetString(witness.OldCoin[i].(string), 10)
+		energy, _ := new(big.Int).SetString(witness.OldEnergy[i].(string), 10)
+		pkNew := recipients[i].Pk
+		newNote := &Note{
+			Value:   Gamma{Coins: coins, Energy: energy},
+			PkOwner: pkNew,
+			Rho:     rhoNew,
+			Rand:    randNew,
+			Cm:      Commitment(coins, energy, pkNew, new(big.Int).SetBytes(rhoNew), new(big.Int).SetBytes(randNew)),
+		}
+
+		r := randomScalar()
+		var g_r, encKey bls12377.G1Affine
+		g_r.ScalarMultiplication(&g, r)
+		encKey.ScalarMultiplication(recipients[i].EncKey, r)
+		encryptedNoteData, err := EncryptNoteForAuctioneer(newNote, auctioneerECDHPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("slot %d: note encryption failed: %w", i, err)
+		}
+		cNew := EncryptNoteWithSharedKey(newNote, &encKey)
+
+		tx.SnOld[i] = witness.SnOld[i].(string)
+		tx.CmNew[i] = new(big.Int).SetBytes(newNote.Cm).String()
+		tx.CNew[i] = encryptedNoteData
+		tx.CNewCircuit[i] = cNew
+		tx.G_b[i] = toGnarkPoint(*recipients[i].EncKey)
+		tx.G_r[i] = toGnarkPoint(g_r)
+		if i < len(transfers) {
+			tx.NewNotes = append(tx.NewNotes, newNote)
+		}
+
+		witness.NewCoin[i] = coins.String()
+		witness.NewEnergy[i] = energy.String()
+		witness.CmNew[i] = tx.CmNew[i]
+		for k := 0; k < 6; k++ {
+			witness.CNew[i][k] = cNew[k]
+		}
+		witness.G_b[i] = tx.G_b[i]
+		witness.G_r[i] = tx.G_r[i]
+		witness.PkNew[i] = new(big.Int).SetBytes(pkNew).String()
+		witness.RhoNew[i] = new(big.Int).SetBytes(rhoNew).String()
+		witness.RandNew[i] = new(big.Int).SetBytes(randNew).String()
+		witness.R[i] = r.String()
+		witness.EncKey[i] = toGnarkPoint(encKey)
+	}
+
+	// Step 4: Prove
+	w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField())
+	if err != nil {
+		return nil, fmt.Errorf("witness creation failed: %w", err)
+	}
+	proof, err := Prove(ccs, pk, w)
+	if err != nil {
+		return nil, fmt.Errorf("proof generation failed: %w", err)
+	}
+	tx.Proof = proof
+	return tx, nil
+}
+
+// VerifyBatchTx verifies the public part of a batch transaction against the ledger's recent anchors.
+// It also rejects batches whose serial numbers are already in the ledger or repeated.
+// A nil vk uses the circuit registry's key for the proof's backend.
+func VerifyBatchTx(tx *PublicBatchTx, ledger *Ledger, params *Params, vk VerifyingKey) error {
+	if ledger == nil {
+		return fmt.Errorf("ledger is required to check the anchor")
+	}
+	if !ledger.Tree.IsKnownRoot(tx.Anchor) {
+		return fmt.Errorf("unknown anchor: not a recent ledger merkle root")
+	}
+	n := len(tx.SnOld)
+	if size, err := FittingSize(n); err != nil || size != n {
+		return fmt.Errorf("batch has %d slots, not a supported size %v", n, SupportedSizes)
+	}
+	for _, l := range []int{len(tx.CmNew), len(tx.CNewCircuit), len(tx.G_b), len(tx.G_r)} {
+		if l != n {
+			return fmt.Errorf("batch has %d serial numbers but a public input of length %d", n, l)
+		}
+	}
+	if err := checkBatchSerialNumbers(tx, ledger); err != nil {
+		return err
+	}
+
+	backendID, err := ProofBackend(tx.Proof)
+	if err != nil {
+		return fmt.Errorf("proof unmarshaling failed: %w", err)
+	}
+	valueBits, err := params.MaxValueBits()
+	if err != nil {
+		return err
+	}
+	vk, err = ResolveVerifyingKey(BatchCircuitID(n), backendID, valueBits, vk)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the public witness
+	witness := NewCircuitTxN(n)
+	witness.Anchor = tx.Anchor
+	witness.G = tx.G
+	for i := 0; i < n; i++ {
+		witness.SnOld[i] = tx.SnOld[i]
+		witness.CmNew[i] = tx.CmNew[i]
+		for k := 0; k < 6; k++ {
+			witness.CNew[i][k] = tx.CNewCircuit[i][k]
+		}
+		witness.G_b[i] = tx.G_b[i]
+		witness.G_r[i] = tx.G_r[i]
+	}
+	w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return fmt.Errorf("public witness creation failed: %w", err)
+	}
+
+	if err := Verify(tx.Proof, vk, w); err != nil {
+		return fmt.Errorf("proof verification failed: %w", err)
+	}
+	return nil
+}
+
+// checkBatchSerialNumbers returns an error if a serial number of the batch is already in the
+// ledger or appears twice in the batch.
+func checkBatchSerialNumbers(tx *PublicBatchTx, ledger *Ledger) error {
+	for i, sn := range tx.SnOld {
+		if ledger.HasSerialNumber(sn) {
+			return errors.New("double-spend detected: serial number already in ledger")
+		}
+		for _, prev := range tx.SnOld[:i] {
+			if prev == sn {
+				return errors.New("double-spend detected: serial number repeated in transaction")
+			}
+		}
+	}
+	return nil
+}
+
+// randomRecipient returns an address nobody can spend from or decrypt, for padding slots.
+func randomRecipient() *PaymentAddress {
+	var g1Jac, _, _, _ = bls12377.Generators()
+	var encKey bls12377.G1Affine
+	encKey.FromJacobian(&g1Jac)
+	encKey.ScalarMultiplication(&encKey, randomScalar())
+	return &PaymentAddress{Pk: mimcHash(randomBytes(32)), EncKey: &encKey}
+}
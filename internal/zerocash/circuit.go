@@ -1,42 +1,61 @@
 package zerocash
 
 import (
+	"errors"
+	"math/big"
+
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 	"github.com/consensys/gnark/std/hash/mimc"
 )
 
+// CircuitTx proves the spend of one ledger note into one new note of the same value.
+// Values and owners are private: the verifier only sees the anchor, the serial number, the new
+// commitment and its ciphertext.
 type CircuitTx struct {
 	// Public inputs
-	OldCoin   frontend.Variable    `gnark:",public"`
-	OldEnergy frontend.Variable    `gnark:",public"`
-	CmOld     frontend.Variable    `gnark:",public"`
-	SnOld     frontend.Variable    `gnark:",public"`
-	PkOld     frontend.Variable    `gnark:",public"`
-	NewCoin   frontend.Variable    `gnark:",public"`
-	NewEnergy frontend.Variable    `gnark:",public"`
-	CmNew     frontend.Variable    `gnark:",public"`
-	CNew      [6]frontend.Variable `gnark:",public"`
-	G         sw_bls12377.G1Affine `gnark:",public"`
-	G_b       sw_bls12377.G1Affine `gnark:",public"`
-	G_r       sw_bls12377.G1Affine `gnark:",public"`
+	Anchor frontend.Variable    `gnark:",public"` // Merkle root of the ledger commitments
+	SnOld  frontend.Variable    `gnark:",public"`
+	CmNew  frontend.Variable    `gnark:",public"`
+	CNew   [6]frontend.Variable `gnark:",public"`
+	G      sw_bls12377.G1Affine `gnark:",public"`
+	G_b    sw_bls12377.G1Affine `gnark:",public"`
+	G_r    sw_bls12377.G1Affine `gnark:",public"`
 
 	// Private inputs
-	SkOld   frontend.Variable
-	RhoOld  frontend.Variable
-	RandOld frontend.Variable
-	PkNew   frontend.Variable
-	RhoNew  frontend.Variable
-	RandNew frontend.Variable
-	R       frontend.Variable
-	EncKey  sw_bls12377.G1Affine
+	OldCoin   frontend.Variable
+	OldEnergy frontend.Variable
+	PkOld     frontend.Variable
+	NewCoin   frontend.Variable
+	NewEnergy frontend.Variable
+	CmOld     frontend.Variable
+	Path      [MerkleTreeDepth]frontend.Variable // Sibling hashes from leaf to root
+	PathBits  [MerkleTreeDepth]frontend.Variable // Leaf index bits (1 = node is a right child)
+	SkOld     frontend.Variable
+	RhoOld    frontend.Variable
+	RandOld   frontend.Variable
+	PkNew     frontend.Variable
+	RhoNew    frontend.Variable
+	RandNew   frontend.Variable
+	R         frontend.Variable
+	EncKey    sw_bls12377.G1Affine
+
+	ValueBits int `gnark:"-"` // Width of coins and energy (0 means DefaultValueBits)
 }
 
 func (c *CircuitTx) Define(api frontend.API) error {
+	// Step 0: Coins and energy fit in ValueBits so they cannot wrap around the field
+	AssertValueRange(api, c.ValueBits, c.OldCoin, c.OldEnergy, c.NewCoin, c.NewEnergy)
+
 	// Step 1: Serial number (snOld = PRF(skOld, rhoOld))
 	snComputed := PRF(api, c.SkOld, c.RhoOld)
 	api.AssertIsEqual(c.SnOld, snComputed)
 
+	// Step 1b: The old note is a ledger leaf: cmOld = Com(Γ || pk || ρ, r) is in the tree under Anchor
+	cmOldComputed := NoteCommitment(api, c.OldCoin, c.OldEnergy, c.PkOld, c.RhoOld, c.RandOld)
+	api.AssertIsEqual(c.CmOld, cmOldComputed)
+	api.AssertIsEqual(c.Anchor, MerkleRoot(api, c.CmOld, c.Path[:], c.PathBits[:]))
+
 	// Step 2: rhoNew = H(j||snOld) as per paper formula (j=0 for single note)
 	hasher, _ := mimc.NewMiMC(api)
 	hasher.Write(0)          // Add index j=0 for single note output
@@ -83,14 +102,67 @@ func (c *CircuitTx) Define(api frontend.API) error {
 	return nil
 }
 
-// PRF implements a pseudo-random function using MiMC hash in the circuit
+// PRF computes the serial number sn = MiMC(nk, rho) in the circuit, with nk = NullifierKeyCircuit(sk)
 func PRF(api frontend.API, sk, rho frontend.Variable) frontend.Variable {
 	hasher, _ := mimc.NewMiMC(api)
+	hasher.Write(NullifierKeyCircuit(api, sk))
+	hasher.Write(rho)
+	return hasher.Sum()
+}
+
+// NullifierKeyCircuit computes nk = MiMC(NullifierDomain, sk) in the circuit, matching NullifierKey
+func NullifierKeyCircuit(api frontend.API, sk frontend.Variable) frontend.Variable {
+	hasher, _ := mimc.NewMiMC(api)
+	hasher.Write(NullifierDomain)
 	hasher.Write(sk)
+	return hasher.Sum()
+}
+
+// NoteCommitment computes cm = Com(Γ || pk || ρ, r) in the circuit, matching Commitment.
+func NoteCommitment(api frontend.API, coins, energy, pk, rho, rand frontend.Variable) frontend.Variable {
+	hasher, _ := mimc.NewMiMC(api)
+	hasher.Write(coins)
+	hasher.Write(energy)
+	hasher.Write(pk)
 	hasher.Write(rho)
+	hasher.Write(rand)
 	return hasher.Sum()
 }
 
+// MerkleRoot recomputes the commitment tree root from a leaf and its authentication path in the circuit.
+// pathBits[h] selects whether the node at height h is a left (0) or right (1) child.
+func MerkleRoot(api frontend.API, leaf frontend.Variable, path, pathBits []frontend.Variable) frontend.Variable {
+	node := leaf
+	for h := range path {
+		api.AssertIsBoolean(pathBits[h])
+		left := api.Select(pathBits[h], path[h], node)
+		right := api.Select(pathBits[h], node, path[h])
+		hasher, _ := mimc.NewMiMC(api)
+		hasher.Write(left)
+		hasher.Write(right)
+		node = hasher.Sum()
+	}
+	return node
+}
+
+// AssertValueRange constrains each value to [0, 2^bits) by decomposing it into bits.
+// bits <= 0 selects DefaultValueBits.
+func AssertValueRange(api frontend.API, bits int, values ...frontend.Variable) {
+	if bits <= 0 {
+		bits = DefaultValueBits
+	}
+	for _, v := range values {
+		api.ToBinary(v, bits)
+	}
+}
+
+// IsLess returns 1 if a < b and 0 otherwise, for a and b in [0, 2^bits).
+func IsLess(api frontend.API, a, b frontend.Variable, bits int) frontend.Variable {
+	// a - b + 2^bits is in [1, 2^(bits+1)); its top bit is set exactly when a >= b
+	shifted := api.Add(api.Sub(a, b), new(big.Int).Lsh(big.NewInt(1), uint(bits)))
+	return api.Sub(1, api.ToBinary(shifted, bits+1)[bits])
+}
+
 // EncZK encrypts note data using MiMC-based encryption in the circuit
 func EncZK(api frontend.API, pk, coins, energy, rho, rand, cm frontend.Variable, enc_key sw_bls12377.G1Affine) []frontend.Variable {
 	h, _ := mimc.NewMiMC(api)
@@ -126,51 +198,106 @@ func EncZK(api frontend.API, pk, coins, energy, rho, rand, cm frontend.Variable,
 	return []frontend.Variable{pk_enc, coins_enc, energy_enc, rho_enc, rand_enc, cm_enc}
 }
 
-// CircuitTx10 implements a batched Zerocash transaction circuit for N=10 notes.
-// This is identical to CircuitTx but vectorized for 10 notes, used in the auction phase.
-type CircuitTx10 struct {
-	// Public inputs (arrays of length 10)
-	OldCoin   [10]frontend.Variable    `gnark:",public"`
-	OldEnergy [10]frontend.Variable    `gnark:",public"`
-	CmOld     [10]frontend.Variable    `gnark:",public"`
-	SnOld     [10]frontend.Variable    `gnark:",public"`
-	PkOld     [10]frontend.Variable    `gnark:",public"`
-	NewCoin   [10]frontend.Variable    `gnark:",public"`
-	NewEnergy [10]frontend.Variable    `gnark:",public"`
-	CmNew     [10]frontend.Variable    `gnark:",public"`
-	CNew      [10][6]frontend.Variable `gnark:",public"`
-	G         sw_bls12377.G1Affine     `gnark:",public"`
-	G_b       sw_bls12377.G1Affine     `gnark:",public"`
-	G_r       [10]sw_bls12377.G1Affine `gnark:",public"`
-
-	// Private inputs (arrays of length 10)
-	SkOld   [10]frontend.Variable
-	RhoOld  [10]frontend.Variable
-	RandOld [10]frontend.Variable
-	PkNew   [10]frontend.Variable
-	RhoNew  [10]frontend.Variable
-	RandNew [10]frontend.Variable
-	R       [10]frontend.Variable
-	EncKey  [10]sw_bls12377.G1Affine
+// CircuitTxN implements a batched Zerocash transaction circuit for N notes.
+// This is identical to CircuitTx but vectorized for N notes, each paid to its own G_b; as there,
+// values and owners are private. All old notes are proven against the same Anchor, except the
+// padding slots of a batch with fewer than N transfers (see CreateBatchTx): those are flagged by
+// the private Padding, carry no value and have no leaf.
+// The shape is fixed at compile time; use NewCircuitTxN to allocate it.
+type CircuitTxN struct {
+	// Public inputs (one per note)
+	Anchor frontend.Variable      `gnark:",public"`
+	SnOld  []frontend.Variable    `gnark:",public"`
+	CmNew  []frontend.Variable    `gnark:",public"`
+	CNew   [][6]frontend.Variable `gnark:",public"`
+	G      sw_bls12377.G1Affine   `gnark:",public"`
+	G_b    []sw_bls12377.G1Affine `gnark:",public"`
+	G_r    []sw_bls12377.G1Affine `gnark:",public"`
+
+	// Private inputs (one per note)
+	OldCoin   []frontend.Variable
+	OldEnergy []frontend.Variable
+	PkOld     []frontend.Variable
+	NewCoin   []frontend.Variable
+	NewEnergy []frontend.Variable
+	Padding   []frontend.Variable // 1 for a padding slot, 0 for a transfer
+	CmOld     []frontend.Variable
+	Path      [][MerkleTreeDepth]frontend.Variable
+	PathBits  [][MerkleTreeDepth]frontend.Variable
+	SkOld     []frontend.Variable
+	RhoOld    []frontend.Variable
+	RandOld   []frontend.Variable
+	PkNew     []frontend.Variable
+	RhoNew    []frontend.Variable
+	RandNew   []frontend.Variable
+	R         []frontend.Variable
+	EncKey    []sw_bls12377.G1Affine
+
+	ValueBits int `gnark:"-"` // Width of coins and energy (0 means DefaultValueBits)
+}
+
+// NewCircuitTxN allocates a batch circuit with n notes.
+func NewCircuitTxN(n int) *CircuitTxN {
+	return &CircuitTxN{
+		OldCoin:   make([]frontend.Variable, n),
+		OldEnergy: make([]frontend.Variable, n),
+		SnOld:     make([]frontend.Variable, n),
+		PkOld:     make([]frontend.Variable, n),
+		NewCoin:   make([]frontend.Variable, n),
+		NewEnergy: make([]frontend.Variable, n),
+		Padding:   make([]frontend.Variable, n),
+		CmNew:     make([]frontend.Variable, n),
+		CNew:      make([][6]frontend.Variable, n),
+		G_b:       make([]sw_bls12377.G1Affine, n),
+		G_r:       make([]sw_bls12377.G1Affine, n),
+		CmOld:     make([]frontend.Variable, n),
+		Path:      make([][MerkleTreeDepth]frontend.Variable, n),
+		PathBits:  make([][MerkleTreeDepth]frontend.Variable, n),
+		SkOld:     make([]frontend.Variable, n),
+		RhoOld:    make([]frontend.Variable, n),
+		RandOld:   make([]frontend.Variable, n),
+		PkNew:     make([]frontend.Variable, n),
+		RhoNew:    make([]frontend.Variable, n),
+		RandNew:   make([]frontend.Variable, n),
+		R:         make([]frontend.Variable, n),
+		EncKey:    make([]sw_bls12377.G1Affine, n),
+	}
 }
 
-func (c *CircuitTx10) Define(api frontend.API) error {
+func (c *CircuitTxN) Define(api frontend.API) error {
+	n := len(c.SnOld)
+	if n == 0 {
+		return errors.New("batch circuit needs at least one note")
+	}
+
 	// First, compute all serial numbers
-	var allSerialNumbers [10]frontend.Variable
-	for i := 0; i < 10; i++ {
+	allSerialNumbers := make([]frontend.Variable, n)
+	for i := 0; i < n; i++ {
+		// Step 0: Coins and energy of note i fit in ValueBits
+		AssertValueRange(api, c.ValueBits, c.OldCoin[i], c.OldEnergy[i], c.NewCoin[i], c.NewEnergy[i])
+
 		// Step 1: Serial number (snOld = PRF(skOld, rhoOld)) for note i
 		snComputed := PRF(api, c.SkOld[i], c.RhoOld[i])
 		api.AssertIsEqual(c.SnOld[i], snComputed)
 		allSerialNumbers[i] = snComputed
+
+		// Step 1b: Old note i is a ledger leaf under Anchor, unless it is a padding note, which has no value
+		cmOldComputed := NoteCommitment(api, c.OldCoin[i], c.OldEnergy[i], c.PkOld[i], c.RhoOld[i], c.RandOld[i])
+		api.AssertIsEqual(c.CmOld[i], cmOldComputed)
+		api.AssertIsBoolean(c.Padding[i])
+		api.AssertIsEqual(api.Mul(c.Padding[i], c.OldCoin[i]), 0)
+		api.AssertIsEqual(api.Mul(c.Padding[i], c.OldEnergy[i]), 0)
+		root := MerkleRoot(api, c.CmOld[i], c.Path[i][:], c.PathBits[i][:])
+		api.AssertIsEqual(api.Mul(api.Sub(1, c.Padding[i]), api.Sub(c.Anchor, root)), 0)
 	}
 
-	// Apply all CircuitTx constraints element-wise for each of the 10 notes
-	for i := 0; i < 10; i++ {
-		// Step 2: rhoNew = H(j||sn₁ᵒˡᵈ||...||sn₁₀ᵒˡᵈ) as per paper formula
+	// Apply all CircuitTx constraints element-wise for each of the N notes
+	for i := 0; i < n; i++ {
+		// Step 2: rhoNew = H(j||sn₁ᵒˡᵈ||...||snₙᵒˡᵈ) as per paper formula
 		hasher, _ := mimc.NewMiMC(api)
 		hasher.Write(i) // Add index j
-		// Add all old serial numbers sn₁ᵒˡᵈ||...||sn₁₀ᵒˡᵈ
-		for j := 0; j < 10; j++ {
+		// Add all old serial numbers sn₁ᵒˡᵈ||...||snₙᵒˡᵈ
+		for j := 0; j < n; j++ {
 			hasher.Write(allSerialNumbers[j])
 		}
 		rhoNewComputed := hasher.Sum()
@@ -198,7 +325,7 @@ func (c *CircuitTx10) Define(api frontend.API) error {
 
 		// Key derivations for encryption for note i
 		G_r_b := new(sw_bls12377.G1Affine)
-		G_r_b.ScalarMul(api, c.G_b, c.R[i])
+		G_r_b.ScalarMul(api, c.G_b[i], c.R[i])
 		api.AssertIsEqual(c.EncKey[i].X, G_r_b.X)
 		api.AssertIsEqual(c.EncKey[i].Y, G_r_b.Y)
 		G_r := new(sw_bls12377.G1Affine)
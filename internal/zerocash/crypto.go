@@ -8,33 +8,52 @@ package zerocash
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"math/big"
 
 	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	bls12377_fp "github.com/consensys/gnark-crypto/ecc/bls12-377/fp"
 	bls12377_fr "github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
 	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
 )
 
-// prf implements a pseudo-random function using MiMC hash.
-// Used for serial number and other protocol PRFs.
+// prf computes the serial number PRF: sn = MiMC(nk, rho) with nk = NullifierKey(sk).
 func prf(sk, rho []byte) []byte {
+	return SerialNumberFromNullifierKey(NullifierKey(sk), rho)
+}
+
+// NullifierDomain separates nullifier keys nk = MiMC(NullifierDomain, sk) from note public keys pk = MiMC(sk).
+var NullifierDomain = new(big.Int).SetBytes([]byte("PPEM nullifier key"))
+
+// NullifierKey returns nk = MiMC(NullifierDomain, sk), the key serial numbers are derived from.
+// It detects spends of the notes owned by sk but cannot spend them (see viewkeys.go).
+func NullifierKey(sk []byte) []byte {
 	h := mimcNative.NewMiMC()
+	h.Write(leftPad(NullifierDomain.Bytes()))
 	h.Write(sk)
+	return h.Sum(nil)
+}
+
+// SerialNumberFromNullifierKey computes sn = MiMC(nk, rho).
+func SerialNumberFromNullifierKey(nk, rho []byte) []byte {
+	h := mimcNative.NewMiMC()
+	h.Write(nk)
 	h.Write(rho)
 	return h.Sum(nil)
 }
 
 // Commitment creates a commitment to note data using MiMC hash.
 // Follows paper specification: cm = Com(Γ || pk || ρ, r)
-// where Γ = (coins, energy), pk is the public key, ρ is rho, and r is randomness
+// where Γ = (coins, energy), pk is the public key, ρ is rho, and r is randomness.
+// Every input is written as a full field element so zero values hash like they do in the circuit.
 func Commitment(coins, energy *big.Int, pk []byte, rho, r *big.Int) []byte {
 	h := mimcNative.NewMiMC()
 	// Commit to Γ || pk || ρ with randomness r
-	h.Write(coins.Bytes())  // Γ.coins
-	h.Write(energy.Bytes()) // Γ.energy
-	h.Write(pk)             // pk (public key)
-	h.Write(rho.Bytes())    // ρ (rho)
-	h.Write(r.Bytes())      // r (randomness)
+	h.Write(leftPad(coins.Bytes()))  // Γ.coins
+	h.Write(leftPad(energy.Bytes())) // Γ.energy
+	h.Write(leftPad(pk))             // pk (public key)
+	h.Write(leftPad(rho.Bytes()))    // ρ (rho)
+	h.Write(leftPad(r.Bytes()))      // r (randomness)
 	return h.Sum(nil)
 }
 
@@ -83,128 +102,80 @@ func ComputeDHShared(sk *bls12377_fr.Element, pk *bls12377.G1Affine) *bls12377.G
 	return &shared
 }
 
-// EncryptNoteWithSharedKey encrypts note fields using MiMC and the shared key.
-// Returns an array of encrypted fields (pkOwner, coins, energy, rho, rand, cm).
-func EncryptNoteWithSharedKey(note *Note, shared *bls12377.G1Affine) [6][]byte {
-	// Use the same MiMC-based mask chain as buildEncMimc, but output as []byte
-	h := mimcNative.NewMiMC()
-	encKeyX := shared.X.Bytes()
-	encKeyY := shared.Y.Bytes()
-	h.Write(encKeyX[:])
-	h.Write(encKeyY[:])
-	h_enc_key := h.Sum(nil)
-
-	h.Write(h_enc_key)
-	h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_enc_key)
-	h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_enc_key)
-	h_h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_h_enc_key)
-	h_h_h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_h_h_enc_key)
-	h_h_h_h_h_h_enc_key := h.Sum(nil)
-
-	fields := [][]byte{
-		note.PkOwner,
-		note.Value.Coins.Bytes(),
-		note.Value.Energy.Bytes(),
-		note.Rho,
-		note.Rand,
-		note.Cm,
-	}
-	masks := [][]byte{
-		h_enc_key,
-		h_h_enc_key,
-		h_h_h_enc_key,
-		h_h_h_h_enc_key,
-		h_h_h_h_h_enc_key,
-		h_h_h_h_h_h_enc_key,
-	}
-	var enc [6][]byte
-	for i := 0; i < 6; i++ {
-		enc[i] = xorPad(fields[i], masks[i])
+// EncryptNoteWithSharedKey encrypts note fields to the shared key G_b^r the same way CircuitTx does:
+// each field is added, in the BLS12-377 base field, to the next mask of a MiMC chain seeded with the key.
+// Returns the ciphertext as decimal strings (pkOwner, coins, energy, rho, rand, cm), i.e. Tx.CNewCircuit.
+func EncryptNoteWithSharedKey(note *Note, shared *bls12377.G1Affine) [6]string {
+	encVals := buildEncMimc(*shared, note.PkOwner, note.Value.Coins, note.Value.Energy,
+		new(big.Int).SetBytes(note.Rho), new(big.Int).SetBytes(note.Rand), note.Cm)
+	var enc [6]string
+	for i := range encVals {
+		enc[i] = encVals[i].String()
 	}
 	return enc
 }
 
-// DecryptNoteWithSharedKey decrypts note fields using MiMC and the shared key.
-// Returns the decrypted fields in the same order as EncryptNoteWithSharedKey.
-func DecryptNoteWithSharedKey(enc [6][]byte, shared *bls12377.G1Affine) (fields [6][]byte, err error) {
-	h := mimcNative.NewMiMC()
-	encKeyX := shared.X.Bytes()
-	encKeyY := shared.Y.Bytes()
-	h.Write(encKeyX[:])
-	h.Write(encKeyY[:])
-	h_enc_key := h.Sum(nil)
-
-	h.Write(h_enc_key)
-	h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_enc_key)
-	h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_enc_key)
-	h_h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_h_enc_key)
-	h_h_h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_h_h_enc_key)
-	h_h_h_h_h_h_enc_key := h.Sum(nil)
-
-	masks := [][]byte{
-		h_enc_key,
-		h_h_enc_key,
-		h_h_h_enc_key,
-		h_h_h_h_enc_key,
-		h_h_h_h_h_enc_key,
-		h_h_h_h_h_h_enc_key,
-	}
+// DecryptNoteWithSharedKey decrypts a CNewCircuit ciphertext by subtracting the masks of EncryptNoteWithSharedKey.
+// The recipient computes the shared key as G_r^sk_b (ComputeDHShared(sk_b, G_r)).
+// Returns the decrypted fields in the same order as EncryptNoteWithSharedKey, each as 48 big-endian bytes.
+func DecryptNoteWithSharedKey(enc [6]string, shared *bls12377.G1Affine) (fields [6][]byte, err error) {
+	masks := noteMasks(*shared)
 	for i := 0; i < 6; i++ {
-		fields[i] = xorPad(enc[i], masks[i])
+		c, ok := new(big.Int).SetString(enc[i], 10)
+		if !ok || c.Sign() < 0 || c.Cmp(bls12377_fp.Modulus()) >= 0 {
+			return fields, fmt.Errorf("ciphertext field %d is not a field element", i)
+		}
+		var field bls12377_fp.Element
+		field.SetBigInt(c)
+		field.Sub(&field, &masks[i])
+		b := field.Bytes()
+		fields[i] = b[:]
 	}
 	return fields, nil
 }
 
-// xorPad xors two byte slices, padding the shorter one with zeros.
-// Used for MiMC-based encryption of note fields.
-func xorPad(a, b []byte) []byte {
-	maxLen := len(a)
-	if len(b) > maxLen {
-		maxLen = len(b)
-	}
-	out := make([]byte, maxLen)
-	for i := 0; i < maxLen; i++ {
-		var ab, bb byte
-		if i < len(a) {
-			ab = a[i]
-		}
-		if i < len(b) {
-			bb = b[i]
+// noteMasks returns the six MiMC masks derived from an encryption key, as used by CircuitTx's EncZK.
+func noteMasks(encKey bls12377.G1Affine) [6]bls12377_fp.Element {
+	h := mimcNative.NewMiMC()
+	encKeyX := encKey.X.Bytes()
+	encKeyY := encKey.Y.Bytes()
+	h.Write(encKeyX[:])
+	h.Write(encKeyY[:])
+
+	// Each mask hashes the previous one into the running state
+	var masks [6]bls12377_fp.Element
+	mask := h.Sum(nil)
+	for i := range masks {
+		if i > 0 {
+			h.Write(mask)
+			mask = h.Sum(nil)
 		}
-		out[i] = ab ^ bb
+		masks[i].SetBigInt(new(big.Int).SetBytes(mask))
 	}
-	return out
+	return masks
 }
 
-// RecognizeNote attempts to decrypt and parse a note, returning true if the pkOwner matches.
+// RecognizeNote attempts to decrypt a CNewCircuit ciphertext, returning true if the note is
+// well formed (its fields open its commitment) and its pkOwner is myPk.
 // Used by recipients to scan for their notes in the ledger.
-func RecognizeNote(enc [6][]byte, shared *bls12377.G1Affine, myPk []byte) (bool, *Note, error) {
+func RecognizeNote(enc [6]string, shared *bls12377.G1Affine, myPk []byte) (bool, *Note, error) {
 	fields, err := DecryptNoteWithSharedKey(enc, shared)
 	if err != nil {
 		return false, nil, err
 	}
-	if !bytes.Equal(fields[0], myPk) {
+	if new(big.Int).SetBytes(fields[0]).Cmp(new(big.Int).SetBytes(myPk)) != 0 {
 		return false, nil, nil
 	}
+	note, ok := openNote(fields)
+	return ok, note, nil
+}
+
+// openNote rebuilds a note from decrypted CNewCircuit fields.
+// A key that is not the recipient's yields fields that do not open the commitment, so ok is false.
+func openNote(fields [6][]byte) (note *Note, ok bool) {
 	coins := new(big.Int).SetBytes(fields[1])
 	energy := new(big.Int).SetBytes(fields[2])
-	note := &Note{
+	note = &Note{
 		Value: Gamma{
 			Coins:  coins,
 			Energy: energy,
@@ -214,7 +185,11 @@ func RecognizeNote(enc [6][]byte, shared *bls12377.G1Affine, myPk []byte) (bool,
 		Rand:    fields[4],
 		Cm:      fields[5],
 	}
-	return true, note, nil
+	if !bytes.Equal(note.Cm, Commitment(coins, energy, note.PkOwner,
+		new(big.Int).SetBytes(note.Rho), new(big.Int).SetBytes(note.Rand))) {
+		return nil, false
+	}
+	return note, true
 }
 
 // NewMiMC creates a new MiMC hash instance.
@@ -235,10 +210,7 @@ func MimcHashPublic(data []byte) *big.Int {
 
 // SerialNumber computes a serial number from secret key and rho
 func SerialNumber(sk, rho []byte) []byte {
-	h := mimcNative.NewMiMC()
-	h.Write(sk)
-	h.Write(rho)
-	return h.Sum(nil)
+	return prf(sk, rho)
 }
 
 // RandomBytesPublic generates random bytes (exposed for testing)
@@ -1,14 +1,14 @@
 // Package zerocash implements a confidential transaction protocol inspired by Zerocash.
 //
 // Overview:
-//   - Provides confidential, unlinkable transactions using zero-knowledge proofs (Groth16)
+//   - Provides confidential, unlinkable transactions using zero-knowledge proofs (Groth16 or PLONK)
 //   - All cryptographic and protocol logic is encapsulated in this package
 //   - Supports note creation, confidential transfer, persistent ledger, and REST API for P2P scenarios
 //
 // Security Model:
 //   - Uses MiMC hash for commitments and PRFs
 //   - Uses BLS12-377 for Diffie-Hellman key exchange
-//   - Zero-knowledge proofs are generated and verified using gnark (Groth16, BW6-761)
+//   - Zero-knowledge proofs are generated and verified using gnark (Groth16 or PLONK, BW6-761)
 //   - All randomness is generated using crypto/rand
 //   - Serial numbers prevent double-spending; commitments ensure confidentiality
 //
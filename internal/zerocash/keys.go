@@ -0,0 +1,167 @@
+// keys.go - Deterministic key hierarchy derived from a wallet seed.
+//
+// Every key a wallet uses is derived from a single seed along a named path, so a wallet can be
+// rebuilt from its seed and a ledger rescan (RestoreWallet):
+//
+//	dh                 DH key pair notes are encrypted to (Wallet.Sk/Pk); the incoming viewing key
+//	spend              main note spending key, which notes paid to the wallet are owned by
+//	note/<i>           note spending keys for payments
+//	auction/<i>/in     sk^in of the i-th registration (owner key of the tx^in note)
+//	auction/<i>/out    sk^out of the i-th registration (owner key of the exchange or withdraw output)
+//	auction/<i>/renc   r_enc of the i-th registration (DH randomness of C^Aux)
+//	auction/<i>/wrho   ρ of the withdraw output note of the i-th registration
+//	auction/<i>/wr     r of the withdraw output note of the i-th registration
+//
+// Each step is HMAC-SHA512 keyed by the parent chain code, as in BIP-32 hardened derivation.
+// The seed can be generated from a BIP-39 mnemonic (NewMnemonic, MnemonicToSeed).
+
+package zerocash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"fmt"
+	"math/big"
+	"strings"
+
+	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	bls12377_fr "github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeyLookahead is how many unused derived keys past the last used one are watched when scanning.
+const KeyLookahead = 20
+
+// seedDomain separates this hierarchy from other uses of the same seed.
+const seedDomain = "PPEM key hierarchy"
+
+// KeyChain derives a wallet's keys from its seed.
+type KeyChain struct {
+	seed []byte
+}
+
+// NewSeed returns a fresh random 32-byte wallet seed.
+func NewSeed() []byte {
+	return randomBytes(32)
+}
+
+// NewKeyChain returns the key hierarchy of a seed, which must be 16 to 64 bytes long.
+func NewKeyChain(seed []byte) (*KeyChain, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("seed must be 16 to 64 bytes, got %d", len(seed))
+	}
+	return &KeyChain{seed: seed}, nil
+}
+
+// derive returns the 64-byte node at path: 32 bytes of key material followed by its chain code.
+func (k *KeyChain) derive(path string) []byte {
+	mac := hmac.New(sha512.New, []byte(seedDomain))
+	mac.Write(k.seed)
+	node := mac.Sum(nil)
+	for _, label := range strings.Split(path, "/") {
+		mac = hmac.New(sha512.New, node[32:])
+		mac.Write(node[:32])
+		mac.Write([]byte(label))
+		node = mac.Sum(nil)
+	}
+	return node
+}
+
+// scalar derives a BLS12-377 scalar at path; the 64-byte node is reduced mod r.
+func (k *KeyChain) scalar(path string) *bls12377_fr.Element {
+	var s bls12377_fr.Element
+	s.SetBigInt(new(big.Int).SetBytes(k.derive(path)))
+	return &s
+}
+
+// DHKey returns the wallet's DH key pair.
+func (k *KeyChain) DHKey() *DHKeyPair {
+	sk := k.scalar("dh")
+	var pk bls12377.G1Affine
+	_, _, g1, _ := bls12377.Generators()
+	pk.ScalarMultiplication(&g1, sk.BigInt(new(big.Int)))
+	return &DHKeyPair{Sk: sk, Pk: &pk}
+}
+
+// SpendKey returns the wallet's main note spending key; payments to the wallet are owned by
+// MimcHashPublic(SpendKey()). It is separate from the DH key, so a viewing key cannot spend.
+func (k *KeyChain) SpendKey() []byte {
+	b := k.scalar("spend").Bytes()
+	return b[:]
+}
+
+// NoteKey returns the i-th note spending key; the note public key is MimcHashPublic(NoteKey(i)).
+func (k *KeyChain) NoteKey(i uint32) []byte {
+	b := k.scalar(fmt.Sprintf("note/%d", i)).Bytes()
+	return b[:]
+}
+
+// AuctionKeys returns sk^in, sk^out and r_enc for the i-th auction registration.
+func (k *KeyChain) AuctionKeys(i uint32) (skIn, skOut, rEnc *bls12377_fr.Element) {
+	prefix := fmt.Sprintf("auction/%d/", i)
+	return k.scalar(prefix + "in"), k.scalar(prefix + "out"), k.scalar(prefix + "renc")
+}
+
+// WithdrawOpening returns ρ and r of the withdraw output note of the i-th auction registration.
+// A withdrawal publishes no ciphertext of its output, so its opening is derived to be found
+// again from the seed.
+func (k *KeyChain) WithdrawOpening(i uint32) (rho, r *bls12377_fr.Element) {
+	prefix := fmt.Sprintf("auction/%d/", i)
+	return k.scalar(prefix + "wrho"), k.scalar(prefix + "wr")
+}
+
+//go:embed bip39_english.txt
+var bip39English string
+
+var bip39Words = strings.Fields(bip39English)
+
+// NewMnemonic returns a fresh 24-word BIP-39 mnemonic (256 bits of entropy).
+func NewMnemonic() string {
+	entropy := randomBytes(32)
+	checksum := sha256.Sum256(entropy)
+	// 256 entropy bits followed by 8 checksum bits, in 11-bit words
+	bits := new(big.Int).SetBytes(append(entropy, checksum[0]))
+	words := make([]string, 24)
+	mask := big.NewInt(2047)
+	for i := 23; i >= 0; i-- {
+		words[i] = bip39Words[new(big.Int).And(bits, mask).Int64()]
+		bits.Rsh(bits, 11)
+	}
+	return strings.Join(words, " ")
+}
+
+// MnemonicToSeed checks a BIP-39 mnemonic (12 to 24 English words) and returns its 64-byte seed.
+// passphrase is the optional BIP-39 passphrase; a different passphrase yields a different wallet.
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("mnemonic must have 12, 15, 18, 21 or 24 words, got %d", len(words))
+	}
+	bits := new(big.Int)
+	for _, word := range words {
+		index := -1
+		for i, w := range bip39Words {
+			if w == word {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("unknown mnemonic word %q", word)
+		}
+		bits.Lsh(bits, 11)
+		bits.Or(bits, big.NewInt(int64(index)))
+	}
+	checksumBits := len(words) / 3
+	entropyLen := (len(words)*11 - checksumBits) / 8
+	checksum := new(big.Int).And(bits, big.NewInt(int64(1)<<checksumBits-1))
+	entropy := bits.Rsh(bits, uint(checksumBits)).FillBytes(make([]byte, entropyLen))
+	hash := sha256.Sum256(entropy)
+	if checksum.Int64() != int64(hash[0]>>(8-checksumBits)) {
+		return nil, fmt.Errorf("invalid mnemonic checksum")
+	}
+	normalized := strings.Join(words, " ")
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), 2048, 64, sha512.New), nil
+}
@@ -2,57 +2,235 @@
 //
 // The Ledger records all commitments, serial numbers, and transactions.
 // It is append-only, supports double-spend detection, and is persisted as a single global JSON file (ledger.json).
+// Commitments are additionally accumulated in an incremental Merkle tree (see merkle.go).
+// Only public transactions (PublicTx, PublicJoinSplitTx, PublicBatchTx, ExchangeTx) are recorded; plaintext notes never reach the ledger.
+// Files written before LedgerVersion 2 embedded the plaintext notes, version 2 files the plaintext
+// values and owner keys of each transaction and version 3 files those of each batch;
+// MigrateLedgerFile rewrites them.
 //
 // NOTE: Ledger is not thread-safe by itself; use a sync.Mutex for concurrent access.
 
 package zerocash
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
-	"implementation/internal/transactions/withdraw"
+	"fmt"
+	"math/big"
 	"os"
+	"path/filepath"
 
-	"github.com/consensys/gnark-crypto/ecc"
-	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
-	"github.com/consensys/gnark/backend/groth16"
-	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 )
 
+// LedgerVersion is the current version of the ledger file format.
+// Version 4 records public transactions only. Version 3 batches and version 2 transactions also
+// hold their plaintext values and old owner keys (OldCoin, OldEnergy, PkOld, NewCoin, NewEnergy),
+// and unversioned files (version 1) their plaintext notes.
+const LedgerVersion = 4
+
 // Ledger is the canonical, append-only public ledger for Zerocash transactions.
 // All participants read from and append to this file.
 type Ledger struct {
-	CmList      []string // Commitments (hex/base64-encoded)
-	SnList      []string // Serial numbers (hex/base64-encoded)
-	TxList      []*Tx    // Full transactions
-	WithdrawTxs []*withdraw.WithdrawTx
+	Version      int
+	CmList       []string             // Commitments (hex/base64-encoded)
+	SnList       []string             // Serial numbers (hex/base64-encoded)
+	TxList       []*PublicTx          // Public transactions (proof, public inputs, ciphertexts)
+	JoinSplitTxs []*PublicJoinSplitTx // N-input/M-output public transactions
+	BatchTxs     []*PublicBatchTx     // Batches of transfers under one CircuitTxN proof
+	WithdrawTxs  []*WithdrawTx
+	ExchangeTxs  []*ExchangeTx // Settled auctions, one entry per exchange proof
+	Tree         *MerkleTree   // Merkle tree over CmList (nodes are rebuilt on load)
+}
+
+// WithdrawTx is the public part of a withdrawal (Algorithm 4), as recorded in the ledger.
+// It is built and verified by the withdraw package.
+type WithdrawTx struct {
+	Anchor    *big.Int // Merkle root the withdrawn note was proven against
+	CmIn      *big.Int // Commitment of the withdrawn note, as registered
+	SnIn      *big.Int
+	CmOut     *big.Int
+	PkT       sw_bls12377.G1Affine
+	CipherAux [3]*big.Int
+}
+
+// ExchangeTx is the public part of a settled exchange (Algorithm 3), as recorded in the ledger.
+// Every slice has one entry per slot of the exchange circuit, dummy slots included.
+// Output j is encrypted (CNew, as CNewCircuit of a PublicTx) to the shared key G_r[j]^s_j, where
+// G_r[j] is the DH key of the registration and G_s[j] = G^s_j; the registrant recovers it with its
+// r_enc. It is built and verified by the exchange package.
+type ExchangeTx struct {
+	SnIn  []string               // Serial numbers of the spent tx^in notes
+	CmOut []string               // Commitments of the output notes
+	CNew  [][6]string            // Output notes encrypted to their owners
+	G_r   []sw_bls12377.G1Affine // DH keys of the registrations
+	G_s   []sw_bls12377.G1Affine // Ephemeral keys of the output encryptions
 }
 
 // NewLedger creates a new, empty ledger.
 func NewLedger() *Ledger {
 	return &Ledger{
-		CmList: make([]string, 0),
-		SnList: make([]string, 0),
-		TxList: make([]*Tx, 0),
+		Version: LedgerVersion,
+		CmList:  make([]string, 0),
+		SnList:  make([]string, 0),
+		TxList:  make([]*PublicTx, 0),
+		Tree:    NewMerkleTree(MerkleTreeDepth),
 	}
 }
 
-// AppendTx appends a verified transaction to the ledger.
+// AppendTx appends a verified public transaction to the ledger (use Tx.Public() for a sender's Tx).
 // It checks for double-spending and updates all lists.
 // Returns an error if the serial number is already present.
-func (l *Ledger) AppendTx(tx *Tx) error {
+func (l *Ledger) AppendTx(tx *PublicTx) error {
 	sn := tx.SnOld
 	cm := tx.CmNew
 	if l.HasSerialNumber(sn) {
 		return errors.New("double-spend detected: serial number already in ledger")
 	}
+	if err := l.appendCommitment(cm); err != nil {
+		return err
+	}
 	l.SnList = append(l.SnList, sn)
-	l.CmList = append(l.CmList, cm)
 	l.TxList = append(l.TxList, tx)
 	return nil
 }
 
+// AppendJoinSplit appends a verified public JoinSplit transaction to the ledger.
+// It checks all of its serial numbers for double-spending before recording anything.
+func (l *Ledger) AppendJoinSplit(tx *PublicJoinSplitTx) error {
+	for i, sn := range tx.SnOld {
+		if l.HasSerialNumber(sn) {
+			return errors.New("double-spend detected: serial number already in ledger")
+		}
+		for _, prev := range tx.SnOld[:i] {
+			if prev == sn {
+				return errors.New("double-spend detected: serial number repeated in transaction")
+			}
+		}
+	}
+	for _, cm := range tx.CmNew {
+		if _, ok := new(big.Int).SetString(cm, 10); !ok {
+			return fmt.Errorf("invalid commitment: %q", cm)
+		}
+	}
+	for _, cm := range tx.CmNew {
+		if err := l.appendCommitment(cm); err != nil {
+			return err
+		}
+	}
+	l.SnList = append(l.SnList, tx.SnOld...)
+	l.JoinSplitTxs = append(l.JoinSplitTxs, tx)
+	return nil
+}
+
+// AppendBatchTx appends a verified public batch transaction to the ledger.
+// All of its serial numbers and commitments, padding slots included, are checked before any
+// is recorded, so the batch is appended as a whole or not at all.
+func (l *Ledger) AppendBatchTx(tx *PublicBatchTx) error {
+	if err := checkBatchSerialNumbers(tx, l); err != nil {
+		return err
+	}
+	for _, cm := range tx.CmNew {
+		if _, ok := new(big.Int).SetString(cm, 10); !ok {
+			return fmt.Errorf("invalid commitment: %q", cm)
+		}
+	}
+	for _, cm := range tx.CmNew {
+		if err := l.appendCommitment(cm); err != nil {
+			return err
+		}
+	}
+	l.SnList = append(l.SnList, tx.SnOld...)
+	l.BatchTxs = append(l.BatchTxs, tx)
+	return nil
+}
+
+// AppendExchangeTx records a verified exchange in the ledger.
+// All of its serial numbers and commitments are checked before any is recorded, so the exchange
+// is appended as a whole or not at all.
+func (l *Ledger) AppendExchangeTx(tx *ExchangeTx) error {
+	n := len(tx.SnIn)
+	if n == 0 {
+		return errors.New("exchange has no slots")
+	}
+	if len(tx.CmOut) != n || len(tx.CNew) != n || len(tx.G_r) != n || len(tx.G_s) != n {
+		return fmt.Errorf("exchange has %d serial numbers but %d commitments, %d ciphertexts, %d G_r and %d G_s",
+			n, len(tx.CmOut), len(tx.CNew), len(tx.G_r), len(tx.G_s))
+	}
+	for i, sn := range tx.SnIn {
+		if l.HasSerialNumber(sn) {
+			return errors.New("double-spend detected: serial number already in ledger")
+		}
+		for _, prev := range tx.SnIn[:i] {
+			if prev == sn {
+				return errors.New("double-spend detected: serial number repeated in transaction")
+			}
+		}
+	}
+	for _, cm := range tx.CmOut {
+		if _, ok := new(big.Int).SetString(cm, 10); !ok {
+			return fmt.Errorf("invalid commitment: %q", cm)
+		}
+	}
+	for _, cm := range tx.CmOut {
+		if err := l.appendCommitment(cm); err != nil {
+			return err
+		}
+	}
+	l.SnList = append(l.SnList, tx.SnIn...)
+	l.ExchangeTxs = append(l.ExchangeTxs, tx)
+	return nil
+}
+
+// appendCommitment adds a commitment to CmList and to the Merkle tree.
+func (l *Ledger) appendCommitment(cm string) error {
+	leaf, ok := new(big.Int).SetString(cm, 10)
+	if !ok {
+		return fmt.Errorf("invalid commitment: %q", cm)
+	}
+	if _, err := l.Tree.Append(leaf.Bytes()); err != nil {
+		return err
+	}
+	l.CmList = append(l.CmList, cm)
+	return nil
+}
+
+// AppendCommitment records a commitment that is not the output of a transaction
+// (e.g. an initial allocation of funds) and returns its leaf index in the commitment tree.
+func (l *Ledger) AppendCommitment(cm []byte) (int, error) {
+	if err := l.appendCommitment(new(big.Int).SetBytes(cm).String()); err != nil {
+		return 0, err
+	}
+	return l.Tree.NumLeaves - 1, nil
+}
+
+// NotePath returns the authentication path of a note's commitment against the current root.
+// If the commitment appears more than once, the first occurrence is used.
+func (l *Ledger) NotePath(note *Note) (*MerklePath, error) {
+	cm := new(big.Int).SetBytes(note.Cm).String()
+	for i, c := range l.CmList {
+		if c == cm {
+			return l.Tree.Path(i)
+		}
+	}
+	return nil, errors.New("note commitment not found in ledger")
+}
+
+// MerkleRoot returns the current root of the commitment tree (decimal string).
+func (l *Ledger) MerkleRoot() string {
+	return l.Tree.RootString()
+}
+
+// RecentMerkleRoots returns the bounded history of commitment tree roots, oldest first.
+func (l *Ledger) RecentMerkleRoots() []string {
+	return l.Tree.RecentRoots()
+}
+
+// MerklePath returns the authentication path of the commitment at the given CmList index.
+func (l *Ledger) MerklePath(index int) (*MerklePath, error) {
+	return l.Tree.Path(index)
+}
+
 // HasSerialNumber returns true if the serial number is already in the ledger.
 func (l *Ledger) HasSerialNumber(sn string) bool {
 	for _, s := range l.SnList {
@@ -73,14 +251,15 @@ func (l *Ledger) HasCommitment(cm string) bool {
 	return false
 }
 
-// GetTxs returns all transactions in the ledger.
-func (l *Ledger) GetTxs() []*Tx {
+// GetTxs returns all public transactions in the ledger.
+func (l *Ledger) GetTxs() []*PublicTx {
 	return l.TxList
 }
 
-// SaveToFile saves the ledger to a JSON file (ledger.json).
+// SaveToFile saves the ledger to a JSON file (ledger.json) in the current format.
 // Overwrites the file if it exists.
 func (l *Ledger) SaveToFile(path string) error {
+	l.Version = LedgerVersion
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -92,57 +271,174 @@ func (l *Ledger) SaveToFile(path string) error {
 }
 
 // LoadLedgerFromFile loads the global ledger from a JSON file (ledger.json).
-// Returns an error if the file is invalid or cannot be read.
+// Files in an older format are accepted; their plaintext notes and values are dropped on load
+// but stay on disk until the ledger is saved again (see MigrateLedgerFile).
+// Returns an error if the file is invalid, cannot be read, or is from a newer version.
 func LoadLedgerFromFile(path string) (*Ledger, error) {
-	f, err := os.Open(path)
+	l, _, err := loadLedger(path)
+	return l, err
+}
+
+// loadLedger loads a ledger file and also returns the format version it was written in.
+func loadLedger(path string) (*Ledger, int, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer f.Close()
+	var header struct{ Version int }
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, 0, err
+	}
+	version := header.Version
+	if version == 0 {
+		version = 1
+	}
+	if version > LedgerVersion {
+		return nil, 0, fmt.Errorf("ledger %s has version %d, newer than supported version %d", path, version, LedgerVersion)
+	}
+
 	var l Ledger
-	dec := json.NewDecoder(f)
-	if err := dec.Decode(&l); err != nil {
-		return nil, err
+	if version == LedgerVersion {
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		var legacy legacyLedger
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, 0, err
+		}
+		if l, err = legacy.upgrade(); err != nil {
+			return nil, 0, fmt.Errorf("ledger %s: %w", path, err)
+		}
+	}
+	if err := l.rebuildTree(); err != nil {
+		return nil, 0, err
 	}
-	return &l, nil
+	l.Version = LedgerVersion
+	return &l, version, nil
 }
 
-func (l *Ledger) SubmitWithdrawTx(tx *withdraw.WithdrawTx, proofBytes []byte, vk groth16.VerifyingKey) error {
-	// 1. Unmarshal proof
-	proof := groth16.NewProof(ecc.BLS12_377)
-	_, err := proof.ReadFrom(bytes.NewReader(proofBytes))
-	if err != nil {
-		return errors.New("invalid withdraw proof: cannot unmarshal")
+// legacyLedger is the version 1 to 3 ledger format. Its transactions also hold the plaintext
+// OldNote/NewNote and CmOld (version 1) or values and PkOld (version 2), and its batches values
+// and PkOld (version 3), which are not decoded.
+type legacyLedger struct {
+	Ledger
+	TxList []*legacyTx
+}
+
+// legacyTx is a version 1 to 3 transaction. CNew is either the auctioneer ciphertext or, in the
+// oldest files, the six circuit ciphertext values that are now stored in CNewCircuit.
+type legacyTx struct {
+	PublicTx
+	CNew json.RawMessage
+}
+
+// upgrade converts a version 1 to 3 ledger to the current format.
+func (legacy *legacyLedger) upgrade() (Ledger, error) {
+	l := legacy.Ledger
+	l.TxList = make([]*PublicTx, 0, len(legacy.TxList))
+	for i, old := range legacy.TxList {
+		if old == nil {
+			continue
+		}
+		tx := old.PublicTx
+		if len(old.CNew) > 0 && old.CNew[0] == '[' {
+			var circuit [6]string
+			if err := json.Unmarshal(old.CNew, &circuit); err != nil {
+				return Ledger{}, fmt.Errorf("transaction %d: invalid CNew: %w", i, err)
+			}
+			tx.CNewCircuit = circuit
+		} else if len(old.CNew) > 0 && string(old.CNew) != "null" {
+			if err := json.Unmarshal(old.CNew, &tx.CNew); err != nil {
+				return Ledger{}, fmt.Errorf("transaction %d: invalid CNew: %w", i, err)
+			}
+		}
+		l.TxList = append(l.TxList, &tx)
 	}
+	return l, nil
+}
 
-	// 2. Build public witness for withdraw circuit
-	publicWitness := &withdraw.CircuitWithdraw{
-		SnIn:  tx.SnIn.String(),
-		CmOut: tx.CmOut.String(),
-		PkT:   tx.PkT,
-		CipherAux: [3]frontend.Variable{
-			tx.CipherAux[0].String(),
-			tx.CipherAux[1].String(),
-			tx.CipherAux[2].String(),
-		},
+// MigrateLedgerFile rewrites a ledger file in the current format, removing the plaintext notes
+// and values that version 1 to 3 files stored with each transaction or batch. The file is replaced atomically.
+// Returns false without touching the file if it is already current.
+func MigrateLedgerFile(path string) (bool, error) {
+	l, version, err := loadLedger(path)
+	if err != nil {
+		return false, err
+	}
+	if version == LedgerVersion {
+		return false, nil
 	}
-	w, err := frontend.NewWitness(publicWitness, bls12377.ID.ScalarField(), frontend.PublicOnly())
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".migrate-*")
 	if err != nil {
-		return errors.New("invalid withdraw proof: cannot build public witness")
+		return false, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := l.SaveToFile(tmp.Name()); err != nil {
+		return false, err
 	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	// 3. Verify proof
-	if err := groth16.Verify(proof, vk, w); err != nil {
-		return errors.New("invalid withdraw proof: verification failed")
+// rebuildTree recomputes the Merkle tree from CmList and checks it against the persisted root history.
+// Ledgers written before the tree existed are accepted and get a fresh tree of the default depth.
+func (l *Ledger) rebuildTree() error {
+	persisted := l.Tree
+	depth := MerkleTreeDepth
+	if persisted != nil && persisted.Depth > 0 {
+		depth = persisted.Depth
 	}
+	cms := l.CmList
+	l.Tree = NewMerkleTree(depth)
+	l.CmList = make([]string, 0, len(cms))
+	for _, cm := range cms {
+		if err := l.appendCommitment(cm); err != nil {
+			return fmt.Errorf("rebuilding merkle tree: %w", err)
+		}
+	}
+	if persisted != nil && len(persisted.RootHistory) > 0 {
+		if persisted.NumLeaves != l.Tree.NumLeaves {
+			return fmt.Errorf("merkle tree has %d leaves, ledger has %d commitments", persisted.NumLeaves, l.Tree.NumLeaves)
+		}
+		if persisted.RootHistory[len(persisted.RootHistory)-1] != l.Tree.RootString() {
+			return errors.New("merkle root does not match ledger commitments")
+		}
+	}
+	return nil
+}
 
-	// 4. Append tx to ledger
+// AppendWithdrawTx records a verified withdrawal (Algorithm 4) in the ledger: the serial number
+// of the registered note and the commitment of the output note, as for a transaction.
+// Returns an error if the anchor is not a recent root, or if the serial number is already
+// present, e.g. when the note was settled by an exchange.
+func (l *Ledger) AppendWithdrawTx(tx *WithdrawTx) error {
+	if tx.Anchor == nil || tx.SnIn == nil || tx.CmOut == nil {
+		return errors.New("withdrawal has no anchor, serial number or commitment")
+	}
+	if !l.Tree.IsKnownRoot(tx.Anchor.String()) {
+		return errors.New("unknown anchor: not a recent ledger merkle root")
+	}
+	sn := tx.SnIn.String()
+	if l.HasSerialNumber(sn) {
+		return errors.New("double-spend detected: serial number already in ledger")
+	}
+	if err := l.appendCommitment(tx.CmOut.String()); err != nil {
+		return err
+	}
+	l.SnList = append(l.SnList, sn)
 	l.WithdrawTxs = append(l.WithdrawTxs, tx)
 	return nil
 }
 
+// HasValidExchange reports whether an exchange has been settled in the ledger.
+// Exchanges are only appended once their proof verifies (see exchange.SettleExchange).
 func (l *Ledger) HasValidExchange() bool {
-	// For now, assume if there is at least one valid exchange tx, return true
-	// In production, verify the proof for the last exchange tx
-	return len(l.TxList) > 0 // Replace with actual proof verification if needed
+	return len(l.ExchangeTxs) > 0
 }
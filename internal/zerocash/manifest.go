@@ -0,0 +1,195 @@
+// manifest.go - Versioned manifest binding key files to the circuit they were generated for.
+//
+// SetupOrLoadKeys writes a manifest next to the proving key recording the circuit ID, the number of
+// slots of a batch or exchange circuit, the value width it was compiled for, a hash of the compiled
+// constraint system, the curve, the backend and the SHA-256 digests of both key files.
+// On load the manifest is checked against the current circuit and the files on disk, so stale or
+// modified keys are reported instead of producing proofs that fail verification.
+
+package zerocash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/constraint"
+)
+
+// KeyManifestVersion is the current version of the key manifest format.
+const KeyManifestVersion = 3
+
+// KeyManifest describes a proving/verifying key pair and the circuit it belongs to.
+type KeyManifest struct {
+	Version   int       `json:"version"`
+	CircuitID CircuitID `json:"circuit_id"`
+	Size      int       `json:"size,omitempty"` // Slots of a sized circuit (see CircuitSize)
+	ValueBits int       `json:"value_bits"`     // Width of coins, energy and bids (see Params.ValueBits)
+	CCSHash   string    `json:"ccs_hash"`       // SHA-256 of the serialized constraint system
+	Curve     string    `json:"curve"`
+	Backend   string    `json:"backend"`
+	PKSHA256  string    `json:"pk_sha256"`
+	VKSHA256  string    `json:"vk_sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyManifestMismatchError reports a manifest field that does not match the current circuit or key files.
+type KeyManifestMismatchError struct {
+	CircuitID CircuitID
+	Field     string
+	Manifest  string // Value recorded in the manifest
+	Current   string // Value of the current circuit or key file
+}
+
+func (e *KeyManifestMismatchError) Error() string {
+	return fmt.Sprintf("key manifest mismatch for circuit %q: %s is %s in the manifest but %s now; regenerate the keys with RotateKeys",
+		e.CircuitID, e.Field, e.Manifest, e.Current)
+}
+
+// ErrKeyManifestMissing is returned when key files exist without a manifest (or only one key file exists).
+var ErrKeyManifestMissing = errors.New("key files without a matching manifest; regenerate the keys with RotateKeys")
+
+// KeyManifestPath returns the path of the manifest describing the keys at pkPath.
+func KeyManifestPath(pkPath string) string {
+	return pkPath + ".manifest.json"
+}
+
+// NewKeyManifest builds the manifest of the key files at pkPath and vkPath for a circuit compiled
+// for valueBits-bit values.
+func NewKeyManifest(id CircuitID, valueBits int, ccs constraint.ConstraintSystem, pkPath, vkPath string) (*KeyManifest, error) {
+	ccsHash, err := ConstraintSystemHash(ccs)
+	if err != nil {
+		return nil, err
+	}
+	backendID, err := CCSBackend(ccs)
+	if err != nil {
+		return nil, err
+	}
+	pkHash, err := fileSHA256(pkPath)
+	if err != nil {
+		return nil, err
+	}
+	vkHash, err := fileSHA256(vkPath)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyManifest{
+		Version:   KeyManifestVersion,
+		CircuitID: id,
+		Size:      CircuitSize(id),
+		ValueBits: valueBits,
+		CCSHash:   ccsHash,
+		Curve:     ecc.BW6_761.String(),
+		Backend:   string(backendID),
+		PKSHA256:  pkHash,
+		VKSHA256:  vkHash,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// Check compares the manifest with the current circuit and the key files on disk.
+// Returns a *KeyManifestMismatchError for the first field that differs.
+func (m *KeyManifest) Check(id CircuitID, valueBits int, ccs constraint.ConstraintSystem, pkPath, vkPath string) error {
+	current, err := NewKeyManifest(id, valueBits, ccs, pkPath, vkPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		field             string
+		manifest, current string
+	}{
+		{"version", fmt.Sprint(m.Version), fmt.Sprint(current.Version)},
+		{"circuit_id", string(m.CircuitID), string(current.CircuitID)},
+		{"size", fmt.Sprint(m.Size), fmt.Sprint(current.Size)},
+		{"value_bits", fmt.Sprint(m.ValueBits), fmt.Sprint(current.ValueBits)},
+		{"ccs_hash", m.CCSHash, current.CCSHash},
+		{"curve", m.Curve, current.Curve},
+		{"backend", m.Backend, current.Backend},
+		{"pk_sha256", m.PKSHA256, current.PKSHA256},
+		{"vk_sha256", m.VKSHA256, current.VKSHA256},
+	} {
+		if f.manifest != f.current {
+			return &KeyManifestMismatchError{CircuitID: id, Field: f.field, Manifest: f.manifest, Current: f.current}
+		}
+	}
+	return nil
+}
+
+// Save writes the manifest as JSON.
+func (m *KeyManifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadKeyManifest reads a manifest from disk.
+func LoadKeyManifest(path string) (*KeyManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m KeyManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid key manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// ConstraintSystemHash returns the hex SHA-256 of the serialized constraint system.
+func ConstraintSystemHash(ccs constraint.ConstraintSystem) (string, error) {
+	h := sha256.New()
+	if _, err := ccs.WriteTo(h); err != nil {
+		return "", fmt.Errorf("hashing constraint system: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RotateKeys runs a new setup for the circuit, overwrites the key files and writes a new manifest.
+func RotateKeys(id CircuitID, valueBits int, ccs constraint.ConstraintSystem, pkPath, vkPath string) (ProvingKey, VerifyingKey, error) {
+	pk, vk, err := SetupKeys(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := SaveProvingKey(pkPath, pk); err != nil {
+		return nil, nil, err
+	}
+	if err := SaveVerifyingKey(vkPath, vk); err != nil {
+		return nil, nil, err
+	}
+	manifest, err := NewKeyManifest(id, valueBits, ccs, pkPath, vkPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := manifest.Save(KeyManifestPath(pkPath)); err != nil {
+		return nil, nil, err
+	}
+	return pk, vk, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's contents.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileExists reports whether path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
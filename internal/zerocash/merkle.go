@@ -0,0 +1,185 @@
+// merkle.go - Incremental Merkle tree over note commitments for the zerocash protocol.
+//
+// The tree is append-only and hashes with the same MiMC instance as Commitment, so that
+// membership of a commitment can later be proven in a circuit without revealing the leaf.
+// Only the root history is persisted; the nodes are rebuilt from the ledger's CmList.
+
+package zerocash
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
+)
+
+const (
+	// MerkleTreeDepth is the number of levels between the leaves and the root.
+	// The ledger can hold up to 2^MerkleTreeDepth commitments.
+	MerkleTreeDepth = 20
+
+	// MerkleRootHistorySize is the number of recent roots kept as valid anchors.
+	MerkleRootHistorySize = 100
+)
+
+// MerkleTree is an append-only Merkle tree of note commitments.
+// Empty leaves are zero; each internal node is MiMC(left || right).
+type MerkleTree struct {
+	Depth       int      // Number of levels below the root
+	NumLeaves   int      // Number of commitments appended so far
+	RootHistory []string // Most recent roots (decimal), oldest first; the last entry is the current root
+
+	levels [][][]byte // levels[h] holds the populated nodes at height h (levels[0] are the leaves)
+	zeros  [][]byte   // zeros[h] is the root of an empty subtree of height h
+}
+
+// MerklePath is an authentication path from a leaf to the root it was computed against.
+type MerklePath struct {
+	Index    int      // Leaf position; bit h selects whether the node at height h is a right child
+	Leaf     []byte   // The commitment at Index
+	Siblings [][]byte // Sibling hashes from the leaf level up to (excluding) the root
+	Root     []byte   // Root of the tree when the path was produced
+}
+
+// NewMerkleTree creates an empty tree of the given depth.
+func NewMerkleTree(depth int) *MerkleTree {
+	t := &MerkleTree{
+		Depth:  depth,
+		levels: make([][][]byte, depth+1),
+		zeros:  make([][]byte, depth+1),
+	}
+	t.zeros[0] = make([]byte, mimcNative.BlockSize)
+	for h := 1; h <= depth; h++ {
+		t.zeros[h] = hashMerkleNode(t.zeros[h-1], t.zeros[h-1])
+	}
+	t.RootHistory = []string{new(big.Int).SetBytes(t.zeros[depth]).String()}
+	return t
+}
+
+// Append inserts a commitment as the next leaf and records the new root.
+// Returns the index of the inserted leaf.
+func (t *MerkleTree) Append(leaf []byte) (int, error) {
+	if t.NumLeaves >= 1<<t.Depth {
+		return 0, errors.New("merkle tree is full")
+	}
+	if len(leaf) > mimcNative.BlockSize {
+		return 0, fmt.Errorf("merkle leaf too long: %d bytes", len(leaf))
+	}
+	index := t.NumLeaves
+	node := leftPad(leaf)
+	t.levels[0] = append(t.levels[0], node)
+	pos := index
+	for h := 0; h < t.Depth; h++ {
+		var left, right []byte
+		if pos%2 == 0 {
+			left, right = node, t.nodeAt(h, pos+1)
+		} else {
+			left, right = t.nodeAt(h, pos-1), node
+		}
+		node = hashMerkleNode(left, right)
+		pos /= 2
+		if pos < len(t.levels[h+1]) {
+			t.levels[h+1][pos] = node
+		} else {
+			t.levels[h+1] = append(t.levels[h+1], node)
+		}
+	}
+	t.NumLeaves++
+	t.RootHistory = append(t.RootHistory, new(big.Int).SetBytes(node).String())
+	if len(t.RootHistory) > MerkleRootHistorySize {
+		t.RootHistory = t.RootHistory[len(t.RootHistory)-MerkleRootHistorySize:]
+	}
+	return index, nil
+}
+
+// Root returns the current root of the tree.
+func (t *MerkleTree) Root() []byte {
+	if t.NumLeaves == 0 {
+		return t.zeros[t.Depth]
+	}
+	return t.levels[t.Depth][0]
+}
+
+// RootString returns the current root as a decimal string, the format used for ledger entries.
+func (t *MerkleTree) RootString() string {
+	return new(big.Int).SetBytes(t.Root()).String()
+}
+
+// RecentRoots returns the bounded history of roots, oldest first.
+func (t *MerkleTree) RecentRoots() []string {
+	roots := make([]string, len(t.RootHistory))
+	copy(roots, t.RootHistory)
+	return roots
+}
+
+// IsKnownRoot returns true if root is one of the recent roots of the tree.
+func (t *MerkleTree) IsKnownRoot(root string) bool {
+	for _, r := range t.RootHistory {
+		if r == root {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the authentication path of the leaf at index against the current root.
+func (t *MerkleTree) Path(index int) (*MerklePath, error) {
+	if index < 0 || index >= t.NumLeaves {
+		return nil, fmt.Errorf("invalid leaf index: %d", index)
+	}
+	siblings := make([][]byte, t.Depth)
+	pos := index
+	for h := 0; h < t.Depth; h++ {
+		siblings[h] = t.nodeAt(h, pos^1)
+		pos /= 2
+	}
+	return &MerklePath{
+		Index:    index,
+		Leaf:     t.levels[0][index],
+		Siblings: siblings,
+		Root:     t.Root(),
+	}, nil
+}
+
+// ComputeRoot recomputes the root from the leaf and its siblings.
+func (p *MerklePath) ComputeRoot() []byte {
+	node := leftPad(p.Leaf)
+	for h, sibling := range p.Siblings {
+		if (p.Index>>h)&1 == 0 {
+			node = hashMerkleNode(node, sibling)
+		} else {
+			node = hashMerkleNode(sibling, node)
+		}
+	}
+	return node
+}
+
+// Verify returns true if the path leads from its leaf to its root.
+func (p *MerklePath) Verify() bool {
+	return new(big.Int).SetBytes(p.ComputeRoot()).Cmp(new(big.Int).SetBytes(p.Root)) == 0
+}
+
+// nodeAt returns the node at the given height and position, or the empty subtree root if unset.
+func (t *MerkleTree) nodeAt(h, pos int) []byte {
+	if pos < len(t.levels[h]) {
+		return t.levels[h][pos]
+	}
+	return t.zeros[h]
+}
+
+// hashMerkleNode computes MiMC(left || right).
+func hashMerkleNode(left, right []byte) []byte {
+	h := mimcNative.NewMiMC()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// leftPad returns a copy of b left-padded with zeros to the MiMC block size.
+// An empty slice becomes the zero element instead of being skipped by the hasher.
+func leftPad(b []byte) []byte {
+	out := make([]byte, max(len(b), mimcNative.BlockSize))
+	copy(out[len(out)-len(b):], b)
+	return out
+}
@@ -20,8 +20,11 @@ type Note struct {
 // NewNote creates a new note with the given coins, energy, and secret key.
 // The note is randomized and committed using MiMC following paper spec: cm = Com(Γ || pk || ρ, r).
 func NewNote(coins, energy *big.Int, sk []byte) *Note {
-	rho := randomBytes(32)
-	rand := randomBytes(32)
+	return newNoteWithOpening(coins, energy, sk, randomBytes(32), randomBytes(32))
+}
+
+// newNoteWithOpening creates a note with the given ρ and r instead of random ones.
+func newNoteWithOpening(coins, energy *big.Int, sk, rho, rand []byte) *Note {
 	pk := mimcHash(sk)
 	// Commitment follows paper: cm = Com(Γ || pk || ρ, r)
 	cm := Commitment(coins, energy, pk, new(big.Int).SetBytes(rho), new(big.Int).SetBytes(rand))
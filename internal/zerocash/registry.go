@@ -0,0 +1,330 @@
+// registry.go - Process-wide registry of compiled circuits and their keys.
+//
+// Each circuit type is compiled at most once per process, backend and value width (Params.ValueBits),
+// and the result is shared by every code path that proves or verifies it (CreateTx, VerifyTx,
+// Register, the exchange phase, Withdraw and Participant). Keys are stored per backend and width.
+// Circuits defined outside this package register themselves in init().
+//
+// The batch and exchange circuits are generic over their number of slots N and registered once per
+// size in SupportedSizes, each under its own ID (BatchCircuitID, ExchangeCircuitID) with its own
+// keys and manifest. A batch or auction of n uses the smallest size that fits (FittingSize).
+
+package zerocash
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+)
+
+// CircuitID identifies a circuit type in the registry.
+type CircuitID string
+
+const (
+	CircuitTxID          CircuitID = "tx"           // CircuitTx (Algorithm 1)
+	CircuitTx10ID        CircuitID = "tx10"         // CircuitTxN for N=10 (batched Algorithm 1)
+	CircuitRegisterID    CircuitID = "register"     // register.CircuitTxRegister (Algorithm 2)
+	CircuitExchangeF10ID CircuitID = "exchange_f10" // exchange.CircuitTxF for N=10 (Algorithm 3)
+	CircuitWithdrawID    CircuitID = "withdraw"     // withdraw.CircuitWithdraw (Algorithm 4)
+)
+
+// SupportedSizes are the slot counts the batch and exchange circuits are registered for, ascending.
+var SupportedSizes = []int{5, 10, 20, 40, 60}
+
+// MaxSize is the largest supported batch or auction.
+func MaxSize() int {
+	return SupportedSizes[len(SupportedSizes)-1]
+}
+
+// FittingSize returns the smallest supported size holding n slots.
+func FittingSize(n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive, got %d", n)
+	}
+	for _, size := range SupportedSizes {
+		if size >= n {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("%d slots exceed the largest supported size %d", n, MaxSize())
+}
+
+// BatchCircuitID returns the ID of the batch circuit (CircuitTxN) with n slots.
+func BatchCircuitID(n int) CircuitID {
+	return CircuitID(fmt.Sprintf("tx%d", n))
+}
+
+// ExchangeCircuitID returns the ID of the exchange circuit (exchange.CircuitTxF) for n participants.
+func ExchangeCircuitID(n int) CircuitID {
+	return CircuitID(fmt.Sprintf("exchange_f%d", n))
+}
+
+// circuitEntry holds a registered circuit and, per backend and value width, its compiled
+// constraint system and keys.
+type circuitEntry struct {
+	newCircuit func(valueBits int) frontend.Circuit
+	size       int // Number of slots of a sized circuit, 0 otherwise
+
+	mu       sync.Mutex
+	variants map[circuitVariant]*variantEntry
+}
+
+// circuitVariant selects one compilation of a registered circuit.
+type circuitVariant struct {
+	backend   BackendID
+	valueBits int
+}
+
+// variantEntry holds a circuit compiled for one backend and value width, and its keys.
+type variantEntry struct {
+	once sync.Once
+	ccs  constraint.ConstraintSystem
+	err  error
+
+	mu sync.RWMutex
+	pk ProvingKey
+	vk VerifyingKey
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[CircuitID]*circuitEntry{}
+)
+
+func init() {
+	RegisterCircuit(CircuitTxID, func(valueBits int) frontend.Circuit { return &CircuitTx{ValueBits: valueBits} })
+	for _, n := range SupportedSizes {
+		n := n
+		RegisterSizedCircuit(BatchCircuitID(n), n, func(valueBits int) frontend.Circuit {
+			c := NewCircuitTxN(n)
+			c.ValueBits = valueBits
+			return c
+		})
+	}
+}
+
+// RegisterCircuit adds a circuit type to the registry. newCircuit must return an empty circuit
+// checking values of valueBits bits, suitable for compilation. Registering the same ID twice panics.
+func RegisterCircuit(id CircuitID, newCircuit func(valueBits int) frontend.Circuit) {
+	RegisterSizedCircuit(id, 0, newCircuit)
+}
+
+// RegisterSizedCircuit registers the instance of a circuit generic over N with size slots.
+// The size is recorded in the key manifest.
+func RegisterSizedCircuit(id CircuitID, size int, newCircuit func(valueBits int) frontend.Circuit) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[id]; ok {
+		panic(fmt.Sprintf("circuit %q registered twice", id))
+	}
+	registry[id] = &circuitEntry{newCircuit: newCircuit, size: size, variants: map[circuitVariant]*variantEntry{}}
+}
+
+// CircuitSize returns the number of slots of a registered sized circuit, or 0 for other circuits.
+func CircuitSize(id CircuitID) int {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if e, ok := registry[id]; ok {
+		return e.size
+	}
+	return 0
+}
+
+// RegisteredCircuits returns the IDs of all registered circuits, sorted.
+func RegisteredCircuits() []CircuitID {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	ids := make([]CircuitID, 0, len(registry))
+	for id := range registry {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func lookupCircuit(id CircuitID, backendID BackendID, valueBits int) (*circuitEntry, *variantEntry, error) {
+	if _, err := GetBackend(backendID); err != nil {
+		return nil, nil, err
+	}
+	if err := checkValueBits(valueBits); err != nil {
+		return nil, nil, fmt.Errorf("circuit %q: %w", id, err)
+	}
+	registryMu.RLock()
+	e, ok := registry[id]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown circuit %q", id)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	variant := circuitVariant{backend: backendID, valueBits: valueBits}
+	b, ok := e.variants[variant]
+	if !ok {
+		b = &variantEntry{}
+		e.variants[variant] = b
+	}
+	return e, b, nil
+}
+
+// CompiledCircuit returns the Groth16 constraint system of a registered circuit for DefaultValueBits,
+// compiling it on first use.
+func CompiledCircuit(id CircuitID) (constraint.ConstraintSystem, error) {
+	return CompiledCircuitFor(id, BackendGroth16, DefaultValueBits)
+}
+
+// CompiledCircuitFor returns the constraint system of a registered circuit for a backend and
+// value width (see Params.MaxValueBits), compiling it on first use.
+func CompiledCircuitFor(id CircuitID, backendID BackendID, valueBits int) (constraint.ConstraintSystem, error) {
+	e, b, err := lookupCircuit(id, backendID, valueBits)
+	if err != nil {
+		return nil, err
+	}
+	b.once.Do(func() {
+		backend, _ := GetBackend(backendID)
+		b.ccs, b.err = backend.Compile(e.newCircuit(valueBits))
+		if b.err != nil {
+			b.err = fmt.Errorf("compiling circuit %q for %s (%d-bit values): %w", id, backendID, valueBits, b.err)
+		}
+	})
+	return b.ccs, b.err
+}
+
+// SetCircuitKeys stores the proving and verifying keys of a registered circuit under their backend
+// and the value width they were generated for. Either key may be nil (e.g. a verifier-only node).
+func SetCircuitKeys(id CircuitID, valueBits int, pk ProvingKey, vk VerifyingKey) error {
+	var backendID BackendID
+	for _, key := range []any{pk, vk} {
+		if key == nil {
+			continue
+		}
+		keyID, err := KeyBackend(key)
+		if err != nil {
+			return err
+		}
+		if backendID != "" && keyID != backendID {
+			return fmt.Errorf("circuit %q: proving key is for %s but verifying key is for %s", id, backendID, keyID)
+		}
+		backendID = keyID
+	}
+	if backendID == "" {
+		return fmt.Errorf("circuit %q: no keys given", id)
+	}
+	_, b, err := lookupCircuit(id, backendID, valueBits)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pk, b.vk = pk, vk
+	return nil
+}
+
+// CircuitKeys returns the keys stored for a registered circuit, backend and value width (nil if not set).
+func CircuitKeys(id CircuitID, backendID BackendID, valueBits int) (ProvingKey, VerifyingKey, error) {
+	_, b, err := lookupCircuit(id, backendID, valueBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.pk, b.vk, nil
+}
+
+// LoadCircuitKeys compiles a registered circuit for a backend and value width (once), loads or
+// generates its keys with SetupOrLoadKeys, and stores them in the registry.
+func LoadCircuitKeys(id CircuitID, backendID BackendID, valueBits int, pkPath, vkPath string) (ProvingKey, VerifyingKey, error) {
+	return registerCircuitKeys(id, backendID, valueBits, pkPath, vkPath, SetupOrLoadKeys)
+}
+
+// LoadSizedCircuitKeys runs LoadCircuitKeys for every supported size of a circuit family, with
+// the keys of size n in dir/<idFor(n)>.pk and .vk.
+func LoadSizedCircuitKeys(idFor func(n int) CircuitID, backendID BackendID, valueBits int, dir string) error {
+	for _, n := range SupportedSizes {
+		id := idFor(n)
+		base := filepath.Join(dir, string(id))
+		if _, _, err := LoadCircuitKeys(id, backendID, valueBits, base+".pk", base+".vk"); err != nil {
+			return fmt.Errorf("circuit %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// RotateCircuitKeys regenerates the keys of a registered circuit with RotateKeys, writes a new
+// manifest, and stores the new keys in the registry.
+func RotateCircuitKeys(id CircuitID, backendID BackendID, valueBits int, pkPath, vkPath string) (ProvingKey, VerifyingKey, error) {
+	return registerCircuitKeys(id, backendID, valueBits, pkPath, vkPath, RotateKeys)
+}
+
+func registerCircuitKeys(id CircuitID, backendID BackendID, valueBits int, pkPath, vkPath string,
+	keys func(CircuitID, int, constraint.ConstraintSystem, string, string) (ProvingKey, VerifyingKey, error),
+) (ProvingKey, VerifyingKey, error) {
+	ccs, err := CompiledCircuitFor(id, backendID, valueBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk, vk, err := keys(id, valueBits, ccs, pkPath, vkPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := SetCircuitKeys(id, valueBits, pk, vk); err != nil {
+		return nil, nil, err
+	}
+	return pk, vk, nil
+}
+
+// ResolveProver fills a nil constraint system or proving key from the registry for the given backend
+// and value width. A constraint system or key given explicitly must belong to that backend.
+func ResolveProver(id CircuitID, backendID BackendID, valueBits int, ccs constraint.ConstraintSystem, pk ProvingKey) (constraint.ConstraintSystem, ProvingKey, error) {
+	if ccs == nil {
+		var err error
+		if ccs, err = CompiledCircuitFor(id, backendID, valueBits); err != nil {
+			return nil, nil, err
+		}
+	} else if ccsID, err := CCSBackend(ccs); err != nil {
+		return nil, nil, err
+	} else if ccsID != backendID {
+		return nil, nil, fmt.Errorf("circuit %q: constraint system is for %s but params select %s", id, ccsID, backendID)
+	}
+	if pk == nil {
+		registered, _, err := CircuitKeys(id, backendID, valueBits)
+		if err != nil {
+			return nil, nil, err
+		}
+		if registered == nil {
+			return nil, nil, fmt.Errorf("no %s proving key for circuit %q with %d-bit values", backendID, id, valueBits)
+		}
+		pk = registered
+	} else if keyID, err := KeyBackend(pk); err != nil {
+		return nil, nil, err
+	} else if keyID != backendID {
+		return nil, nil, fmt.Errorf("circuit %q: proving key is for %s but params select %s", id, keyID, backendID)
+	}
+	return ccs, pk, nil
+}
+
+// ResolveVerifyingKey returns vk after checking its backend, or the registry's verifying key for the
+// circuit, backend and value width if vk is nil.
+func ResolveVerifyingKey(id CircuitID, backendID BackendID, valueBits int, vk VerifyingKey) (VerifyingKey, error) {
+	if vk != nil {
+		keyID, err := KeyBackend(vk)
+		if err != nil {
+			return nil, err
+		}
+		if keyID != backendID {
+			return nil, fmt.Errorf("circuit %q: verifying key is for %s but the proof is %s", id, keyID, backendID)
+		}
+		return vk, nil
+	}
+	_, registered, err := CircuitKeys(id, backendID, valueBits)
+	if err != nil {
+		return nil, err
+	}
+	if registered == nil {
+		return nil, fmt.Errorf("no %s verifying key for circuit %q with %d-bit values", backendID, id, valueBits)
+	}
+	return registered, nil
+}
@@ -0,0 +1,342 @@
+// scan.go - Wallet ledger scanner: trial decryption of new notes and spend detection.
+//
+// A wallet does not need to be told about the notes sent to it: every output ciphertext in the
+// ledger is encrypted to its recipient's DH key (CNewCircuit, with G_r published next to it), so
+// the wallet trial-decrypts each one with its own key. The outputs of a settled exchange are
+// encrypted to the DH key of each registration instead, and are decrypted with the r_enc of the
+// wallet's registrations. A withdrawal publishes no ciphertext: its output is recognized by
+// comparing its commitment with the withdraw output note of each registration of the wallet
+// (see Wallet.GetWithdrawOutputNote), whose opening seed wallets derive from the seed. Spends are detected by recomputing the serial numbers of the wallet's
+// unspent notes. The scan resumes from a checkpoint saved in the wallet file, so only entries
+// appended since the previous scan are visited.
+
+package zerocash
+
+import (
+	"fmt"
+	"math/big"
+
+	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	bls12377_fr "github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
+	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
+)
+
+// ScanCheckpoint records how many entries of each ledger list a wallet has already scanned.
+type ScanCheckpoint struct {
+	Txs        int `json:"txs"`
+	JoinSplits int `json:"joinsplits"`
+	Batches    int `json:"batches"`
+	Withdraws  int `json:"withdraws"`
+	Exchanges  int `json:"exchanges"`
+}
+
+// ScanResult lists the changes made to a wallet by one ScanLedger call.
+type ScanResult struct {
+	Received []*Note // Notes recognized and added to the wallet
+	Spent    []*Note // Wallet notes whose serial number appeared in the ledger
+}
+
+// ScanLedger scans the ledger entries appended since the wallet's checkpoint.
+// Each output ciphertext is trial-decrypted with the wallet's DH key; a note is added when its
+// pkOwner belongs to one of the wallet's note keys (see noteKeysByPk), with that key as its secret key.
+// The output of a withdrawal of a registered note is added under sk^out. Unspent notes whose serial number appears in a scanned entry are
+// marked as spent. The checkpoint is advanced to the end of the ledger; save the wallet to keep it.
+// Returns an error if the ledger has fewer entries than the checkpoint (e.g. another ledger).
+func (w *Wallet) ScanLedger(ledger *Ledger) (*ScanResult, error) {
+	cp := w.Checkpoint
+	if cp.Txs > len(ledger.TxList) || cp.JoinSplits > len(ledger.JoinSplitTxs) ||
+		cp.Batches > len(ledger.BatchTxs) || cp.Withdraws > len(ledger.WithdrawTxs) || cp.Exchanges > len(ledger.ExchangeTxs) {
+		return nil, fmt.Errorf("ledger is behind the wallet checkpoint %+v", cp)
+	}
+
+	result := &ScanResult{}
+	keys := w.noteKeysByPk()
+	var spent []string
+	for _, tx := range ledger.TxList[cp.Txs:] {
+		spent = append(spent, tx.SnOld)
+		if note, key := w.trialDecrypt(tx.CNewCircuit, tx.G_r, keys); note != nil {
+			w.addScannedNote(note, key)
+			result.Received = append(result.Received, note)
+		}
+	}
+	for _, tx := range ledger.JoinSplitTxs[cp.JoinSplits:] {
+		spent = append(spent, tx.SnOld...)
+		for j := range tx.CNewCircuit {
+			if j >= len(tx.G_r) {
+				break
+			}
+			if note, key := w.trialDecrypt(tx.CNewCircuit[j], tx.G_r[j], keys); note != nil {
+				w.addScannedNote(note, key)
+				result.Received = append(result.Received, note)
+			}
+		}
+	}
+	for _, tx := range ledger.BatchTxs[cp.Batches:] {
+		spent = append(spent, tx.SnOld...)
+		for j := range tx.CNewCircuit {
+			if j >= len(tx.G_r) {
+				break
+			}
+			if note, key := w.trialDecrypt(tx.CNewCircuit[j], tx.G_r[j], keys); note != nil {
+				w.addScannedNote(note, key)
+				result.Received = append(result.Received, note)
+			}
+		}
+	}
+	if exchanges := ledger.ExchangeTxs[cp.Exchanges:]; len(exchanges) > 0 {
+		recipients := w.registrationKeys()
+		for _, tx := range exchanges {
+			spent = append(spent, tx.SnIn...)
+			for j := range tx.CNew {
+				if j >= len(tx.G_r) || j >= len(tx.G_s) {
+					break
+				}
+				if note, key := w.decryptExchangeOutput(tx.CNew[j], tx.G_r[j], tx.G_s[j], recipients, keys); note != nil {
+					w.addScannedNote(note, key)
+					result.Received = append(result.Received, note)
+				}
+			}
+		}
+	}
+	if withdraws := ledger.WithdrawTxs[cp.Withdraws:]; len(withdraws) > 0 {
+		outputs := w.withdrawOutputs()
+		for _, tx := range withdraws {
+			if tx.SnIn != nil {
+				spent = append(spent, tx.SnIn.String())
+			}
+			if tx.CmOut == nil {
+				continue
+			}
+			if out, ok := outputs[tx.CmOut.String()]; ok && !w.hasNote(out.note) {
+				w.addScannedNote(out.note, out.key)
+				result.Received = append(result.Received, out.note)
+			}
+		}
+	}
+
+	// Notes received in this scan may already be spent by a later entry
+	if len(spent) > 0 {
+		serials := make(map[string]bool, len(spent))
+		for _, sn := range spent {
+			serials[sn] = true
+		}
+		for i, note := range w.Notes {
+			nk := w.nullifierKey(i)
+			if w.Spent[i] || nk == nil {
+				continue
+			}
+			sn := new(big.Int).SetBytes(SerialNumberFromNullifierKey(nk, note.Rho)).String()
+			if serials[sn] {
+				w.Spent[i] = true
+				result.Spent = append(result.Spent, note)
+			}
+		}
+	}
+
+	w.Checkpoint = ScanCheckpoint{
+		Txs:        len(ledger.TxList),
+		JoinSplits: len(ledger.JoinSplitTxs),
+		Batches:    len(ledger.BatchTxs),
+		Withdraws:  len(ledger.WithdrawTxs),
+		Exchanges:  len(ledger.ExchangeTxs),
+	}
+	return result, nil
+}
+
+// scanKey is a note secret key the scanner recognizes notes for.
+type scanKey struct {
+	sk []byte
+	// For keys of the seed hierarchy: derivation index + 1, and whether it is an auction sk^in
+	// or sk^out
+	index   uint32
+	auction bool
+	output  bool
+}
+
+// noteKeysByPk maps the decimal pk of each note key the wallet holds to that key: the spend key,
+// the keys of known notes, the sk^out of its registrations and, for seed wallets, derived note,
+// sk^in and sk^out keys up to KeyLookahead past the last used ones. Watch-only wallets hold no keys.
+func (w *Wallet) noteKeysByPk() map[string]scanKey {
+	keys := make(map[string]scanKey)
+	add := func(k scanKey) {
+		if len(k.sk) > 0 {
+			keys[MimcHashPublic(k.sk).String()] = k
+		}
+	}
+	add(scanKey{sk: w.SpendKey()})
+	for _, sk := range w.NoteKeys {
+		add(scanKey{sk: sk})
+	}
+	for _, reg := range w.Registrations {
+		if reg != nil {
+			add(scanKey{sk: reg.SkOut})
+		}
+	}
+	if chain, err := w.KeyChain(); err == nil {
+		for i := uint32(0); i < w.NextNoteKey+KeyLookahead; i++ {
+			add(scanKey{sk: chain.NoteKey(i), index: i + 1})
+		}
+		for i := uint32(0); i < w.NextAuction+KeyLookahead; i++ {
+			skIn, skOut, _ := chain.AuctionKeys(i)
+			b, out := skIn.Bytes(), skOut.Bytes()
+			add(scanKey{sk: b[:], index: i + 1, auction: true})
+			add(scanKey{sk: out[:], index: i + 1, output: true})
+		}
+	}
+	return keys
+}
+
+// addScannedNote adds a recognized note under its key. Derived keys past the wallet's counters
+// advance them; a note owned by a derived sk^in is the tx^in note of a registration, whose
+// derivable secrets are restored (the bid and C^Aux are not in the ledger). A note owned by an
+// sk^out is an exchange output and is spent like any other note.
+func (w *Wallet) addScannedNote(note *Note, key scanKey) {
+	var reg *RegistrationRecord
+	switch {
+	case key.auction:
+		if key.index > w.NextAuction {
+			w.NextAuction = key.index
+		}
+		chain, _ := w.KeyChain()
+		index := key.index - 1
+		_, skOut, rEnc := chain.AuctionKeys(index)
+		skOutBytes, rEncBytes := skOut.Bytes(), rEnc.Bytes()
+		reg = &RegistrationRecord{Index: &index, SkIn: key.sk, SkOut: skOutBytes[:], REnc: rEncBytes[:], NoteIn: note}
+	case key.output:
+		if key.index > w.NextAuction {
+			w.NextAuction = key.index
+		}
+	case key.index > w.NextNoteKey:
+		w.NextNoteKey = key.index
+	}
+	w.AddNote(note, key.sk, reg, nil)
+}
+
+// trialDecrypt decrypts one output ciphertext with the wallet's DH key.
+// Returns the note and its key if it is addressed to one of keys and not already in the wallet;
+// a watch-only wallet, which has no keys, takes every note that decrypts to a valid opening.
+// Ciphertexts that are malformed or encrypted to someone else are skipped.
+func (w *Wallet) trialDecrypt(enc [6]string, g_r sw_bls12377.G1Affine, keys map[string]scanKey) (*Note, scanKey) {
+	if w.Sk == nil {
+		return nil, scanKey{}
+	}
+	ephemeral, err := fromGnarkPoint(g_r)
+	if err != nil {
+		return nil, scanKey{}
+	}
+	return w.openScanned(enc, ComputeDHShared(w.Sk, &ephemeral), keys)
+}
+
+// registrationKeys maps each DH key G^r a registration of the wallet may have used to its
+// secret r: the r_enc of its registration records and, for seed wallets, of the derived auction
+// keys up to KeyLookahead past the last used ones, and the wallet's own DH key.
+func (w *Wallet) registrationKeys() map[string]*bls12377_fr.Element {
+	_, _, g1, _ := bls12377.Generators()
+	keys := make(map[string]*bls12377_fr.Element)
+	add := func(r *bls12377_fr.Element) {
+		if r == nil || r.IsZero() {
+			return
+		}
+		var gr bls12377.G1Affine
+		gr.ScalarMultiplication(&g1, r.BigInt(new(big.Int)))
+		keys[pointKey(gr)] = r
+	}
+	if w.Sk != nil && w.Pk != nil {
+		keys[pointKey(*w.Pk)] = w.Sk
+	}
+	for _, reg := range w.Registrations {
+		if reg != nil && len(reg.REnc) > 0 {
+			add(new(bls12377_fr.Element).SetBytes(reg.REnc))
+		}
+	}
+	if chain, err := w.KeyChain(); err == nil {
+		for i := uint32(0); i < w.NextAuction+KeyLookahead; i++ {
+			_, _, rEnc := chain.AuctionKeys(i)
+			add(rEnc)
+		}
+	}
+	return keys
+}
+
+// withdrawOutput is the withdraw output note of a registration and its sk^out.
+type withdrawOutput struct {
+	note *Note
+	key  scanKey
+}
+
+// withdrawOutputs maps the decimal commitment of the withdraw output note of each registration
+// of the wallet to that note, owned by the registration's sk^out: the one kept in the wallet or,
+// for registrations with seed-derived keys, the one derived from the seed.
+func (w *Wallet) withdrawOutputs() map[string]withdrawOutput {
+	outputs := make(map[string]withdrawOutput)
+	for i, reg := range w.Registrations {
+		if reg == nil || len(reg.SkOut) == 0 {
+			continue
+		}
+		var note *Note
+		if i < len(w.WithdrawOutNote) {
+			note = w.WithdrawOutNote[i]
+		}
+		if note == nil {
+			note = w.derivedWithdrawOutput(i)
+		}
+		if note == nil {
+			continue
+		}
+		outputs[new(big.Int).SetBytes(note.Cm).String()] = withdrawOutput{note: note, key: scanKey{sk: reg.SkOut}}
+	}
+	return outputs
+}
+
+// pointKey identifies a point in the maps of registrationKeys.
+func pointKey(p bls12377.G1Affine) string {
+	return p.X.String() + "," + p.Y.String()
+}
+
+// decryptExchangeOutput decrypts one output of an exchange, encrypted to the shared key G_r^s
+// of a registration's DH key G_r. Returns the note and its key if G_r is one of recipients,
+// the note is addressed to one of keys and it is not already in the wallet.
+func (w *Wallet) decryptExchangeOutput(enc [6]string, g_r, g_s sw_bls12377.G1Affine,
+	recipients map[string]*bls12377_fr.Element, keys map[string]scanKey) (*Note, scanKey) {
+	recipient, err := fromGnarkPoint(g_r)
+	if err != nil {
+		return nil, scanKey{}
+	}
+	r, ok := recipients[pointKey(recipient)]
+	if !ok {
+		return nil, scanKey{}
+	}
+	ephemeral, err := fromGnarkPoint(g_s)
+	if err != nil {
+		return nil, scanKey{}
+	}
+	return w.openScanned(enc, ComputeDHShared(r, &ephemeral), keys)
+}
+
+// openScanned decrypts an output ciphertext with a shared key and opens the note, as trialDecrypt.
+func (w *Wallet) openScanned(enc [6]string, shared *bls12377.G1Affine, keys map[string]scanKey) (*Note, scanKey) {
+	fields, err := DecryptNoteWithSharedKey(enc, shared)
+	if err != nil {
+		return nil, scanKey{}
+	}
+	key, mine := keys[new(big.Int).SetBytes(fields[0]).String()]
+	if !mine && !w.WatchOnly {
+		return nil, scanKey{}
+	}
+	note, ok := openNote(fields)
+	if !ok || w.hasNote(note) {
+		return nil, scanKey{}
+	}
+	return note, key
+}
+
+// hasNote reports whether a note with the same commitment is already in the wallet.
+func (w *Wallet) hasNote(note *Note) bool {
+	cm := new(big.Int).SetBytes(note.Cm)
+	for _, known := range w.Notes {
+		if known != nil && new(big.Int).SetBytes(known.Cm).Cmp(cm) == 0 {
+			return true
+		}
+	}
+	return false
+}
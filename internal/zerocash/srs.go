@@ -0,0 +1,113 @@
+// srs.go - Shared KZG structured reference string for the PLONK backend.
+//
+// PLONK's setup is universal: every circuit's keys are derived from one KZG SRS, the powers of a
+// secret tau that nobody may know. The SRS is produced once, by a powers-of-tau ceremony, and
+// loaded with LoadKZGSRS; every PLONK setup in the process then reuses it, so the keys of all
+// circuits rest on the same trust assumption. NewUnsafeKZGSRS samples tau locally and exists for
+// tests only.
+
+package zerocash
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bw6761 "github.com/consensys/gnark-crypto/ecc/bw6-761/kzg"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/constraint"
+)
+
+// ErrNoKZGSRS is returned by a PLONK setup when no SRS has been loaded.
+var ErrNoKZGSRS = errors.New("no KZG SRS loaded: load a ceremony output with LoadKZGSRS")
+
+// kzgSRS is the SRS shared by every PLONK setup of the process.
+var kzgSRS struct {
+	sync.RWMutex
+	srs *kzg_bw6761.SRS
+}
+
+// SetKZGSRS makes srs the SRS of every subsequent PLONK setup. A nil srs unloads it.
+func SetKZGSRS(srs *kzg_bw6761.SRS) error {
+	if srs != nil && len(srs.Pk.G1) < 2 {
+		return fmt.Errorf("KZG SRS has %d G1 points, need at least 2", len(srs.Pk.G1))
+	}
+	kzgSRS.Lock()
+	defer kzgSRS.Unlock()
+	kzgSRS.srs = srs
+	return nil
+}
+
+// LoadKZGSRS reads a KZG SRS in canonical form (as written by SaveKZGSRS or a ceremony
+// coordinator) and makes it the SRS of every subsequent PLONK setup. Points are checked to be
+// on the curve and in the right subgroup.
+func LoadKZGSRS(path string) (*kzg_bw6761.SRS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var srs kzg_bw6761.SRS
+	if _, err := srs.ReadFrom(f); err != nil {
+		return nil, fmt.Errorf("reading KZG SRS %s: %w", path, err)
+	}
+	if err := SetKZGSRS(&srs); err != nil {
+		return nil, err
+	}
+	return &srs, nil
+}
+
+// SaveKZGSRS writes a KZG SRS in canonical form.
+func SaveKZGSRS(path string, srs *kzg_bw6761.SRS) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = srs.WriteTo(f)
+	return err
+}
+
+// KZGSRSSize returns the number of G1 points a KZG SRS needs to set up the circuit with PLONK.
+func KZGSRSSize(ccs constraint.ConstraintSystem) int {
+	sizeCanonical, _ := plonk.SRSSize(ccs)
+	return sizeCanonical
+}
+
+// NewUnsafeKZGSRS samples a KZG SRS of size G1 points from a locally generated tau.
+// Anyone who learns tau can forge PLONK proofs, and tau passes through this process's memory:
+// use it in tests only, and a ceremony output everywhere else.
+func NewUnsafeKZGSRS(size int) (*kzg_bw6761.SRS, error) {
+	tau, err := rand.Int(rand.Reader, ecc.BW6_761.ScalarField())
+	if err != nil {
+		return nil, fmt.Errorf("sampling SRS secret: %w", err)
+	}
+	return kzg_bw6761.NewSRS(uint64(size), tau)
+}
+
+// kzgSRSFor returns the shared SRS in canonical and Lagrange form, truncated to the circuit's size.
+// The Lagrange form is computed from the canonical points, without knowledge of tau.
+func kzgSRSFor(ccs constraint.ConstraintSystem) (*kzg_bw6761.SRS, *kzg_bw6761.SRS, error) {
+	kzgSRS.RLock()
+	srs := kzgSRS.srs
+	kzgSRS.RUnlock()
+	if srs == nil {
+		return nil, nil, ErrNoKZGSRS
+	}
+	sizeCanonical, sizeLagrange := plonk.SRSSize(ccs)
+	if len(srs.Pk.G1) < sizeCanonical {
+		return nil, nil, fmt.Errorf("KZG SRS has %d G1 points, circuit needs %d", len(srs.Pk.G1), sizeCanonical)
+	}
+	canonical := &kzg_bw6761.SRS{Vk: srs.Vk}
+	canonical.Pk.G1 = srs.Pk.G1[:sizeCanonical]
+	lagrangeG1, err := kzg_bw6761.ToLagrangeG1(srs.Pk.G1[:sizeLagrange])
+	if err != nil {
+		return nil, nil, fmt.Errorf("computing Lagrange SRS: %w", err)
+	}
+	lagrange := &kzg_bw6761.SRS{Vk: srs.Vk}
+	lagrange.Pk.G1 = lagrangeG1
+	return canonical, lagrange, nil
+}
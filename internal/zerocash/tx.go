@@ -22,43 +22,53 @@ import (
 	"github.com/consensys/gnark-crypto/ecc"
 	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
 	bls12377_fp "github.com/consensys/gnark-crypto/ecc/bls12-377/fp"
-	bls12377_fr "github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
 	mimcNative "github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
-	"github.com/consensys/gnark/backend/groth16"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/frontend/cs/r1cs"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 )
 
-// Tx represents a Zerocash-like transaction.
-// Contains old/new notes, ZKP proof, and all public inputs for verification.
-type Tx struct {
-	OldNote *Note  // The note being spent
-	NewNote *Note  // The note being created
-	Proof   []byte // ZKP proof (opaque, Groth16)
+// PublicTx is the ledger-facing part of a transaction: the proof, its public inputs and the
+// note ciphertexts. It never carries a plaintext note, value or owner key; those stay in the
+// sender's and recipient's wallets. This is what VerifyTx checks and what the ledger records.
+type PublicTx struct {
+	Proof []byte // ZKP proof (opaque, tagged with its backend)
 	// Public inputs for verification
-	OldCoin     string
-	OldEnergy   string
-	CmOld       string
+	Anchor      string // Merkle root the old note commitment is proven against
 	SnOld       string
-	PkOld       string
-	NewCoin     string
-	NewEnergy   string
 	CmNew       string
 	CNew        []byte    // Encrypted note data using ECDH + AES for auctioneer
-	CNewCircuit [6]string // Circuit-compatible encrypted values for verification
+	CNewCircuit [6]string // New note encrypted to G_b^r, checked by the circuit
 	G           sw_bls12377.G1Affine
-	G_b         sw_bls12377.G1Affine
-	G_r         sw_bls12377.G1Affine
+	G_b         sw_bls12377.G1Affine // Recipient's DH public key
+	G_r         sw_bls12377.G1Affine // Ephemeral DH key G^r; the recipient's shared key is G_r^sk_b
+}
+
+// Tx represents a Zerocash-like transaction as built by its sender.
+// It holds the plaintext old/new notes next to the public transaction; only Public() is sent to the ledger.
+type Tx struct {
+	OldNote *Note // The note being spent
+	NewNote *Note // The note being created
+	PublicTx
+}
+
+// Public returns a copy of the ledger-facing part of the transaction, without the plaintext notes.
+func (tx *Tx) Public() *PublicTx {
+	public := tx.PublicTx
+	return &public
 }
 
 // CreateTx creates a new confidential transaction following Algorithm 1 from the paper.
 // Algorithm 1: Transaction([n_i^old]^n_{i=1}, [sk_i^old]^n_{i=1}, [Γ_j^new]^m_{j=1}, [pk_j]^m_{j=1}) → (tx)
 // Note: pk is passed as parameter, not computed inside (as per Algorithm 1)
+// path: authentication path of oldNote.Cm in the ledger commitment tree; its root becomes the public anchor
+// recipientPub: the recipient's BLS12-377 DH public key; it is the circuit's G_b, so CNewCircuit is
+// encrypted to G_b^r and the recipient recovers the note with DecryptNoteWithSharedKey(CNewCircuit, G_r^sk_b)
 // auctioneerECDHPubKey: Auctioneer's ECDH public key for note encryption
-func CreateTx(oldNote *Note, oldSk, pkNew []byte, value, energy *big.Int, params *Params,
-	ccs constraint.ConstraintSystem, pk groth16.ProvingKey, auctioneerECDHPubKey *ecdh.PublicKey) (*Tx, error) {
+// ccs and pk may be nil, in which case the circuit registry's CircuitTx is used.
+// Returns a *ValueRangeError if a value does not fit in params.MaxValueBits().
+func CreateTx(oldNote *Note, oldSk, pkNew []byte, recipientPub *bls12377.G1Affine, value, energy *big.Int, path *MerklePath, params *Params,
+	ccs constraint.ConstraintSystem, pk ProvingKey, auctioneerECDHPubKey *ecdh.PublicKey) (*Tx, error) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("[PANIC RECOVERED] in CreateTx. Witness struct:")
@@ -68,6 +78,30 @@ func CreateTx(oldNote *Note, oldSk, pkNew []byte, value, energy *big.Int, params
 			fmt.Printf("value: %v, energy: %v\n", value, energy)
 		}
 	}()
+	// Step 0: Validate that all values fit in the protocol-wide width
+	bits, err := params.MaxValueBits()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range []struct {
+		field string
+		value *big.Int
+	}{
+		{"old coins", oldNote.Value.Coins},
+		{"old energy", oldNote.Value.Energy},
+		{"coins", value},
+		{"energy", energy},
+	} {
+		if err := CheckValueRange(v.field, v.value, bits); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 0b: The recipient key must be a valid G1 point, or nobody could decrypt the note
+	if recipientPub == nil || recipientPub.IsInfinity() || !recipientPub.IsInSubGroup() {
+		return nil, fmt.Errorf("invalid recipient public key")
+	}
+
 	// Step 1: Validate that the secret key corresponds to the note owner
 	h := mimcNative.NewMiMC()
 	h.Write(oldSk)
@@ -76,11 +110,14 @@ func CreateTx(oldNote *Note, oldSk, pkNew []byte, value, energy *big.Int, params
 		return nil, fmt.Errorf("secret key does not match note owner")
 	}
 
+	// Step 1b: Validate that the old note is the leaf the authentication path starts from
+	if err := checkNotePath(oldNote, path); err != nil {
+		return nil, err
+	}
+	pathVars, pathBits := merklePathWitness(path)
+
 	// Step 2: Compute serial number for old note (prevents double-spending)
-	h.Reset()
-	h.Write(oldSk)
-	h.Write(oldNote.Rho)
-	snOld := h.Sum(nil)
+	snOld := SerialNumber(oldSk, oldNote.Rho)
 
 	// Step 3: Compute rhoNew as H(0||snOld) to match circuit constraint
 	h.Reset()
@@ -106,49 +143,38 @@ func CreateTx(oldNote *Note, oldSk, pkNew []byte, value, energy *big.Int, params
 		Cm:      cmNew,
 	}
 
-	// Step 7: Set up EC points for ZK circuit (using DH protocol for circuit compatibility)
+	// Step 7: Ephemeral DH key: G_r = G^r is published, the note is encrypted to G_b^r with G_b the recipient's key
 	var g1Jac, _, _, _ = bls12377.Generators()
-	var g, g_b, g_r, encKey bls12377.G1Affine
-	var b, r bls12377_fp.Element
-	bSeed := randomBytes(32)
-	bHash := mimcHash(bSeed)
-	bBig := new(big.Int).SetBytes(bHash)
-	bBig.Mod(bBig, bls12377_fr.Modulus())
-	b.SetBigInt(bBig)
-	rSeed := randomBytes(32)
-	rHash := mimcHash(rSeed)
-	rBig := new(big.Int).SetBytes(rHash)
-	rBig.Mod(rBig, bls12377_fr.Modulus())
-	r.SetBigInt(rBig)
+	var g, g_r, encKey bls12377.G1Affine
 	g.FromJacobian(&g1Jac)
-	g_b.ScalarMultiplication(&g, b.BigInt(new(big.Int)))
-	g_r.ScalarMultiplication(&g, r.BigInt(new(big.Int)))
-	encKey.ScalarMultiplication(&g_b, r.BigInt(new(big.Int)))
+	r := randomScalar()
+	g_r.ScalarMultiplication(&g, r)
+	encKey.ScalarMultiplication(recipientPub, r)
+	g_b := *recipientPub
 
 	// Step 8: Encrypt note data using ECDH + AES-256-GCM for auctioneer
-	encryptedNoteData, err := encryptNoteForAuctioneer(newNote, auctioneerECDHPubKey)
+	encryptedNoteData, err := EncryptNoteForAuctioneer(newNote, auctioneerECDHPubKey)
 	if err != nil {
 		return nil, fmt.Errorf("note encryption failed: %w", err)
 	}
 
-	// Step 9: Build fake encrypted values for circuit compatibility (circuit expects [6]string)
-	encVals := buildEncMimc(encKey, newNote.PkOwner, newNote.Value.Coins, newNote.Value.Energy,
-		new(big.Int).SetBytes(newNote.Rho), new(big.Int).SetBytes(newNote.Rand), newNote.Cm)
-	var cNewStrs [6]string
-	for i := 0; i < 6; i++ {
-		cNewStrs[i] = encVals[i].String()
-	}
+	// Step 9: Encrypt the note to the recipient; the circuit checks this ciphertext
+	cNewStrs := EncryptNoteWithSharedKey(newNote, &encKey)
 
 	// Step 10: Compute PkOld as H(skOld) to match circuit constraint
 	h.Reset()
 	h.Write(oldSk)
 	pkOldComputed := h.Sum(nil)
 
-	// Step 11: Build witness for the circuit
+	// Step 11: Build witness for the circuit (compiled once per process if not given)
+	ccs, pk, err = ResolveProver(CircuitTxID, params.ProvingBackend(), bits, ccs, pk)
+	if err != nil {
+		return nil, err
+	}
 	witness := &CircuitTx{
 		OldCoin:   oldNote.Value.Coins.String(),
 		OldEnergy: oldNote.Value.Energy.String(),
-		CmOld:     new(big.Int).SetBytes(oldNote.Cm).String(),
+		Anchor:    new(big.Int).SetBytes(path.Root).String(),
 		SnOld:     new(big.Int).SetBytes(snOld).String(),
 		PkOld:     new(big.Int).SetBytes(pkOldComputed).String(),
 		NewCoin:   newNote.Value.Coins.String(),
@@ -158,77 +184,99 @@ func CreateTx(oldNote *Note, oldSk, pkNew []byte, value, energy *big.Int, params
 			cNewStrs[0], cNewStrs[1], cNewStrs[2],
 			cNewStrs[3], cNewStrs[4], cNewStrs[5],
 		},
-		G:       toGnarkPoint(g),
-		G_b:     toGnarkPoint(g_b),
-		G_r:     toGnarkPoint(g_r),
-		SkOld:   new(big.Int).SetBytes(oldSk).String(),
-		RhoOld:  new(big.Int).SetBytes(oldNote.Rho).String(),
-		RandOld: new(big.Int).SetBytes(oldNote.Rand).String(),
-		PkNew:   new(big.Int).SetBytes(newNote.PkOwner).String(),
-		RhoNew:  new(big.Int).SetBytes(newNote.Rho).String(),
-		RandNew: new(big.Int).SetBytes(newNote.Rand).String(),
-		R:       r.String(),
-		EncKey:  toGnarkPoint(encKey),
+		G:        toGnarkPoint(g),
+		G_b:      toGnarkPoint(g_b),
+		G_r:      toGnarkPoint(g_r),
+		CmOld:    new(big.Int).SetBytes(oldNote.Cm).String(),
+		Path:     pathVars,
+		PathBits: pathBits,
+		SkOld:    new(big.Int).SetBytes(oldSk).String(),
+		RhoOld:   new(big.Int).SetBytes(oldNote.Rho).String(),
+		RandOld:  new(big.Int).SetBytes(oldNote.Rand).String(),
+		PkNew:    new(big.Int).SetBytes(newNote.PkOwner).String(),
+		RhoNew:   new(big.Int).SetBytes(newNote.Rho).String(),
+		RandNew:  new(big.Int).SetBytes(newNote.Rand).String(),
+		R:        r.String(),
+		EncKey:   toGnarkPoint(encKey),
 	}
 	fmt.Printf("[DEBUG] About to create witness: %+v\n", witness)
 	w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField())
 	if err != nil {
 		return nil, fmt.Errorf("witness creation failed: %w", err)
 	}
-	proof, err := groth16.Prove(ccs, pk, w)
+	proof, err := Prove(ccs, pk, w)
 	if err != nil {
 		return nil, fmt.Errorf("proof generation failed: %w", err)
 	}
-	var proofBuf bytes.Buffer
-	_, err = proof.WriteTo(&proofBuf)
-	if err != nil {
-		return nil, fmt.Errorf("proof marshaling failed: %w", err)
-	}
 	return &Tx{
-		OldNote:     oldNote,
-		NewNote:     newNote,
-		Proof:       proofBuf.Bytes(),
-		OldCoin:     oldNote.Value.Coins.String(),
-		OldEnergy:   oldNote.Value.Energy.String(),
-		CmOld:       new(big.Int).SetBytes(oldNote.Cm).String(),
-		SnOld:       new(big.Int).SetBytes(snOld).String(),
-		PkOld:       new(big.Int).SetBytes(pkOldComputed).String(),
-		NewCoin:     newNote.Value.Coins.String(),
-		NewEnergy:   newNote.Value.Energy.String(),
-		CmNew:       new(big.Int).SetBytes(newNote.Cm).String(),
-		CNew:        encryptedNoteData, // Real encrypted note data for auctioneer
-		CNewCircuit: cNewStrs,          // Circuit-compatible values for verification
-		G:           toGnarkPoint(g),
-		G_b:         toGnarkPoint(g_b),
-		G_r:         toGnarkPoint(g_r),
+		OldNote: oldNote,
+		NewNote: newNote,
+		PublicTx: PublicTx{
+			Proof:       proof,
+			Anchor:      new(big.Int).SetBytes(path.Root).String(),
+			SnOld:       new(big.Int).SetBytes(snOld).String(),
+			CmNew:       new(big.Int).SetBytes(newNote.Cm).String(),
+			CNew:        encryptedNoteData, // Real encrypted note data for auctioneer
+			CNewCircuit: cNewStrs,          // Note encrypted to the recipient
+			G:           toGnarkPoint(g),
+			G_b:         toGnarkPoint(g_b),
+			G_r:         toGnarkPoint(g_r),
+		},
 	}, nil
 }
 
-// VerifyTx verifies a Zerocash-like transaction.
+// CreateTxToAddress is CreateTx paying value and energy to a payment address: the new note is
+// owned by to.Pk and encrypted to to.EncKey. Returns an error wrapping ErrAddressNetwork if the
+// address is not on params.AddressNetwork().
+func CreateTxToAddress(oldNote *Note, oldSk []byte, to *PaymentAddress, value, energy *big.Int, path *MerklePath, params *Params,
+	ccs constraint.ConstraintSystem, pk ProvingKey, auctioneerECDHPubKey *ecdh.PublicKey) (*Tx, error) {
+	if to == nil {
+		return nil, fmt.Errorf("no payment address")
+	}
+	if err := to.Validate(); err != nil {
+		return nil, err
+	}
+	if network := params.AddressNetwork(); to.Network != network {
+		return nil, fmt.Errorf("%w: %s, want %s", ErrAddressNetwork, to.Network, network)
+	}
+	return CreateTx(oldNote, oldSk, to.Pk, to.EncKey, value, energy, path, params, ccs, pk, auctioneerECDHPubKey)
+}
+
+// VerifyTx verifies the public part of a transaction against the ledger's recent anchors.
 // Steps:
-//  1. Rebuild the circuit and public witness
-//  2. Unmarshal the proof
-//  3. Verify the Groth16 proof
+//  1. Resolve the verifying key (a nil vk uses the circuit registry, for the proof's backend)
+//  2. Rebuild the public witness
+//  3. Verify the proof with the backend named by its tag
 //
-// Returns an error if verification fails.
-func VerifyTx(tx *Tx, params *Params, vk groth16.VerifyingKey) error {
-	// Step 1: Rebuild the circuit and public witness
-	var circuit CircuitTx
-	_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+// Returns an error if the anchor is unknown to the ledger or if verification fails.
+func VerifyTx(tx *PublicTx, ledger *Ledger, params *Params, vk VerifyingKey) error {
+	// The anchor must be one of the ledger's recent commitment tree roots
+	if ledger == nil {
+		return fmt.Errorf("ledger is required to check the anchor")
+	}
+	if !ledger.Tree.IsKnownRoot(tx.Anchor) {
+		return fmt.Errorf("unknown anchor: not a recent ledger merkle root")
+	}
+
+	// Step 1: Use the registry's verifying key if none is given
+	backendID, err := ProofBackend(tx.Proof)
+	if err != nil {
+		return fmt.Errorf("proof unmarshaling failed: %w", err)
+	}
+	valueBits, err := params.MaxValueBits()
 	if err != nil {
-		return fmt.Errorf("circuit compilation failed: %w", err)
+		return err
+	}
+	vk, err = ResolveVerifyingKey(CircuitTxID, backendID, valueBits, vk)
+	if err != nil {
+		return err
 	}
 
 	// Step 2: Rebuild the public witness
 	witness := &CircuitTx{
-		OldCoin:   tx.OldCoin,
-		OldEnergy: tx.OldEnergy,
-		CmOld:     tx.CmOld,
-		SnOld:     tx.SnOld,
-		PkOld:     tx.PkOld,
-		NewCoin:   tx.NewCoin,
-		NewEnergy: tx.NewEnergy,
-		CmNew:     tx.CmNew,
+		Anchor: tx.Anchor,
+		SnOld:  tx.SnOld,
+		CmNew:  tx.CmNew,
 		CNew: [6]frontend.Variable{
 			tx.CNewCircuit[0], tx.CNewCircuit[1], tx.CNewCircuit[2],
 			tx.CNewCircuit[3], tx.CNewCircuit[4], tx.CNewCircuit[5],
@@ -242,15 +290,8 @@ func VerifyTx(tx *Tx, params *Params, vk groth16.VerifyingKey) error {
 		return fmt.Errorf("public witness creation failed: %w", err)
 	}
 
-	// Step 3: Unmarshal proof
-	proof := groth16.NewProof(ecc.BW6_761)
-	_, err = proof.ReadFrom(bytes.NewReader(tx.Proof))
-	if err != nil {
-		return fmt.Errorf("proof unmarshaling failed: %w", err)
-	}
-
-	// Step 5: Verify the proof
-	if err := groth16.Verify(proof, vk, w); err != nil {
+	// Step 3: Verify the proof
+	if err := Verify(tx.Proof, vk, w); err != nil {
 		return fmt.Errorf("proof verification failed: %w", err)
 	}
 	return nil
@@ -259,58 +300,41 @@ func VerifyTx(tx *Tx, params *Params, vk groth16.VerifyingKey) error {
 // buildEncMimc encrypts note data using MiMC and the encryption key.
 // Returns an array of BLS12-377 field elements (for use in the circuit).
 func buildEncMimc(encKey bls12377.G1Affine, pk []byte, coins, energy, rho, rand *big.Int, cm []byte) [6]bls12377_fp.Element {
-	pk_int := new(big.Int).SetBytes(pk[:])
-	h := mimcNative.NewMiMC()
-
-	// Convert encryption key to bytes
-	encKeyX := encKey.X.Bytes()
-	encKeyXBytes := make([]byte, len(encKeyX))
-	copy(encKeyXBytes[:], encKeyX[:])
-
-	encKeyY := encKey.Y.Bytes()
-	encKeyYBytes := make([]byte, len(encKeyY))
-	copy(encKeyYBytes[:], encKeyY[:])
-
-	// Generate encryption masks using MiMC hash chain
-	h.Write(encKeyXBytes)
-	h.Write(encKeyYBytes)
-	h_enc_key := h.Sum(nil)
-
-	h.Write(h_enc_key)
-	h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_enc_key)
-	h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_enc_key)
-	h_h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_h_enc_key)
-	h_h_h_h_h_enc_key := h.Sum(nil)
-
-	h.Write(h_h_h_h_h_enc_key)
-	h_h_h_h_h_h_enc_key := h.Sum(nil)
-
 	// Encrypt each field by adding the corresponding mask
-	pk_ := new(bls12377_fp.Element).SetBigInt(pk_int)
-	pk_enc := new(bls12377_fp.Element).Add(pk_, new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(h_enc_key[:])))
-
-	coins_ := new(bls12377_fp.Element).SetBigInt(coins)
-	coins_enc := new(bls12377_fp.Element).Add(coins_, new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(h_h_enc_key[:])))
-
-	energy_ := new(bls12377_fp.Element).SetBigInt(energy)
-	energy_enc := new(bls12377_fp.Element).Add(energy_, new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(h_h_h_enc_key[:])))
-
-	rho_ := new(bls12377_fp.Element).SetBigInt(rho)
-	rho_enc := new(bls12377_fp.Element).Add(rho_, new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(h_h_h_h_enc_key[:])))
-
-	rand_ := new(bls12377_fp.Element).SetBigInt(rand)
-	rand_enc := new(bls12377_fp.Element).Add(rand_, new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(h_h_h_h_h_enc_key[:])))
+	masks := noteMasks(encKey)
+	values := [6]*big.Int{new(big.Int).SetBytes(pk), coins, energy, rho, rand, new(big.Int).SetBytes(cm)}
+	var enc [6]bls12377_fp.Element
+	for i := range enc {
+		enc[i].SetBigInt(values[i])
+		enc[i].Add(&enc[i], &masks[i])
+	}
+	return enc
+}
 
-	cm_ := new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(cm[:]))
-	cm_enc := new(bls12377_fp.Element).Add(cm_, new(bls12377_fp.Element).SetBigInt(new(big.Int).SetBytes(h_h_h_h_h_h_enc_key[:])))
+// checkNotePath checks that path is a valid authentication path for note's commitment.
+func checkNotePath(note *Note, path *MerklePath) error {
+	if path == nil {
+		return fmt.Errorf("merkle path for the old note is required")
+	}
+	if new(big.Int).SetBytes(path.Leaf).Cmp(new(big.Int).SetBytes(note.Cm)) != 0 {
+		return fmt.Errorf("merkle path does not belong to the old note commitment")
+	}
+	if len(path.Siblings) != MerkleTreeDepth {
+		return fmt.Errorf("merkle path has depth %d, circuit expects %d", len(path.Siblings), MerkleTreeDepth)
+	}
+	if !path.Verify() {
+		return fmt.Errorf("merkle path does not lead to its root")
+	}
+	return nil
+}
 
-	return [6]bls12377_fp.Element{*pk_enc, *coins_enc, *energy_enc, *rho_enc, *rand_enc, *cm_enc}
+// merklePathWitness converts an authentication path to the circuit's sibling and index-bit arrays.
+func merklePathWitness(path *MerklePath) (siblings, bits [MerkleTreeDepth]frontend.Variable) {
+	for h := 0; h < MerkleTreeDepth; h++ {
+		siblings[h] = new(big.Int).SetBytes(path.Siblings[h]).String()
+		bits[h] = (path.Index >> h) & 1
+	}
+	return siblings, bits
 }
 
 // toGnarkPoint converts a native BLS12-377 point to gnark format.
@@ -323,76 +347,122 @@ func toGnarkPoint(p bls12377.G1Affine) sw_bls12377.G1Affine {
 	}
 }
 
-// SaveProvingKey saves a Groth16 proving key to disk.
-func SaveProvingKey(path string, pk groth16.ProvingKey) error {
+// fromGnarkPoint converts a gnark-format point (decimal coordinates) back to a native BLS12-377 point.
+// Returns an error if the coordinates are not a point of the G1 subgroup.
+func fromGnarkPoint(p sw_bls12377.G1Affine) (bls12377.G1Affine, error) {
+	var out bls12377.G1Affine
+	x, okX := new(big.Int).SetString(fmt.Sprint(p.X), 10)
+	y, okY := new(big.Int).SetString(fmt.Sprint(p.Y), 10)
+	if !okX || !okY {
+		return out, fmt.Errorf("invalid point coordinates")
+	}
+	out.X.SetBigInt(x)
+	out.Y.SetBigInt(y)
+	if !out.IsOnCurve() || !out.IsInSubGroup() {
+		return out, fmt.Errorf("point is not in the BLS12-377 G1 subgroup")
+	}
+	return out, nil
+}
+
+// EphemeralKey returns G_r, from which the recipient derives the note's shared key as G_r^sk_b.
+func (tx *PublicTx) EphemeralKey() (*bls12377.G1Affine, error) {
+	g_r, err := fromGnarkPoint(tx.G_r)
+	if err != nil {
+		return nil, fmt.Errorf("G_r: %w", err)
+	}
+	return &g_r, nil
+}
+
+// SaveProvingKey saves a proving key to disk, prefixed with its backend tag.
+func SaveProvingKey(path string, pk ProvingKey) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = pk.WriteTo(f)
+	_, err = WriteKey(f, pk)
 	return err
 }
 
-// SaveVerifyingKey saves a Groth16 verifying key to disk.
-func SaveVerifyingKey(path string, vk groth16.VerifyingKey) error {
+// SaveVerifyingKey saves a verifying key to disk, prefixed with its backend tag.
+func SaveVerifyingKey(path string, vk VerifyingKey) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = vk.WriteTo(f)
+	_, err = WriteKey(f, vk)
 	return err
 }
 
-// LoadProvingKey loads a Groth16 proving key from disk.
-func LoadProvingKey(path string) (groth16.ProvingKey, error) {
+// LoadProvingKey loads a proving key of the backend named by its tag from disk.
+func LoadProvingKey(path string) (ProvingKey, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	pk := groth16.NewProvingKey(ecc.BW6_761)
+	b, err := readKeyTag(f)
+	if err != nil {
+		return nil, err
+	}
+	pk := b.NewProvingKey()
 	_, err = pk.ReadFrom(f)
 	return pk, err
 }
 
-// LoadVerifyingKey loads a Groth16 verifying key from disk.
-func LoadVerifyingKey(path string) (groth16.VerifyingKey, error) {
+// LoadVerifyingKey loads a verifying key of the backend named by its tag from disk.
+func LoadVerifyingKey(path string) (VerifyingKey, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	vk := groth16.NewVerifyingKey(ecc.BW6_761)
+	b, err := readKeyTag(f)
+	if err != nil {
+		return nil, err
+	}
+	vk := b.NewVerifyingKey()
 	_, err = vk.ReadFrom(f)
 	return vk, err
 }
 
-// SetupOrLoadKeys generates or loads Groth16 keys for the circuit.
-// If keys exist on disk, loads them; otherwise, generates and saves new keys.
-func SetupOrLoadKeys(ccs constraint.ConstraintSystem, pkPath, vkPath string) (groth16.ProvingKey, groth16.VerifyingKey, error) {
-	pk, pkErr := LoadProvingKey(pkPath)
-	vk, vkErr := LoadVerifyingKey(vkPath)
-	if pkErr == nil && vkErr == nil {
-		return pk, vk, nil
+// SetupOrLoadKeys generates or loads keys for the circuit, with the backend its constraint system was
+// compiled for; valueBits is the value width it was compiled with. If keys exist on disk, their manifest is checked against the circuit and the key files before
+// loading them; otherwise, generates and saves new keys with a manifest (see RotateKeys).
+// Returns a *KeyManifestMismatchError if the keys were generated for a different circuit or modified,
+// and ErrKeyManifestMissing if the manifest or one of the key files is missing.
+func SetupOrLoadKeys(id CircuitID, valueBits int, ccs constraint.ConstraintSystem, pkPath, vkPath string) (ProvingKey, VerifyingKey, error) {
+	manifestPath := KeyManifestPath(pkPath)
+	if !fileExists(pkPath) && !fileExists(vkPath) {
+		return RotateKeys(id, valueBits, ccs, pkPath, vkPath)
+	}
+	if !fileExists(pkPath) || !fileExists(vkPath) || !fileExists(manifestPath) {
+		return nil, nil, fmt.Errorf("circuit %q: %w", id, ErrKeyManifestMissing)
 	}
-	// Generate keys
-	pk, vk, err := groth16.Setup(ccs)
+
+	// Check the manifest before trusting the key files
+	manifest, err := LoadKeyManifest(manifestPath)
 	if err != nil {
 		return nil, nil, err
 	}
-	if err := SaveProvingKey(pkPath, pk); err != nil {
+	if err := manifest.Check(id, valueBits, ccs, pkPath, vkPath); err != nil {
 		return nil, nil, err
 	}
-	if err := SaveVerifyingKey(vkPath, vk); err != nil {
-		return nil, nil, err
+
+	pk, err := LoadProvingKey(pkPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading proving key: %w", err)
+	}
+	vk, err := LoadVerifyingKey(vkPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading verifying key: %w", err)
 	}
 	return pk, vk, nil
 }
 
-// encryptNoteForAuctioneer encrypts note data using ECDH + AES-256-GCM
-func encryptNoteForAuctioneer(note *Note, auctioneerECDHPubKey *ecdh.PublicKey) ([]byte, error) {
+// EncryptNoteForAuctioneer encrypts note data using ECDH + AES-256-GCM
+func EncryptNoteForAuctioneer(note *Note, auctioneerECDHPubKey *ecdh.PublicKey) ([]byte, error) {
 	// 1. Generate ephemeral ECDH key pair
 	ephemeralPrivKey, err := ecdh.P256().GenerateKey(rand.Reader)
 	if err != nil {
@@ -500,27 +570,35 @@ func DecryptNoteFromAuctioneer(encryptedData []byte, auctioneerECDHPrivKey *ecdh
 		return nil, fmt.Errorf("decryption failed: %w", err)
 	}
 
-	// 7. Unmarshal note data
-	var noteData map[string]interface{}
+	// 7. Unmarshal note data; byte fields are base64 in JSON
+	var noteData struct {
+		Pk     []byte `json:"pk"`
+		Coins  string `json:"coins"`
+		Energy string `json:"energy"`
+		Rho    []byte `json:"rho"`
+		Rand   []byte `json:"rand"`
+		Cm     []byte `json:"cm"`
+	}
 	if err := json.Unmarshal(plaintextBytes, &noteData); err != nil {
 		return nil, fmt.Errorf("JSON unmarshaling failed: %w", err)
 	}
 
 	// 8. Reconstruct note
-	coins := new(big.Int)
-	coins.SetString(noteData["coins"].(string), 10)
-	energy := new(big.Int)
-	energy.SetString(noteData["energy"].(string), 10)
+	coins, okCoins := new(big.Int).SetString(noteData.Coins, 10)
+	energy, okEnergy := new(big.Int).SetString(noteData.Energy, 10)
+	if !okCoins || !okEnergy {
+		return nil, fmt.Errorf("invalid note value: %q coins, %q energy", noteData.Coins, noteData.Energy)
+	}
 
 	note := &Note{
 		Value: Gamma{
 			Coins:  coins,
 			Energy: energy,
 		},
-		PkOwner: noteData["pk"].([]byte),
-		Rho:     noteData["rho"].([]byte),
-		Rand:    noteData["rand"].([]byte),
-		Cm:      noteData["cm"].([]byte),
+		PkOwner: noteData.Pk,
+		Rho:     noteData.Rho,
+		Rand:    noteData.Rand,
+		Cm:      noteData.Cm,
 	}
 
 	return note, nil
@@ -4,7 +4,14 @@
 
 package zerocash
 
-import "math/big"
+import (
+	"fmt"
+	"math/big"
+)
+
+// DefaultValueBits is the maximum bit width of coins, energy and bids when Params.ValueBits is unset.
+// It is also the widest supported: circuits multiply two values, which must not wrap around the field.
+const DefaultValueBits = 64
 
 // Gamma represents the value of a note (coins and energy).
 // Both fields are arbitrary-precision integers for flexibility.
@@ -16,5 +23,129 @@ type Gamma struct {
 // Params holds protocol and curve parameters.
 // Extend this struct to add protocol-wide configuration or cryptographic parameters.
 type Params struct {
-	// Add curve, field, or protocol parameters here if needed
+	// ValueBits is the maximum bit width of every value-carrying variable (coins, energy, bids),
+	// between 1 and DefaultValueBits; 0 means DefaultValueBits. Circuits are compiled, and their
+	// keys registered and generated, per width.
+	ValueBits int
+
+	// Backend selects the proving backend used to compile circuits, generate keys and prove;
+	// "" means DefaultBackend. Verification dispatches on the backend tag of each proof.
+	Backend BackendID
+
+	// Network is the payment address prefix of the network the protocol runs on;
+	// "" means DefaultNetwork. Addresses of other networks are refused.
+	Network string
+}
+
+// ProvingBackend returns the configured proving backend, or DefaultBackend if unset.
+func (p *Params) ProvingBackend() BackendID {
+	if p == nil || p.Backend == "" {
+		return DefaultBackend
+	}
+	return p.Backend
+}
+
+// AddressNetwork returns the configured payment address network, or DefaultNetwork if unset.
+func (p *Params) AddressNetwork() string {
+	if p == nil || p.Network == "" {
+		return DefaultNetwork
+	}
+	return p.Network
+}
+
+// MaxValueBits returns the configured value width, or DefaultValueBits if unset.
+// Returns an error if ValueBits is negative or wider than DefaultValueBits.
+func (p *Params) MaxValueBits() (int, error) {
+	if p == nil || p.ValueBits == 0 {
+		return DefaultValueBits, nil
+	}
+	if err := checkValueBits(p.ValueBits); err != nil {
+		return 0, err
+	}
+	return p.ValueBits, nil
+}
+
+// checkValueBits returns an error unless bits is a supported value width.
+func checkValueBits(bits int) error {
+	if bits < 1 || bits > DefaultValueBits {
+		return fmt.Errorf("unsupported value width %d: must be between 1 and %d bits", bits, DefaultValueBits)
+	}
+	return nil
+}
+
+// ValueRangeError reports a coin, energy or bid value outside [0, 2^Bits).
+type ValueRangeError struct {
+	Field string   // Name of the offending value (e.g. "coins")
+	Value *big.Int // The rejected value
+	Bits  int      // The allowed width
+}
+
+func (e *ValueRangeError) Error() string {
+	return fmt.Sprintf("%s out of range: %s does not fit in %d bits", e.Field, e.Value, e.Bits)
+}
+
+// CheckValueRange returns a *ValueRangeError if v is nil, negative or wider than bits.
+func CheckValueRange(field string, v *big.Int, bits int) error {
+	if v == nil || v.Sign() < 0 || v.BitLen() > bits {
+		return &ValueRangeError{Field: field, Value: v, Bits: bits}
+	}
+	return nil
+}
+
+// RegistrationFields is the number of field elements of a registration plaintext and of its
+// ciphertext C^Aux: (pk^out, sk^in, limit price, coins, energy, side, quantity, ρ^in, r^in), where
+// ρ^in and r^in open the commitment of the tx^in note with the coins and energy.
+const RegistrationFields = 9
+
+// OrderSide is the side of an auction order, as encoded in the registration plaintext.
+type OrderSide uint8
+
+const (
+	SideBuy  OrderSide = 0 // Buy energy with the note's coins
+	SideSell OrderSide = 1 // Sell the note's energy
+)
+
+func (s OrderSide) String() string {
+	switch s {
+	case SideBuy:
+		return "buy"
+	case SideSell:
+		return "sell"
+	default:
+		return fmt.Sprintf("side(%d)", uint8(s))
+	}
+}
+
+// Order is what a participant registers for an auction: buy or sell Quantity units of energy
+// at no worse than LimitPrice coins per unit (the bid b_i).
+type Order struct {
+	Side       OrderSide
+	Quantity   *big.Int
+	LimitPrice *big.Int
+}
+
+// Validate checks that the order fits in bits and is backed by the registered note value:
+// a sell order by its energy, a buy order by its coins at the limit price. Range errors are
+// *ValueRangeError.
+func (o Order) Validate(value Gamma, bits int) error {
+	if o.Side != SideBuy && o.Side != SideSell {
+		return fmt.Errorf("invalid order side %v", o.Side)
+	}
+	if err := CheckValueRange("quantity", o.Quantity, bits); err != nil {
+		return err
+	}
+	if err := CheckValueRange("limit price", o.LimitPrice, bits); err != nil {
+		return err
+	}
+	if o.Side == SideSell {
+		if value.Energy == nil || o.Quantity.Cmp(value.Energy) > 0 {
+			return fmt.Errorf("sell order of %v energy is not backed by the note's %v energy", o.Quantity, value.Energy)
+		}
+		return nil
+	}
+	cost := new(big.Int).Mul(o.Quantity, o.LimitPrice)
+	if value.Coins == nil || cost.Cmp(value.Coins) > 0 {
+		return fmt.Errorf("buy order of %v energy at %v costs %v, more than the note's %v coins", o.Quantity, o.LimitPrice, cost, value.Coins)
+	}
+	return nil
 }
@@ -0,0 +1,196 @@
+// viewkeys.go - Viewing keys and watch-only wallets.
+//
+// Spending a note needs its secret key sk (pk = MiMC(sk)), while seeing it only needs:
+//
+//	incoming viewing key   the DH secret key notes are encrypted to: decrypts and lists the notes
+//	full viewing key       the incoming key and the nullifier key nk = NullifierKey(sk) of each
+//	                       note key, from which serial numbers sn = MiMC(nk, rho) are recomputed,
+//	                       so spends are detected as well
+//
+// Neither reveals a spending key, so an auditor or a watch-only node can follow a wallet without
+// being able to spend from it. A wallet imported from a viewing key (NewWatchOnlyWallet) scans the
+// ledger like any other, and refuses CreateTx, Register and Withdraw with ErrWatchOnly.
+//
+// A viewing key does not cover auction outputs. Exchange outputs are encrypted to the G^r of the
+// registration, whose secret r_enc also decrypts the registration ciphertext C_i and with it
+// sk^in, and withdraw outputs are opened from the wallet's registration records; neither is part
+// of a viewing key, so a watch-only wallet lists neither.
+//
+// The DH key only separates from the spending keys in wallets with a seed (see keys.go); older
+// wallets own their notes with the DH key itself and cannot export viewing keys.
+
+package zerocash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	"github.com/consensys/gnark-crypto/ecc/bls12-377/fr"
+)
+
+// ViewingKeyVersion is the version of the viewing key format written by SaveViewingKey.
+const ViewingKeyVersion = 1
+
+// ErrWatchOnly is returned when a watch-only wallet is asked to spend.
+var ErrWatchOnly = errors.New("watch-only wallet cannot spend")
+
+// ViewingKey is an exported incoming or full viewing key.
+type ViewingKey struct {
+	Version int                `json:"version"`
+	Name    string             `json:"name"`
+	DHSk    *fr.Element        `json:"dh_sk"` // Incoming viewing key
+	DHPk    *bls12377.G1Affine `json:"dh_pk"`
+	// Nullifier keys by decimal note pk; nil for an incoming viewing key. They cover the keys the
+	// wallet had used, and the derived keys up to KeyLookahead past them, when the key was exported.
+	NullifierKeys map[string][]byte `json:"nullifier_keys,omitempty"`
+}
+
+// Full reports whether vk is a full viewing key.
+func (vk *ViewingKey) Full() bool {
+	return vk.NullifierKeys != nil
+}
+
+// Incoming returns the incoming viewing key contained in vk.
+func (vk *ViewingKey) Incoming() *ViewingKey {
+	return &ViewingKey{Version: vk.Version, Name: vk.Name, DHSk: vk.DHSk, DHPk: vk.DHPk}
+}
+
+// IncomingViewingKey returns the wallet's incoming viewing key.
+func (w *Wallet) IncomingViewingKey() (*ViewingKey, error) {
+	if err := w.checkViewable(); err != nil {
+		return nil, err
+	}
+	sk := *w.Sk
+	pk := *w.Pk
+	return &ViewingKey{Version: ViewingKeyVersion, Name: w.Name, DHSk: &sk, DHPk: &pk}, nil
+}
+
+// FullViewingKey returns the wallet's full viewing key: its incoming viewing key and the
+// nullifier keys of its spend key, note keys and derived keys. A full viewing key can be
+// exported again from a watch-only wallet.
+func (w *Wallet) FullViewingKey() (*ViewingKey, error) {
+	if w.WatchOnly && w.NullifierKeys == nil {
+		return nil, fmt.Errorf("wallet %s only holds an incoming viewing key", w.Name)
+	}
+	vk, err := w.IncomingViewingKey()
+	if err != nil {
+		return nil, err
+	}
+	vk.NullifierKeys = make(map[string][]byte)
+	add := func(sk []byte) {
+		if len(sk) > 0 {
+			vk.NullifierKeys[MimcHashPublic(sk).String()] = NullifierKey(sk)
+		}
+	}
+	for pk, nk := range w.NullifierKeys {
+		vk.NullifierKeys[pk] = append([]byte(nil), nk...)
+	}
+	for _, k := range w.noteKeysByPk() {
+		add(k.sk)
+	}
+	// Exchange and withdraw outputs are owned by sk^out
+	if chain, err := w.KeyChain(); err == nil {
+		for i := uint32(0); i < w.NextAuction+KeyLookahead; i++ {
+			_, skOut, _ := chain.AuctionKeys(i)
+			b := skOut.Bytes()
+			add(b[:])
+		}
+	}
+	for _, reg := range w.Registrations {
+		if reg != nil {
+			add(reg.SkOut)
+		}
+	}
+	return vk, nil
+}
+
+// checkViewable returns an error if the wallet's DH key cannot be handed out as a viewing key.
+func (w *Wallet) checkViewable() error {
+	if w.Locked() {
+		return ErrWalletLocked
+	}
+	if w.Sk == nil || w.Pk == nil {
+		return fmt.Errorf("wallet %s has no DH key", w.Name)
+	}
+	if w.WatchOnly {
+		return nil
+	}
+	// The DH key must not also be a note spending key
+	dh := w.Sk.Bytes()
+	if len(w.Seed) == 0 {
+		return fmt.Errorf("wallet %s has no seed: its DH key also spends its notes", w.Name)
+	}
+	for _, sk := range w.NoteKeys {
+		if bytes.Equal(sk, dh[:]) {
+			return fmt.Errorf("wallet %s has notes owned by its DH key", w.Name)
+		}
+	}
+	return nil
+}
+
+// NewWatchOnlyWallet creates a wallet from a viewing key. It lists the notes the key decrypts
+// when scanning the ledger and, with a full viewing key, detects their spends; it cannot spend.
+// Exchange and withdraw outputs are not listed.
+func NewWatchOnlyWallet(name string, vk *ViewingKey) (*Wallet, error) {
+	if vk == nil || vk.DHSk == nil || vk.DHPk == nil {
+		return nil, fmt.Errorf("incomplete viewing key")
+	}
+	// The public key must match the secret key, or notes would be scanned for the wrong key
+	var pk bls12377.G1Affine
+	_, _, g1, _ := bls12377.Generators()
+	pk.ScalarMultiplication(&g1, vk.DHSk.BigInt(new(big.Int)))
+	if !pk.Equal(vk.DHPk) {
+		return nil, fmt.Errorf("viewing key does not match its public key")
+	}
+	sk := *vk.DHSk
+	w := &Wallet{
+		Version:         WalletSchemaVersion,
+		Name:            name,
+		Sk:              &sk,
+		Pk:              &pk,
+		Notes:           []*Note{},
+		NoteKeys:        [][]byte{},
+		Spent:           []bool{},
+		Registrations:   []*RegistrationRecord{},
+		WithdrawOutNote: []*Note{},
+		WatchOnly:       true,
+	}
+	if vk.Full() {
+		w.NullifierKeys = make(map[string][]byte, len(vk.NullifierKeys))
+		for pk, nk := range vk.NullifierKeys {
+			w.NullifierKeys[pk] = append([]byte(nil), nk...)
+		}
+	}
+	return w, nil
+}
+
+// SaveViewingKey writes a viewing key to path, readable only by its owner.
+// It spends nothing, but reveals every note it covers.
+func SaveViewingKey(path string, vk *ViewingKey) error {
+	data, err := json.MarshalIndent(vk, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// LoadViewingKey reads a viewing key written by SaveViewingKey.
+func LoadViewingKey(path string) (*ViewingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vk ViewingKey
+	if err := json.Unmarshal(data, &vk); err != nil {
+		return nil, fmt.Errorf("viewing key %s: %w", path, err)
+	}
+	if vk.Version != ViewingKeyVersion {
+		return nil, fmt.Errorf("unsupported viewing key version %d", vk.Version)
+	}
+	return &vk, nil
+}
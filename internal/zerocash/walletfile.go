@@ -0,0 +1,414 @@
+// walletfile.go - Encrypted-at-rest wallet files.
+//
+// A wallet file holds the participant's DH secret key, the secret keys of its notes and every
+// note opening, so it is sealed with AES-256-GCM under a key derived from a passphrase with
+// scrypt. The header (format version, KDF and its parameters) is authenticated as additional
+// data, so any modification of the file is detected when it is opened. The plaintext JSON
+// format is only read and written by ImportPlaintextWallet and ExportPlaintext.
+
+package zerocash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// WalletFileVersion is the version of the encrypted wallet container written by Save.
+const WalletFileVersion = 1
+
+// Default scrypt cost for wallet keys (N=2^15, r=8, p=1: about 32 MiB and 100ms per derivation).
+const (
+	walletScryptN = 1 << 15
+	walletScryptR = 8
+	walletScryptP = 1
+)
+
+// Largest scrypt cost accepted when opening a wallet (N=2^18, r=8, p=4: 256 MiB and a few
+// seconds per derivation), so a tampered header cannot make unlocking exhaust memory or CPU
+// before the file is authenticated.
+const (
+	walletScryptMaxN = 1 << 18
+	walletScryptMaxR = 8
+	walletScryptMaxP = 4
+)
+
+var (
+	// ErrWrongPassphrase is returned when a wallet cannot be opened, either because the
+	// passphrase is wrong or because the file was modified.
+	ErrWrongPassphrase = errors.New("wrong passphrase or tampered wallet file")
+	// ErrNoPassphrase is returned when saving a wallet that has no passphrase set.
+	ErrNoPassphrase = errors.New("wallet has no passphrase; call SetPassphrase first")
+	// ErrWalletLocked is returned when the secrets of a locked wallet are needed.
+	ErrWalletLocked = errors.New("wallet is locked")
+)
+
+// WalletKDFParams are the scrypt parameters a wallet key was derived with.
+type WalletKDFParams struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+}
+
+// walletHeader is the authenticated, unencrypted part of a wallet file.
+type walletHeader struct {
+	Version   int             `json:"version"`
+	KDF       string          `json:"kdf"`
+	KDFParams WalletKDFParams `json:"kdf_params"`
+	Cipher    string          `json:"cipher"`
+}
+
+// EncryptedWallet is the on-disk form of a wallet: the header and the sealed plaintext wallet.
+type EncryptedWallet struct {
+	walletHeader
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// walletVault holds a wallet's sealing key while unlocked, and its sealed form while locked.
+type walletVault struct {
+	kdf    WalletKDFParams
+	key    []byte
+	sealed *EncryptedWallet
+}
+
+// deriveWalletKey derives the 32-byte sealing key from a passphrase.
+// Returns an error without deriving anything if the parameters exceed the walletScryptMax bounds
+// or N is not a power of two.
+func deriveWalletKey(passphrase []byte, kdf WalletKDFParams) ([]byte, error) {
+	if kdf.N < 2 || kdf.N > walletScryptMaxN || kdf.N&(kdf.N-1) != 0 ||
+		kdf.R < 1 || kdf.R > walletScryptMaxR || kdf.P < 1 || kdf.P > walletScryptMaxP {
+		return nil, fmt.Errorf("unsupported scrypt parameters N=%d r=%d p=%d (N must be a power of two up to %d, r at most %d, p at most %d)",
+			kdf.N, kdf.R, kdf.P, walletScryptMaxN, walletScryptMaxR, walletScryptMaxP)
+	}
+	return scrypt.Key(passphrase, kdf.Salt, kdf.N, kdf.R, kdf.P, 32)
+}
+
+// SetPassphrase sets the passphrase the wallet is sealed with by Save and Lock,
+// with a fresh salt. Use ChangePassphrase to replace an existing passphrase.
+func (w *Wallet) SetPassphrase(passphrase []byte) error {
+	if w.Locked() {
+		return ErrWalletLocked
+	}
+	if len(passphrase) == 0 {
+		return fmt.Errorf("empty passphrase")
+	}
+	kdf := WalletKDFParams{N: walletScryptN, R: walletScryptR, P: walletScryptP, Salt: randomBytes(32)}
+	key, err := deriveWalletKey(passphrase, kdf)
+	if err != nil {
+		return err
+	}
+	w.vault = &walletVault{kdf: kdf, key: key}
+	return nil
+}
+
+// ChangePassphrase replaces the wallet passphrase after checking the current one.
+// The wallet file is only re-encrypted by the next Save.
+func (w *Wallet) ChangePassphrase(oldPassphrase, newPassphrase []byte) error {
+	if w.vault == nil {
+		return ErrNoPassphrase
+	}
+	if w.Locked() {
+		return ErrWalletLocked
+	}
+	key, err := deriveWalletKey(oldPassphrase, w.vault.kdf)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, w.vault.key) != 1 {
+		return ErrWrongPassphrase
+	}
+	return w.SetPassphrase(newPassphrase)
+}
+
+// Locked reports whether the wallet's secrets have been wiped from memory by Lock.
+func (w *Wallet) Locked() bool {
+	return w.vault != nil && w.vault.sealed != nil
+}
+
+// Lock seals the wallet and wipes its keys and notes from memory until Unlock.
+// A locked wallet can still be saved.
+func (w *Wallet) Lock() error {
+	if w.vault == nil {
+		return ErrNoPassphrase
+	}
+	if w.Locked() {
+		return nil
+	}
+	sealed, err := w.seal()
+	if err != nil {
+		return err
+	}
+	vault := w.vault
+	w.wipe()
+	*w = Wallet{Name: w.Name, Pk: w.Pk, vault: vault}
+	vault.sealed = sealed
+	return nil
+}
+
+// Unlock restores a locked wallet with its passphrase.
+func (w *Wallet) Unlock(passphrase []byte) error {
+	if !w.Locked() {
+		return nil
+	}
+	opened, err := w.vault.sealed.Open(passphrase)
+	if err != nil {
+		return err
+	}
+	*w = *opened
+	return nil
+}
+
+// wipe zeroes the secret keys, the registration secrets, the withdraw output note openings and
+// the sealing key held in memory.
+func (w *Wallet) wipe() {
+	if w.Sk != nil {
+		w.Sk.SetZero()
+	}
+	for _, sk := range w.NoteKeys {
+		clear(sk)
+	}
+	for _, reg := range w.Registrations {
+		if reg != nil {
+			clear(reg.SkIn)
+			clear(reg.SkOut)
+			clear(reg.REnc)
+		}
+	}
+	for _, out := range w.WithdrawOutNote {
+		if out != nil {
+			clear(out.Rho)
+			clear(out.Rand)
+		}
+	}
+	for _, nk := range w.NullifierKeys {
+		clear(nk)
+	}
+	clear(w.Seed)
+	if w.vault != nil {
+		clear(w.vault.key)
+		w.vault.key = nil
+	}
+}
+
+// seal encrypts the plaintext wallet under the vault key.
+func (w *Wallet) seal() (*EncryptedWallet, error) {
+	w.Version = WalletSchemaVersion
+	plaintext, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	header := walletHeader{Version: WalletFileVersion, KDF: "scrypt", KDFParams: w.vault.kdf, Cipher: "aes-256-gcm"}
+	aead, err := walletAEAD(w.vault.key)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	nonce := randomBytes(aead.NonceSize())
+	return &EncryptedWallet{
+		walletHeader: header,
+		Nonce:        nonce,
+		Ciphertext:   aead.Seal(nil, nonce, plaintext, ad),
+	}, nil
+}
+
+// Open decrypts an encrypted wallet with its passphrase.
+// Returns ErrWrongPassphrase if the passphrase is wrong or any part of the file was modified.
+func (e *EncryptedWallet) Open(passphrase []byte) (*Wallet, error) {
+	if e.Version != WalletFileVersion {
+		return nil, fmt.Errorf("unsupported wallet file version %d (this build reads version %d)", e.Version, WalletFileVersion)
+	}
+	if e.KDF != "scrypt" || e.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("unsupported wallet encryption %s/%s", e.KDF, e.Cipher)
+	}
+	key, err := deriveWalletKey(passphrase, e.KDFParams)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := walletAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	ad, err := json.Marshal(e.walletHeader)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, e.Nonce, e.Ciphertext, ad)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	defer clear(plaintext)
+	w, err := decodeWallet(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	w.vault = &walletVault{kdf: e.KDFParams, key: key}
+	return w, nil
+}
+
+// walletAEAD returns the AES-256-GCM cipher for a sealing key.
+func walletAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadWallet loads and decrypts a wallet file written by Save.
+// Plaintext wallet files are refused; import them with ImportPlaintextWallet.
+func LoadWallet(path string, passphrase []byte) (*Wallet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e EncryptedWallet
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("wallet file %s: %w", path, err)
+	}
+	if e.Ciphertext == nil {
+		return nil, fmt.Errorf("wallet file %s is not encrypted; import it with ImportPlaintextWallet", path)
+	}
+	return e.Open(passphrase)
+}
+
+// Save encrypts the wallet with its passphrase and writes it to path.
+// The file is replaced atomically and is only readable by its owner.
+func (w *Wallet) Save(path string) error {
+	if w.vault == nil {
+		return ErrNoPassphrase
+	}
+	sealed := w.vault.sealed
+	if sealed == nil {
+		var err error
+		if sealed, err = w.seal(); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// ImportPlaintextWallet reads a wallet from the plaintext JSON format, upgrading older schemas.
+// Set a passphrase on the result before saving it.
+func ImportPlaintextWallet(path string) (*Wallet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeWallet(data)
+}
+
+// ExportPlaintext writes the wallet, secret keys included, in the plaintext JSON format.
+func (w *Wallet) ExportPlaintext(path string) error {
+	if w.Locked() {
+		return ErrWalletLocked
+	}
+	w.Version = WalletSchemaVersion
+	data, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// WalletMigration reports how the loader upgraded a wallet from an older schema.
+type WalletMigration struct {
+	FromVersion int
+	// Indices of notes that cannot be spent or withdrawn: notes without a secret key, and
+	// registered notes whose registration secrets (r_enc, sk^in, bid) were never saved
+	Unrecoverable []int
+}
+
+// legacyWallet is the version 1 schema: registration ciphertexts were saved per note,
+// but not the randomness and keys needed to use them.
+type legacyWallet struct {
+	Wallet
+	CAux [][][5]byte
+}
+
+// decodeWallet decodes wallet contents of any supported schema, upgrading older ones.
+// An upgraded wallet has its Migration report set.
+func decodeWallet(data []byte) (*Wallet, error) {
+	var peek struct{ Version int }
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return nil, err
+	}
+	version := peek.Version
+	if version == 0 {
+		version = 1
+	}
+	if version > WalletSchemaVersion {
+		return nil, fmt.Errorf("wallet schema version %d is newer than this build (version %d)", version, WalletSchemaVersion)
+	}
+	if version == WalletSchemaVersion {
+		var w Wallet
+		if err := json.Unmarshal(data, &w); err != nil {
+			return nil, err
+		}
+		return &w, nil
+	}
+
+	var legacy legacyWallet
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	w := legacy.Wallet
+	w.Version = WalletSchemaVersion
+	w.Migration = &WalletMigration{FromVersion: version}
+	n := len(w.Notes)
+	w.NoteKeys = append(w.NoteKeys, make([][]byte, max(0, n-len(w.NoteKeys)))...)
+	w.Spent = append(w.Spent, make([]bool, max(0, n-len(w.Spent)))...)
+	w.WithdrawOutNote = append(w.WithdrawOutNote, make([]*Note, max(0, n-len(w.WithdrawOutNote)))...)
+	w.Registrations = make([]*RegistrationRecord, n)
+	for i := 0; i < n; i++ {
+		registered := false
+		if i < len(legacy.CAux) {
+			for _, c := range legacy.CAux[i] {
+				registered = registered || c != [5]byte{}
+			}
+		}
+		if len(w.NoteKeys[i]) == 0 || registered {
+			w.Migration.Unrecoverable = append(w.Migration.Unrecoverable, i)
+		}
+	}
+	return &w, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,10 @@
+//go:build large
+
+package main
+
+// Building the tests with -tags large also exercises the exchange circuits of sizes 10 to 60:
+//
+//	go test -tags large -timeout 0 ./...
+func init() {
+	largeCircuits = true
+}
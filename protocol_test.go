@@ -1,22 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdh"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/consensys/gnark-crypto/ecc"
 	bls12377 "github.com/consensys/gnark-crypto/ecc/bls12-377"
+	bls12377_fp "github.com/consensys/gnark-crypto/ecc/bls12-377/fp"
+	bw6761_fr "github.com/consensys/gnark-crypto/ecc/bw6-761/fr"
 	"github.com/consensys/gnark-crypto/ecc/bw6-761/fr/mimc"
 	"github.com/consensys/gnark/backend/groth16"
+	plonk_bw6761 "github.com/consensys/gnark/backend/plonk/bw6-761"
 	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
 	"github.com/consensys/gnark/std/algebra/native/sw_bls12377"
 
+	"implementation/internal/auction"
+	"implementation/internal/ceremony"
 	"implementation/internal/transactions/exchange"
 	"implementation/internal/transactions/register"
 	"implementation/internal/transactions/withdraw"
@@ -187,13 +200,14 @@ func TestEncryptionDecryption(t *testing.T) {
 		pkOut := big.NewInt(67890)
 
 		// Encrypt using DH-OTP (no additional randomness needed)
-		ciphertext := register.EncryptRegistrationData(*sharedKey, coins, energy, bid, skIn, pkOut)
+		note := registeredNote(coins, energy, skIn)
+		ciphertext := register.EncryptRegistrationData(*sharedKey, note, newOrder(zerocash.SideSell, 40, bid), skIn, pkOut)
 
 		// Decrypt using the same shared secret
 		sharedKey2 := zerocash.ComputeDHShared(kp2.Sk, kp1.Pk)
 		decrypted := register.DecryptRegistrationData(ciphertext, *sharedKey2)
 
-		// Verify decryption - order is: (pkOut, skIn, bid, coins, energy)
+		// Verify decryption - order is: (pkOut, skIn, bid, coins, energy, side, quantity, rhoIn, randIn)
 		if decrypted[0].Cmp(pkOut) != 0 {
 			t.Error("PkOut decryption failed")
 		}
@@ -209,248 +223,2324 @@ func TestEncryptionDecryption(t *testing.T) {
 		if decrypted[4].Cmp(energy) != 0 {
 			t.Error("Energy decryption failed")
 		}
+		if decrypted[5].Int64() != int64(zerocash.SideSell) || decrypted[6].Int64() != 40 {
+			t.Error("Order side and quantity decryption failed")
+		}
+		if decrypted[7].Cmp(new(big.Int).SetBytes(note.Rho)) != 0 || decrypted[8].Cmp(new(big.Int).SetBytes(note.Rand)) != 0 {
+			t.Error("Note opening decryption failed")
+		}
 	})
-}
-
-// =============================================================================
-// 2. CIRCUIT-SPECIFIC TESTS
-// =============================================================================
 
-func TestCircuitTx(t *testing.T) {
-	t.Run("CircuitTx Compilation", func(t *testing.T) {
-		var circuit zerocash.CircuitTx
-		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+	t.Run("ECDH-AES Note Encryption", func(t *testing.T) {
+		// The tx^in note sent to the auctioneer decrypts to the same note
+		priv, pub, _ := generateECDHKeyPair()
+		note := registeredNote(big.NewInt(100), big.NewInt(50), big.NewInt(12345))
+		ciphertext, err := zerocash.EncryptNoteForAuctioneer(note, pub)
 		if err != nil {
-			t.Fatalf("CircuitTx compilation failed: %v", err)
+			t.Fatalf("Note encryption failed: %v", err)
+		}
+		decrypted, err := zerocash.DecryptNoteFromAuctioneer(ciphertext, priv)
+		if err != nil {
+			t.Fatalf("Note decryption failed: %v", err)
+		}
+		if decrypted.Value.Coins.Cmp(note.Value.Coins) != 0 || decrypted.Value.Energy.Cmp(note.Value.Energy) != 0 ||
+			!bytes.Equal(decrypted.PkOwner, note.PkOwner) || !bytes.Equal(decrypted.Rho, note.Rho) ||
+			!bytes.Equal(decrypted.Rand, note.Rand) || !bytes.Equal(decrypted.Cm, note.Cm) {
+			t.Error("Decrypted note does not match the encrypted one")
+		}
+		other, _, _ := generateECDHKeyPair()
+		if _, err := zerocash.DecryptNoteFromAuctioneer(ciphertext, other); err == nil {
+			t.Error("Another key should not decrypt the note")
 		}
 	})
+}
 
-	t.Run("CircuitTx Key Generation", func(t *testing.T) {
-		var circuit zerocash.CircuitTx
-		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
-		if err != nil {
-			t.Fatalf("CircuitTx compilation failed: %v", err)
+func TestLedgerMerkleTree(t *testing.T) {
+	t.Run("Authentication Paths", func(t *testing.T) {
+		ledger := zerocash.NewLedger()
+		emptyRoot := ledger.MerkleRoot()
+
+		notes := make([]*zerocash.Note, 5)
+		for i := range notes {
+			notes[i] = zerocash.NewNote(big.NewInt(int64(100+i)), big.NewInt(50), zerocash.RandomBytesPublic(32))
+			tx := &zerocash.PublicTx{
+				SnOld: fmt.Sprintf("%d", i+1),
+				CmNew: new(big.Int).SetBytes(notes[i].Cm).String(),
+			}
+			if err := ledger.AppendTx(tx); err != nil {
+				t.Fatalf("AppendTx failed: %v", err)
+			}
 		}
 
-		pk, vk, err := groth16.Setup(ccs)
-		if err != nil {
-			t.Fatalf("CircuitTx key generation failed: %v", err)
+		if ledger.MerkleRoot() == emptyRoot {
+			t.Error("Merkle root did not change after appending commitments")
+		}
+		roots := ledger.RecentMerkleRoots()
+		if len(roots) != len(notes)+1 {
+			t.Errorf("Expected %d roots in history, got %d", len(notes)+1, len(roots))
+		}
+		if roots[len(roots)-1] != ledger.MerkleRoot() {
+			t.Error("Last root in history is not the current root")
 		}
 
-		if pk == nil || vk == nil {
-			t.Error("Generated keys are nil")
+		for i, note := range notes {
+			path, err := ledger.MerklePath(i)
+			if err != nil {
+				t.Fatalf("MerklePath(%d) failed: %v", i, err)
+			}
+			if new(big.Int).SetBytes(path.Leaf).Cmp(new(big.Int).SetBytes(note.Cm)) != 0 {
+				t.Errorf("Path %d does not start at the note commitment", i)
+			}
+			if len(path.Siblings) != zerocash.MerkleTreeDepth {
+				t.Errorf("Path %d has %d siblings, expected %d", i, len(path.Siblings), zerocash.MerkleTreeDepth)
+			}
+			if !path.Verify() {
+				t.Errorf("Path %d does not verify against the current root", i)
+			}
+		}
+
+		path, _ := ledger.MerklePath(2)
+		path.Leaf = notes[3].Cm
+		if path.Verify() {
+			t.Error("Path verified for the wrong leaf")
+		}
+		if _, err := ledger.MerklePath(len(notes)); err == nil {
+			t.Error("MerklePath should fail for an index past the last leaf")
 		}
 	})
-}
 
-func TestCircuitTxRegister(t *testing.T) {
-	t.Run("CircuitTxRegister Compilation", func(t *testing.T) {
-		var circuit register.CircuitTxRegister
-		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+	t.Run("Persistence", func(t *testing.T) {
+		ledger := zerocash.NewLedger()
+		for i := 0; i < 3; i++ {
+			note := zerocash.NewNote(big.NewInt(10), big.NewInt(20), zerocash.RandomBytesPublic(32))
+			tx := &zerocash.PublicTx{SnOld: fmt.Sprintf("%d", i+1), CmNew: new(big.Int).SetBytes(note.Cm).String()}
+			if err := ledger.AppendTx(tx); err != nil {
+				t.Fatalf("AppendTx failed: %v", err)
+			}
+		}
+
+		path := filepath.Join(t.TempDir(), "ledger.json")
+		if err := ledger.SaveToFile(path); err != nil {
+			t.Fatalf("SaveToFile failed: %v", err)
+		}
+		loaded, err := zerocash.LoadLedgerFromFile(path)
 		if err != nil {
-			t.Fatalf("CircuitTxRegister compilation failed: %v", err)
+			t.Fatalf("LoadLedgerFromFile failed: %v", err)
+		}
+		if loaded.MerkleRoot() != ledger.MerkleRoot() {
+			t.Error("Merkle root changed across save/load")
+		}
+		if p, err := loaded.MerklePath(1); err != nil || !p.Verify() {
+			t.Errorf("Rebuilt tree does not produce valid paths: %v", err)
+		}
+
+		// A ledger whose commitments no longer match the persisted root must be rejected
+		loaded.CmList[0] = loaded.CmList[1]
+		if err := loaded.SaveToFile(path); err != nil {
+			t.Fatalf("SaveToFile failed: %v", err)
+		}
+		if _, err := zerocash.LoadLedgerFromFile(path); err == nil {
+			t.Error("Loading a ledger with tampered commitments should fail")
 		}
 	})
 
-	t.Run("CircuitTxRegister Key Generation", func(t *testing.T) {
-		var circuit register.CircuitTxRegister
-		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+	t.Run("Legacy Format Migration", func(t *testing.T) {
+		// A version 1 ledger stored each transaction with its plaintext notes
+		note := zerocash.NewNote(big.NewInt(10), big.NewInt(20), zerocash.RandomBytesPublic(32))
+		cm := new(big.Int).SetBytes(note.Cm).String()
+		legacy := map[string]any{
+			"CmList": []string{cm},
+			"SnList": []string{"1"},
+			"TxList": []map[string]any{{
+				"OldNote": note,
+				"NewNote": note,
+				"Proof":   []byte{1, 2, 3},
+				"CmOld":   cm,
+				"SnOld":   "1",
+				"CmNew":   cm,
+				"CNew":    []string{"1", "2", "3", "4", "5", "6"}, // circuit ciphertext in the oldest format
+			}},
+		}
+		data, err := json.Marshal(legacy)
 		if err != nil {
-			t.Fatalf("CircuitTxRegister compilation failed: %v", err)
+			t.Fatalf("Marshaling legacy ledger failed: %v", err)
+		}
+		path := filepath.Join(t.TempDir(), "ledger.json")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Writing legacy ledger failed: %v", err)
 		}
 
-		pk, vk, err := groth16.Setup(ccs)
+		migrated, err := zerocash.MigrateLedgerFile(path)
+		if err != nil || !migrated {
+			t.Fatalf("Migration failed: migrated=%v, err=%v", migrated, err)
+		}
+		data, _ = os.ReadFile(path)
+		for _, field := range []string{"OldNote", "NewNote", "PkOwner", "Rho", "Rand"} {
+			if strings.Contains(string(data), field) {
+				t.Errorf("Migrated ledger still contains %s", field)
+			}
+		}
+		loaded, err := zerocash.LoadLedgerFromFile(path)
 		if err != nil {
-			t.Fatalf("CircuitTxRegister key generation failed: %v", err)
+			t.Fatalf("Loading migrated ledger failed: %v", err)
+		}
+		if loaded.Version != zerocash.LedgerVersion || len(loaded.TxList) != 1 || loaded.TxList[0].CmNew != cm {
+			t.Fatalf("Migrated ledger lost data: version %d, %d transactions", loaded.Version, len(loaded.TxList))
+		}
+		if loaded.TxList[0].CNewCircuit[5] != "6" {
+			t.Errorf("Legacy circuit ciphertext not carried over: %v", loaded.TxList[0].CNewCircuit)
+		}
+		if !loaded.HasSerialNumber("1") || !loaded.HasCommitment(cm) {
+			t.Error("Migrated ledger lost its serial numbers or commitments")
 		}
 
-		if pk == nil || vk == nil {
-			t.Error("Generated keys are nil")
+		if migrated, err := zerocash.MigrateLedgerFile(path); err != nil || migrated {
+			t.Errorf("Migrating a current ledger should be a no-op: migrated=%v, err=%v", migrated, err)
+		}
+
+		// A version 2 ledger stored each transaction's values and old owner key in the clear
+		v2 := map[string]any{
+			"Version": 2,
+			"CmList":  []string{cm},
+			"SnList":  []string{"1"},
+			"TxList": []map[string]any{{
+				"Proof":     []byte{1, 2, 3},
+				"OldCoin":   "10",
+				"OldEnergy": "20",
+				"SnOld":     "1",
+				"PkOld":     "12345",
+				"NewCoin":   "10",
+				"NewEnergy": "20",
+				"CmNew":     cm,
+			}},
+		}
+		data, _ = json.Marshal(v2)
+		os.WriteFile(path, data, 0644)
+		if migrated, err := zerocash.MigrateLedgerFile(path); err != nil || !migrated {
+			t.Fatalf("Version 2 migration failed: migrated=%v, err=%v", migrated, err)
+		}
+		data, _ = os.ReadFile(path)
+		for _, field := range []string{"OldCoin", "OldEnergy", "PkOld", "NewCoin", "NewEnergy"} {
+			if strings.Contains(string(data), field) {
+				t.Errorf("Migrated version 2 ledger still contains %s", field)
+			}
+		}
+		if loaded, err := zerocash.LoadLedgerFromFile(path); err != nil || len(loaded.TxList) != 1 || loaded.TxList[0].SnOld != "1" {
+			t.Errorf("Migrated version 2 ledger lost data: %v", err)
+		}
+
+		// A version 3 ledger stored the values and old owner keys of each batch
+		v3 := map[string]any{
+			"Version": 3,
+			"CmList":  []string{cm},
+			"SnList":  []string{"2"},
+			"BatchTxs": []map[string]any{{
+				"Proof":     []byte{1, 2, 3},
+				"OldCoin":   []string{"10"},
+				"OldEnergy": []string{"20"},
+				"SnOld":     []string{"2"},
+				"PkOld":     []string{"12345"},
+				"NewCoin":   []string{"10"},
+				"NewEnergy": []string{"20"},
+				"CmNew":     []string{cm},
+			}},
+		}
+		data, _ = json.Marshal(v3)
+		os.WriteFile(path, data, 0644)
+		if migrated, err := zerocash.MigrateLedgerFile(path); err != nil || !migrated {
+			t.Fatalf("Version 3 migration failed: migrated=%v, err=%v", migrated, err)
+		}
+		data, _ = os.ReadFile(path)
+		for _, field := range []string{"OldCoin", "OldEnergy", "PkOld", "NewCoin", "NewEnergy"} {
+			if strings.Contains(string(data), field) {
+				t.Errorf("Migrated version 3 ledger still contains %s", field)
+			}
+		}
+		if loaded, err := zerocash.LoadLedgerFromFile(path); err != nil || len(loaded.BatchTxs) != 1 || loaded.BatchTxs[0].SnOld[0] != "2" {
+			t.Errorf("Migrated version 3 ledger lost data: %v", err)
+		}
+
+		// Ledgers from a newer format are refused rather than silently rewritten
+		os.WriteFile(path, []byte(`{"Version": 99}`), 0644)
+		if _, err := zerocash.LoadLedgerFromFile(path); err == nil {
+			t.Error("Loading a ledger from a newer version should fail")
 		}
 	})
 }
 
-func TestCircuitTxF10(t *testing.T) {
-	t.Run("CircuitTxF10 Compilation", func(t *testing.T) {
-		var circuit exchange.CircuitTxF10
-		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+func TestWalletLedgerScanner(t *testing.T) {
+	// Ledger entries are built directly: the scanner only reads public data, so no proofs are needed
+	owner, _ := zerocash.GenerateDHKeyPair()
+	other, _ := zerocash.GenerateDHKeyPair()
+	wallet := &zerocash.Wallet{Name: "owner", Sk: owner.Sk, Pk: owner.Pk}
+	skBytes := owner.Sk.Bytes()
+	sk := skBytes[:]
+	otherSk := other.Sk.Bytes()
+
+	ledger := zerocash.NewLedger()
+	note1 := zerocash.NewNote(big.NewInt(100), big.NewInt(50), sk)
+	note2 := zerocash.NewNote(big.NewInt(7), big.NewInt(3), sk)
+	foreign := zerocash.NewNote(big.NewInt(1), big.NewInt(1), otherSk[:])
+	for _, out := range []struct {
+		note *zerocash.Note
+		to   *bls12377.G1Affine
+	}{{note1, owner.Pk}, {foreign, other.Pk}, {note2, owner.Pk}} {
+		if err := ledger.AppendTx(publicTxTo(out.note, out.to, zerocash.RandomBytesPublic(32))); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+	}
+
+	t.Run("Trial Decryption", func(t *testing.T) {
+		result, err := wallet.ScanLedger(ledger)
 		if err != nil {
-			t.Fatalf("CircuitTxF10 compilation failed: %v", err)
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(result.Received) != 2 || len(wallet.Notes) != 2 {
+			t.Fatalf("Received %d notes (wallet has %d), want 2", len(result.Received), len(wallet.Notes))
+		}
+		for i, want := range []*zerocash.Note{note1, note2} {
+			if new(big.Int).SetBytes(wallet.Notes[i].Cm).Cmp(new(big.Int).SetBytes(want.Cm)) != 0 {
+				t.Errorf("Note %d does not match the sent note", i)
+			}
+			if !bytes.Equal(wallet.NoteKeys[i], sk) {
+				t.Errorf("Note %d was added with the wrong secret key", i)
+			}
+		}
+		if wallet.Checkpoint.Txs != 3 {
+			t.Errorf("Checkpoint is at %d transactions, want 3", wallet.Checkpoint.Txs)
 		}
 	})
 
-	t.Run("CircuitTxF10 Key Generation", func(t *testing.T) {
-		var circuit exchange.CircuitTxF10
-		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+	t.Run("Incremental Rescan", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "wallet.json")
+		if err := wallet.SetPassphrase([]byte("passphrase")); err != nil {
+			t.Fatalf("Setting wallet passphrase failed: %v", err)
+		}
+		if err := wallet.Save(path); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
+		loaded, err := zerocash.LoadWallet(path, []byte("passphrase"))
 		if err != nil {
-			t.Fatalf("CircuitTxF10 compilation failed: %v", err)
+			t.Fatalf("Wallet load failed: %v", err)
 		}
-
-		pk, vk, err := groth16.Setup(ccs)
+		if loaded.Checkpoint != wallet.Checkpoint {
+			t.Errorf("Checkpoint %+v was not persisted, got %+v", wallet.Checkpoint, loaded.Checkpoint)
+		}
+		result, err := loaded.ScanLedger(ledger)
 		if err != nil {
-			t.Fatalf("CircuitTxF10 key generation failed: %v", err)
+			t.Fatalf("Rescan failed: %v", err)
 		}
-
-		if pk == nil || vk == nil {
-			t.Error("Generated keys are nil")
+		if len(result.Received) != 0 || len(loaded.Notes) != 2 {
+			t.Errorf("Rescan received %d notes (wallet has %d), want none new", len(result.Received), len(loaded.Notes))
 		}
 	})
-}
 
-func TestCircuitWithdraw(t *testing.T) {
-	t.Run("CircuitWithdraw Compilation", func(t *testing.T) {
-		var circuit withdraw.CircuitWithdraw
-		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+	t.Run("Spend Detection", func(t *testing.T) {
+		// note1 is spent by a transaction, note2 by a withdrawal
+		sn1 := new(big.Int).SetBytes(zerocash.SerialNumber(sk, note1.Rho))
+		spendTx := publicTxTo(zerocash.NewNote(big.NewInt(100), big.NewInt(50), otherSk[:]), other.Pk, sn1.Bytes())
+		if err := ledger.AppendTx(spendTx); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+		sn2 := new(big.Int).SetBytes(zerocash.SerialNumber(sk, note2.Rho))
+		anchor, _ := new(big.Int).SetString(ledger.MerkleRoot(), 10)
+		if err := ledger.AppendWithdrawTx(&zerocash.WithdrawTx{Anchor: anchor, SnIn: sn2, CmOut: big.NewInt(1)}); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+
+		result, err := wallet.ScanLedger(ledger)
 		if err != nil {
-			t.Fatalf("CircuitWithdraw compilation failed: %v", err)
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(result.Spent) != 2 || !wallet.Spent[0] || !wallet.Spent[1] {
+			t.Errorf("Spent notes not detected: result %d, wallet %v", len(result.Spent), wallet.Spent)
+		}
+		if len(result.Received) != 0 {
+			t.Errorf("A payment to another wallet was recognized")
+		}
+		if wallet.Checkpoint.Withdraws != 1 {
+			t.Errorf("Checkpoint is at %d withdrawals, want 1", wallet.Checkpoint.Withdraws)
 		}
 	})
 
-	t.Run("CircuitWithdraw Key Generation", func(t *testing.T) {
-		var circuit withdraw.CircuitWithdraw
-		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
-		if err != nil {
-			t.Fatalf("CircuitWithdraw compilation failed: %v", err)
+	t.Run("Ledger Behind Checkpoint", func(t *testing.T) {
+		if _, err := wallet.ScanLedger(zerocash.NewLedger()); err == nil {
+			t.Error("Scanning a ledger shorter than the checkpoint should fail")
 		}
+	})
 
-		pk, vk, err := groth16.Setup(ccs)
-		if err != nil {
-			t.Fatalf("CircuitWithdraw key generation failed: %v", err)
+	t.Run("Claim Exchange Output", func(t *testing.T) {
+		// An exchange output is owned by pk^out and claimed with the registration's sk^out
+		skOut := zerocash.RandomBytesPublic(31)
+		claimer := &zerocash.Wallet{Name: "claimer", Sk: owner.Sk, Pk: owner.Pk}
+		claimer.AddNote(note1, sk, &zerocash.RegistrationRecord{SkIn: sk, SkOut: skOut, NoteIn: note1}, nil)
+		output := zerocash.NewNote(big.NewInt(90), big.NewInt(60), skOut)
+		stray := zerocash.NewNote(big.NewInt(90), big.NewInt(60), sk)
+		exchangeLedger := zerocash.NewLedger()
+		entry := &zerocash.ExchangeTx{
+			SnIn:  []string{"1", "2"},
+			CmOut: []string{new(big.Int).SetBytes(output.Cm).String(), new(big.Int).SetBytes(stray.Cm).String()},
+			CNew:  make([][6]string, 2),
+			G_r:   make([]sw_bls12377.G1Affine, 2),
+			G_s:   make([]sw_bls12377.G1Affine, 2),
+		}
+		if err := exchangeLedger.AppendExchangeTx(entry); err != nil {
+			t.Fatalf("Appending the exchange failed: %v", err)
 		}
 
-		if pk == nil || vk == nil {
-			t.Error("Generated keys are nil")
+		if err := claimer.ClaimExchangeOutput(exchangeLedger, stray); err == nil {
+			t.Error("Claiming an output no registration's pk^out owns should fail")
+		}
+		if err := claimer.ClaimExchangeOutput(exchangeLedger, output); err != nil {
+			t.Fatalf("Claiming the exchange output failed: %v", err)
+		}
+		if len(claimer.Notes) != 2 || !bytes.Equal(claimer.NoteKeys[1], skOut) {
+			t.Error("The exchange output was not added with the registration's sk^out")
+		}
+		if err := claimer.ClaimExchangeOutput(exchangeLedger, output); err == nil || len(claimer.Notes) != 2 {
+			t.Error("Claiming the same exchange output twice should fail")
 		}
 	})
 }
 
-// =============================================================================
-// 3. INDIVIDUAL ALGORITHM TESTS
-// =============================================================================
-
-func TestAlgorithm1Transaction(t *testing.T) {
-	// Setup circuit keys
-	var circuit zerocash.CircuitTx
-	ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
-	if err != nil {
-		t.Fatalf("Circuit compilation failed: %v", err)
-	}
-	pk, vk, err := groth16.Setup(ccs)
-	if err != nil {
-		t.Fatalf("Key generation failed: %v", err)
+func TestEncryptedWallet(t *testing.T) {
+	kp, _ := zerocash.GenerateDHKeyPair()
+	sk := zerocash.RandomBytesPublic(32)
+	note := zerocash.NewNote(big.NewInt(100), big.NewInt(50), sk)
+	newWallet := func() *zerocash.Wallet {
+		return &zerocash.Wallet{Name: "alice", Sk: kp.Sk, Pk: kp.Pk,
+			Notes: []*zerocash.Note{note}, NoteKeys: [][]byte{sk}, Spent: []bool{false}}
 	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alice_wallet.json")
 
-	t.Run("Valid Transaction Creation", func(t *testing.T) {
-		// Create a note
-		coins := big.NewInt(100)
-		energy := big.NewInt(50)
-		sk := zerocash.RandomBytesPublic(32)
-		note := zerocash.NewNote(coins, energy, sk)
-
-		// Create transaction
-		newSk := zerocash.RandomBytesPublic(32)
-		pkNew := zerocash.MimcHashPublic(newSk).Bytes() // Compute pk from sk as per Algorithm 1
-		params := &zerocash.Params{}
-
-		// Generate ECDH key pair for auctioneer
-		_, auctioneerECDHPub, err := generateECDHKeyPair()
-		if err != nil {
-			t.Fatalf("ECDH key generation failed: %v", err)
+	t.Run("Save and Load", func(t *testing.T) {
+		w := newWallet()
+		if err := w.Save(path); !errors.Is(err, zerocash.ErrNoPassphrase) {
+			t.Fatalf("Saving without a passphrase should fail with ErrNoPassphrase, got %v", err)
 		}
-
-		tx, err := zerocash.CreateTx(note, sk, pkNew, coins, energy, params, ccs, pk, auctioneerECDHPub)
-		if err != nil {
-			t.Fatalf("Transaction creation failed: %v", err)
+		if err := w.SetPassphrase([]byte("correct horse")); err != nil {
+			t.Fatalf("Setting passphrase failed: %v", err)
+		}
+		if err := w.Save(path); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), kp.Sk.String()) || strings.Contains(string(data), "NoteKeys") {
+			t.Error("Wallet file contains plaintext secrets")
 		}
 
-		// Verify transaction
-		err = zerocash.VerifyTx(tx, params, vk)
+		loaded, err := zerocash.LoadWallet(path, []byte("correct horse"))
 		if err != nil {
-			t.Fatalf("Transaction verification failed: %v", err)
+			t.Fatalf("Wallet load failed: %v", err)
+		}
+		if !loaded.Sk.Equal(kp.Sk) || len(loaded.Notes) != 1 || !bytes.Equal(loaded.NoteKeys[0], sk) {
+			t.Error("Loaded wallet does not match the saved wallet")
+		}
+		if _, err := zerocash.LoadWallet(path, []byte("wrong")); !errors.Is(err, zerocash.ErrWrongPassphrase) {
+			t.Errorf("Loading with a wrong passphrase should fail with ErrWrongPassphrase, got %v", err)
 		}
 	})
 
-	t.Run("Invalid Transaction Rejection", func(t *testing.T) {
-		// Create a note
-		coins := big.NewInt(100)
-		energy := big.NewInt(50)
-		sk := zerocash.RandomBytesPublic(32)
-		note := zerocash.NewNote(coins, energy, sk)
+	t.Run("Tamper Detection", func(t *testing.T) {
+		data, _ := os.ReadFile(path)
+		var file map[string]any
+		json.Unmarshal(data, &file)
+		for _, tamper := range []func(){
+			func() { ct := file["ciphertext"].(string); file["ciphertext"] = "AAAA" + ct[4:] },
+			func() { file["kdf_params"].(map[string]any)["n"] = 1 << 14 },
+		} {
+			json.Unmarshal(data, &file)
+			tamper()
+			tampered, _ := json.Marshal(file)
+			tamperedPath := filepath.Join(dir, "tampered.json")
+			os.WriteFile(tamperedPath, tampered, 0600)
+			if _, err := zerocash.LoadWallet(tamperedPath, []byte("correct horse")); err == nil {
+				t.Error("A tampered wallet file should not load")
+			}
+		}
 
-		// Try to create transaction with wrong secret key
-		wrongSk := zerocash.RandomBytesPublic(32)
-		newSk := zerocash.RandomBytesPublic(32)
-		pkNew := zerocash.MimcHashPublic(newSk).Bytes()
-		params := &zerocash.Params{}
+		// Costs past the bounds are refused before scrypt runs: N=2^30 would need 1 TiB, and
+		// N=2^20 with r=32 and p=16 4 GiB and minutes of CPU
+		for _, kdf := range []map[string]any{
+			{"n": 1 << 30}, {"n": 3 << 10}, {"n": 0}, {"r": 1 << 10}, {"r": 0}, {"p": 1 << 10},
+			{"n": 1 << 20, "r": 32, "p": 16}, {"n": 1 << 19}, {"r": 9}, {"p": 5},
+		} {
+			json.Unmarshal(data, &file)
+			for k, v := range kdf {
+				file["kdf_params"].(map[string]any)[k] = v
+			}
+			tampered, _ := json.Marshal(file)
+			tamperedPath := filepath.Join(dir, "tampered.json")
+			os.WriteFile(tamperedPath, tampered, 0600)
+			_, err := zerocash.LoadWallet(tamperedPath, []byte("correct horse"))
+			if err == nil || !strings.Contains(err.Error(), "unsupported scrypt parameters") {
+				t.Errorf("Wallet with scrypt parameters %v should be refused, got %v", kdf, err)
+			}
+		}
+	})
 
-		// Generate ECDH key pair for auctioneer
-		_, auctioneerECDHPub, err := generateECDHKeyPair()
+	t.Run("Lock and Unlock", func(t *testing.T) {
+		w, err := zerocash.LoadWallet(path, []byte("correct horse"))
 		if err != nil {
-			t.Fatalf("ECDH key generation failed: %v", err)
+			t.Fatalf("Wallet load failed: %v", err)
+		}
+		if err := w.Lock(); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+		if !w.Locked() || w.Sk != nil || len(w.Notes) != 0 {
+			t.Error("A locked wallet should not hold its keys or notes")
 		}
 
-		_, err = zerocash.CreateTx(note, wrongSk, pkNew, coins, energy, params, ccs, pk, auctioneerECDHPub)
-		if err == nil {
-			t.Error("Transaction with wrong secret key should have failed")
+		// The registration secrets and withdraw output openings are wiped too
+		registered, _ := zerocash.LoadWallet(path, []byte("correct horse"))
+		reg := &zerocash.RegistrationRecord{SkIn: zerocash.RandomBytesPublic(32), SkOut: zerocash.RandomBytesPublic(32),
+			REnc: zerocash.RandomBytesPublic(32), NoteIn: zerocash.NewNote(big.NewInt(100), big.NewInt(50), sk)}
+		if err := registered.RecordRegistration(reg); err != nil {
+			t.Fatalf("Recording the registration failed: %v", err)
+		}
+		out := registered.GetWithdrawOutputNote()
+		if out == nil {
+			t.Fatal("Wallet has no withdraw output note")
+		}
+		if err := registered.Lock(); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+		for name, secret := range map[string][]byte{"sk^in": reg.SkIn, "sk^out": reg.SkOut, "r_enc": reg.REnc, "withdraw ρ": out.Rho, "withdraw r": out.Rand} {
+			if new(big.Int).SetBytes(secret).Sign() != 0 {
+				t.Errorf("Lock left %s in memory", name)
+			}
+		}
+		if err := w.SetPassphrase([]byte("other")); !errors.Is(err, zerocash.ErrWalletLocked) {
+			t.Errorf("Changing the passphrase of a locked wallet should fail, got %v", err)
+		}
+		if err := w.Unlock([]byte("wrong")); !errors.Is(err, zerocash.ErrWrongPassphrase) {
+			t.Errorf("Unlocking with a wrong passphrase should fail, got %v", err)
+		}
+		if err := w.Unlock([]byte("correct horse")); err != nil {
+			t.Fatalf("Unlock failed: %v", err)
+		}
+		if w.Locked() || !w.Sk.Equal(kp.Sk) || len(w.Notes) != 1 {
+			t.Error("Unlocked wallet does not match the saved wallet")
 		}
 	})
 
-	t.Run("Double Spending Prevention", func(t *testing.T) {
-		// Create a note
-		coins := big.NewInt(100)
-		energy := big.NewInt(50)
-		sk := zerocash.RandomBytesPublic(32)
-		note := zerocash.NewNote(coins, energy, sk)
-
-		// Create first transaction
-		newSk1 := zerocash.RandomBytesPublic(32)
-		pkNew1 := zerocash.MimcHashPublic(newSk1).Bytes()
-		params := &zerocash.Params{}
-
-		// Generate ECDH key pair for auctioneer
-		_, auctioneerECDHPub, err := generateECDHKeyPair()
+	t.Run("Passphrase Change", func(t *testing.T) {
+		w, err := zerocash.LoadWallet(path, []byte("correct horse"))
 		if err != nil {
-			t.Fatalf("ECDH key generation failed: %v", err)
+			t.Fatalf("Wallet load failed: %v", err)
 		}
-
-		tx1, err := zerocash.CreateTx(note, sk, pkNew1, coins, energy, params, ccs, pk, auctioneerECDHPub)
-		if err != nil {
-			t.Fatalf("First transaction creation failed: %v", err)
+		if err := w.ChangePassphrase([]byte("wrong"), []byte("battery staple")); !errors.Is(err, zerocash.ErrWrongPassphrase) {
+			t.Errorf("Changing the passphrase with a wrong one should fail, got %v", err)
+		}
+		if err := w.ChangePassphrase([]byte("correct horse"), []byte("battery staple")); err != nil {
+			t.Fatalf("Passphrase change failed: %v", err)
+		}
+		if err := w.Save(path); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
+		if _, err := zerocash.LoadWallet(path, []byte("correct horse")); err == nil {
+			t.Error("The old passphrase should no longer open the wallet")
 		}
+		if _, err := zerocash.LoadWallet(path, []byte("battery staple")); err != nil {
+			t.Errorf("The new passphrase should open the wallet: %v", err)
+		}
+	})
 
-		// Create second transaction with same note (double spending)
-		newSk2 := zerocash.RandomBytesPublic(32)
-		pkNew2 := zerocash.MimcHashPublic(newSk2).Bytes()
-		tx2, err := zerocash.CreateTx(note, sk, pkNew2, coins, energy, params, ccs, pk, auctioneerECDHPub)
+	t.Run("Plaintext Import and Export", func(t *testing.T) {
+		plainPath := filepath.Join(dir, "plain.json")
+		if err := newWallet().ExportPlaintext(plainPath); err != nil {
+			t.Fatalf("Plaintext export failed: %v", err)
+		}
+		if _, err := zerocash.LoadWallet(plainPath, []byte("correct horse")); err == nil {
+			t.Error("LoadWallet should refuse a plaintext wallet file")
+		}
+		imported, err := zerocash.ImportPlaintextWallet(plainPath)
 		if err != nil {
-			t.Fatalf("Second transaction creation failed: %v", err)
+			t.Fatalf("Plaintext import failed: %v", err)
 		}
-
-		// Both transactions should have the same serial number (detecting double spend)
-		if tx1.SnOld != tx2.SnOld {
-			t.Error("Double spending not detected - serial numbers differ")
+		if !imported.Sk.Equal(kp.Sk) || !bytes.Equal(imported.NoteKeys[0], sk) {
+			t.Error("Imported wallet does not match the exported wallet")
 		}
 	})
 }
 
-func TestAlgorithm2Register(t *testing.T) {
-	// Setup circuit keys
-	var circuitTx zerocash.CircuitTx
-	ccsTx, _ := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitTx)
-	pkTx, vkTx, _ := groth16.Setup(ccsTx)
-
-	var circuitReg register.CircuitTxRegister
-	ccsReg, _ := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitReg)
-	pkReg, _, _ := groth16.Setup(ccsReg)
+func TestWalletPersistence(t *testing.T) {
+	kp, _ := zerocash.GenerateDHKeyPair()
+	skIn := zerocash.RandomBytesPublic(32)
+	skOut := zerocash.RandomBytesPublic(32)
+	reg := &zerocash.RegistrationRecord{
+		Round:    "round-7",
+		Bid:      big.NewInt(25),
+		Side:     zerocash.SideSell,
+		Quantity: big.NewInt(30),
+		SkIn:     skIn,
+		SkOut:    skOut,
+		REnc:     zerocash.RandomBytesPublic(32),
+		CAux: [zerocash.RegistrationFields]*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4),
+			big.NewInt(5), big.NewInt(1), big.NewInt(30)},
+		NoteIn: zerocash.NewNote(big.NewInt(100), big.NewInt(50), skIn),
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallet.json")
 
-	t.Run("Valid Registration", func(t *testing.T) {
-		// Create participant and auctioneer
-		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
-		participantKp, _ := zerocash.GenerateDHKeyPair()
+	t.Run("Registration Survives Restart", func(t *testing.T) {
+		w := &zerocash.Wallet{Name: "alice", Sk: kp.Sk, Pk: kp.Pk}
+		if err := w.RecordRegistration(reg); err != nil {
+			t.Fatalf("Recording registration failed: %v", err)
+		}
+		if err := w.RecordRegistration(reg); err == nil {
+			t.Error("Recording the same registration twice should fail")
+		}
+		outNote := w.GetWithdrawOutputNote()
+		cipherAux := w.GetWithdrawCipherAux()
+		w.SetPassphrase([]byte("passphrase"))
+		if err := w.Save(path); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
 
-		params := &zerocash.Params{}
-		participant := &zerocash.Participant{
-			Name:          "TestParticipant",
+		loaded, err := zerocash.LoadWallet(path, []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("Wallet load failed: %v", err)
+		}
+		if loaded.Version != zerocash.WalletSchemaVersion || loaded.Migration != nil {
+			t.Errorf("Loaded wallet has version %d, migration %+v", loaded.Version, loaded.Migration)
+		}
+		got := loaded.Registrations[0]
+		if got == nil || got.Round != "round-7" || got.Bid.Cmp(reg.Bid) != 0 || !bytes.Equal(got.SkOut, skOut) ||
+			got.Side != reg.Side || got.Quantity.Cmp(reg.Quantity) != 0 ||
+			got.CAux[4].Cmp(reg.CAux[4]) != 0 || new(big.Int).SetBytes(got.NoteIn.Cm).Cmp(new(big.Int).SetBytes(reg.NoteIn.Cm)) != 0 {
+			t.Fatalf("Registration record was not persisted: %+v", got)
+		}
+		if !bytes.Equal(loaded.GetWithdrawREnc(), reg.REnc) || !bytes.Equal(loaded.GetWithdrawSk(), skIn) {
+			t.Error("Withdraw secrets were lost on reload")
+		}
+		if !bytes.Equal(loaded.GetWithdrawOutputNote().Cm, outNote.Cm) {
+			t.Error("The withdraw output note changed across a reload")
+		}
+
+		// The withdraw ciphertext is the one CircuitWithdraw recomputes from (bid, sk^in, pk^out)
+		want := computeDHOTPEncryption(reg.Bid, new(big.Int).SetBytes(skIn), zerocash.MimcHashPublic(skOut), *convertToGnarkPoint(kp.Pk))
+		for i, c := range loaded.GetWithdrawCipherAux() {
+			if !bytes.Equal(c, cipherAux[i]) {
+				t.Errorf("Withdraw ciphertext %d changed across a reload", i)
+			}
+			if new(big.Int).SetBytes(c).Cmp(new(big.Int).Mod(want[i], bls12377_fp.Modulus())) != 0 {
+				t.Errorf("Withdraw ciphertext %d does not match the circuit encryption", i)
+			}
+		}
+	})
+
+	t.Run("Withdraw Output Scanned", func(t *testing.T) {
+		w := &zerocash.Wallet{Name: "alice", Sk: kp.Sk, Pk: kp.Pk}
+		if err := w.RecordRegistration(reg); err != nil {
+			t.Fatalf("Recording registration failed: %v", err)
+		}
+		ledger := zerocash.NewLedger()
+		addNoteToLedger(t, ledger, reg.NoteIn)
+		if _, err := w.ScanLedger(ledger); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+
+		// The registered note is withdrawn to its withdraw output note
+		outNote := w.GetWithdrawOutputNote()
+		anchor, _ := new(big.Int).SetString(ledger.MerkleRoot(), 10)
+		if err := ledger.AppendWithdrawTx(&zerocash.WithdrawTx{Anchor: anchor, CmIn: new(big.Int).SetBytes(reg.NoteIn.Cm),
+			SnIn: new(big.Int).SetBytes(zerocash.SerialNumber(skIn, reg.NoteIn.Rho)), CmOut: new(big.Int).SetBytes(outNote.Cm)}); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+		result, err := w.ScanLedger(ledger)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(result.Spent) != 1 || len(result.Received) != 1 || !bytes.Equal(result.Received[0].Cm, outNote.Cm) {
+			t.Fatalf("Scan found %d spent and %d received notes, want the registered note spent and the withdraw output received",
+				len(result.Spent), len(result.Received))
+		}
+		unspent := w.GetUnspentNotes()
+		if len(unspent) != 1 || unspent[0].Value.Coins.Cmp(big.NewInt(100)) != 0 || unspent[0].Value.Energy.Cmp(big.NewInt(50)) != 0 {
+			t.Errorf("Balance after the withdrawal is %d notes, want the 100 coins and 50 energy of the output", len(unspent))
+		}
+		if keys := w.GetUnspentNoteKeys(); len(keys) != 1 || !bytes.Equal(keys[0], skOut) {
+			t.Error("The withdraw output should be spendable with sk^out")
+		}
+		if result, _ := w.ScanLedger(ledger); len(result.Received) != 0 {
+			t.Error("A second scan should find nothing new")
+		}
+	})
+
+	t.Run("Withdraw Output Survives Restart", func(t *testing.T) {
+		w := &zerocash.Wallet{Name: "alice", Sk: kp.Sk, Pk: kp.Pk}
+		if err := w.RecordRegistration(reg); err != nil {
+			t.Fatalf("Recording registration failed: %v", err)
+		}
+		outNote := w.GetWithdrawOutputNote()
+		w.SetPassphrase([]byte("passphrase"))
+		withdrawPath := filepath.Join(dir, "withdraw_wallet.json")
+		if err := w.Save(withdrawPath); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
+
+		// The withdrawal lands while the wallet is closed
+		ledger := zerocash.NewLedger()
+		addNoteToLedger(t, ledger, reg.NoteIn)
+		anchor, _ := new(big.Int).SetString(ledger.MerkleRoot(), 10)
+		if err := ledger.AppendWithdrawTx(&zerocash.WithdrawTx{Anchor: anchor, CmIn: new(big.Int).SetBytes(reg.NoteIn.Cm),
+			SnIn: new(big.Int).SetBytes(zerocash.SerialNumber(skIn, reg.NoteIn.Rho)), CmOut: new(big.Int).SetBytes(outNote.Cm)}); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+
+		loaded, err := zerocash.LoadWallet(withdrawPath, []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("Wallet load failed: %v", err)
+		}
+		loaded.CheckNoteStatusAgainstLedger(ledger)
+		loaded.CheckNoteStatusAgainstLedger(ledger) // A second check adds nothing
+		if !loaded.Spent[0] || loaded.GetWithdrawInputNote() != nil {
+			t.Error("The withdrawn note should be spent")
+		}
+		unspent, keys := loaded.GetUnspentNotes(), loaded.GetUnspentNoteKeys()
+		if len(unspent) != 1 || !bytes.Equal(unspent[0].Cm, outNote.Cm) || !bytes.Equal(keys[0], skOut) {
+			t.Fatalf("Wallet holds %d unspent notes, want the withdraw output under sk^out", len(unspent))
+		}
+
+		// It stays a note of the wallet across the next restart
+		if err := loaded.Save(withdrawPath); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
+		reloaded, err := zerocash.LoadWallet(withdrawPath, []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("Wallet load failed: %v", err)
+		}
+		if unspent := reloaded.GetUnspentNotes(); len(unspent) != 1 || !bytes.Equal(unspent[0].Cm, outNote.Cm) {
+			t.Error("The withdraw output was lost across a restart")
+		}
+	})
+
+	t.Run("Legacy Wallet Migration", func(t *testing.T) {
+		// Version 1 wallets saved the registration ciphertext but not r_enc or the registration keys
+		noteKey := zerocash.RandomBytesPublic(32)
+		legacy := map[string]any{
+			"Name":     "bob",
+			"Sk":       kp.Sk,
+			"Pk":       kp.Pk,
+			"Notes":    []*zerocash.Note{zerocash.NewNote(big.NewInt(1), big.NewInt(1), noteKey), reg.NoteIn, reg.NoteIn},
+			"NoteKeys": [][]byte{noteKey, skIn},
+			"Spent":    []bool{false, false, false},
+			"CAux":     [][][5]byte{{{}}, {{1, 2, 3, 4, 5}}, {{}}},
+		}
+		data, _ := json.Marshal(legacy)
+		legacyPath := filepath.Join(dir, "legacy.json")
+		os.WriteFile(legacyPath, data, 0600)
+
+		w, err := zerocash.ImportPlaintextWallet(legacyPath)
+		if err != nil {
+			t.Fatalf("Legacy import failed: %v", err)
+		}
+		if w.Migration == nil || w.Migration.FromVersion != 1 {
+			t.Fatalf("Legacy wallet was not reported as migrated: %+v", w.Migration)
+		}
+		// Note 1 was registered without its secrets, note 2 has no key
+		if fmt.Sprint(w.Migration.Unrecoverable) != "[1 2]" {
+			t.Errorf("Unrecoverable notes %v, want [1 2]", w.Migration.Unrecoverable)
+		}
+		if w.Version != zerocash.WalletSchemaVersion || len(w.Registrations) != 3 || len(w.NoteKeys) != 3 {
+			t.Errorf("Migrated wallet is inconsistent: version %d, %d registrations, %d keys", w.Version, len(w.Registrations), len(w.NoteKeys))
+		}
+
+		os.WriteFile(legacyPath, []byte(`{"Version": 99}`), 0600)
+		if _, err := zerocash.ImportPlaintextWallet(legacyPath); err == nil {
+			t.Error("A wallet from a newer schema should be refused")
+		}
+	})
+}
+
+func TestKeyHierarchy(t *testing.T) {
+	seed := zerocash.NewSeed()
+	keys, err := zerocash.NewKeyChain(seed)
+	if err != nil {
+		t.Fatalf("Key chain creation failed: %v", err)
+	}
+
+	t.Run("Deterministic Derivation", func(t *testing.T) {
+		again, _ := zerocash.NewKeyChain(seed)
+		if !keys.DHKey().Pk.Equal(again.DHKey().Pk) || !bytes.Equal(keys.NoteKey(5), again.NoteKey(5)) {
+			t.Error("The same seed should derive the same keys")
+		}
+		inA, outA, rA := keys.AuctionKeys(0)
+		inB, outB, rB := again.AuctionKeys(0)
+		if !inA.Equal(inB) || !outA.Equal(outB) || !rA.Equal(rB) {
+			t.Error("The same seed should derive the same auction keys")
+		}
+		inNext, _, _ := keys.AuctionKeys(1)
+		if inA.Equal(outA) || inA.Equal(inNext) || bytes.Equal(keys.NoteKey(0), keys.NoteKey(1)) {
+			t.Error("Different paths should derive different keys")
+		}
+		other, _ := zerocash.NewKeyChain(zerocash.NewSeed())
+		if other.DHKey().Pk.Equal(keys.DHKey().Pk) {
+			t.Error("Different seeds should derive different keys")
+		}
+		if _, err := zerocash.NewKeyChain(make([]byte, 8)); err == nil {
+			t.Error("A short seed should be rejected")
+		}
+	})
+
+	t.Run("Mnemonic", func(t *testing.T) {
+		// BIP-39 test vector
+		got, err := zerocash.MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "TREZOR")
+		if err != nil {
+			t.Fatalf("Mnemonic conversion failed: %v", err)
+		}
+		want := "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"
+		if fmt.Sprintf("%x", got) != want {
+			t.Errorf("Mnemonic seed %x, want %s", got, want)
+		}
+		if _, err := zerocash.MnemonicToSeed(strings.Repeat("abandon ", 12), ""); err == nil {
+			t.Error("A mnemonic with a bad checksum should be rejected")
+		}
+		if _, err := zerocash.MnemonicToSeed(strings.Repeat("notaword ", 12), ""); err == nil {
+			t.Error("A mnemonic with unknown words should be rejected")
+		}
+		mnemonic := zerocash.NewMnemonic()
+		if len(strings.Fields(mnemonic)) != 24 {
+			t.Errorf("New mnemonic has %d words, want 24", len(strings.Fields(mnemonic)))
+		}
+		if _, err := zerocash.MnemonicToSeed(mnemonic, ""); err != nil {
+			t.Errorf("A new mnemonic should be valid: %v", err)
+		}
+	})
+
+	t.Run("Restore From Seed", func(t *testing.T) {
+		wallet, err := zerocash.NewWalletFromSeed("alice", seed)
+		if err != nil {
+			t.Fatalf("Wallet creation failed: %v", err)
+		}
+		noteKey0, _ := wallet.NewNoteKey()
+		for i := 0; i < 3; i++ {
+			wallet.NewNoteKey()
+		}
+		noteKey3 := keys.NoteKey(3)
+		in, _, _, err := wallet.NewAuctionKeys()
+		if err != nil {
+			t.Fatalf("Auction key derivation failed: %v", err)
+		}
+		inBytes := in.Bytes()
+		skIn := inBytes[:]
+
+		// Payments to a derived note key, a later note key and a registration's sk^in; the first one is spent
+		ledger := zerocash.NewLedger()
+		paid := []*zerocash.Note{
+			zerocash.NewNote(big.NewInt(10), big.NewInt(1), noteKey0),
+			zerocash.NewNote(big.NewInt(20), big.NewInt(2), noteKey3),
+			zerocash.NewNote(big.NewInt(30), big.NewInt(3), skIn),
+		}
+		for _, note := range paid {
+			if err := ledger.AppendTx(publicTxTo(note, wallet.Pk, zerocash.RandomBytesPublic(32))); err != nil {
+				t.Fatalf("Ledger append failed: %v", err)
+			}
+		}
+		spendSn := zerocash.SerialNumber(noteKey0, paid[0].Rho)
+		foreign, _ := zerocash.GenerateDHKeyPair()
+		ledger.AppendTx(publicTxTo(zerocash.NewNote(big.NewInt(10), big.NewInt(1), zerocash.RandomBytesPublic(32)), foreign.Pk, spendSn))
+
+		restored, err := zerocash.RestoreWallet("alice", seed, ledger)
+		if err != nil {
+			t.Fatalf("Wallet restore failed: %v", err)
+		}
+		if !restored.Pk.Equal(wallet.Pk) {
+			t.Error("Restored wallet has another DH key")
+		}
+		if len(restored.Notes) != 3 {
+			t.Fatalf("Restored %d notes, want 3", len(restored.Notes))
+		}
+		if !restored.Spent[0] || restored.Spent[1] || restored.Spent[2] {
+			t.Errorf("Restored spent flags %v, want [true false false]", restored.Spent)
+		}
+		if !bytes.Equal(restored.NoteKeys[1], noteKey3) || !bytes.Equal(restored.NoteKeys[2], skIn) {
+			t.Error("Restored notes have the wrong secret keys")
+		}
+		if restored.NextNoteKey != 4 || restored.NextAuction != 1 {
+			t.Errorf("Restored key counters (%d, %d), want (4, 1)", restored.NextNoteKey, restored.NextAuction)
+		}
+		reg := restored.Registrations[2]
+		if reg == nil || reg.Index == nil || *reg.Index != 0 || !bytes.Equal(restored.GetWithdrawSk(), skIn) {
+			t.Error("The registration note was not restored with its derived keys")
+		}
+	})
+
+	t.Run("Restore After Withdraw", func(t *testing.T) {
+		withdrawSeed := zerocash.NewSeed()
+		wallet, err := zerocash.NewWalletFromSeed("bob", withdrawSeed)
+		if err != nil {
+			t.Fatalf("Wallet creation failed: %v", err)
+		}
+		in, _, _, err := wallet.NewAuctionKeys()
+		if err != nil {
+			t.Fatalf("Auction key derivation failed: %v", err)
+		}
+		inBytes := in.Bytes()
+		noteIn := zerocash.NewNote(big.NewInt(40), big.NewInt(4), inBytes[:])
+		ledger := zerocash.NewLedger()
+		if err := ledger.AppendTx(publicTxTo(noteIn, wallet.Pk, zerocash.RandomBytesPublic(32))); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+		if _, err := wallet.ScanLedger(ledger); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+
+		// The registered note is withdrawn; the withdrawal publishes only the output commitment
+		outNote := wallet.GetWithdrawOutputNote()
+		if outNote == nil {
+			t.Fatal("Wallet has no withdraw output note")
+		}
+		anchor, _ := new(big.Int).SetString(ledger.MerkleRoot(), 10)
+		if err := ledger.AppendWithdrawTx(&zerocash.WithdrawTx{Anchor: anchor, CmIn: new(big.Int).SetBytes(noteIn.Cm),
+			SnIn: new(big.Int).SetBytes(zerocash.SerialNumber(inBytes[:], noteIn.Rho)), CmOut: new(big.Int).SetBytes(outNote.Cm)}); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+
+		restored, err := zerocash.RestoreWallet("bob", withdrawSeed, ledger)
+		if err != nil {
+			t.Fatalf("Wallet restore failed: %v", err)
+		}
+		unspent := restored.GetUnspentNotes()
+		if len(unspent) != 1 || !bytes.Equal(unspent[0].Cm, outNote.Cm) || !bytes.Equal(unspent[0].Rho, outNote.Rho) {
+			t.Fatalf("Restored wallet holds %d unspent notes, want the withdraw output", len(unspent))
+		}
+		if !restored.Spent[0] {
+			t.Error("The withdrawn registration note should be restored as spent")
+		}
+	})
+}
+
+func TestViewingKeys(t *testing.T) {
+	wallet, err := zerocash.NewWalletFromSeed("alice", zerocash.NewSeed())
+	if err != nil {
+		t.Fatalf("Wallet creation failed: %v", err)
+	}
+	spendKey := wallet.SpendKey()
+	noteKey, _ := wallet.NewNoteKey()
+
+	// Payments to the spend key and a derived note key, and to someone else; the first one is spent
+	ledger := zerocash.NewLedger()
+	foreign, _ := zerocash.GenerateDHKeyPair()
+	paid := []*zerocash.Note{
+		zerocash.NewNote(big.NewInt(10), big.NewInt(1), spendKey),
+		zerocash.NewNote(big.NewInt(20), big.NewInt(2), noteKey),
+	}
+	for _, note := range paid {
+		if err := ledger.AppendTx(publicTxTo(note, wallet.Pk, zerocash.RandomBytesPublic(32))); err != nil {
+			t.Fatalf("Ledger append failed: %v", err)
+		}
+	}
+	spendSn := zerocash.SerialNumber(spendKey, paid[0].Rho)
+	ledger.AppendTx(publicTxTo(zerocash.NewNote(big.NewInt(10), big.NewInt(1), zerocash.RandomBytesPublic(32)), foreign.Pk, spendSn))
+
+	t.Run("Nullifier Key", func(t *testing.T) {
+		nk := zerocash.NullifierKey(spendKey)
+		if !bytes.Equal(zerocash.SerialNumberFromNullifierKey(nk, paid[0].Rho), spendSn) {
+			t.Error("Serial number from the nullifier key differs from SerialNumber")
+		}
+		if bytes.Equal(nk, zerocash.MimcHashPublic(spendKey).Bytes()) {
+			t.Error("Nullifier key equals the public note key")
+		}
+		skBytes := wallet.Sk.Bytes()
+		if bytes.Equal(spendKey, skBytes[:]) {
+			t.Error("Spend key equals the DH key")
+		}
+	})
+
+	t.Run("Incoming Viewing Key", func(t *testing.T) {
+		ivk, err := wallet.IncomingViewingKey()
+		if err != nil {
+			t.Fatalf("Incoming viewing key export failed: %v", err)
+		}
+		if ivk.Full() {
+			t.Error("Incoming viewing key reports itself as full")
+		}
+		watch, err := zerocash.NewWatchOnlyWallet("auditor", ivk)
+		if err != nil {
+			t.Fatalf("Watch-only wallet creation failed: %v", err)
+		}
+		result, err := watch.ScanLedger(ledger)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(result.Received) != 2 || len(result.Spent) != 0 {
+			t.Errorf("Received %d notes and %d spends, want 2 and 0", len(result.Received), len(result.Spent))
+		}
+		for i := range watch.Notes {
+			if len(watch.NoteKeys[i]) != 0 {
+				t.Errorf("Watch-only note %d has a secret key", i)
+			}
+		}
+		if _, err := watch.FullViewingKey(); err == nil {
+			t.Error("A full viewing key was exported from an incoming viewing key")
+		}
+	})
+
+	t.Run("Full Viewing Key", func(t *testing.T) {
+		fvk, err := wallet.FullViewingKey()
+		if err != nil {
+			t.Fatalf("Full viewing key export failed: %v", err)
+		}
+		path := filepath.Join(t.TempDir(), "view.json")
+		if err := zerocash.SaveViewingKey(path, fvk); err != nil {
+			t.Fatalf("Viewing key save failed: %v", err)
+		}
+		data, _ := os.ReadFile(path)
+		if bytes.Contains(data, []byte(new(big.Int).SetBytes(spendKey).String())) {
+			t.Error("Viewing key file contains the spend key")
+		}
+		loaded, err := zerocash.LoadViewingKey(path)
+		if err != nil {
+			t.Fatalf("Viewing key load failed: %v", err)
+		}
+		watch, err := zerocash.NewWatchOnlyWallet("auditor", loaded)
+		if err != nil {
+			t.Fatalf("Watch-only wallet creation failed: %v", err)
+		}
+		result, err := watch.ScanLedger(ledger)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(result.Received) != 2 || len(result.Spent) != 1 {
+			t.Fatalf("Received %d notes and %d spends, want 2 and 1", len(result.Received), len(result.Spent))
+		}
+		if !watch.Spent[0] || watch.Spent[1] {
+			t.Errorf("Watch-only spent flags %v, want [true false]", watch.Spent)
+		}
+
+		// The watch-only wallet survives a save and load
+		if err := watch.SetPassphrase([]byte("passphrase")); err != nil {
+			t.Fatalf("Setting wallet passphrase failed: %v", err)
+		}
+		walletPath := filepath.Join(t.TempDir(), "watch.json")
+		if err := watch.Save(walletPath); err != nil {
+			t.Fatalf("Wallet save failed: %v", err)
+		}
+		reloaded, err := zerocash.LoadWallet(walletPath, []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("Wallet load failed: %v", err)
+		}
+		if !reloaded.WatchOnly || len(reloaded.NullifierKeys) != len(fvk.NullifierKeys) {
+			t.Error("Watch-only state was not persisted")
+		}
+	})
+
+	t.Run("Watch-Only Refuses Spending", func(t *testing.T) {
+		fvk, _ := wallet.FullViewingKey()
+		watch, _ := zerocash.NewWatchOnlyWallet("auditor", fvk)
+		if _, err := watch.ScanLedger(ledger); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		to, _ := wallet.PaymentAddress(zerocash.DefaultNetwork)
+		if _, err := watch.CreateTx(1, to, big.NewInt(20), big.NewInt(2), ledger, &zerocash.Params{}, nil, nil, nil); !errors.Is(err, zerocash.ErrWatchOnly) {
+			t.Errorf("CreateTx on a watch-only wallet returned %v, want ErrWatchOnly", err)
+		}
+		participant := &zerocash.Participant{Name: "auditor", Wallet: watch, Params: &zerocash.Params{}}
+		if _, err := register.Register(participant, watch.Notes[1], newOrder(zerocash.SideBuy, 1, big.NewInt(5)), nil, nil, nil, nil, nil, nil, nil); !errors.Is(err, zerocash.ErrWatchOnly) {
+			t.Errorf("Register with a watch-only wallet returned %v, want ErrWatchOnly", err)
+		}
+		if _, _, err := withdraw.WithdrawFromWallet(watch, ledger, &zerocash.Params{}, nil, nil); !errors.Is(err, zerocash.ErrWatchOnly) {
+			t.Errorf("Withdraw from a watch-only wallet returned %v, want ErrWatchOnly", err)
+		}
+	})
+
+	t.Run("Wallet Without Seed", func(t *testing.T) {
+		// Its notes are owned by the DH key, which therefore cannot be handed out
+		kp, _ := zerocash.GenerateDHKeyPair()
+		legacy := &zerocash.Wallet{Name: "legacy", Sk: kp.Sk, Pk: kp.Pk}
+		if _, err := legacy.IncomingViewingKey(); err == nil {
+			t.Error("A wallet without a seed exported its DH key as a viewing key")
+		}
+	})
+}
+
+func TestPaymentAddress(t *testing.T) {
+	wallet, err := zerocash.NewWalletFromSeed("bob", zerocash.NewSeed())
+	if err != nil {
+		t.Fatalf("Wallet creation failed: %v", err)
+	}
+	addr, err := wallet.PaymentAddress(zerocash.NetworkTest)
+	if err != nil {
+		t.Fatalf("Payment address failed: %v", err)
+	}
+	encoded := addr.String()
+
+	t.Run("Round Trip", func(t *testing.T) {
+		if !strings.HasPrefix(encoded, zerocash.NetworkTest+"1") {
+			t.Errorf("Address %s does not start with its network prefix", encoded)
+		}
+		if !bytes.Equal(addr.Pk, zerocash.MimcHashPublic(wallet.SpendKey()).Bytes()) || !addr.EncKey.Equal(wallet.Pk) {
+			t.Error("Address does not bundle the wallet's note public key and DH key")
+		}
+		for _, s := range []string{encoded, strings.ToUpper(encoded)} {
+			parsed, err := zerocash.ParsePaymentAddress(s)
+			if err != nil {
+				t.Fatalf("Parsing %s failed: %v", s, err)
+			}
+			if !parsed.Equal(addr) {
+				t.Error("Parsed address differs from the original")
+			}
+		}
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		// Change one data character
+		i := len(zerocash.NetworkTest) + 10
+		typo := []byte(encoded)
+		if typo[i] == 'q' {
+			typo[i] = 'p'
+		} else {
+			typo[i] = 'q'
+		}
+		if _, err := zerocash.ParsePaymentAddress(string(typo)); err == nil {
+			t.Error("Address with a typo was accepted")
+		}
+		if _, err := zerocash.ParsePaymentAddress(encoded[:len(encoded)-1]); err == nil {
+			t.Error("Truncated address was accepted")
+		}
+		mixed := strings.ToUpper(encoded[:20]) + encoded[20:]
+		if _, err := zerocash.ParsePaymentAddress(mixed); err == nil {
+			t.Error("Mixed-case address was accepted")
+		}
+	})
+
+	t.Run("Network", func(t *testing.T) {
+		if _, err := zerocash.ValidatePaymentAddress(encoded, zerocash.NetworkTest); err != nil {
+			t.Errorf("Address rejected on its own network: %v", err)
+		}
+		if _, err := zerocash.ValidatePaymentAddress(encoded, zerocash.NetworkMain); !errors.Is(err, zerocash.ErrAddressNetwork) {
+			t.Errorf("Address of another network returned %v, want ErrAddressNetwork", err)
+		}
+		params := &zerocash.Params{Network: zerocash.NetworkMain}
+		if _, err := zerocash.CreateTxToAddress(nil, nil, addr, big.NewInt(1), big.NewInt(1), nil, params, nil, nil, nil); !errors.Is(err, zerocash.ErrAddressNetwork) {
+			t.Errorf("CreateTxToAddress to another network returned %v, want ErrAddressNetwork", err)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		var infinity bls12377.G1Affine
+		if _, err := zerocash.NewPaymentAddress(zerocash.NetworkMain, addr.Pk, &infinity); err == nil {
+			t.Error("Address with the point at infinity was accepted")
+		}
+		if _, err := zerocash.NewPaymentAddress(zerocash.NetworkMain, bls12377_fp.Modulus().Bytes(), addr.EncKey); err == nil {
+			t.Error("Address with a note public key outside the field was accepted")
+		}
+		if _, err := zerocash.NewPaymentAddress("Bad1", addr.Pk, addr.EncKey); err == nil {
+			t.Error("Address with an invalid network prefix was accepted")
+		}
+	})
+
+	t.Run("Participant Endpoint", func(t *testing.T) {
+		participant := &zerocash.Participant{Name: "bob", Pk: wallet.Pk, Wallet: wallet, Params: &zerocash.Params{Network: zerocash.NetworkTest}}
+		resp := participant.PubKeyResponse()
+		parsed, err := zerocash.ValidatePaymentAddress(resp.Address, zerocash.NetworkTest)
+		if err != nil || !parsed.Equal(addr) {
+			t.Errorf("Public key response has address %q (%v), want %s", resp.Address, err, encoded)
+		}
+	})
+}
+
+// valueRangeCircuit applies the protocol range check to a single value.
+type valueRangeCircuit struct {
+	V frontend.Variable
+
+	Bits int `gnark:"-"`
+}
+
+func (c *valueRangeCircuit) Define(api frontend.API) error {
+	zerocash.AssertValueRange(api, c.Bits, c.V)
+	return nil
+}
+
+func TestValueRangeChecks(t *testing.T) {
+	maxValue := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), zerocash.DefaultValueBits), big.NewInt(1))
+	tooLarge := new(big.Int).Lsh(big.NewInt(1), zerocash.DefaultValueBits)
+
+	t.Run("Circuit Range Constraint", func(t *testing.T) {
+		field := ecc.BW6_761.ScalarField()
+		ccs, err := frontend.Compile(field, r1cs.NewBuilder, &valueRangeCircuit{})
+		if err != nil {
+			t.Fatalf("Circuit compilation failed: %v", err)
+		}
+		isSolved := func(v *big.Int) bool {
+			w, err := frontend.NewWitness(&valueRangeCircuit{V: v}, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs.IsSolved(w) == nil
+		}
+
+		if !isSolved(maxValue) {
+			t.Error("Largest value should satisfy the range constraint")
+		}
+		if isSolved(tooLarge) {
+			t.Error("Value of 2^64 should violate the range constraint")
+		}
+		// -1 wraps around to p-1 in the field
+		if isSolved(new(big.Int).Sub(field, big.NewInt(1))) {
+			t.Error("Negative value should violate the range constraint")
+		}
+	})
+
+	t.Run("Params Width", func(t *testing.T) {
+		if bits, err := (&zerocash.Params{}).MaxValueBits(); err != nil || bits != zerocash.DefaultValueBits {
+			t.Errorf("Default width should be %d, got %d (%v)", zerocash.DefaultValueBits, bits, err)
+		}
+		if bits, err := (&zerocash.Params{ValueBits: 32}).MaxValueBits(); err != nil || bits != 32 {
+			t.Errorf("Configured width should be 32, got %d (%v)", bits, err)
+		}
+		for _, bits := range []int{-1, zerocash.DefaultValueBits + 1} {
+			if _, err := (&zerocash.Params{ValueBits: bits}).MaxValueBits(); err == nil {
+				t.Errorf("Width %d should be rejected", bits)
+			}
+		}
+		if err := zerocash.CheckValueRange("coins", big.NewInt(256), 8); err == nil {
+			t.Error("256 should not fit in 8 bits")
+		}
+		if err := zerocash.CheckValueRange("coins", big.NewInt(255), 8); err != nil {
+			t.Errorf("255 should fit in 8 bits: %v", err)
+		}
+	})
+
+	t.Run("Typed Errors Before Proving", func(t *testing.T) {
+		// No proving keys are needed: out-of-range values are rejected before any proof work
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+		params := &zerocash.Params{}
+		sk := zerocash.RandomBytesPublic(32)
+		pkNew := zerocash.MimcHashPublic(zerocash.RandomBytesPublic(32)).Bytes()
+		var rangeErr *zerocash.ValueRangeError
+
+		note := zerocash.NewNote(tooLarge, big.NewInt(50), sk)
+		path := addNoteToLedger(t, zerocash.NewLedger(), note)
+		_, err = zerocash.CreateTx(note, sk, pkNew, recipientKey(t), tooLarge, big.NewInt(50), path, params, nil, nil, auctioneerECDHPub)
+		if !errors.As(err, &rangeErr) {
+			t.Errorf("CreateTx should return a ValueRangeError, got %v", err)
+		}
+
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		participantKp, _ := zerocash.GenerateDHKeyPair()
+		participant := &zerocash.Participant{
+			Sk:            participantKp.Sk,
+			Pk:            participantKp.Pk,
+			Params:        params,
+			AuctioneerPub: auctioneerKp.Pk,
+		}
+		note = zerocash.NewNote(big.NewInt(100), big.NewInt(50), sk)
+		path = addNoteToLedger(t, zerocash.NewLedger(), note)
+		_, err = register.Register(participant, note, newOrder(zerocash.SideBuy, 1, big.NewInt(-1)), path, nil, nil, nil, nil, sk, auctioneerECDHPub)
+		if !errors.As(err, &rangeErr) || rangeErr.Field != "limit price" {
+			t.Errorf("Register should return a ValueRangeError for the limit price, got %v", err)
+		}
+
+		nIn := withdraw.Note{Coins: maxValue, Energy: big.NewInt(50), Pk: big.NewInt(1), Rho: big.NewInt(2), R: big.NewInt(3), Cm: big.NewInt(4)}
+		nOut := withdraw.Note{Coins: tooLarge, Energy: big.NewInt(50), Pk: big.NewInt(5), Rho: big.NewInt(6), R: big.NewInt(7), Cm: big.NewInt(8)}
+		cipherAux := [3]*big.Int{big.NewInt(0), big.NewInt(0), big.NewInt(0)}
+		_, _, err = withdraw.Withdraw(nIn, big.NewInt(12345), nOut, sw_bls12377.G1Affine{}, cipherAux, big.NewInt(25), zerocash.NewLedger(), params, nil, nil)
+		if !errors.As(err, &rangeErr) || rangeErr.Field != "output coins" {
+			t.Errorf("Withdraw should return a ValueRangeError for the output coins, got %v", err)
+		}
+	})
+}
+
+// =============================================================================
+// 2. CIRCUIT-SPECIFIC TESTS
+// =============================================================================
+
+func TestCircuitTx(t *testing.T) {
+	t.Run("CircuitTx Compilation", func(t *testing.T) {
+		var circuit zerocash.CircuitTx
+		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitTx compilation failed: %v", err)
+		}
+	})
+
+	t.Run("CircuitTx Key Generation", func(t *testing.T) {
+		var circuit zerocash.CircuitTx
+		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitTx compilation failed: %v", err)
+		}
+
+		pk, vk, err := groth16.Setup(ccs)
+		if err != nil {
+			t.Fatalf("CircuitTx key generation failed: %v", err)
+		}
+
+		if pk == nil || vk == nil {
+			t.Error("Generated keys are nil")
+		}
+	})
+}
+
+func TestCircuitTxRegister(t *testing.T) {
+	t.Run("CircuitTxRegister Compilation", func(t *testing.T) {
+		var circuit register.CircuitTxRegister
+		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitTxRegister compilation failed: %v", err)
+		}
+	})
+
+	t.Run("CircuitTxRegister Key Generation", func(t *testing.T) {
+		var circuit register.CircuitTxRegister
+		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitTxRegister compilation failed: %v", err)
+		}
+
+		pk, vk, err := groth16.Setup(ccs)
+		if err != nil {
+			t.Fatalf("CircuitTxRegister key generation failed: %v", err)
+		}
+
+		if pk == nil || vk == nil {
+			t.Error("Generated keys are nil")
+		}
+	})
+
+	t.Run("Order Backed By Note", func(t *testing.T) {
+		// A note of 100 coins and 50 energy backs selling up to 50 energy, or buying up to
+		// 100 coins' worth
+		field := ecc.BW6_761.ScalarField()
+		var circuit register.CircuitTxRegister
+		ccs, err := frontend.Compile(field, r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitTxRegister compilation failed: %v", err)
+		}
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		coins, energy := big.NewInt(100), big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(31)
+		note := zerocash.NewNote(coins, energy, sk)
+		pkIn := new(big.Int).SetBytes(note.PkOwner)
+		pkOut := zerocash.MimcHashPublic(zerocash.RandomBytesPublic(31))
+		rho, rand := new(big.Int).SetBytes(note.Rho), new(big.Int).SetBytes(note.Rand)
+		cm := new(big.Int).SetBytes(note.Cm)
+
+		_, _, g1, _ := bls12377.Generators()
+		r := new(big.Int).SetBytes(zerocash.RandomBytesPublic(31))
+		var gr, encKey bls12377.G1Affine
+		gr.ScalarMultiplication(&g1, r)
+		encKey.ScalarMultiplication(auctioneerKp.Pk, r)
+
+		isSolved := func(order zerocash.Order, declared zerocash.Gamma) bool {
+			declaredNote := *note
+			declaredNote.Value = declared
+			cAux := register.EncryptRegistrationData(encKey, &declaredNote, order, new(big.Int).SetBytes(sk), pkOut)
+			witness := &register.CircuitTxRegister{
+				CmIn:          cm.String(),
+				GammaInEnergy: declared.Energy.String(),
+				GammaInCoins:  declared.Coins.String(),
+				Bid:           order.LimitPrice.String(),
+				G:             *convertToGnarkPoint(&g1),
+				G_b:           *convertToGnarkPoint(auctioneerKp.Pk),
+				G_r:           *convertToGnarkPoint(&gr),
+				InCoin:        coins.String(),
+				InEnergy:      energy.String(),
+				RhoIn:         rho.String(),
+				RandIn:        rand.String(),
+				SkIn:          new(big.Int).SetBytes(sk).String(),
+				PkIn:          pkIn.String(),
+				PkOut:         pkOut.String(),
+				Side:          int(order.Side),
+				Quantity:      order.Quantity.String(),
+				EncKey:        *convertToGnarkPoint(&encKey),
+				R:             r.String(),
+			}
+			for i := range cAux {
+				witness.CAux[i] = cAux[i].String()
+			}
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs.IsSolved(w) == nil
+		}
+
+		for _, tc := range []struct {
+			order  zerocash.Order
+			backed bool
+		}{
+			{newOrder(zerocash.SideSell, 50, big.NewInt(1000)), true},
+			{newOrder(zerocash.SideSell, 51, big.NewInt(1)), false},
+			{newOrder(zerocash.SideBuy, 20, big.NewInt(5)), true},
+			{newOrder(zerocash.SideBuy, 21, big.NewInt(5)), false},
+			{newOrder(zerocash.OrderSide(2), 1, big.NewInt(1)), false},
+		} {
+			if got := isSolved(tc.order, zerocash.Gamma{Coins: coins, Energy: energy}); got != tc.backed {
+				t.Errorf("%v %v at %v: circuit satisfied %v, want %v", tc.order.Side, tc.order.Quantity, tc.order.LimitPrice, got, tc.backed)
+			}
+			if err := tc.order.Validate(zerocash.Gamma{Coins: coins, Energy: energy}, zerocash.DefaultValueBits); (err == nil) != tc.backed {
+				t.Errorf("%v %v at %v: Validate returned %v", tc.order.Side, tc.order.Quantity, tc.order.LimitPrice, err)
+			}
+		}
+
+		// Declaring more than the note holds must not back a larger order
+		richer := zerocash.Gamma{Coins: coins, Energy: big.NewInt(500)}
+		if isSolved(newOrder(zerocash.SideSell, 400, big.NewInt(1)), richer) {
+			t.Error("Circuit accepted an order backed by values the note does not hold")
+		}
+	})
+}
+
+func TestCircuitTxF(t *testing.T) {
+	for _, n := range exchangeTestSizes() {
+		t.Run(fmt.Sprintf("CircuitTxF%d Compilation", n), func(t *testing.T) {
+			_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, exchange.NewCircuitTxF(n))
+			if err != nil {
+				t.Fatalf("CircuitTxF%d compilation failed: %v", n, err)
+			}
+		})
+
+		t.Run(fmt.Sprintf("CircuitTxF%d Key Generation", n), func(t *testing.T) {
+			_, pk, vk := circuitTestKeys(t, zerocash.ExchangeCircuitID(n))
+			if pk == nil || vk == nil {
+				t.Error("Generated keys are nil")
+			}
+		})
+	}
+}
+
+func TestCircuitWithdraw(t *testing.T) {
+	t.Run("CircuitWithdraw Compilation", func(t *testing.T) {
+		var circuit withdraw.CircuitWithdraw
+		_, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitWithdraw compilation failed: %v", err)
+		}
+	})
+
+	t.Run("CircuitWithdraw Key Generation", func(t *testing.T) {
+		var circuit withdraw.CircuitWithdraw
+		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatalf("CircuitWithdraw compilation failed: %v", err)
+		}
+
+		pk, vk, err := groth16.Setup(ccs)
+		if err != nil {
+			t.Fatalf("CircuitWithdraw key generation failed: %v", err)
+		}
+
+		if pk == nil || vk == nil {
+			t.Error("Generated keys are nil")
+		}
+	})
+}
+
+// =============================================================================
+// 3. INDIVIDUAL ALGORITHM TESTS
+// =============================================================================
+
+func TestCircuitRegistry(t *testing.T) {
+	t.Run("All Circuits Registered", func(t *testing.T) {
+		registered := make(map[zerocash.CircuitID]bool)
+		for _, id := range zerocash.RegisteredCircuits() {
+			registered[id] = true
+		}
+		ids := []zerocash.CircuitID{
+			zerocash.CircuitTxID, zerocash.CircuitTx10ID, zerocash.CircuitRegisterID,
+			zerocash.CircuitExchangeF10ID, zerocash.CircuitWithdrawID,
+		}
+		for _, n := range zerocash.SupportedSizes {
+			ids = append(ids, zerocash.BatchCircuitID(n), zerocash.ExchangeCircuitID(n))
+		}
+		for _, id := range ids {
+			if !registered[id] {
+				t.Errorf("Circuit %q not registered", id)
+			}
+		}
+		if n := zerocash.CircuitSize(zerocash.CircuitExchangeF10ID); n != 10 {
+			t.Errorf("exchange_f10 has size %d, want 10", n)
+		}
+		if n := zerocash.CircuitSize(zerocash.CircuitTxID); n != 0 {
+			t.Errorf("tx is not a sized circuit but has size %d", n)
+		}
+	})
+
+	t.Run("Smallest Fitting Size", func(t *testing.T) {
+		for _, c := range []struct{ n, size int }{{1, 5}, {3, 5}, {5, 5}, {6, 10}, {11, 20}, {60, 60}} {
+			if size, err := zerocash.FittingSize(c.n); err != nil || size != c.size {
+				t.Errorf("FittingSize(%d) = %d, %v, want %d", c.n, size, err, c.size)
+			}
+		}
+		for _, n := range []int{0, zerocash.MaxSize() + 1} {
+			if _, err := zerocash.FittingSize(n); err == nil {
+				t.Errorf("FittingSize(%d) should fail", n)
+			}
+		}
+	})
+
+	t.Run("Compiled Once", func(t *testing.T) {
+		first, err := zerocash.CompiledCircuit(zerocash.CircuitTxID)
+		if err != nil {
+			t.Fatalf("CircuitTx compilation failed: %v", err)
+		}
+		second, err := zerocash.CompiledCircuit(zerocash.CircuitTxID)
+		if err != nil {
+			t.Fatalf("CircuitTx compilation failed: %v", err)
+		}
+		if first != second {
+			t.Error("CircuitTx was compiled twice")
+		}
+	})
+
+	t.Run("Per Value Width", func(t *testing.T) {
+		wide, err := zerocash.CompiledCircuit(zerocash.CircuitTxID)
+		if err != nil {
+			t.Fatalf("CircuitTx compilation failed: %v", err)
+		}
+		narrow, err := zerocash.CompiledCircuitFor(zerocash.CircuitTxID, zerocash.BackendGroth16, 32)
+		if err != nil {
+			t.Fatalf("32-bit CircuitTx compilation failed: %v", err)
+		}
+		if narrow.GetNbConstraints() >= wide.GetNbConstraints() {
+			t.Errorf("32-bit CircuitTx has %d constraints, 64-bit has %d", narrow.GetNbConstraints(), wide.GetNbConstraints())
+		}
+		if _, err := zerocash.ResolveVerifyingKey(zerocash.CircuitTxID, zerocash.BackendGroth16, 32, nil); err == nil {
+			t.Error("Keys of another value width should not resolve for a 32-bit circuit")
+		}
+		for _, bits := range []int{0, zerocash.DefaultValueBits + 1} {
+			if _, err := zerocash.CompiledCircuitFor(zerocash.CircuitTxID, zerocash.BackendGroth16, bits); err == nil {
+				t.Errorf("Compiling for %d-bit values should fail", bits)
+			}
+		}
+	})
+
+	t.Run("Unknown Circuit", func(t *testing.T) {
+		if _, err := zerocash.CompiledCircuit("unknown"); err == nil {
+			t.Error("Compiling an unregistered circuit should fail")
+		}
+		if _, err := zerocash.ResolveVerifyingKey("unknown", zerocash.DefaultBackend, zerocash.DefaultValueBits, nil); err == nil {
+			t.Error("Resolving the key of an unregistered circuit should fail")
+		}
+	})
+}
+
+func TestKeyManifest(t *testing.T) {
+	const id zerocash.CircuitID = "value_range"
+	compile := func(bits int) constraint.ConstraintSystem {
+		ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &valueRangeCircuit{Bits: bits})
+		if err != nil {
+			t.Fatalf("Circuit compilation failed: %v", err)
+		}
+		return ccs
+	}
+	const bits = zerocash.DefaultValueBits
+	ccs := compile(bits)
+	dir := t.TempDir()
+	pkPath := filepath.Join(dir, "value_range.pk")
+	vkPath := filepath.Join(dir, "value_range.vk")
+
+	t.Run("Generate and Reload", func(t *testing.T) {
+		pk, vk, err := zerocash.SetupOrLoadKeys(id, bits, ccs, pkPath, vkPath)
+		if err != nil || pk == nil || vk == nil {
+			t.Fatalf("Key generation failed: %v", err)
+		}
+		manifest, err := zerocash.LoadKeyManifest(zerocash.KeyManifestPath(pkPath))
+		if err != nil {
+			t.Fatalf("Manifest not written: %v", err)
+		}
+		if manifest.CircuitID != id || manifest.ValueBits != bits || manifest.Curve != ecc.BW6_761.String() || manifest.Backend != "groth16" {
+			t.Errorf("Unexpected manifest: %+v", manifest)
+		}
+		if _, _, err := zerocash.SetupOrLoadKeys(id, bits, ccs, pkPath, vkPath); err != nil {
+			t.Fatalf("Reloading matching keys failed: %v", err)
+		}
+	})
+
+	t.Run("Circuit Changed", func(t *testing.T) {
+		_, _, err := zerocash.SetupOrLoadKeys(id, bits, compile(32), pkPath, vkPath)
+		var mismatch *zerocash.KeyManifestMismatchError
+		if !errors.As(err, &mismatch) || mismatch.Field != "ccs_hash" {
+			t.Fatalf("Expected ccs_hash mismatch, got %v", err)
+		}
+		if _, _, err := zerocash.SetupOrLoadKeys(id, 32, compile(32), pkPath, vkPath); !errors.As(err, &mismatch) || mismatch.Field != "value_bits" {
+			t.Errorf("Expected value_bits mismatch, got %v", err)
+		}
+		if _, _, err := zerocash.SetupOrLoadKeys("tx", bits, ccs, pkPath, vkPath); !errors.As(err, &mismatch) || mismatch.Field != "circuit_id" {
+			t.Errorf("Expected circuit_id mismatch, got %v", err)
+		}
+	})
+
+	t.Run("Tampered Key File", func(t *testing.T) {
+		original, err := os.ReadFile(vkPath)
+		if err != nil {
+			t.Fatalf("Failed to read verifying key: %v", err)
+		}
+		tampered := append([]byte{}, original...)
+		tampered[len(tampered)-1] ^= 1
+		if err := os.WriteFile(vkPath, tampered, 0644); err != nil {
+			t.Fatalf("Failed to write verifying key: %v", err)
+		}
+		_, _, err = zerocash.SetupOrLoadKeys(id, bits, ccs, pkPath, vkPath)
+		var mismatch *zerocash.KeyManifestMismatchError
+		if !errors.As(err, &mismatch) || mismatch.Field != "vk_sha256" {
+			t.Errorf("Expected vk_sha256 mismatch, got %v", err)
+		}
+		if err := os.WriteFile(vkPath, original, 0644); err != nil {
+			t.Fatalf("Failed to restore verifying key: %v", err)
+		}
+	})
+
+	t.Run("Missing Manifest", func(t *testing.T) {
+		manifestPath := zerocash.KeyManifestPath(pkPath)
+		saved, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatalf("Failed to read manifest: %v", err)
+		}
+		os.Remove(manifestPath)
+		if _, _, err := zerocash.SetupOrLoadKeys(id, bits, ccs, pkPath, vkPath); !errors.Is(err, zerocash.ErrKeyManifestMissing) {
+			t.Errorf("Expected ErrKeyManifestMissing, got %v", err)
+		}
+		if err := os.WriteFile(manifestPath, saved, 0644); err != nil {
+			t.Fatalf("Failed to restore manifest: %v", err)
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		changed := compile(32)
+		if _, _, err := zerocash.RotateKeys(id, 32, changed, pkPath, vkPath); err != nil {
+			t.Fatalf("Key rotation failed: %v", err)
+		}
+		if _, _, err := zerocash.SetupOrLoadKeys(id, 32, changed, pkPath, vkPath); err != nil {
+			t.Errorf("Loading rotated keys failed: %v", err)
+		}
+		if _, _, err := zerocash.SetupOrLoadKeys(id, bits, ccs, pkPath, vkPath); err == nil {
+			t.Error("Rotated keys should not load for the previous circuit")
+		}
+	})
+}
+
+func TestSetupCeremony(t *testing.T) {
+	const id zerocash.CircuitID = "value_range"
+	field := ecc.BW6_761.ScalarField()
+	ccs, err := frontend.Compile(field, r1cs.NewBuilder, &valueRangeCircuit{})
+	if err != nil {
+		t.Fatalf("Circuit compilation failed: %v", err)
+	}
+	dir := t.TempDir()
+	contributors := []string{"Alice", "Bob", "Carol"}
+
+	if _, err := ceremony.Start(dir, id, zerocash.DefaultValueBits, ccs); err != nil {
+		t.Fatalf("Starting ceremony failed: %v", err)
+	}
+	if _, err := ceremony.Start(dir, id, zerocash.DefaultValueBits, ccs); err == nil {
+		t.Error("Starting a ceremony twice should fail")
+	}
+
+	for _, phase := range []ceremony.Phase{ceremony.PhasePowersOfTau, ceremony.PhaseCircuit} {
+		for _, name := range contributors {
+			a, err := ceremony.Contribute(dir, name, "local test contribution")
+			if err != nil {
+				t.Fatalf("%s contribution by %s failed: %v", phase, name, err)
+			}
+			if a.Phase != phase {
+				t.Errorf("Contribution recorded in %s, expected %s", a.Phase, phase)
+			}
+		}
+		if _, err := ceremony.Verify(dir, ccs); err != nil {
+			t.Fatalf("%s transcript verification failed: %v", phase, err)
+		}
+		if _, err := ceremony.Finalize(dir, ccs, []byte("beacon "+string(phase))); err != nil {
+			t.Fatalf("Finalizing %s failed: %v", phase, err)
+		}
+	}
+
+	transcript, err := ceremony.Verify(dir, ccs)
+	if err != nil {
+		t.Fatalf("Final transcript verification failed: %v", err)
+	}
+	if transcript.Phase != ceremony.PhaseDone || len(transcript.Attestations) != 2*len(contributors) {
+		t.Errorf("Unexpected transcript: phase %s, %d attestations", transcript.Phase, len(transcript.Attestations))
+	}
+
+	t.Run("Extracted Keys", func(t *testing.T) {
+		pkPath, vkPath := ceremony.KeyPaths(dir, id)
+		pk, vk, err := zerocash.SetupOrLoadKeys(id, zerocash.DefaultValueBits, ccs, pkPath, vkPath)
+		if err != nil {
+			t.Fatalf("Loading ceremony keys failed: %v", err)
+		}
+		w, err := frontend.NewWitness(&valueRangeCircuit{V: 42}, field)
+		if err != nil {
+			t.Fatalf("Witness creation failed: %v", err)
+		}
+		proof, err := zerocash.Prove(ccs, pk, w)
+		if err != nil {
+			t.Fatalf("Proving with ceremony keys failed: %v", err)
+		}
+		pub, _ := w.Public()
+		if err := zerocash.Verify(proof, vk, pub); err != nil {
+			t.Errorf("Verifying with ceremony keys failed: %v", err)
+		}
+	})
+
+	t.Run("Tampered Transcript", func(t *testing.T) {
+		path := filepath.Join(dir, string(ceremony.PhaseCircuit), "0002.bin")
+		original, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read contribution: %v", err)
+		}
+		tampered := append([]byte{}, original...)
+		tampered[len(tampered)/2] ^= 1
+		if err := os.WriteFile(path, tampered, 0644); err != nil {
+			t.Fatalf("Failed to write contribution: %v", err)
+		}
+		if _, err := ceremony.Verify(dir, ccs); err == nil {
+			t.Error("Tampered contribution should fail transcript verification")
+		}
+		os.WriteFile(path, original, 0644)
+
+		if _, err := ceremony.Contribute(dir, "Mallory", ""); err == nil {
+			t.Error("Contributing to a finalized ceremony should fail")
+		}
+	})
+}
+
+func TestProofBackends(t *testing.T) {
+	field := ecc.BW6_761.ScalarField()
+	w, err := frontend.NewWitness(&valueRangeCircuit{V: 42}, field)
+	if err != nil {
+		t.Fatalf("Witness creation failed: %v", err)
+	}
+	pub, _ := w.Public()
+
+	// One SRS, saved as a ceremony output would be, sized for the largest circuit set up below
+	txCCS, err := zerocash.CompiledCircuitFor(zerocash.CircuitTxID, zerocash.BackendPlonk, zerocash.DefaultValueBits)
+	if err != nil {
+		t.Fatalf("CircuitTx compilation failed: %v", err)
+	}
+	srs, err := zerocash.NewUnsafeKZGSRS(zerocash.KZGSRSSize(txCCS))
+	if err != nil {
+		t.Fatalf("SRS generation failed: %v", err)
+	}
+	srsPath := filepath.Join(t.TempDir(), "kzg.srs")
+	if err := zerocash.SaveKZGSRS(srsPath, srs); err != nil {
+		t.Fatalf("Saving SRS failed: %v", err)
+	}
+	zerocash.SetKZGSRS(nil)
+	t.Cleanup(func() { zerocash.SetKZGSRS(nil) })
+
+	t.Run("Shared KZG SRS", func(t *testing.T) {
+		plonkBackend, _ := zerocash.GetBackend(zerocash.BackendPlonk)
+		rangeCCS, err := plonkBackend.Compile(&valueRangeCircuit{})
+		if err != nil {
+			t.Fatalf("Circuit compilation failed: %v", err)
+		}
+		if _, _, err := zerocash.SetupKeys(rangeCCS); !errors.Is(err, zerocash.ErrNoKZGSRS) {
+			t.Errorf("PLONK setup without an SRS should fail with ErrNoKZGSRS, got %v", err)
+		}
+		small, err := zerocash.NewUnsafeKZGSRS(zerocash.KZGSRSSize(rangeCCS) - 1)
+		if err != nil {
+			t.Fatalf("SRS generation failed: %v", err)
+		}
+		zerocash.SetKZGSRS(small)
+		if _, _, err := zerocash.SetupKeys(rangeCCS); err == nil {
+			t.Error("PLONK setup with an SRS smaller than the circuit should fail")
+		}
+		if _, err := zerocash.LoadKZGSRS(srsPath); err != nil {
+			t.Fatalf("Loading SRS failed: %v", err)
+		}
+	})
+
+	proofs := map[zerocash.BackendID][]byte{}
+	vks := map[zerocash.BackendID]zerocash.VerifyingKey{}
+	for _, id := range []zerocash.BackendID{zerocash.BackendGroth16, zerocash.BackendPlonk} {
+		t.Run(string(id), func(t *testing.T) {
+			b, err := zerocash.GetBackend(id)
+			if err != nil {
+				t.Fatalf("Unknown backend: %v", err)
+			}
+			ccs, err := b.Compile(&valueRangeCircuit{})
+			if err != nil {
+				t.Fatalf("Circuit compilation failed: %v", err)
+			}
+			if got, _ := zerocash.CCSBackend(ccs); got != id {
+				t.Errorf("Constraint system backend is %s, want %s", got, id)
+			}
+			pk, vk, err := zerocash.SetupKeys(ccs)
+			if err != nil {
+				t.Fatalf("Key generation failed: %v", err)
+			}
+
+			dir := t.TempDir()
+			pkPath, vkPath := filepath.Join(dir, "range.pk"), filepath.Join(dir, "range.vk")
+			if err := zerocash.SaveProvingKey(pkPath, pk); err != nil {
+				t.Fatalf("Saving proving key failed: %v", err)
+			}
+			if err := zerocash.SaveVerifyingKey(vkPath, vk); err != nil {
+				t.Fatalf("Saving verifying key failed: %v", err)
+			}
+			if pk, err = zerocash.LoadProvingKey(pkPath); err != nil {
+				t.Fatalf("Loading proving key failed: %v", err)
+			}
+			if vk, err = zerocash.LoadVerifyingKey(vkPath); err != nil {
+				t.Fatalf("Loading verifying key failed: %v", err)
+			}
+
+			proof, err := zerocash.Prove(ccs, pk, w)
+			if err != nil {
+				t.Fatalf("Proof generation failed: %v", err)
+			}
+			if got, _ := zerocash.ProofBackend(proof); got != id {
+				t.Errorf("Proof is tagged %s, want %s", got, id)
+			}
+			if err := zerocash.Verify(proof, vk, pub); err != nil {
+				t.Errorf("Proof verification failed: %v", err)
+			}
+			proofs[id], vks[id] = proof, vk
+		})
+	}
+
+	t.Run("Cross Backend Rejection", func(t *testing.T) {
+		if len(proofs) != 2 {
+			t.Skip("backend setup failed")
+		}
+		if err := zerocash.Verify(proofs[zerocash.BackendGroth16], vks[zerocash.BackendPlonk], pub); err == nil {
+			t.Error("A Groth16 proof should not verify against a PLONK key")
+		}
+		if err := zerocash.Verify(proofs[zerocash.BackendPlonk], vks[zerocash.BackendGroth16], pub); err == nil {
+			t.Error("A PLONK proof should not verify against a Groth16 key")
+		}
+		if _, err := zerocash.ResolveVerifyingKey(zerocash.CircuitTxID, zerocash.BackendPlonk, zerocash.DefaultValueBits, vks[zerocash.BackendGroth16]); err == nil {
+			t.Error("Resolving a Groth16 key for the PLONK backend should fail")
+		}
+		if _, err := zerocash.GetBackend("marlin"); err == nil {
+			t.Error("An unknown backend should be rejected")
+		}
+	})
+
+	t.Run("PLONK Transaction", func(t *testing.T) {
+		ccs := txCCS
+		pk, vk, err := zerocash.SetupKeys(ccs)
+		if err != nil {
+			t.Fatalf("Key generation failed: %v", err)
+		}
+
+		// Both PLONK circuits were set up from the loaded SRS
+		for _, key := range []zerocash.VerifyingKey{vk, vks[zerocash.BackendPlonk]} {
+			if plonkVk, ok := key.(*plonk_bw6761.VerifyingKey); !ok || !plonkVk.Kzg.G2[1].Equal(&srs.Vk.G2[1]) {
+				t.Error("PLONK verifying key was not derived from the shared SRS")
+			}
+		}
+
+		coins, energy := big.NewInt(100), big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(coins, energy, sk)
+		pkNew := zerocash.MimcHashPublic(zerocash.RandomBytesPublic(32)).Bytes()
+		params := &zerocash.Params{Backend: zerocash.BackendPlonk}
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+		ledger := zerocash.NewLedger()
+		path := addNoteToLedger(t, ledger, note)
+
+		tx, err := zerocash.CreateTx(note, sk, pkNew, recipientKey(t), coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("Transaction creation failed: %v", err)
+		}
+		if got, _ := zerocash.ProofBackend(tx.Proof); got != zerocash.BackendPlonk {
+			t.Errorf("Transaction proof is tagged %s, want plonk", got)
+		}
+		if err := zerocash.VerifyTx(tx.Public(), ledger, params, vk); err != nil {
+			t.Fatalf("Transaction verification failed: %v", err)
+		}
+
+		// Groth16 keys cannot prove for a PLONK-configured transaction
+		rangeCCS, err := frontend.Compile(field, r1cs.NewBuilder, &valueRangeCircuit{})
+		if err != nil {
+			t.Fatalf("Circuit compilation failed: %v", err)
+		}
+		groth16Pk, _, err := groth16.Setup(rangeCCS)
+		if err != nil {
+			t.Fatalf("Key generation failed: %v", err)
+		}
+		if _, err := zerocash.CreateTx(note, sk, pkNew, recipientKey(t), coins, energy, path, params, ccs, groth16Pk, auctioneerECDHPub); err == nil {
+			t.Error("Proving with a key of another backend should fail")
+		}
+	})
+}
+
+func TestAlgorithm1Transaction(t *testing.T) {
+	// Setup circuit keys
+	var circuit zerocash.CircuitTx
+	ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit)
+	if err != nil {
+		t.Fatalf("Circuit compilation failed: %v", err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatalf("Key generation failed: %v", err)
+	}
+
+	t.Run("Valid Transaction Creation", func(t *testing.T) {
+		// Create a note
+		coins := big.NewInt(100)
+		energy := big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(coins, energy, sk)
+
+		// Create transaction
+		newSk := zerocash.RandomBytesPublic(32)
+		pkNew := zerocash.MimcHashPublic(newSk).Bytes() // Compute pk from sk as per Algorithm 1
+		params := &zerocash.Params{}
+
+		// Generate ECDH key pair for auctioneer
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+
+		ledger := zerocash.NewLedger()
+		path := addNoteToLedger(t, ledger, note)
+
+		recipient, err := zerocash.GenerateDHKeyPair()
+		if err != nil {
+			t.Fatalf("DH key generation failed: %v", err)
+		}
+		tx, err := zerocash.CreateTx(note, sk, pkNew, recipient.Pk, coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("Transaction creation failed: %v", err)
+		}
+
+		// Verify transaction
+		err = zerocash.VerifyTx(tx.Public(), ledger, params, vk)
+		if err != nil {
+			t.Fatalf("Transaction verification failed: %v", err)
+		}
+
+		// The recipient recovers the new note from the public transaction alone
+		public := tx.Public()
+		g_r, err := public.EphemeralKey()
+		if err != nil {
+			t.Fatalf("Reading G_r failed: %v", err)
+		}
+		ok, received, err := zerocash.RecognizeNote(public.CNewCircuit, zerocash.ComputeDHShared(recipient.Sk, g_r), pkNew)
+		if err != nil || !ok {
+			t.Fatalf("Recipient did not recognize the note: ok=%v err=%v", ok, err)
+		}
+		if received.Value.Coins.Cmp(coins) != 0 || received.Value.Energy.Cmp(energy) != 0 {
+			t.Errorf("Recovered value (%s, %s), want (%s, %s)", received.Value.Coins, received.Value.Energy, coins, energy)
+		}
+		if new(big.Int).SetBytes(received.Cm).String() != public.CmNew {
+			t.Error("Recovered note does not match the transaction commitment")
+		}
+
+		// Any other key yields garbage that does not open the commitment
+		other, _ := zerocash.GenerateDHKeyPair()
+		if ok, _, _ := zerocash.RecognizeNote(public.CNewCircuit, zerocash.ComputeDHShared(other.Sk, g_r), pkNew); ok {
+			t.Error("A note should not be recognized with another recipient's key")
+		}
+
+		// A ledger that never saw the note does not know the anchor
+		err = zerocash.VerifyTx(tx.Public(), zerocash.NewLedger(), params, vk)
+		if err == nil {
+			t.Error("Transaction with unknown anchor should fail verification")
+		}
+
+		// Without an explicit key, the registry's verifying key is used
+		if err := zerocash.SetCircuitKeys(zerocash.CircuitTxID, zerocash.DefaultValueBits, pk, vk); err != nil {
+			t.Fatalf("Registering circuit keys failed: %v", err)
+		}
+		if err := zerocash.VerifyTx(tx.Public(), ledger, params, nil); err != nil {
+			t.Fatalf("Transaction verification with registry key failed: %v", err)
+		}
+	})
+
+	t.Run("Invalid Transaction Rejection", func(t *testing.T) {
+		// Create a note
+		coins := big.NewInt(100)
+		energy := big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(coins, energy, sk)
+
+		// Try to create transaction with wrong secret key
+		wrongSk := zerocash.RandomBytesPublic(32)
+		newSk := zerocash.RandomBytesPublic(32)
+		pkNew := zerocash.MimcHashPublic(newSk).Bytes()
+		params := &zerocash.Params{}
+
+		// Generate ECDH key pair for auctioneer
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+
+		path := addNoteToLedger(t, zerocash.NewLedger(), note)
+		_, err = zerocash.CreateTx(note, wrongSk, pkNew, recipientKey(t), coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err == nil {
+			t.Error("Transaction with wrong secret key should have failed")
+		}
+
+		_, err = zerocash.CreateTx(note, sk, pkNew, nil, coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err == nil {
+			t.Error("Transaction without a recipient key should have failed")
+		}
+	})
+
+	t.Run("Spend of Note Not in Ledger", func(t *testing.T) {
+		coins := big.NewInt(100)
+		energy := big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(coins, energy, sk)
+		forged := zerocash.NewNote(big.NewInt(1000000), energy, sk)
+
+		newSk := zerocash.RandomBytesPublic(32)
+		pkNew := zerocash.MimcHashPublic(newSk).Bytes()
+		params := &zerocash.Params{}
+
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+
+		// The forged note is owned by sk but its commitment was never appended to the ledger,
+		// so it can only borrow the path of a real note
+		ledger := zerocash.NewLedger()
+		path := addNoteToLedger(t, ledger, note)
+		_, err = zerocash.CreateTx(forged, sk, pkNew, recipientKey(t), forged.Value.Coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err == nil {
+			t.Error("Transaction spending a note outside the ledger should have failed")
+		}
+
+		// Claiming the forged commitment as the leaf does not lead to the ledger root either
+		forgedPath := *path
+		forgedPath.Leaf = forged.Cm
+		_, err = zerocash.CreateTx(forged, sk, pkNew, recipientKey(t), forged.Value.Coins, energy, &forgedPath, params, ccs, pk, auctioneerECDHPub)
+		if err == nil {
+			t.Error("Transaction with a forged authentication path should have failed")
+		}
+	})
+
+	t.Run("Double Spending Prevention", func(t *testing.T) {
+		// Create a note
+		coins := big.NewInt(100)
+		energy := big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(coins, energy, sk)
+
+		// Create first transaction
+		newSk1 := zerocash.RandomBytesPublic(32)
+		pkNew1 := zerocash.MimcHashPublic(newSk1).Bytes()
+		params := &zerocash.Params{}
+
+		// Generate ECDH key pair for auctioneer
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+
+		path := addNoteToLedger(t, zerocash.NewLedger(), note)
+		tx1, err := zerocash.CreateTx(note, sk, pkNew1, recipientKey(t), coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("First transaction creation failed: %v", err)
+		}
+
+		// Create second transaction with same note (double spending)
+		newSk2 := zerocash.RandomBytesPublic(32)
+		pkNew2 := zerocash.MimcHashPublic(newSk2).Bytes()
+		tx2, err := zerocash.CreateTx(note, sk, pkNew2, recipientKey(t), coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("Second transaction creation failed: %v", err)
+		}
+
+		// Both transactions should have the same serial number (detecting double spend)
+		if tx1.SnOld != tx2.SnOld {
+			t.Error("Double spending not detected - serial numbers differ")
+		}
+	})
+}
+
+func TestJoinSplitTransaction(t *testing.T) {
+	// Setup circuit keys for 2 inputs and 2 outputs (payment + change)
+	circuit := zerocash.NewCircuitJoinSplit(2, 2)
+	ccs, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, circuit)
+	if err != nil {
+		t.Fatalf("Circuit compilation failed: %v", err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatalf("Key generation failed: %v", err)
+	}
+	params := &zerocash.Params{}
+	_, auctioneerECDHPub, err := generateECDHKeyPair()
+	if err != nil {
+		t.Fatalf("ECDH key generation failed: %v", err)
+	}
+
+	// Two notes of the same owner in the ledger
+	sk := zerocash.RandomBytesPublic(32)
+	note1 := zerocash.NewNote(big.NewInt(100), big.NewInt(50), sk)
+	note2 := zerocash.NewNote(big.NewInt(30), big.NewInt(0), sk)
+	ledger := zerocash.NewLedger()
+	addNoteToLedger(t, ledger, note1)
+	path2 := addNoteToLedger(t, ledger, note2)
+	path1, err := ledger.NotePath(note1)
+	if err != nil {
+		t.Fatalf("Failed to get merkle path: %v", err)
+	}
+	inputs := []zerocash.JoinSplitInput{
+		{Note: note1, Sk: sk, Path: path1},
+		{Note: note2, Sk: sk, Path: path2},
+	}
+
+	// The payment goes to a recipient wallet, the change back to the sender's
+	newAddress := func(name string) (*zerocash.Wallet, *zerocash.PaymentAddress) {
+		w, err := zerocash.NewWalletFromSeed(name, zerocash.NewSeed())
+		if err != nil {
+			t.Fatalf("Wallet creation failed: %v", err)
+		}
+		to, err := w.PaymentAddress(zerocash.DefaultNetwork)
+		if err != nil {
+			t.Fatalf("Payment address failed: %v", err)
+		}
+		return w, to
+	}
+	recipient, recipientTo := newAddress("recipient")
+	_, changeTo := newAddress("change")
+
+	t.Run("Payment with Change", func(t *testing.T) {
+		outputs := []zerocash.JoinSplitOutput{
+			{Value: zerocash.Gamma{Coins: big.NewInt(120), Energy: big.NewInt(20)}, To: recipientTo},
+			{Value: zerocash.Gamma{Coins: big.NewInt(10), Energy: big.NewInt(30)}, To: changeTo},
+		}
+		tx, err := zerocash.CreateJoinSplit(inputs, outputs, params, ccs, pk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("JoinSplit creation failed: %v", err)
+		}
+		if len(tx.SnOld) != 2 || len(tx.NewNotes) != 2 {
+			t.Fatalf("Expected 2 serial numbers and 2 new notes, got %d and %d", len(tx.SnOld), len(tx.NewNotes))
+		}
+		if string(tx.NewNotes[0].Rho) == string(tx.NewNotes[1].Rho) {
+			t.Error("Output notes share the same rho")
+		}
+
+		if err := zerocash.VerifyJoinSplit(tx.Public(), ledger, params, vk); err != nil {
+			t.Fatalf("JoinSplit verification failed: %v", err)
+		}
+
+		// Tampering with an output commitment invalidates the proof
+		originalCm := tx.CmNew[0]
+		tx.CmNew[0] = tx.CmNew[1]
+		if err := zerocash.VerifyJoinSplit(tx.Public(), ledger, params, vk); err == nil {
+			t.Error("Tampered JoinSplit should fail verification")
+		}
+		tx.CmNew[0] = originalCm
+
+		// Redirecting an output to another recipient invalidates the proof
+		tampered := tx.Public()
+		tampered.G_b = []sw_bls12377.G1Affine{tx.G_b[1], tx.G_b[0]}
+		if err := zerocash.VerifyJoinSplit(tampered, ledger, params, vk); err == nil {
+			t.Error("JoinSplit with swapped recipients should fail verification")
+		}
+
+		// Once recorded, the inputs cannot be spent again
+		if err := ledger.AppendJoinSplit(tx.Public()); err != nil {
+			t.Fatalf("JoinSplit append failed: %v", err)
+		}
+		if !ledger.HasCommitment(tx.CmNew[0]) || !ledger.HasCommitment(tx.CmNew[1]) {
+			t.Error("JoinSplit output commitments missing from ledger")
+		}
+
+		// The recipient finds the payment by scanning the ledger
+		result, err := recipient.ScanLedger(ledger)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(result.Received) != 1 || result.Received[0].Value.Coins.Cmp(big.NewInt(120)) != 0 ||
+			result.Received[0].Value.Energy.Cmp(big.NewInt(20)) != 0 {
+			t.Errorf("Recipient did not receive the JoinSplit payment: %+v", result.Received)
+		}
+
+		if err := zerocash.VerifyJoinSplit(tx.Public(), ledger, params, vk); err == nil {
+			t.Error("JoinSplit spending recorded serial numbers should fail verification")
+		}
+		if err := ledger.AppendJoinSplit(tx.Public()); err == nil {
+			t.Error("Double spending not detected by ledger")
+		}
+	})
+
+	t.Run("Value Not Conserved", func(t *testing.T) {
+		outputs := []zerocash.JoinSplitOutput{
+			{Value: zerocash.Gamma{Coins: big.NewInt(125), Energy: big.NewInt(20)}, To: recipientTo},
+			{Value: zerocash.Gamma{Coins: big.NewInt(10), Energy: big.NewInt(30)}, To: changeTo},
+		}
+		if _, err := zerocash.CreateJoinSplit(inputs, outputs, params, ccs, pk, auctioneerECDHPub); err == nil {
+			t.Error("JoinSplit creating value should have failed")
+		}
+	})
+
+	t.Run("Same Note Spent Twice", func(t *testing.T) {
+		outputs := []zerocash.JoinSplitOutput{
+			{Value: zerocash.Gamma{Coins: big.NewInt(200), Energy: big.NewInt(100)}, To: recipientTo},
+			{Value: zerocash.Gamma{Coins: big.NewInt(0), Energy: big.NewInt(0)}, To: changeTo},
+		}
+		doubled := []zerocash.JoinSplitInput{inputs[0], inputs[0]}
+		if _, err := zerocash.CreateJoinSplit(doubled, outputs, params, ccs, pk, auctioneerECDHPub); err == nil {
+			t.Error("JoinSplit spending the same note twice should have failed")
+		}
+	})
+}
+
+func TestBatchTransaction(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping batch transaction test in short mode (CircuitTxN key generation)")
+	}
+	// Three transfers use the smallest batch circuit
+	const size = 5
+	ccs, err := zerocash.CompiledCircuit(zerocash.BatchCircuitID(size))
+	if err != nil {
+		t.Fatalf("CircuitTxN compilation failed: %v", err)
+	}
+	pk, vk, err := zerocash.SetupKeys(ccs)
+	if err != nil {
+		t.Fatalf("Key generation failed: %v", err)
+	}
+	params := &zerocash.Params{}
+	_, auctioneerECDHPub, err := generateECDHKeyPair()
+	if err != nil {
+		t.Fatalf("ECDH key generation failed: %v", err)
+	}
+
+	// Three notes of different owners, each paid to its own recipient wallet
+	ledger := zerocash.NewLedger()
+	var transfers []zerocash.BatchTransfer
+	var recipients []*zerocash.Wallet
+	for i := 0; i < 3; i++ {
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(big.NewInt(int64(100+i)), big.NewInt(int64(10*i)), sk)
+		addNoteToLedger(t, ledger, note)
+		recipient, err := zerocash.NewWalletFromSeed(fmt.Sprintf("recipient%d", i), zerocash.NewSeed())
+		if err != nil {
+			t.Fatalf("Wallet creation failed: %v", err)
+		}
+		to, err := recipient.PaymentAddress(zerocash.DefaultNetwork)
+		if err != nil {
+			t.Fatalf("Payment address failed: %v", err)
+		}
+		transfers = append(transfers, zerocash.BatchTransfer{Note: note, Sk: sk, To: to})
+		recipients = append(recipients, recipient)
+	}
+
+	t.Run("Padded Batch", func(t *testing.T) {
+		tx, err := zerocash.CreateBatchTx(transfers, ledger, params, ccs, pk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("Batch creation failed: %v", err)
+		}
+		if len(tx.NewNotes) != len(transfers) {
+			t.Fatalf("Batch created %d notes, want %d", len(tx.NewNotes), len(transfers))
+		}
+		if len(tx.SnOld) != size {
+			t.Fatalf("Batch of %d transfers has %d slots, want %d", len(transfers), len(tx.SnOld), size)
+		}
+		// Values and owner keys stay private, so padding slots look like transfers
+		public, _ := json.Marshal(tx.Public())
+		for _, field := range []string{"OldCoin", "OldEnergy", "PkOld", "NewCoin", "NewEnergy"} {
+			if strings.Contains(string(public), field) {
+				t.Errorf("Public batch contains %s", field)
+			}
+		}
+		if err := zerocash.VerifyBatchTx(tx.Public(), ledger, params, vk); err != nil {
+			t.Fatalf("Batch verification failed: %v", err)
+		}
+
+		// Redirecting a slot to another recipient invalidates the proof
+		tampered := tx.Public()
+		tampered.G_b[0], tampered.G_b[1] = tampered.G_b[1], tampered.G_b[0]
+		if err := zerocash.VerifyBatchTx(tampered, ledger, params, vk); err == nil {
+			t.Error("Batch with swapped recipients should fail verification")
+		}
+
+		// All slots are recorded by a single entry, and the recipients find their notes
+		cms, sns := len(ledger.CmList), len(ledger.SnList)
+		if err := ledger.AppendBatchTx(tx.Public()); err != nil {
+			t.Fatalf("Batch append failed: %v", err)
+		}
+		if len(ledger.CmList) != cms+size || len(ledger.SnList) != sns+size || len(ledger.BatchTxs) != 1 {
+			t.Errorf("Batch recorded %d commitments and %d serial numbers, want %d each",
+				len(ledger.CmList)-cms, len(ledger.SnList)-sns, size)
+		}
+		for i, recipient := range recipients {
+			result, err := recipient.ScanLedger(ledger)
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if len(result.Received) != 1 || result.Received[0].Value.Coins.Cmp(transfers[i].Note.Value.Coins) != 0 {
+				t.Errorf("Recipient %d did not receive its note", i)
+			}
+		}
+
+		if err := zerocash.VerifyBatchTx(tx.Public(), ledger, params, vk); err == nil {
+			t.Error("Batch spending recorded serial numbers should fail verification")
+		}
+	})
+
+	t.Run("Atomic Append", func(t *testing.T) {
+		// A batch with one already spent serial number records nothing
+		spent := zerocash.PublicBatchTx{SnOld: make([]string, size), CmNew: make([]string, size)}
+		for i := range spent.SnOld {
+			spent.SnOld[i] = fmt.Sprint(1000 + i)
+			spent.CmNew[i] = fmt.Sprint(2000 + i)
+		}
+		spent.SnOld[size-1] = ledger.SnList[0]
+		cms, sns := len(ledger.CmList), len(ledger.SnList)
+		if err := ledger.AppendBatchTx(&spent); err == nil {
+			t.Error("Batch with a spent serial number should be rejected")
+		}
+		if len(ledger.CmList) != cms || len(ledger.SnList) != sns || len(ledger.BatchTxs) != 1 {
+			t.Error("Rejected batch was partially recorded")
+		}
+	})
+
+	t.Run("Invalid Batches", func(t *testing.T) {
+		if _, err := zerocash.CreateBatchTx(nil, ledger, params, ccs, pk, auctioneerECDHPub); err == nil {
+			t.Error("Empty batch should be rejected")
+		}
+		tooMany := make([]zerocash.BatchTransfer, zerocash.MaxSize()+1)
+		if _, err := zerocash.CreateBatchTx(tooMany, ledger, params, ccs, pk, auctioneerECDHPub); err == nil {
+			t.Error("Batch with more than MaxSize transfers should be rejected")
+		}
+		sk := zerocash.RandomBytesPublic(32)
+		fresh := zerocash.NewNote(big.NewInt(5), big.NewInt(5), sk)
+		addNoteToLedger(t, ledger, fresh)
+		doubled := []zerocash.BatchTransfer{{Note: fresh, Sk: sk, To: transfers[0].To}, {Note: fresh, Sk: sk, To: transfers[1].To}}
+		if _, err := zerocash.CreateBatchTx(doubled, ledger, params, ccs, pk, auctioneerECDHPub); err == nil {
+			t.Error("Batch spending the same note twice should be rejected")
+		}
+		testnet := *transfers[0].To
+		testnet.Network = zerocash.NetworkTest
+		wrongNetwork := []zerocash.BatchTransfer{{Note: fresh, Sk: sk, To: &testnet}}
+		if _, err := zerocash.CreateBatchTx(wrongNetwork, ledger, params, ccs, pk, auctioneerECDHPub); !errors.Is(err, zerocash.ErrAddressNetwork) {
+			t.Errorf("Batch paying a testnet address should return ErrAddressNetwork, got %v", err)
+		}
+	})
+}
+
+func TestAlgorithm2Register(t *testing.T) {
+	// Setup circuit keys
+	var circuitTx zerocash.CircuitTx
+	ccsTx, _ := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitTx)
+	pkTx, vkTx, _ := groth16.Setup(ccsTx)
+
+	var circuitReg register.CircuitTxRegister
+	ccsReg, _ := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitReg)
+	pkReg, _, _ := groth16.Setup(ccsReg)
+
+	t.Run("Valid Registration", func(t *testing.T) {
+		// Create participant and auctioneer
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		participantKp, _ := zerocash.GenerateDHKeyPair()
+
+		params := &zerocash.Params{}
+		participant := &zerocash.Participant{
+			Name:          "TestParticipant",
 			Sk:            participantKp.Sk,
 			Pk:            participantKp.Pk,
 			Params:        params,
@@ -470,182 +2560,1077 @@ func TestAlgorithm2Register(t *testing.T) {
 			t.Fatalf("ECDH key generation failed: %v", err)
 		}
 
-		// Execute registration using the SAME secret key that created the note
-		result, err := register.Register(participant, note, bid, pkTx, ccsTx, pkReg, ccsReg, sk, auctioneerECDHPub)
-		if err != nil {
-			t.Fatalf("Registration failed: %v", err)
+		ledger := zerocash.NewLedger()
+		path := addNoteToLedger(t, ledger, note)
+
+		// Execute registration using the SAME secret key that created the note
+		result, err := register.Register(participant, note, newOrder(zerocash.SideSell, 30, bid), path, pkTx, ccsTx, pkReg, ccsReg, sk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("Registration failed: %v", err)
+		}
+
+		// Validate result structure
+		if len(result.CAux) != zerocash.RegistrationFields {
+			t.Errorf("CAux should have %d elements", zerocash.RegistrationFields)
+		}
+		if result.TxIn == nil {
+			t.Error("TxIn is nil")
+		}
+		if len(result.InfoBid) == 0 {
+			t.Error("InfoBid is empty")
+		}
+		if len(result.Proof) == 0 {
+			t.Error("Proof is empty")
+		}
+		if result.Record == nil || !bytes.Equal(zerocash.MimcHashPublic(result.Record.SkIn).Bytes(), result.TxIn.NewNote.PkOwner) {
+			t.Error("Registration record does not hold the key of the tx^in note")
+		}
+
+		// Verify the transaction proof
+		err = zerocash.VerifyTx(result.TxIn.Public(), ledger, params, vkTx)
+		if err != nil {
+			t.Fatalf("Transaction verification failed: %v", err)
+		}
+
+		// Verify the registration proof (simplified check)
+		if len(result.Proof) == 0 {
+			t.Error("Registration proof is empty")
+		}
+	})
+
+	t.Run("Registration with Invalid Participant", func(t *testing.T) {
+		// Create participant without auctioneer public key
+		participantKp, _ := zerocash.GenerateDHKeyPair()
+		params := &zerocash.Params{}
+		participant := &zerocash.Participant{
+			Name:          "TestParticipant",
+			Sk:            participantKp.Sk,
+			Pk:            participantKp.Pk,
+			Params:        params,
+			AuctioneerPub: nil, // Missing auctioneer public key
+		}
+
+		coins := big.NewInt(100)
+		energy := big.NewInt(50)
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(coins, energy, sk)
+		bid := big.NewInt(25)
+
+		// Generate ECDH key pair for auctioneer
+		_, auctioneerECDHPub, err := generateECDHKeyPair()
+		if err != nil {
+			t.Fatalf("ECDH key generation failed: %v", err)
+		}
+
+		// Registration should fail due to missing auctioneer public key, not secret key mismatch
+		path := addNoteToLedger(t, zerocash.NewLedger(), note)
+		_, err = register.Register(participant, note, newOrder(zerocash.SideBuy, 1, bid), path, pkTx, ccsTx, pkReg, ccsReg, sk, auctioneerECDHPub)
+		if err == nil {
+			t.Error("Registration should fail with missing auctioneer public key")
+		}
+	})
+}
+
+func TestAlgorithm3Exchange(t *testing.T) {
+	for _, N := range exchangeTestSizes() {
+		t.Run(fmt.Sprintf("Valid Exchange with %d Participants", N), func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("Skipping exchange test in short mode")
+			}
+			testValidExchange(t, N)
+		})
+	}
+
+	t.Run("Exchange with Invalid Payloads", func(t *testing.T) {
+		// Test with empty payloads
+		var regPayloads []exchange.RegistrationPayload
+
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerECDHPriv, _, _ := generateECDHKeyPair()
+		ledger := zerocash.NewLedger()
+		params := &zerocash.Params{}
+
+		_, _, _, err := exchange.ExchangePhaseWithNotes(regPayloads, exchange.UniformPrice{}, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, nil, nil)
+		if err == nil {
+			t.Error("Exchange should fail with empty payloads")
+		}
+	})
+
+	t.Run("Exchange with Too Many Participants", func(t *testing.T) {
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerECDHPriv, _, _ := generateECDHKeyPair()
+		regPayloads := make([]exchange.RegistrationPayload, zerocash.MaxSize()+1)
+		ledger := zerocash.NewLedger()
+		params := &zerocash.Params{}
+
+		_, _, _, err := exchange.ExchangePhaseWithNotes(regPayloads, exchange.UniformPrice{}, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, nil, nil)
+		if err == nil {
+			t.Errorf("Exchange should fail with more than %d participants", zerocash.MaxSize())
+		}
+	})
+
+	t.Run("Dummy Slots", func(t *testing.T) {
+		// Three participants fill the size-5 circuit with two provably empty slots
+		field := ecc.BW6_761.ScalarField()
+		ccs5, err := frontend.Compile(field, r1cs.NewBuilder, exchange.NewCircuitTxF(5))
+		if err != nil {
+			t.Fatalf("CircuitTxF compilation failed: %v", err)
+		}
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		ledger := zerocash.NewLedger()
+		regPayloads := make([]exchange.RegistrationPayload, 3)
+		for i := range regPayloads {
+			participantKp, _ := zerocash.GenerateDHKeyPair()
+			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+			regPayloads[i] = exchange.RegistrationPayload{
+				Ciphertext: encryptRegistration(t, ledger, *sharedKey, big.NewInt(100), big.NewInt(50), newOrder(zerocash.SideBuy, 1, big.NewInt(int64(20+i))),
+					big.NewInt(int64(12345+i)), big.NewInt(int64(67890+i))),
+				PubKey: convertToGnarkPoint(participantKp.Pk),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		isSolved := func(witness *exchange.CircuitTxF) bool {
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs5.IsSolved(w) == nil
+		}
+
+		outcome, err := exchange.UniformPrice{}.Clear(inputs)
+		if err != nil {
+			t.Fatalf("Auction failed: %v", err)
+		}
+		witness, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+		if err != nil {
+			t.Fatalf("Witness construction failed: %v", err)
+		}
+		if witness.Dummy[2] != 0 || witness.Dummy[3] != 1 || witness.Dummy[4] != 1 {
+			t.Errorf("Dummy flags are %v, want the last two slots", witness.Dummy)
+		}
+		if !isSolved(witness) {
+			t.Fatal("Padded witness should satisfy the circuit")
+		}
+		// A participant holding coins cannot be passed off as a dummy
+		witness.Dummy[0] = 1
+		if isSolved(witness) {
+			t.Error("A dummy slot with coins should violate the circuit")
+		}
+	})
+
+	t.Run("Registered Notes", func(t *testing.T) {
+		// Each slot spends the ledger note its registration opens
+		field := ecc.BW6_761.ScalarField()
+		ccs5, err := frontend.Compile(field, r1cs.NewBuilder, exchange.NewCircuitTxF(5))
+		if err != nil {
+			t.Fatalf("CircuitTxF compilation failed: %v", err)
+		}
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		ledger := zerocash.NewLedger()
+		skIns := []*big.Int{big.NewInt(12345), big.NewInt(12346)}
+		notes := make([]*zerocash.Note, len(skIns))
+		regPayloads := make([]exchange.RegistrationPayload, len(skIns))
+		for i, skIn := range skIns {
+			participantKp, _ := zerocash.GenerateDHKeyPair()
+			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+			notes[i] = registeredNote(big.NewInt(100), big.NewInt(50), skIn)
+			regPayloads[i] = exchange.RegistrationPayload{
+				Ciphertext: register.EncryptRegistrationData(*sharedKey, notes[i], newOrder(zerocash.SideBuy, 1, big.NewInt(20)),
+					skIn, big.NewInt(int64(67890+i))),
+				PubKey: convertToGnarkPoint(participantKp.Pk),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		outcome, err := exchange.UniformPrice{}.Clear(inputs)
+		if err != nil {
+			t.Fatalf("Auction failed: %v", err)
+		}
+		isSolved := func(witness *exchange.CircuitTxF) bool {
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs5.IsSolved(w) == nil
+		}
+
+		addNoteToLedger(t, ledger, notes[0])
+		if _, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5); err == nil {
+			t.Error("A registration whose note is not in the ledger should be rejected")
+		}
+		addNoteToLedger(t, ledger, notes[1])
+		witness, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+		if err != nil {
+			t.Fatalf("Witness construction failed: %v", err)
+		}
+		if !isSolved(witness) {
+			t.Fatal("Witness over registered notes should satisfy the circuit")
+		}
+		// The serial numbers are those of the notes, as in any other spend of them
+		for i, note := range notes {
+			if sn := new(big.Int).SetBytes(zerocash.SerialNumber(skIns[i].Bytes(), note.Rho)).String(); witness.InSn[i] != sn {
+				t.Errorf("Slot %d spends serial number %v, want %s", i, witness.InSn[i], sn)
+			}
+		}
+
+		// The notes are proven against the anchor, along their own paths
+		tampered := *witness
+		tampered.Anchor = zerocash.NewLedger().MerkleRoot()
+		if isSolved(&tampered) {
+			t.Error("Notes proven against another anchor should violate the circuit")
+		}
+		tampered = *witness
+		tampered.PathBits = append([][zerocash.MerkleTreeDepth]frontend.Variable(nil), witness.PathBits...)
+		tampered.PathBits[0] = witness.PathBits[1]
+		if isSolved(&tampered) {
+			t.Error("A path to another leaf should violate the circuit")
+		}
+	})
+	t.Run("Clearing Rule", func(t *testing.T) {
+		// Two buyers and two sellers: only the highest buyer and lowest seller bids cross
+		field := ecc.BW6_761.ScalarField()
+		ccs5, err := frontend.Compile(field, r1cs.NewBuilder, exchange.NewCircuitTxF(5))
+		if err != nil {
+			t.Fatalf("CircuitTxF compilation failed: %v", err)
+		}
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		orders := []struct {
+			coins, energy int64
+			order         zerocash.Order
+		}{
+			{10000, 10, newOrder(zerocash.SideBuy, 10, big.NewInt(600))},
+			{5000, 5, newOrder(zerocash.SideBuy, 5, big.NewInt(300))},
+			{1000, 200, newOrder(zerocash.SideSell, 10, big.NewInt(400))},
+			{1000, 150, newOrder(zerocash.SideSell, 150, big.NewInt(700))},
+		}
+		ledger := zerocash.NewLedger()
+		regPayloads := make([]exchange.RegistrationPayload, len(orders))
+		for i, o := range orders {
+			participantKp, _ := zerocash.GenerateDHKeyPair()
+			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+			regPayloads[i] = exchange.RegistrationPayload{
+				Ciphertext: encryptRegistration(t, ledger, *sharedKey, big.NewInt(o.coins), big.NewInt(o.energy), o.order,
+					big.NewInt(int64(12345+i)), big.NewInt(int64(67890+i))),
+				PubKey: convertToGnarkPoint(participantKp.Pk),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+
+		// Buyer 0 takes 10 energy from seller 2 at the midpoint of [max(400, 300), min(600, 700)]
+		outcome, err := exchange.UniformPrice{}.Clear(inputs)
+		if err != nil {
+			t.Fatalf("Auction failed: %v", err)
+		}
+		outputs := outcome.Outputs
+		want := []struct{ coins, energy int64 }{{5000, 20}, {5000, 5}, {6000, 190}, {1000, 150}}
+		for i, w := range want {
+			if outputs[i].Coins.Int64() != w.coins || outputs[i].Energy.Int64() != w.energy {
+				t.Errorf("Participant %d ends with %v coins and %v energy, want %d and %d",
+					i, outputs[i].Coins, outputs[i].Energy, w.coins, w.energy)
+			}
+		}
+		if inputs[0].Coins.Int64() != 10000 || inputs[0].Energy.Int64() != 10 {
+			t.Error("The auction should not modify its inputs")
+		}
+
+		isSolved := func(outputs []exchange.DecryptedRegistration, tamper func(*exchange.CircuitTxF)) bool {
+			claimed := *outcome
+			claimed.Outputs = outputs
+			witness, err := exchange.BuildWitnessF(inputs, &claimed, regPayloads, auctioneerSk, ledger, 5)
+			if err != nil {
+				t.Fatalf("Witness construction failed: %v", err)
+			}
+			if tamper != nil {
+				tamper(witness)
+			}
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs5.IsSolved(w) == nil
+		}
+		if !isSolved(outputs, nil) {
+			t.Fatal("The auction outputs should satisfy the circuit")
+		}
+
+		// Another allocation conserving the totals is still rejected
+		moved := make([]exchange.DecryptedRegistration, len(outputs))
+		for i, output := range outputs {
+			moved[i] = output
+			moved[i].Coins = new(big.Int).Set(output.Coins)
+		}
+		moved[0].Coins.Add(moved[0].Coins, big.NewInt(1))
+		moved[2].Coins.Sub(moved[2].Coins, big.NewInt(1))
+		if isSolved(moved, nil) {
+			t.Error("A price other than the clearing price should violate the circuit")
+		}
+		if isSolved(inputs, nil) {
+			t.Error("Skipping a crossing trade should violate the circuit")
+		}
+		// Matching the second buyer first breaks the bid order
+		if isSolved(outputs, func(w *exchange.CircuitTxF) { w.Rank[0], w.Rank[1] = 1, 0 }) {
+			t.Error("Unsorted buyer ranks should violate the circuit")
+		}
+		if isSolved(outputs, func(w *exchange.CircuitTxF) { w.Rank[1] = 0 }) {
+			t.Error("Two buyers of the same rank should violate the circuit")
+		}
+		if isSolved(outputs, func(w *exchange.CircuitTxF) { w.ClearingPrice = 499 }) {
+			t.Error("A price below the midpoint should violate the circuit")
+		}
+		if isSolved(outputs, func(w *exchange.CircuitTxF) { w.Volume = 5 }) {
+			t.Error("Stopping the matching while the bids still cross should violate the circuit")
+		}
+		// The same outputs are not those of another mechanism
+		if isSolved(outputs, func(w *exchange.CircuitTxF) { w.Mechanism = int(exchange.MechanismPayAsBid) }) {
+			t.Error("Uniform-price outputs should not satisfy the pay-as-bid rule")
+		}
+		if isSolved(outputs, func(w *exchange.CircuitTxF) { w.Mechanism = 0 }) {
+			t.Error("An unknown mechanism should violate the circuit")
+		}
+	})
+
+	t.Run("Secrets Not Public", func(t *testing.T) {
+		// Only ciphertexts, serial numbers, output commitments and ciphertexts, the auctioneer key
+		// and the mechanism are public
+		field := ecc.BW6_761.ScalarField()
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		ledger := zerocash.NewLedger()
+		regPayloads := make([]exchange.RegistrationPayload, 3)
+		for i := range regPayloads {
+			participantKp, _ := zerocash.GenerateDHKeyPair()
+			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+			regPayloads[i] = exchange.RegistrationPayload{
+				Ciphertext: encryptRegistration(t, ledger, *sharedKey, big.NewInt(int64(1000+i)), big.NewInt(int64(500+i)),
+					newOrder(zerocash.SideSell, int64(100+i), big.NewInt(int64(20+i))), new(big.Int).SetBytes(zerocash.RandomBytesPublic(31)), new(big.Int).SetBytes(zerocash.RandomBytesPublic(31))),
+				PubKey: convertToGnarkPoint(participantKp.Pk),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		outcome, err := exchange.UniformPrice{}.Clear(inputs)
+		if err != nil {
+			t.Fatalf("Auction failed: %v", err)
+		}
+		witness, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+		if err != nil {
+			t.Fatalf("Witness construction failed: %v", err)
+		}
+
+		secrets := map[string]string{"auctioneer sk": auctioneerSk.String()}
+		for i := range witness.InSn {
+			// The side is a single bit and cannot be told apart from the public mechanism ID
+			for j, name := range []string{"pk^out", "sk^in", "limit price", "coins", "energy", "", "quantity", "input rho", "input rand"} {
+				if name != "" {
+					secrets[fmt.Sprintf("slot %d %s", i, name)] = fmt.Sprint(witness.DecVal[i][j])
+				}
+			}
+			secrets[fmt.Sprintf("slot %d output rho", i)] = fmt.Sprint(witness.OutRho[i])
+			secrets[fmt.Sprintf("slot %d output rand", i)] = fmt.Sprint(witness.OutRand[i])
+			secrets[fmt.Sprintf("slot %d encryption randomness", i)] = fmt.Sprint(witness.S[i])
+		}
+
+		public, err := frontend.NewWitness(witness, field, frontend.PublicOnly())
+		if err != nil {
+			t.Fatalf("Public witness creation failed: %v", err)
+		}
+		vector, ok := public.Vector().(bw6761_fr.Vector)
+		if !ok {
+			t.Fatalf("Unexpected public witness vector type %T", public.Vector())
+		}
+		// G_b, the mechanism and k, the anchor, and per slot 9 ciphertext elements, G_r, a serial
+		// number, an output commitment, 6 output ciphertext elements, G_s and the dummy flag
+		if want := 2 + 3 + 1 + 5*(zerocash.RegistrationFields+2+1+1+6+2+1); len(vector) != want {
+			t.Errorf("Public witness has %d elements, want %d", len(vector), want)
+		}
+		values := make(map[string]bool, len(vector))
+		for i := range vector {
+			values[vector[i].String()] = true
+		}
+		for name, secret := range secrets {
+			if secret != "0" && values[secret] {
+				t.Errorf("The %s appears in the public witness", name)
+			}
+		}
+	})
+
+	t.Run("Settlement", func(t *testing.T) {
+		// Two seed wallets register with derived auction keys; the settled exchange is a single
+		// ledger entry, and restored copies of the wallets find their outputs by scanning
+		field := ecc.BW6_761.ScalarField()
+		ccs5, err := frontend.Compile(field, r1cs.NewBuilder, exchange.NewCircuitTxF(5))
+		if err != nil {
+			t.Fatalf("CircuitTxF compilation failed: %v", err)
+		}
+		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		_, _, g1, _ := bls12377.Generators()
+		seeds := [][]byte{zerocash.NewSeed(), zerocash.NewSeed()}
+		orders := []zerocash.Order{newOrder(zerocash.SideSell, 10, big.NewInt(20)), newOrder(zerocash.SideBuy, 10, big.NewInt(40))}
+		ledger := zerocash.NewLedger()
+		regPayloads := make([]exchange.RegistrationPayload, len(seeds))
+		for i, seed := range seeds {
+			wallet, err := zerocash.NewWalletFromSeed(fmt.Sprintf("participant%d", i), seed)
+			if err != nil {
+				t.Fatalf("Wallet creation failed: %v", err)
+			}
+			skIn, skOut, rEnc, err := wallet.NewAuctionKeys()
+			if err != nil {
+				t.Fatalf("Auction key derivation failed: %v", err)
+			}
+			skOutBytes := skOut.Bytes()
+			var gr bls12377.G1Affine
+			gr.ScalarMultiplication(&g1, rEnc.BigInt(new(big.Int)))
+			regPayloads[i] = exchange.RegistrationPayload{
+				Ciphertext: encryptRegistration(t, ledger, *zerocash.ComputeDHShared(rEnc, auctioneerKp.Pk), big.NewInt(1000), big.NewInt(50),
+					orders[i], skIn.BigInt(new(big.Int)), zerocash.MimcHashPublic(skOutBytes[:])),
+				PubKey: convertToGnarkPoint(&gr),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		outcome, err := exchange.UniformPrice{}.Clear(inputs)
+		if err != nil {
+			t.Fatalf("Auction failed: %v", err)
+		}
+		witness, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+		if err != nil {
+			t.Fatalf("Witness construction failed: %v", err)
+		}
+		isSolved := func(witness *exchange.CircuitTxF) bool {
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs5.IsSolved(w) == nil
+		}
+		if !isSolved(witness) {
+			t.Fatal("Witness with encrypted outputs should satisfy the circuit")
+		}
+
+		// The encryptions are proven: a changed ciphertext or ephemeral key is rejected
+		tampered := *witness
+		tampered.CNew = append([][6]frontend.Variable(nil), witness.CNew...)
+		tampered.CNew[0][1] = witness.CNew[1][1]
+		if isSolved(&tampered) {
+			t.Error("An output ciphertext that does not encrypt the note should violate the circuit")
+		}
+		tampered = *witness
+		tampered.G_s = append([]sw_bls12377.G1Affine(nil), witness.G_s...)
+		tampered.G_s[0], tampered.G_s[1] = witness.G_s[1], witness.G_s[0]
+		if isSolved(&tampered) {
+			t.Error("Swapped encryption keys should violate the circuit")
 		}
 
-		// Validate result structure
-		if len(result.CAux) != 5 {
-			t.Error("CAux should have 5 elements")
+		// The ledger entry holds every slot, dummies included
+		entry := &zerocash.ExchangeTx{}
+		for i := range witness.InSn {
+			var cNew [6]string
+			for k := range cNew {
+				cNew[k] = fmt.Sprint(witness.CNew[i][k])
+			}
+			entry.SnIn = append(entry.SnIn, fmt.Sprint(witness.InSn[i]))
+			entry.CmOut = append(entry.CmOut, fmt.Sprint(witness.OutCm[i]))
+			entry.CNew = append(entry.CNew, cNew)
+			entry.G_r = append(entry.G_r, witness.G_r[i])
+			entry.G_s = append(entry.G_s, witness.G_s[i])
 		}
-		if result.TxIn == nil {
-			t.Error("TxIn is nil")
+		// The ledger already holds the two registered notes
+		if err := ledger.AppendExchangeTx(entry); err != nil {
+			t.Fatalf("Appending the exchange failed: %v", err)
 		}
-		if len(result.InfoBid) == 0 {
-			t.Error("InfoBid is empty")
+		if len(ledger.ExchangeTxs) != 1 || len(ledger.CmList) != 7 || len(ledger.SnList) != 5 || !ledger.HasValidExchange() {
+			t.Errorf("Ledger has %d exchanges, %d commitments and %d serial numbers, want 1, 7 and 5",
+				len(ledger.ExchangeTxs), len(ledger.CmList), len(ledger.SnList))
 		}
-		if len(result.Proof) == 0 {
-			t.Error("Proof is empty")
+		if err := ledger.AppendExchangeTx(entry); err == nil {
+			t.Error("Settling the same exchange twice should be a double spend")
+		}
+		if len(ledger.ExchangeTxs) != 1 || len(ledger.CmList) != 7 {
+			t.Error("A rejected exchange should leave the ledger unchanged")
+		}
+		ledgerPath := filepath.Join(t.TempDir(), "ledger.json")
+		if err := ledger.SaveToFile(ledgerPath); err != nil {
+			t.Fatalf("Saving the ledger failed: %v", err)
+		}
+		if ledger, err = zerocash.LoadLedgerFromFile(ledgerPath); err != nil {
+			t.Fatalf("Reloading the ledger failed: %v", err)
 		}
 
-		// Verify the transaction proof
-		err = zerocash.VerifyTx(result.TxIn, params, vkTx)
-		if err != nil {
-			t.Fatalf("Transaction verification failed: %v", err)
+		for i, seed := range seeds {
+			restored, err := zerocash.NewWalletFromSeed(fmt.Sprintf("participant%d", i), seed)
+			if err != nil {
+				t.Fatalf("Wallet restore failed: %v", err)
+			}
+			// A full viewing key does not cover exchange outputs: the r_enc they are encrypted
+			// to also decrypts the registration, sk^in included
+			fvk, err := restored.FullViewingKey()
+			if err != nil {
+				t.Fatalf("Full viewing key export failed: %v", err)
+			}
+			watch, _ := zerocash.NewWatchOnlyWallet("auditor", fvk)
+			if result, err := watch.ScanLedger(ledger); err != nil || len(result.Received) != 0 {
+				t.Errorf("A watch-only wallet listed %d exchange outputs of participant %d (%v)", len(result.Received), i, err)
+			}
+			result, err := restored.ScanLedger(ledger)
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if len(result.Received) != 1 {
+				t.Fatalf("Participant %d found %d outputs, want 1", i, len(result.Received))
+			}
+			got := result.Received[0]
+			if got.Value.Coins.Cmp(outcome.Outputs[i].Coins) != 0 || got.Value.Energy.Cmp(outcome.Outputs[i].Energy) != 0 {
+				t.Errorf("Participant %d output is %v coins and %v energy, want %v and %v", i,
+					got.Value.Coins, got.Value.Energy, outcome.Outputs[i].Coins, outcome.Outputs[i].Energy)
+			}
+			if cm := new(big.Int).SetBytes(got.Cm).String(); cm != entry.CmOut[i] {
+				t.Errorf("Participant %d output does not match commitment %d", i, i)
+			}
+			if restored.NextAuction != 1 {
+				t.Errorf("Scanning should advance the auction key counter to 1, got %d", restored.NextAuction)
+			}
+			// The output the scan found cannot be claimed a second time
+			held := len(restored.Notes)
+			if err := restored.ClaimExchangeOutput(ledger, got); err == nil || len(restored.Notes) != held {
+				t.Errorf("Participant %d claimed an output the scan already added", i)
+			}
+			if result, _ := restored.ScanLedger(ledger); len(result.Received) != 0 {
+				t.Error("A second scan should find nothing new")
+			}
 		}
 
-		// Verify the registration proof (simplified check)
-		if len(result.Proof) == 0 {
-			t.Error("Registration proof is empty")
+		// Someone else finds nothing
+		stranger, _ := zerocash.NewWalletFromSeed("stranger", zerocash.NewSeed())
+		if result, err := stranger.ScanLedger(ledger); err != nil || len(result.Received) != 0 {
+			t.Errorf("A stranger found %d outputs (%v)", len(result.Received), err)
 		}
 	})
+}
 
-	t.Run("Registration with Invalid Participant", func(t *testing.T) {
-		// Create participant without auctioneer public key
+// randomMarket returns n registrations with random orders, each backed by the note: buyers
+// hold enough coins for their quantity at their limit price, sellers enough energy.
+
+// testValidExchange runs an exchange of N participants on the exchange circuit of size N.
+func testValidExchange(t *testing.T, N int) {
+	ccsF, pkF, vkF := circuitTestKeys(t, zerocash.ExchangeCircuitID(N))
+
+	// Create auctioneer
+	auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+	auctioneerECDHPriv, auctioneerECDHPub, _ := generateECDHKeyPair()
+
+	// Create registration payloads for N participants, filling the circuit
+	ledger := zerocash.NewLedger()
+	regPayloads := make([]exchange.RegistrationPayload, N)
+	t.Logf("Creating registration payloads for %d participants", N)
+
+	for i := 0; i < N; i++ {
 		participantKp, _ := zerocash.GenerateDHKeyPair()
-		params := &zerocash.Params{}
-		participant := &zerocash.Participant{
-			Name:          "TestParticipant",
-			Sk:            participantKp.Sk,
-			Pk:            participantKp.Pk,
-			Params:        params,
-			AuctioneerPub: nil, // Missing auctioneer public key
+
+		// Create encrypted registration data with realistic values
+		coins := big.NewInt(int64(1000 + i*200))
+		energy := big.NewInt(int64(50 + i*10))
+		bid := big.NewInt(int64(25 + i*3))
+		skIn := big.NewInt(int64(12345 + i))
+		pkOut := big.NewInt(int64(67890 + i))
+		// Even participants sell half their energy, odd ones buy 20 units
+		order := newOrder(zerocash.SideBuy, 20, bid)
+		if i%2 == 0 {
+			order = newOrder(zerocash.SideSell, energy.Int64()/2, bid)
 		}
 
-		coins := big.NewInt(100)
-		energy := big.NewInt(50)
-		sk := zerocash.RandomBytesPublic(32)
-		note := zerocash.NewNote(coins, energy, sk)
-		bid := big.NewInt(25)
+		sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+		ciphertext := encryptRegistration(t, ledger, *sharedKey, coins, energy, order, skIn, pkOut)
 
-		// Generate ECDH key pair for auctioneer
-		_, auctioneerECDHPub, err := generateECDHKeyPair()
-		if err != nil {
-			t.Fatalf("ECDH key generation failed: %v", err)
+		regPayloads[i] = exchange.RegistrationPayload{
+			Ciphertext: ciphertext,
+			PubKey:     convertToGnarkPoint(participantKp.Pk),
+			TxNoteData: []byte{}, // Empty for test
 		}
+	}
 
-		// Registration should fail due to missing auctioneer public key, not secret key mismatch
-		_, err = register.Register(participant, note, bid, pkTx, ccsTx, pkReg, ccsReg, sk, auctioneerECDHPub)
-		if err == nil {
-			t.Error("Registration should fail with missing auctioneer public key")
-		}
-	})
-}
+	// Create ledger and params
+	params := &zerocash.Params{}
 
-func TestAlgorithm3Exchange(t *testing.T) {
-	// Setup circuit keys
-	var circuitF10 exchange.CircuitTxF10
-	ccsF10, _ := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitF10)
-	pkF10, _, _ := groth16.Setup(ccsF10)
+	// The note sent with tx^in must hold the values the registration is matched on
+	skIn := big.NewInt(12345)
+	richer, err := zerocash.EncryptNoteForAuctioneer(registeredNote(big.NewInt(5000), big.NewInt(50), skIn), auctioneerECDHPub)
+	if err != nil {
+		t.Fatalf("Note encryption failed: %v", err)
+	}
+	regPayloads[0].TxNoteData = richer
+	_, _, _, err = exchange.ExchangePhaseWithNotes(regPayloads, exchange.UniformPrice{}, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, pkF, ccsF)
+	if err == nil || !strings.Contains(err.Error(), "registration declares") {
+		t.Errorf("Exchange over a note of other values should fail before proving, got %v", err)
+	}
+	regPayloads[0].TxNoteData, err = zerocash.EncryptNoteForAuctioneer(registeredNote(big.NewInt(1000), big.NewInt(50), skIn), auctioneerECDHPub)
+	if err != nil {
+		t.Fatalf("Note encryption failed: %v", err)
+	}
 
-	t.Run("Valid Exchange with Multiple Participants", func(t *testing.T) {
-		if testing.Short() {
-			t.Skip("Skipping exchange test in short mode")
-		}
+	t.Logf("Executing exchange phase...")
+	// Execute exchange
+	txOut, info, proof, err := exchange.ExchangePhaseWithNotes(regPayloads, exchange.UniformPrice{}, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, pkF, ccsF)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
 
-		// Create auctioneer
-		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
-		auctioneerECDHPriv, _, _ := generateECDHKeyPair()
+	// Validate results
+	if txOut == nil {
+		t.Error("txOut is nil")
+	}
+	if info == nil {
+		t.Error("info is nil")
+	}
+	if len(proof) == 0 {
+		t.Error("proof is empty")
+	}
 
-		// Create registration payloads for 10 participants (to match circuit design)
-		N := 10
-		regPayloads := make([]exchange.RegistrationPayload, N)
-		t.Logf("Creating registration payloads for %d participants", N)
+	// The published part verifies on its own, and binds its public inputs
+	public := txOut.(*exchange.ExchangeTransaction).Public()
+	terms, err := exchange.NewTerms(exchange.UniformPrice{}, *auctioneerKp.Pk)
+	if err != nil {
+		t.Fatalf("Terms creation failed: %v", err)
+	}
+	if err := exchange.VerifyExchange(public, terms, ledger, params, vkF); err != nil {
+		t.Errorf("Exchange proof should verify: %v", err)
+	}
+	tampered := *public
+	tampered.SnIn = append([]string(nil), public.SnIn...)
+	tampered.SnIn[0] = public.SnIn[1]
+	if err := exchange.VerifyExchange(&tampered, terms, ledger, params, vkF); err == nil {
+		t.Error("Exchange proof should not verify with another serial number")
+	}
+	// The registered notes are proven against a root of this ledger
+	if err := exchange.VerifyExchange(public, terms, zerocash.NewLedger(), params, vkF); err == nil {
+		t.Error("Exchange proof should not verify against another ledger's anchors")
+	}
+	// The auction's terms fix the auctioneer key and the mechanism, not the exchange
+	otherKp, _ := zerocash.GenerateDHKeyPair()
+	otherKey, _ := exchange.NewTerms(exchange.UniformPrice{}, *otherKp.Pk)
+	if err := exchange.VerifyExchange(public, otherKey, ledger, params, vkF); err == nil {
+		t.Error("Exchange proof should not verify for another auctioneer key")
+	}
+	otherMechanism, _ := exchange.NewTerms(exchange.McAfee{}, *auctioneerKp.Pk)
+	if err := exchange.VerifyExchange(public, otherMechanism, ledger, params, vkF); err == nil {
+		t.Error("Exchange proof should not verify for another mechanism")
+	}
+	tampered = *public
+	tampered.Mechanism = exchange.MechanismMcAfee
+	if err := exchange.VerifyExchange(&tampered, otherMechanism, ledger, params, vkF); err == nil {
+		t.Error("Exchange proof should not verify once relabeled with another mechanism")
+	}
 
-		for i := 0; i < N; i++ {
-			participantKp, _ := zerocash.GenerateDHKeyPair()
+	t.Logf("✅ Exchange completed successfully with %d participants", N)
+	t.Logf("  Proof size: %d bytes", len(proof))
+}
 
-			// Create encrypted registration data with realistic values
-			coins := big.NewInt(int64(1000 + i*200)) // 1000-2800 coins
-			energy := big.NewInt(int64(50 + i*10))   // 50-140 energy
-			bid := big.NewInt(int64(25 + i*3))       // 25-52 bid
-			skIn := big.NewInt(int64(12345 + i))
-			pkOut := big.NewInt(int64(67890 + i))
+func randomMarket(rng *mathrand.Rand, n int) []exchange.DecryptedRegistration {
+	market := make([]exchange.DecryptedRegistration, n)
+	for i := range market {
+		energy := 1 + rng.Int63n(500)
+		quantity := 1 + rng.Int63n(100)
+		side := zerocash.SideBuy
+		if rng.Intn(2) == 0 {
+			side = zerocash.SideSell
+			quantity = 1 + rng.Int63n(energy)
+		}
+		market[i] = exchange.DecryptedRegistration{
+			PkOut:      big.NewInt(int64(67890 + i)),
+			SkIn:       big.NewInt(int64(12345 + i)),
+			Side:       side,
+			Quantity:   big.NewInt(quantity),
+			LimitPrice: big.NewInt(rng.Int63n(3000)),
+			Coins:      big.NewInt(1_000_000 + rng.Int63n(1000)),
+			Energy:     big.NewInt(energy),
+		}
+	}
+	return market
+}
 
-			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
-			ciphertext := register.EncryptRegistrationData(*sharedKey, coins, energy, bid, skIn, pkOut)
+func TestAuctionMechanisms(t *testing.T) {
+	mechanisms := []exchange.AuctionMechanism{
+		exchange.UniformPrice{},
+		exchange.KDouble{Num: 1, Den: 2},
+		exchange.KDouble{Num: 1, Den: 3},
+		exchange.McAfee{},
+		exchange.PayAsBid{},
+	}
+	clearWith := func(t *testing.T, m exchange.AuctionMechanism, inputs []exchange.DecryptedRegistration) *exchange.AuctionOutcome {
+		t.Helper()
+		outcome, err := m.Clear(inputs)
+		if err != nil {
+			t.Fatalf("%v auction failed: %v", m.ID(), err)
+		}
+		return outcome
+	}
 
-			regPayloads[i] = exchange.RegistrationPayload{
-				Ciphertext: ciphertext,
-				PubKey:     convertToGnarkPoint(participantKp.Pk),
-				TxNoteData: []byte{}, // Empty for test
+	t.Run("Budget Balance", func(t *testing.T) {
+		rng := mathrand.New(mathrand.NewSource(21))
+		for _, m := range mechanisms {
+			for round := 0; round < 200; round++ {
+				inputs := randomMarket(rng, 1+rng.Intn(12))
+				outcome := clearWith(t, m, inputs)
+
+				paid, received := big.NewInt(0), big.NewInt(0)
+				for _, trade := range outcome.Trades {
+					paid.Add(paid, new(big.Int).Mul(trade.BuyerPrice, trade.Quantity))
+					received.Add(received, new(big.Int).Mul(trade.SellerPrice, trade.Quantity))
+				}
+				if paid.Cmp(received) < 0 {
+					t.Fatalf("%v: buyers pay %v but sellers receive %v", m.ID(), paid, received)
+				}
+				if surplus := new(big.Int).Sub(paid, received); surplus.Cmp(outcome.Surplus) != 0 {
+					t.Fatalf("%v: surplus is %v, want %v", m.ID(), outcome.Surplus, surplus)
+				}
+				if id := m.ID(); (id == exchange.MechanismUniformPrice || id == exchange.MechanismKDouble) && outcome.Surplus.Sign() != 0 {
+					t.Fatalf("%v should be strongly budget balanced, surplus %v", id, outcome.Surplus)
+				}
+
+				// Energy is conserved, coins up to the surplus
+				coinsIn, coinsOut, energyIn, energyOut := big.NewInt(0), new(big.Int).Set(outcome.Surplus), big.NewInt(0), big.NewInt(0)
+				for i := range inputs {
+					coinsIn.Add(coinsIn, inputs[i].Coins)
+					energyIn.Add(energyIn, inputs[i].Energy)
+					coinsOut.Add(coinsOut, outcome.Outputs[i].Coins)
+					energyOut.Add(energyOut, outcome.Outputs[i].Energy)
+				}
+				if coinsIn.Cmp(coinsOut) != 0 || energyIn.Cmp(energyOut) != 0 {
+					t.Fatalf("%v: totals (%v, %v) become (%v, %v) with the surplus", m.ID(), coinsIn, energyIn, coinsOut, energyOut)
+				}
 			}
 		}
+	})
 
-		// Create ledger and params
-		ledger := zerocash.NewLedger()
-		params := &zerocash.Params{}
-
-		t.Logf("Executing exchange phase...")
-		// Execute exchange
-		txOut, info, proof, err := exchange.ExchangePhaseWithNotes(regPayloads, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, pkF10, ccsF10)
-		if err != nil {
-			t.Fatalf("Exchange failed: %v", err)
+	t.Run("Individual Rationality", func(t *testing.T) {
+		rng := mathrand.New(mathrand.NewSource(42))
+		for _, m := range mechanisms {
+			for round := 0; round < 200; round++ {
+				inputs := randomMarket(rng, 1+rng.Intn(12))
+				outcome := clearWith(t, m, inputs)
+
+				traded := make(map[int]bool)
+				filled := make(map[int]*big.Int)
+				for _, trade := range outcome.Trades {
+					buyer, seller := inputs[trade.Buyer], inputs[trade.Seller]
+					if buyer.Side != zerocash.SideBuy || seller.Side != zerocash.SideSell {
+						t.Fatalf("%v: trade %d -> %d does not match the declared sides", m.ID(), trade.Seller, trade.Buyer)
+					}
+					if trade.BuyerPrice.Cmp(buyer.LimitPrice) > 0 {
+						t.Fatalf("%v: buyer %d pays %v per unit above its limit %v", m.ID(), trade.Buyer, trade.BuyerPrice, buyer.LimitPrice)
+					}
+					if trade.SellerPrice.Cmp(seller.LimitPrice) < 0 {
+						t.Fatalf("%v: seller %d receives %v per unit below its limit %v", m.ID(), trade.Seller, trade.SellerPrice, seller.LimitPrice)
+					}
+					if trade.Quantity.Sign() <= 0 {
+						t.Fatalf("%v: empty fill %d -> %d", m.ID(), trade.Seller, trade.Buyer)
+					}
+					for _, i := range []int{trade.Buyer, trade.Seller} {
+						if filled[i] == nil {
+							filled[i] = big.NewInt(0)
+						}
+						filled[i].Add(filled[i], trade.Quantity)
+						if filled[i].Cmp(inputs[i].Quantity) > 0 {
+							t.Fatalf("%v: participant %d is filled %v, more than its order of %v", m.ID(), i, filled[i], inputs[i].Quantity)
+						}
+					}
+					traded[trade.Buyer], traded[trade.Seller] = true, true
+				}
+				// Apart from McAfee's trade reduction, no remaining buyer and seller still cross
+				if m.ID() != exchange.MechanismMcAfee {
+					for i, buyer := range inputs {
+						for j, seller := range inputs {
+							if buyer.Side != zerocash.SideBuy || seller.Side != zerocash.SideSell || buyer.LimitPrice.Cmp(seller.LimitPrice) < 0 {
+								continue
+							}
+							if (filled[i] == nil || filled[i].Cmp(buyer.Quantity) < 0) && (filled[j] == nil || filled[j].Cmp(seller.Quantity) < 0) {
+								t.Fatalf("%v: buyer %d and seller %d cross but are not fully filled", m.ID(), i, j)
+							}
+						}
+					}
+				}
+				// Participants without a trade keep their values
+				for i := range inputs {
+					if !traded[i] && (inputs[i].Coins.Cmp(outcome.Outputs[i].Coins) != 0 || inputs[i].Energy.Cmp(outcome.Outputs[i].Energy) != 0) {
+						t.Fatalf("%v: participant %d changes without trading", m.ID(), i)
+					}
+				}
+			}
 		}
+	})
 
-		// Validate results
-		if txOut == nil {
-			t.Error("txOut is nil")
+	t.Run("McAfee Trade Reduction", func(t *testing.T) {
+		// 20 units match (10 from 100 to 900, 10 from 200 to 800), the next unit (300, 5000) prices
+		// at 2650, outside [200, 800]: the second fill is dropped and its bids price the first
+		order := func(side zerocash.OrderSide, quantity, price, coins, energy int64) exchange.DecryptedRegistration {
+			return exchange.DecryptedRegistration{Side: side, Quantity: big.NewInt(quantity), LimitPrice: big.NewInt(price),
+				Coins: big.NewInt(coins), Energy: big.NewInt(energy)}
 		}
-		if info == nil {
-			t.Error("info is nil")
+		inputs := []exchange.DecryptedRegistration{
+			order(zerocash.SideBuy, 10, 900, 100000, 10),
+			order(zerocash.SideBuy, 10, 800, 100000, 10),
+			order(zerocash.SideBuy, 5, 300, 100000, 5),
+			order(zerocash.SideSell, 10, 100, 10, 200),
+			order(zerocash.SideSell, 10, 200, 10, 200),
+			order(zerocash.SideSell, 10, 5000, 10, 200),
 		}
-		if len(proof) == 0 {
-			t.Error("proof is empty")
+		outcome := clearWith(t, exchange.McAfee{}, inputs)
+		if len(outcome.Trades) != 1 {
+			t.Fatalf("McAfee made %d trades, want 1", len(outcome.Trades))
+		}
+		trade := outcome.Trades[0]
+		if trade.Buyer != 0 || trade.Seller != 3 || trade.BuyerPrice.Int64() != 800 || trade.SellerPrice.Int64() != 200 {
+			t.Errorf("Trade is %d -> %d at %v / %v, want 3 -> 0 at 800 / 200", trade.Seller, trade.Buyer, trade.BuyerPrice, trade.SellerPrice)
+		}
+		if outcome.Surplus.Int64() != 6000 {
+			t.Errorf("Surplus is %v, want 6000", outcome.Surplus)
+		}
+		if len(outcome.Transcript) == 0 {
+			t.Error("The outcome should carry a transcript")
 		}
 
-		t.Logf("✅ Exchange completed successfully with %d participants", N)
-		t.Logf("  Proof size: %d bytes", len(proof))
+		if _, err := (exchange.KDouble{Num: 3, Den: 2}).Clear(inputs); err == nil {
+			t.Error("A k-double auction with k > 1 should be rejected")
+		}
 	})
 
-	t.Run("Exchange with Invalid Payloads", func(t *testing.T) {
-		// Test with empty payloads
-		var regPayloads []exchange.RegistrationPayload
-
+	t.Run("Partial Fills", func(t *testing.T) {
+		// One large seller serves three buyers and fills the last one partially; the next seller
+		// asks more than that buyer bids
+		field := ecc.BW6_761.ScalarField()
+		ccs5, err := frontend.Compile(field, r1cs.NewBuilder, exchange.NewCircuitTxF(5))
+		if err != nil {
+			t.Fatalf("CircuitTxF compilation failed: %v", err)
+		}
 		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
-		auctioneerECDHPriv, _, _ := generateECDHKeyPair()
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		orders := []struct {
+			coins, energy int64
+			order         zerocash.Order
+		}{
+			{0, 100, newOrder(zerocash.SideSell, 100, big.NewInt(10))},
+			{5000, 0, newOrder(zerocash.SideBuy, 30, big.NewInt(50))},
+			{5000, 0, newOrder(zerocash.SideBuy, 30, big.NewInt(40))},
+			{5000, 0, newOrder(zerocash.SideBuy, 60, big.NewInt(30))},
+			{0, 50, newOrder(zerocash.SideSell, 50, big.NewInt(35))},
+		}
 		ledger := zerocash.NewLedger()
-		params := &zerocash.Params{}
+		regPayloads := make([]exchange.RegistrationPayload, len(orders))
+		for i, o := range orders {
+			participantKp, _ := zerocash.GenerateDHKeyPair()
+			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+			regPayloads[i] = exchange.RegistrationPayload{
+				Ciphertext: encryptRegistration(t, ledger, *sharedKey, big.NewInt(o.coins), big.NewInt(o.energy), o.order,
+					big.NewInt(int64(12345+i)), big.NewInt(int64(67890+i))),
+				PubKey: convertToGnarkPoint(participantKp.Pk),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
 
-		_, _, _, err := exchange.ExchangePhaseWithNotes(regPayloads, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, pkF10, ccsF10)
-		if err == nil {
-			t.Error("Exchange should fail with empty payloads")
+		// Uniform price: the last unit matches (30, 10) and the next one (30, 35), so [30, 30]
+		outcome := clearWith(t, exchange.UniformPrice{}, inputs)
+		want := []struct{ buyer, seller, quantity int64 }{{1, 0, 30}, {2, 0, 30}, {3, 0, 40}}
+		if len(outcome.Trades) != len(want) {
+			t.Fatalf("Auction made %d fills, want %d: %v", len(outcome.Trades), len(want), outcome.Transcript)
+		}
+		for k, w := range want {
+			trade := outcome.Trades[k]
+			if int64(trade.Buyer) != w.buyer || int64(trade.Seller) != w.seller || trade.Quantity.Int64() != w.quantity ||
+				trade.BuyerPrice.Int64() != 30 || trade.SellerPrice.Int64() != 30 {
+				t.Errorf("Fill %d is %d -> %d, %v at %v / %v, want %d -> %d, %d at 30", k, trade.Seller, trade.Buyer,
+					trade.Quantity, trade.BuyerPrice, trade.SellerPrice, w.seller, w.buyer, w.quantity)
+			}
+		}
+		wantOutputs := []struct{ coins, energy int64 }{{3000, 0}, {4100, 30}, {4100, 30}, {3800, 40}, {0, 50}}
+		for i, w := range wantOutputs {
+			if outcome.Outputs[i].Coins.Int64() != w.coins || outcome.Outputs[i].Energy.Int64() != w.energy {
+				t.Errorf("Participant %d ends with %v coins and %v energy, want %d and %d",
+					i, outcome.Outputs[i].Coins, outcome.Outputs[i].Energy, w.coins, w.energy)
+			}
+		}
+
+		isSolved := func(outcome *exchange.AuctionOutcome, tamper func(*exchange.CircuitTxF)) bool {
+			witness, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+			if err != nil {
+				t.Fatalf("Witness construction failed: %v", err)
+			}
+			if tamper != nil {
+				tamper(witness)
+			}
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccs5.IsSolved(w) == nil
+		}
+		for _, m := range mechanisms {
+			if !isSolved(clearWith(t, m, inputs), nil) {
+				t.Errorf("%v fills should satisfy the circuit", m.ID())
+			}
+		}
+		// Filling the partial buyer completely takes units that do not cross
+		if isSolved(outcome, func(w *exchange.CircuitTxF) { w.Volume = 120 }) {
+			t.Error("Matching past the crossing volume should violate the circuit")
+		}
+		// One fill per participant is not the matching
+		single := *outcome
+		single.Outputs = append([]exchange.DecryptedRegistration(nil), outcome.Outputs...)
+		single.Outputs[0] = inputs[0]
+		single.Outputs[0].Coins, single.Outputs[0].Energy = big.NewInt(900), big.NewInt(70)
+		single.Outputs[2], single.Outputs[3] = inputs[2], inputs[3]
+		if isSolved(&single, nil) {
+			t.Error("Dropping the partial fills should violate the circuit")
 		}
 	})
 
-	t.Run("Exchange with Incorrect Number of Participants", func(t *testing.T) {
-		// Test with wrong number of participants (not 10)
+	t.Run("Proven In Circuit", func(t *testing.T) {
+		// Every mechanism's outcome satisfies the circuit under its own ID only
+		field := ecc.BW6_761.ScalarField()
+		ccs5, err := frontend.Compile(field, r1cs.NewBuilder, exchange.NewCircuitTxF(5))
+		if err != nil {
+			t.Fatalf("CircuitTxF compilation failed: %v", err)
+		}
 		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
-		auctioneerECDHPriv, _, _ := generateECDHKeyPair()
-
-		// Create only 5 registration payloads (should fail for CircuitTxF10)
-		regPayloads := make([]exchange.RegistrationPayload, 5)
-		for i := 0; i < 5; i++ {
+		auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+		orders := []struct {
+			coins, energy int64
+			order         zerocash.Order
+		}{
+			{100000, 10, newOrder(zerocash.SideBuy, 10, big.NewInt(900))},
+			{100000, 10, newOrder(zerocash.SideBuy, 10, big.NewInt(800))},
+			{1000, 200, newOrder(zerocash.SideSell, 200, big.NewInt(100))},
+			{1000, 200, newOrder(zerocash.SideSell, 200, big.NewInt(200))},
+			{1000, 200, newOrder(zerocash.SideSell, 200, big.NewInt(650))},
+		}
+		ledger := zerocash.NewLedger()
+		regPayloads := make([]exchange.RegistrationPayload, len(orders))
+		for i, o := range orders {
 			participantKp, _ := zerocash.GenerateDHKeyPair()
-			coins := big.NewInt(100)
-			energy := big.NewInt(50)
-			bid := big.NewInt(25)
-			skIn := big.NewInt(12345)
-			pkOut := big.NewInt(67890)
-
 			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
-			ciphertext := register.EncryptRegistrationData(*sharedKey, coins, energy, bid, skIn, pkOut)
-
 			regPayloads[i] = exchange.RegistrationPayload{
-				Ciphertext: ciphertext,
-				PubKey:     convertToGnarkPoint(participantKp.Pk),
-				TxNoteData: []byte{},
+				Ciphertext: encryptRegistration(t, ledger, *sharedKey, big.NewInt(o.coins), big.NewInt(o.energy), o.order,
+					big.NewInt(int64(12345+i)), big.NewInt(int64(67890+i))),
+				PubKey: convertToGnarkPoint(participantKp.Pk),
+			}
+		}
+		inputs, err := exchange.DecryptAllRegistrations(regPayloads, auctioneerSk)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		isSolved := func(witness *exchange.CircuitTxF) bool {
+			w, err := frontend.NewWitness(witness, field)
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
 			}
+			return ccs5.IsSolved(w) == nil
 		}
 
-		ledger := zerocash.NewLedger()
-		params := &zerocash.Params{}
+		for _, m := range mechanisms {
+			outcome := clearWith(t, m, inputs)
+			witness, err := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+			if err != nil {
+				t.Fatalf("Witness construction failed: %v", err)
+			}
+			if !isSolved(witness) {
+				t.Errorf("%v outcome should satisfy the circuit", m.ID())
+			}
+			// The surplus cannot be moved to a participant
+			if outcome.Surplus.Sign() > 0 {
+				claimed := *outcome
+				claimed.Outputs = append([]exchange.DecryptedRegistration(nil), outcome.Outputs...)
+				claimed.Outputs[0].Coins = new(big.Int).Add(outcome.Outputs[0].Coins, outcome.Surplus)
+				witness, _ := exchange.BuildWitnessF(inputs, &claimed, regPayloads, auctioneerSk, ledger, 5)
+				if isSolved(witness) {
+					t.Errorf("%v: paying the surplus out should violate the circuit", m.ID())
+				}
+			}
+		}
 
-		_, _, _, err := exchange.ExchangePhaseWithNotes(regPayloads, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, pkF10, ccsF10)
-		if err == nil {
-			t.Error("Exchange should fail with incorrect number of participants (5 instead of 10)")
+		// The surplus is burned: the outputs hold the input coins less the surplus, and no slot,
+		// not even a dummy one, can be minted the difference
+		for _, m := range []exchange.AuctionMechanism{exchange.McAfee{}, exchange.PayAsBid{}} {
+			outcome := clearWith(t, m, inputs[:4])
+			if outcome.Surplus.Sign() <= 0 {
+				t.Fatalf("%v should leave a surplus in this market", m.ID())
+			}
+			coinsIn, coinsOut := big.NewInt(0), new(big.Int).Set(outcome.Surplus)
+			for i := range outcome.Outputs {
+				coinsIn.Add(coinsIn, inputs[i].Coins)
+				coinsOut.Add(coinsOut, outcome.Outputs[i].Coins)
+			}
+			if coinsIn.Cmp(coinsOut) != 0 {
+				t.Errorf("%v: outputs plus surplus hold %v coins, want %v", m.ID(), coinsOut, coinsIn)
+			}
+			witness, err := exchange.BuildWitnessF(inputs[:4], outcome, regPayloads[:4], auctioneerSk, ledger, 5)
+			if err != nil {
+				t.Fatalf("Witness construction failed: %v", err)
+			}
+			if !isSolved(witness) {
+				t.Errorf("%v outcome with a dummy slot should satisfy the circuit", m.ID())
+			}
+			witness.OutCoin[4] = outcome.Surplus
+			if isSolved(witness) {
+				t.Errorf("%v: minting the surplus to the dummy slot should violate the circuit", m.ID())
+			}
+		}
+
+		// Random markets, padded with dummies, clear the same way in the circuit
+		rng := mathrand.New(mathrand.NewSource(23))
+		for round := 0; round < 10; round++ {
+			market := randomMarket(rng, 1+rng.Intn(5))
+			payloads := make([]exchange.RegistrationPayload, len(market))
+			for i, r := range market {
+				participantKp, _ := zerocash.GenerateDHKeyPair()
+				sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
+				order := zerocash.Order{Side: r.Side, Quantity: r.Quantity, LimitPrice: r.LimitPrice}
+				payloads[i] = exchange.RegistrationPayload{
+					Ciphertext: encryptRegistration(t, ledger, *sharedKey, r.Coins, r.Energy, order, r.SkIn, r.PkOut),
+					PubKey:     convertToGnarkPoint(participantKp.Pk),
+				}
+			}
+			for _, m := range mechanisms {
+				outcome := clearWith(t, m, market)
+				witness, err := exchange.BuildWitnessF(market, outcome, payloads, auctioneerSk, ledger, 5)
+				if err != nil {
+					t.Fatalf("Witness construction failed: %v", err)
+				}
+				if !isSolved(witness) {
+					t.Errorf("%v outcome of random market %d should satisfy the circuit: %v", m.ID(), round, outcome.Transcript)
+				}
+			}
+		}
+
+		// Pay-as-bid outputs are not those of the uniform price
+		outcome := clearWith(t, exchange.PayAsBid{}, inputs)
+		witness, _ := exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+		witness.Mechanism = int(exchange.MechanismUniformPrice)
+		if isSolved(witness) {
+			t.Error("Pay-as-bid outputs should not satisfy the uniform-price rule")
+		}
+		// k is public: the outputs of k = 1/2 do not prove k = 1/3
+		outcome = clearWith(t, exchange.KDouble{Num: 1, Den: 2}, inputs)
+		witness, _ = exchange.BuildWitnessF(inputs, outcome, regPayloads, auctioneerSk, ledger, 5)
+		witness.KDen = 3
+		if isSolved(witness) {
+			t.Error("k-double outputs should not satisfy another k")
 		}
 	})
 }
@@ -663,45 +3648,11 @@ func TestAlgorithm4Withdraw(t *testing.T) {
 	}
 
 	t.Run("Valid Withdrawal", func(t *testing.T) {
-		// Create input note with proper commitment
-		inCoins := big.NewInt(100)
-		inEnergy := big.NewInt(50)
-		inPk := big.NewInt(12345)
-		inRho := big.NewInt(111)
-		inR := big.NewInt(222)
-
-		// Compute the commitment using MiMC like the circuit does
-		inCm := computeMimcCommitment(inCoins, inEnergy, inPk, inRho, inR)
-
-		nIn := withdraw.Note{
-			Coins:  inCoins,
-			Energy: inEnergy,
-			Pk:     inPk,
-			Rho:    inRho,
-			R:      inR,
-			Cm:     inCm,
-		}
-
-		// Create output note with proper commitment
-		outCoins := big.NewInt(90)  // Reduced by fee
-		outEnergy := big.NewInt(45) // Reduced by fee
-		outPk := big.NewInt(54321)
-		outRho := big.NewInt(444)
-		outR := big.NewInt(555)
-
-		// Compute the commitment using MiMC like the circuit does
-		outCm := computeMimcCommitment(outCoins, outEnergy, outPk, outRho, outR)
-
-		nOut := withdraw.Note{
-			Coins:  outCoins,
-			Energy: outEnergy,
-			Pk:     outPk,
-			Rho:    outRho,
-			R:      outR,
-			Cm:     outCm,
-		}
-
+		// The registered note is in the ledger; the output note keeps its value under pk^out
+		ledger := zerocash.NewLedger()
 		skIn := big.NewInt(12345)
+		nIn, nOut := withdrawalNotes(t, ledger, big.NewInt(100), big.NewInt(50), skIn, big.NewInt(54321))
+		outPk := nOut.Pk
 		bid := big.NewInt(25) // bid value instead of rEnc
 
 		// Create participant's public key
@@ -722,7 +3673,7 @@ func TestAlgorithm4Withdraw(t *testing.T) {
 		}
 
 		// Execute withdrawal with correct parameter order
-		tx, proof, err := withdraw.Withdraw(nIn, skIn, nOut, pkT, cipherAux, bid, pkWithdraw, ccsWithdraw)
+		tx, proof, err := withdraw.Withdraw(nIn, skIn, nOut, pkT, cipherAux, bid, ledger, &zerocash.Params{}, pkWithdraw, ccsWithdraw)
 		if err != nil {
 			t.Fatalf("Withdrawal failed: %v", err)
 		}
@@ -743,10 +3694,81 @@ func TestAlgorithm4Withdraw(t *testing.T) {
 		t.Logf("vkWithdraw: %+v", vkWithdraw)
 
 		// Verify withdrawal proof
-		err = withdraw.VerifyWithdraw(tx, proof, vkWithdraw)
+		err = withdraw.VerifyWithdraw(tx, proof, &zerocash.Params{}, vkWithdraw)
 		if err != nil {
 			t.Fatalf("Withdrawal verification failed: %v", err)
 		}
+
+		// The ledger spends the note and adds the output note to the tree, once
+		if err := withdraw.SubmitWithdrawTx(ledger, tx, proof, &zerocash.Params{}, vkWithdraw); err != nil {
+			t.Fatalf("Submitting the withdrawal failed: %v", err)
+		}
+		if !ledger.HasSerialNumber(tx.SnIn.String()) || ledger.CmList[len(ledger.CmList)-1] != tx.CmOut.String() {
+			t.Error("The withdrawal should record its serial number and output commitment")
+		}
+		if err := withdraw.SubmitWithdrawTx(ledger, tx, proof, &zerocash.Params{}, vkWithdraw); err == nil {
+			t.Error("Withdrawing the same note twice should be rejected")
+		}
+		stale := *tx
+		stale.Anchor = big.NewInt(1)
+		if err := zerocash.NewLedger().AppendWithdrawTx(&stale); err == nil {
+			t.Error("A withdrawal under an unknown anchor should be rejected")
+		}
+	})
+
+	t.Run("Made-Up Note", func(t *testing.T) {
+		ledger := zerocash.NewLedger()
+		skIn := big.NewInt(12345)
+		nIn, nOut := withdrawalNotes(t, ledger, big.NewInt(100), big.NewInt(50), skIn, big.NewInt(54321))
+		bid := big.NewInt(25)
+		participantKp, _ := zerocash.GenerateDHKeyPair()
+		pkT := sw_bls12377.G1Affine{X: participantKp.Pk.X.String(), Y: participantKp.Pk.Y.String()}
+		cipherAux := computeDHOTPEncryption(bid, skIn, nOut.Pk, pkT)
+		isSolved := func(nIn, nOut withdraw.Note, tamper func(w *withdraw.CircuitWithdraw)) bool {
+			witness, err := withdraw.BuildWithdrawWitness(nIn, skIn, nOut, pkT, cipherAux, bid, ledger)
+			if err != nil {
+				t.Fatalf("Witness construction failed: %v", err)
+			}
+			if tamper != nil {
+				tamper(witness)
+			}
+			w, err := frontend.NewWitness(witness, ecc.BW6_761.ScalarField())
+			if err != nil {
+				t.Fatalf("Witness creation failed: %v", err)
+			}
+			return ccsWithdraw.IsSolved(w) == nil
+		}
+		if !isSolved(nIn, nOut, nil) {
+			t.Fatal("The withdrawal of a ledger note should satisfy the circuit")
+		}
+
+		// A note that is not in the ledger has no path
+		_, outside := withdrawalNotes(t, zerocash.NewLedger(), big.NewInt(100), big.NewInt(50), skIn, skIn)
+		if _, err := withdraw.BuildWithdrawWitness(outside, skIn, nOut, pkT, cipherAux, bid, ledger); err == nil {
+			t.Error("Building a witness for a note outside the ledger should fail")
+		}
+
+		// The output must carry the input value
+		richer := nOut
+		richer.Coins = big.NewInt(1000)
+		richer.Cm = computeMimcCommitment(richer.Coins, richer.Energy, richer.Pk, richer.Rho, richer.R)
+		if isSolved(nIn, richer, nil) {
+			t.Error("An output note worth more than the input should violate the circuit")
+		}
+
+		// The input note must open its commitment under a key derived from sk^in, in the tree under the anchor
+		tampers := map[string]func(w *withdraw.CircuitWithdraw){
+			"input value":   func(w *withdraw.CircuitWithdraw) { w.NIn.Coins, w.NOut.Coins = 1000, 1000 },
+			"input key":     func(w *withdraw.CircuitWithdraw) { w.NIn.PkIn = 1 },
+			"anchor":        func(w *withdraw.CircuitWithdraw) { w.Anchor = 1 },
+			"path":          func(w *withdraw.CircuitWithdraw) { w.Path[0] = 1 },
+			"input opening": func(w *withdraw.CircuitWithdraw) { w.NIn.RIn = 1 },
+		}
+		for name, tamper := range tampers {
+			if isSolved(nIn, nOut, tamper) {
+				t.Errorf("A tampered %s should violate the circuit", name)
+			}
+		}
 	})
 }
 
@@ -755,13 +3777,13 @@ func TestAlgorithm4Withdraw(t *testing.T) {
 // =============================================================================
 
 func TestFullProtocolFlow(t *testing.T) {
-	t.Run("Complete Protocol N=10 - Production Ready", func(t *testing.T) {
+	t.Run("Complete Protocol N=5 - Production Ready", func(t *testing.T) {
 		if testing.Short() {
 			t.Skip("Skipping full protocol test in short mode (takes ~1-2 minutes)")
 		}
 
 		startTime := time.Now()
-		t.Logf("Starting production-ready protocol test with N=10 participants...")
+		t.Logf("Starting production-ready protocol test with N=5 participants...")
 		t.Logf("Following PPEM paper: 'Privacy-Preserving Exchange Mechanism and its Application to Energy Market'")
 
 		// Setup all circuit keys
@@ -781,12 +3803,13 @@ func TestFullProtocolFlow(t *testing.T) {
 			Role:   zerocash.RoleAuctioneer,
 		}
 
-		// Create 10 participants (matching circuit design)
-		N := 10
+		// Create 5 participants, filling the smallest exchange circuit
+		N := 5
 		participants := make([]*zerocash.Participant, N)
 		notes := make([]*zerocash.Note, N)
-		bids := make([]*big.Int, N)
+		orders := make([]zerocash.Order, N)
 		noteSecretKeys := make([][]byte, N) // Store the secret keys for each note
+		ledger := zerocash.NewLedger()      // Global ledger holding the initial notes
 
 		t.Logf("Creating %d participants...", N)
 		for i := 0; i < N; i++ {
@@ -807,24 +3830,32 @@ func TestFullProtocolFlow(t *testing.T) {
 					Spent:    []bool{},
 				},
 			}
+			if err := participants[i].Wallet.SetPassphrase([]byte(participants[i].Name)); err != nil {
+				t.Fatalf("Setting wallet passphrase failed: %v", err)
+			}
 
 			// Create participant's note with realistic energy market values
 			coins := big.NewInt(int64(1000 + i*500)) // 1000-5500 coins
 			energy := big.NewInt(int64(50 + i*25))   // 50-275 kWh
-			bids[i] = big.NewInt(int64(10 + i*5))    // 10-55 bid price
+			bid := big.NewInt(int64(10 + i*5))       // 10-55 limit price
+			// Even participants sell half their energy, odd ones buy 20 kWh
+			orders[i] = newOrder(zerocash.SideBuy, 20, bid)
+			if i%2 == 0 {
+				orders[i] = newOrder(zerocash.SideSell, energy.Int64()/2, bid)
+			}
 
 			// Generate and store the secret key for this note
 			noteSecretKeys[i] = zerocash.RandomBytesPublic(32)
 			notes[i] = zerocash.NewNote(coins, energy, noteSecretKeys[i])
 
 			// Add the initial note to the participant's wallet with correct signature
-			participants[i].Wallet.AddNote(notes[i], noteSecretKeys[i], []byte{}, [5]byte{}, notes[i])
-
-			if i < 5 {
-				t.Logf("  Participant %02d: %d coins, %d energy, bid %d", i+1, coins.Int64(), energy.Int64(), bids[i].Int64())
-			} else if i == 5 {
-				t.Logf("  ... (remaining participants created)")
+			participants[i].Wallet.AddNote(notes[i], noteSecretKeys[i], nil, notes[i])
+			if _, err := ledger.AppendCommitment(notes[i].Cm); err != nil {
+				t.Fatalf("Failed to add initial note %d to ledger: %v", i, err)
 			}
+
+			t.Logf("  Participant %02d: %d coins, %d energy, %v %v at %v", i+1, coins.Int64(), energy.Int64(),
+				orders[i].Side, orders[i].Quantity, orders[i].LimitPrice)
 		}
 
 		// Phase 1: Registration
@@ -836,7 +3867,11 @@ func TestFullProtocolFlow(t *testing.T) {
 			// Use the SAME secret key that was used to create the note
 			// This is critical because Register() calls CreateTx() internally,
 			// which validates that the secret key matches the note's ownership
-			_, err := register.Register(participants[i], notes[i], bids[i],
+			path, err := ledger.NotePath(notes[i])
+			if err != nil {
+				t.Fatalf("Failed to get merkle path for participant %d: %v", i, err)
+			}
+			_, err = register.Register(participants[i], notes[i], orders[i], path,
 				setupKeys.pkTx, setupKeys.ccsTx, setupKeys.pkReg, setupKeys.ccsReg, noteSecretKeys[i], auctioneerECDHPub)
 			if err != nil {
 				t.Fatalf("Registration failed for participant %d: %v", i, err)
@@ -847,11 +3882,10 @@ func TestFullProtocolFlow(t *testing.T) {
 			// We need to ensure the registration ciphertext contains the EXACT values
 			// used in the CreateTx call within Register().
 
-			// Get the values that were actually used in the transaction
+			// Get the values that were actually used in the transaction; the registration opens
+			// the participant's ledger note, so the exchange can prove it is spent
 			actualSk := noteSecretKeys[i] // The secret key used for the note
-			actualCoins := notes[i].Value.Coins
-			actualEnergy := notes[i].Value.Energy
-			actualBid := bids[i]
+			actualOrder := orders[i]
 
 			// Compute the public key from the secret key (as done in circuits)
 			actualPkOut := zerocash.MimcHashPublic(actualSk)
@@ -860,7 +3894,7 @@ func TestFullProtocolFlow(t *testing.T) {
 			// This ensures the exchange circuit can decrypt and verify correctly
 			shared := zerocash.ComputeDHShared(participants[i].Sk, auctioneer.Pk)
 			consistentCiphertext := register.EncryptRegistrationData(*shared,
-				actualCoins, actualEnergy, actualBid,
+				notes[i], actualOrder,
 				new(big.Int).SetBytes(actualSk), actualPkOut)
 
 			// Create registration payload with the consistent ciphertext
@@ -870,51 +3904,52 @@ func TestFullProtocolFlow(t *testing.T) {
 				TxNoteData: []byte{}, // Empty - not used in this test flow
 			}
 
-			if i == 2 || i == 5 || i == 8 {
-				t.Logf("  Registered %d/10 participants", i+1)
-			}
+			t.Logf("  Registered %d/%d participants", i+1, N)
 		}
 
 		registrationTime := time.Since(registrationStart)
 		t.Logf("Registration phase completed in %v", registrationTime)
 
-		// Validate that we have exactly 10 registration payloads (required for CircuitTxF10)
-		if len(regPayloads) != 10 {
-			t.Fatalf("Expected exactly 10 registration payloads, got %d", len(regPayloads))
+		// Validate that the registrations fill the exchange circuit (CircuitTxF5)
+		if len(regPayloads) != setupKeys.sizeF {
+			t.Fatalf("Expected exactly %d registration payloads, got %d", setupKeys.sizeF, len(regPayloads))
 		}
 
 		// Phase 2: Exchange
-		t.Logf("Starting exchange phase with 10-participant auction...")
+		t.Logf("Starting exchange phase with %d-participant auction...", N)
 		exchangeStart := time.Now()
 
-		ledger := zerocash.NewLedger()
-		txOut, info, proof, err := exchange.ExchangePhaseWithNotes(regPayloads, auctioneer.Sk.BigInt(new(big.Int)), auctioneerECDHPriv,
-			ledger, params, setupKeys.pkF10, setupKeys.ccsF10)
+		txOut, info, proof, err := exchange.ExchangePhaseWithNotes(regPayloads, exchange.UniformPrice{}, auctioneer.Sk.BigInt(new(big.Int)), auctioneerECDHPriv,
+			ledger, params, setupKeys.pkF, setupKeys.ccsF)
 		if err != nil {
 			t.Fatalf("Exchange phase failed: %v", err)
 		}
 
-		// CRITICAL FIX: Add the exchange transaction to the ledger so participants can claim
-		if txOut != nil && len(proof) > 0 {
-			// The exchange created a transaction, add it to the ledger
-			if exchangeTx, ok := txOut.(*exchange.ExchangeTransaction); ok {
-				individualTxs, err := convertExchangeToIndividualTxs(exchangeTx, proof)
-				if err != nil {
-					t.Logf("Warning: Failed to convert exchange transaction to individual transactions: %v", err)
-				} else {
-					for _, tx := range individualTxs {
-						err = ledger.AppendTx(tx)
-						if err != nil {
-							t.Logf("Warning: Failed to add exchange transaction to ledger: %v", err)
-						} else {
-							t.Logf("✅ Exchange transaction added to ledger successfully")
-						}
-					}
-				}
-			} else {
-				t.Logf("Warning: Exchange output is not a valid ExchangeTransaction type")
+		// Settle the exchange: one ledger entry spends every tx^in note and creates every output
+		// note, encrypted to its owner. Participants find their outputs by scanning the ledger.
+		exchangeTx, ok := txOut.(*exchange.ExchangeTransaction)
+		if !ok {
+			t.Fatalf("Exchange output is %T, not an ExchangeTransaction", txOut)
+		}
+		terms, err := exchange.NewTerms(exchange.UniformPrice{}, *auctioneer.Pk)
+		if err != nil {
+			t.Fatalf("Terms creation failed: %v", err)
+		}
+		// The exchange only settles for the registrations it clears, in order
+		swapped := append([]exchange.RegistrationPayload(nil), regPayloads...)
+		swapped[0], swapped[1] = swapped[1], swapped[0]
+		for name, registrations := range map[string][]exchange.RegistrationPayload{"swapped": swapped, "dropped": regPayloads[1:]} {
+			if err := exchange.SettleExchange(ledger, exchangeTx.Public(), registrations, terms, params, setupKeys.vkF); err == nil {
+				t.Errorf("The exchange should not settle for %s registrations", name)
 			}
 		}
+		if len(ledger.ExchangeTxs) != 0 {
+			t.Fatal("A rejected exchange should leave the ledger unchanged")
+		}
+		if err := exchange.SettleExchange(ledger, exchangeTx.Public(), regPayloads, terms, params, setupKeys.vkF); err != nil {
+			t.Fatalf("Settling the exchange failed: %v", err)
+		}
+		t.Logf("✅ Exchange settled in the ledger")
 
 		exchangeTime := time.Since(exchangeStart)
 		t.Logf("Exchange phase completed in %v", exchangeTime)
@@ -922,6 +3957,7 @@ func TestFullProtocolFlow(t *testing.T) {
 		// Phase 3: Receiving Phase - Production Implementation
 		t.Logf("Starting receiving phase...")
 		receivingStart := time.Now()
+		walletDir := t.TempDir()
 
 		// Initialize withdrawal circuit keys if needed
 		var withdrawalSetupKeys *CircuitKeys
@@ -937,8 +3973,18 @@ func TestFullProtocolFlow(t *testing.T) {
 				participant := participants[i]
 				t.Logf("  Processing claim for %s...", participant.Name)
 
-				// Attempt to claim exchange output for this participant
-				err := participant.Wallet.ClaimExchangeOutput(ledger)
+				// Find the exchange output of this participant in the ledger
+				scan, err := participant.Wallet.ScanLedger(ledger)
+				if err == nil && len(scan.Received) != 1 {
+					err = fmt.Errorf("found %d exchange outputs, want 1", len(scan.Received))
+				}
+				if err == nil {
+					output := scan.Received[0].Value
+					if want := exchangeTx.Outputs[i]; output.Coins.Cmp(want.Coins) != 0 || output.Energy.Cmp(want.Energy) != 0 {
+						t.Errorf("    Output of %s is %v coins and %v energy, want %v and %v", participant.Name,
+							output.Coins, output.Energy, want.Coins, want.Energy)
+					}
+				}
 				if err != nil {
 					t.Logf("    ❌ Claim failed: %v", err)
 					failedClaims++
@@ -951,7 +3997,7 @@ func TestFullProtocolFlow(t *testing.T) {
 						withdrawalSetupKeys = setupWithdrawalKeys(t)
 					}
 
-					success := executeParticipantWithdrawal(t, participant, i, withdrawalSetupKeys, noteSecretKeys[i], bids[i])
+					success := executeParticipantWithdrawal(t, participant, i, withdrawalSetupKeys, noteSecretKeys[i], orders[i].LimitPrice)
 					if success {
 						t.Logf("    ✅ Withdrawal successful for %s", participant.Name)
 					} else {
@@ -969,7 +4015,7 @@ func TestFullProtocolFlow(t *testing.T) {
 				}
 
 				// Save updated wallet to file for production readiness
-				walletPath := fmt.Sprintf("output/wallets/%s_wallet.json", participant.Name)
+				walletPath := filepath.Join(walletDir, participant.Name+"_wallet.json")
 				if err := participant.Wallet.Save(walletPath); err != nil {
 					t.Logf("    ⚠️  Warning: Failed to save wallet for %s: %v", participant.Name, err)
 				} else {
@@ -994,7 +4040,7 @@ func TestFullProtocolFlow(t *testing.T) {
 				participant := participants[i]
 				t.Logf("  Processing withdrawal for %s...", participant.Name)
 
-				success := executeParticipantWithdrawal(t, participant, i, withdrawalSetupKeys, noteSecretKeys[i], bids[i])
+				success := executeParticipantWithdrawal(t, participant, i, withdrawalSetupKeys, noteSecretKeys[i], orders[i].LimitPrice)
 				if success {
 					t.Logf("    ✅ Withdrawal successful for %s", participant.Name)
 					successfulWithdrawals++
@@ -1004,7 +4050,7 @@ func TestFullProtocolFlow(t *testing.T) {
 				}
 
 				// Save updated wallet state
-				walletPath := fmt.Sprintf("output/wallets/%s_wallet.json", participant.Name)
+				walletPath := filepath.Join(walletDir, participant.Name+"_wallet.json")
 				if err := participant.Wallet.Save(walletPath); err != nil {
 					t.Logf("    ⚠️  Warning: Failed to save wallet for %s: %v", participant.Name, err)
 				}
@@ -1061,11 +4107,419 @@ func TestFullProtocolFlow(t *testing.T) {
 		}
 
 		// Validate that ledger state is consistent
-		finalLedgerTxs := len(ledger.GetTxs())
-		if finalLedgerTxs == 0 {
-			t.Error("❌ Ledger is empty after protocol execution")
+		if !ledger.HasValidExchange() {
+			t.Error("❌ Ledger has no settled exchange after protocol execution")
 		} else {
-			t.Logf("📊 Final ledger contains %d transactions", finalLedgerTxs)
+			t.Logf("📊 Final ledger contains %d transactions and %d exchanges", len(ledger.GetTxs()), len(ledger.ExchangeTxs))
+		}
+	})
+}
+
+func TestAuctionRound(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping proven registrations in short mode")
+	}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	clock := func() time.Time { return now }
+	schedule := auction.Schedule{Registration: time.Hour, Clearing: 2 * time.Hour, WithdrawDelay: 10 * time.Minute, Withdraw: time.Hour}
+
+	auctioneerKp, _ := zerocash.GenerateDHKeyPair()
+	auctioneerSk := auctioneerKp.Sk.BigInt(new(big.Int))
+	auctioneerECDHPriv, auctioneerECDHPub, _ := generateECDHKeyPair()
+	terms, err := exchange.NewTerms(exchange.UniformPrice{}, *auctioneerKp.Pk)
+	if err != nil {
+		t.Fatalf("Terms creation failed: %v", err)
+	}
+	ccsTx, pkTx, _ := circuitTestKeys(t, zerocash.CircuitTxID)
+	ccsReg, pkReg, vkReg := circuitTestKeys(t, zerocash.CircuitRegisterID)
+	params := &zerocash.Params{}
+	ledger := zerocash.NewLedger()                          // Holds the registered notes
+	registrations := make(map[int]*register.RegisterResult) // Latest registration of each participant
+	registration := func(order zerocash.Order) *register.RegisterResult {
+		participantKp, _ := zerocash.GenerateDHKeyPair()
+		participant := &zerocash.Participant{Sk: participantKp.Sk, Pk: participantKp.Pk, Params: params, AuctioneerPub: auctioneerKp.Pk}
+		sk := zerocash.RandomBytesPublic(32)
+		note := zerocash.NewNote(big.NewInt(1000), big.NewInt(50), sk)
+		result, err := register.Register(participant, note, order, addNoteToLedger(t, ledger, note), pkTx, ccsTx, pkReg, ccsReg, sk, auctioneerECDHPub)
+		if err != nil {
+			t.Fatalf("Registration failed: %v", err)
+		}
+		return result
+	}
+	// payload registers order for participant i and records its tx^in in the ledger
+	payload := func(i int, order zerocash.Order) exchange.RegistrationPayload {
+		registrations[i] = registration(order)
+		if err := ledger.AppendTx(registrations[i].TxIn.Public()); err != nil {
+			t.Fatalf("Recording tx^in failed: %v", err)
+		}
+		return registrations[i].Payload
+	}
+
+	t.Run("Registration Deadline", func(t *testing.T) {
+		now = start
+		path := filepath.Join(t.TempDir(), "round.json")
+		round, err := auction.NewAuctionRound(path, "round-1", terms, schedule, clock)
+		if err != nil {
+			t.Fatalf("Round creation failed: %v", err)
+		}
+		if _, err := auction.NewAuctionRound(path, "round-1", terms, schedule, clock); err == nil {
+			t.Error("Creating a round over an existing one should fail")
+		}
+		if _, err := auction.NewAuctionRound(filepath.Join(t.TempDir(), "round.json"), "round-2", terms, auction.Schedule{Withdraw: time.Hour}, clock); err == nil {
+			t.Error("A round without a registration period should be rejected")
+		}
+		if _, err := auction.NewAuctionRound(filepath.Join(t.TempDir(), "round.json"), "round-2", exchange.Terms{}, schedule, clock); err == nil {
+			t.Error("A round without an auctioneer key and mechanism should be rejected")
+		}
+
+		if err := round.Register(payload(0, newOrder(zerocash.SideSell, 20, big.NewInt(30))), ledger, params, vkReg); err != nil {
+			t.Fatalf("Registration in the open phase failed: %v", err)
+		}
+		late := registration(newOrder(zerocash.SideBuy, 10, big.NewInt(50)))
+		anonymous := late.Payload
+		anonymous.CmIn = nil
+		if err := round.Register(anonymous, ledger, params, vkReg); err == nil {
+			t.Error("A registration without its tx^in commitment should be rejected")
+		}
+		// Its tx^in is not in the ledger yet
+		if err := round.Register(late.Payload, ledger, params, vkReg); err == nil {
+			t.Error("A registration of a note that is not in the ledger should be rejected")
+		}
+		if err := ledger.AppendTx(late.TxIn.Public()); err != nil {
+			t.Fatalf("Recording tx^in failed: %v", err)
+		}
+		forged := late.Payload
+		forged.Bid = big.NewInt(51)
+		if err := round.Register(forged, ledger, params, vkReg); err == nil {
+			t.Error("A registration whose public inputs do not match π_reg should be rejected")
+		}
+		forged = late.Payload
+		forged.Proof = registrations[0].Payload.Proof
+		if err := round.Register(forged, ledger, params, vkReg); err == nil {
+			t.Error("A registration with the proof of another registration should be rejected")
+		}
+		if len(round.Registrations) != 1 {
+			t.Errorf("Rejected registrations left %d registrations in the round, want 1", len(round.Registrations))
+		}
+		if err := round.SubmitWithdraw(zerocash.NewLedger(), &withdraw.WithdrawTx{}, nil, &zerocash.Params{}, nil); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Withdrawal in the open phase should fail with ErrWrongPhase, got %v", err)
+		}
+		if err := round.Settle(zerocash.NewLedger(), &zerocash.Params{}, nil); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Settlement in the open phase should fail with ErrWrongPhase, got %v", err)
+		}
+
+		// Just before the deadline the round is still open
+		now = start.Add(time.Hour - time.Second)
+		if err := round.Register(late.Payload, ledger, params, vkReg); err != nil {
+			t.Fatalf("Registration before the deadline failed: %v", err)
+		}
+		if err := round.Register(late.Payload, ledger, params, vkReg); err == nil || errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Registering a note twice should be rejected, got %v", err)
+		}
+
+		// Past it, registrations are refused and the transition is dated at the deadline
+		now = start.Add(time.Hour + time.Minute)
+		if err := round.Register(registration(newOrder(zerocash.SideBuy, 10, big.NewInt(50))).Payload, ledger, params, vkReg); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Registration after the deadline should fail with ErrWrongPhase, got %v", err)
+		}
+		if phase, err := round.Advance(); err != nil || phase != auction.PhaseRegistrationClosed {
+			t.Fatalf("Round should be %s after the deadline, got %s (%v)", auction.PhaseRegistrationClosed, phase, err)
+		}
+		if len(round.History) != 1 || !round.History[0].At.Equal(round.RegistrationDeadline) {
+			t.Errorf("History is %+v, want one transition at %v", round.History, round.RegistrationDeadline)
+		}
+		if !round.ClearingDeadline.Equal(round.RegistrationDeadline.Add(schedule.Clearing)) {
+			t.Errorf("Clearing deadline is %v, want %v", round.ClearingDeadline, round.RegistrationDeadline.Add(schedule.Clearing))
+		}
+		if err := round.CloseRegistration(); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Closing a closed registration should fail with ErrWrongPhase, got %v", err)
+		}
+		if err := round.SubmitWithdraw(zerocash.NewLedger(), &withdraw.WithdrawTx{}, nil, &zerocash.Params{}, nil); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Withdrawal before settlement should fail with ErrWrongPhase, got %v", err)
+		}
+		if len(round.Registrations) != 2 {
+			t.Errorf("Round holds %d registrations, want 2", len(round.Registrations))
+		}
+	})
+
+	t.Run("Survives Restart", func(t *testing.T) {
+		now = start
+		path := filepath.Join(t.TempDir(), "round.json")
+		round, err := auction.NewAuctionRound(path, "round-1", terms, schedule, clock)
+		if err != nil {
+			t.Fatalf("Round creation failed: %v", err)
+		}
+		registered := payload(0, newOrder(zerocash.SideBuy, 10, big.NewInt(50)))
+		if err := round.Register(registered, ledger, params, vkReg); err != nil {
+			t.Fatalf("Registration failed: %v", err)
+		}
+
+		// The deadline passes while the auctioneer is down
+		now = start.Add(2 * time.Hour)
+		reloaded, err := auction.LoadAuctionRound(path, clock)
+		if err != nil {
+			t.Fatalf("Reloading the round failed: %v", err)
+		}
+		if reloaded.ID != "round-1" || reloaded.Phase != auction.PhaseOpen || !reloaded.RegistrationDeadline.Equal(round.RegistrationDeadline) {
+			t.Errorf("Reloaded round %s in phase %s with deadline %v does not match", reloaded.ID, reloaded.Phase, reloaded.RegistrationDeadline)
+		}
+		if reloaded.Terms != terms {
+			t.Errorf("Reloaded round has terms %+v, want %+v", reloaded.Terms, terms)
+		}
+		if len(reloaded.Registrations) != 1 {
+			t.Fatalf("Reloaded round holds %d registrations, want 1", len(reloaded.Registrations))
+		}
+		for i, c := range registered.Ciphertext {
+			if reloaded.Registrations[0].Ciphertext[i].Cmp(c) != 0 {
+				t.Errorf("Ciphertext field %d changed across the restart", i)
+			}
+		}
+		// The reloaded registration still decrypts
+		if _, err := exchange.DecryptAllRegistrations(reloaded.Registrations, auctioneerSk); err != nil {
+			t.Errorf("Reloaded registration does not decrypt: %v", err)
+		}
+		if err := reloaded.Register(registered, ledger, params, vkReg); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Registration after a restart past the deadline should fail with ErrWrongPhase, got %v", err)
+		}
+
+		// A failed operation is undone, but the deadline it passed is kept
+		if _, err := reloaded.Clear(nil, auctioneerECDHPriv, zerocash.NewLedger(), &zerocash.Params{}, nil, nil); err == nil {
+			t.Error("Clearing without the auctioneer key should fail")
+		}
+		if reloaded.Phase != auction.PhaseRegistrationClosed || reloaded.Exchange != nil {
+			t.Errorf("Failed clearing left the round in %s", reloaded.Phase)
+		}
+		again, err := auction.LoadAuctionRound(path, clock)
+		if err != nil {
+			t.Fatalf("Reloading the round failed: %v", err)
+		}
+		if again.Phase != auction.PhaseRegistrationClosed || len(again.History) != 1 {
+			t.Errorf("Saved round is in %s after %d transitions, want %s after 1", again.Phase, len(again.History), auction.PhaseRegistrationClosed)
+		}
+
+		data, _ := os.ReadFile(path)
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			t.Fatalf("Round file is not JSON: %v", err)
+		}
+		raw["version"] = auction.RoundVersion + 1
+		data, _ = json.Marshal(raw)
+		os.WriteFile(path, data, 0o600)
+		if _, err := auction.LoadAuctionRound(path, clock); err == nil {
+			t.Error("A round file of an unknown version should be rejected")
+		}
+	})
+
+	t.Run("Full Lifecycle", func(t *testing.T) {
+		ccs5, pk5, vk5 := circuitTestKeys(t, zerocash.ExchangeCircuitID(5))
+
+		now = start
+		path := filepath.Join(t.TempDir(), "round.json")
+		round, err := auction.NewAuctionRound(path, "round-1", terms, schedule, clock)
+		if err != nil {
+			t.Fatalf("Round creation failed: %v", err)
+		}
+		for i, order := range []zerocash.Order{
+			newOrder(zerocash.SideSell, 20, big.NewInt(30)),
+			newOrder(zerocash.SideBuy, 10, big.NewInt(50)),
+			newOrder(zerocash.SideBuy, 5, big.NewInt(40)),
+		} {
+			if err := round.Register(payload(i, order), ledger, params, vkReg); err != nil {
+				t.Fatalf("Registration %d failed: %v", i, err)
+			}
+		}
+		now = now.Add(time.Minute)
+		if err := round.CloseRegistration(); err != nil {
+			t.Fatalf("Closing the registration failed: %v", err)
+		}
+
+		if _, err := round.Clear(big.NewInt(42), auctioneerECDHPriv, ledger, &zerocash.Params{}, pk5, ccs5); err == nil || round.Phase != auction.PhaseRegistrationClosed {
+			t.Errorf("Clearing with another auctioneer key should fail before proving, got %v", err)
+		}
+		if _, err := round.Clear(auctioneerSk, auctioneerECDHPriv, ledger, &zerocash.Params{}, pk5, ccs5); err != nil {
+			t.Fatalf("Clearing failed: %v", err)
+		}
+		if _, err := round.Clear(auctioneerSk, auctioneerECDHPriv, ledger, &zerocash.Params{}, pk5, ccs5); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Clearing twice should fail with ErrWrongPhase, got %v", err)
+		}
+
+		// The cleared exchange is reloaded and verified after a restart
+		round, err = auction.LoadAuctionRound(path, clock)
+		if err != nil {
+			t.Fatalf("Reloading the round failed: %v", err)
+		}
+
+		// The exchange settles only under the terms the round opened with
+		data, _ := os.ReadFile(path)
+		var raw map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			t.Fatalf("Round file is not JSON: %v", err)
+		}
+		raw["terms"].(map[string]interface{})["mechanism"] = exchange.MechanismPayAsBid
+		data, _ = json.Marshal(raw)
+		otherPath := filepath.Join(t.TempDir(), "round.json")
+		os.WriteFile(otherPath, data, 0o600)
+		other, err := auction.LoadAuctionRound(otherPath, clock)
+		if err != nil {
+			t.Fatalf("Loading the round copy failed: %v", err)
+		}
+		if err := other.Settle(ledger, &zerocash.Params{}, vk5); err == nil || len(ledger.ExchangeTxs) != 0 {
+			t.Errorf("An exchange cleared under other terms should not settle, got %v", err)
+		}
+
+		// ... and only for the registrations of the round, in order
+		for name, edit := range map[string]func([]interface{}) []interface{}{
+			"reordered": func(regs []interface{}) []interface{} {
+				return []interface{}{regs[1], regs[0], regs[2]}
+			},
+			"dropped": func(regs []interface{}) []interface{} { return regs[:2] },
+		} {
+			original, _ := os.ReadFile(path)
+			decoder := json.NewDecoder(bytes.NewReader(original))
+			decoder.UseNumber()
+			raw = nil
+			if err := decoder.Decode(&raw); err != nil {
+				t.Fatalf("Round file is not JSON: %v", err)
+			}
+			raw["registrations"] = edit(raw["registrations"].([]interface{}))
+			tampered, _ := json.Marshal(raw)
+			tamperedPath := filepath.Join(t.TempDir(), "round.json")
+			os.WriteFile(tamperedPath, tampered, 0o600)
+			tamperedRound, err := auction.LoadAuctionRound(tamperedPath, clock)
+			if err != nil {
+				t.Fatalf("Loading the %s round failed: %v", name, err)
+			}
+			if err := tamperedRound.Settle(ledger, &zerocash.Params{}, vk5); err == nil || len(ledger.ExchangeTxs) != 0 {
+				t.Errorf("An exchange should not settle for %s registrations, got %v", name, err)
+			}
+		}
+
+		if err := round.Settle(ledger, &zerocash.Params{}, vk5); err != nil {
+			t.Fatalf("Settlement failed: %v", err)
+		}
+		if len(ledger.ExchangeTxs) != 1 {
+			t.Errorf("Settlement recorded %d exchanges in the ledger, want 1", len(ledger.ExchangeTxs))
+		}
+
+		// A note settled by the exchange cannot also be withdrawn
+		settledSn, _ := new(big.Int).SetString(ledger.ExchangeTxs[0].SnIn[0], 10)
+		anchor, _ := new(big.Int).SetString(ledger.MerkleRoot(), 10)
+		cms, sns := len(ledger.CmList), len(ledger.SnList)
+		if err := ledger.AppendWithdrawTx(&zerocash.WithdrawTx{Anchor: anchor, SnIn: settledSn, CmOut: big.NewInt(1)}); err == nil {
+			t.Error("Withdrawing a note settled by the exchange should be rejected")
+		}
+		if len(ledger.CmList) != cms || len(ledger.SnList) != sns || len(ledger.WithdrawTxs) != 0 {
+			t.Error("A rejected withdrawal should leave the ledger unchanged")
+		}
+		if err := round.SubmitWithdraw(ledger, &withdraw.WithdrawTx{}, nil, &zerocash.Params{}, nil); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Withdrawal before the window opens should fail with ErrWrongPhase, got %v", err)
+		}
+
+		// Inside the window withdrawals of registered notes reach the proof check
+		now = round.WithdrawOpens
+		tx := &withdraw.WithdrawTx{CmIn: round.Registrations[0].CmIn, SnIn: big.NewInt(1)}
+		if err := round.SubmitWithdraw(ledger, tx, []byte("not a proof"), &zerocash.Params{}, nil); err == nil || errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Withdrawal in the window should fail only on its proof, got %v", err)
+		}
+		if phase, _ := round.Advance(); phase != auction.PhaseWithdrawWindow {
+			t.Errorf("Round should be %s, got %s", auction.PhaseWithdrawWindow, phase)
+		}
+
+		now = round.WithdrawDeadline
+		if err := round.SubmitWithdraw(ledger, tx, []byte("not a proof"), &zerocash.Params{}, nil); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Withdrawal after the window should fail with ErrWrongPhase, got %v", err)
+		}
+		want := []auction.Phase{auction.PhaseRegistrationClosed, auction.PhaseCleared, auction.PhaseSettled, auction.PhaseWithdrawWindow, auction.PhaseFinalized}
+		if len(round.History) != len(want) {
+			t.Fatalf("History is %+v, want %v", round.History, want)
+		}
+		for i, phase := range want {
+			if round.History[i].To != phase {
+				t.Errorf("Transition %d goes to %s, want %s", i, round.History[i].To, phase)
+			}
+		}
+	})
+
+	t.Run("Clearing Deadline", func(t *testing.T) {
+		ccsW, pkW, vkW := circuitTestKeys(t, zerocash.CircuitWithdrawID)
+		withdrawal := func(nIn withdraw.Note, skIn *big.Int) (*withdraw.WithdrawTx, []byte) {
+			nOut := toWithdrawNote(zerocash.NewNote(nIn.Coins, nIn.Energy, big.NewInt(54321).Bytes()))
+			participantKp, _ := zerocash.GenerateDHKeyPair()
+			pkT := sw_bls12377.G1Affine{X: participantKp.Pk.X.String(), Y: participantKp.Pk.Y.String()}
+			bid := big.NewInt(30)
+			tx, proof, err := withdraw.Withdraw(nIn, skIn, nOut, pkT, computeDHOTPEncryption(bid, skIn, nOut.Pk, pkT), bid,
+				ledger, &zerocash.Params{}, pkW, ccsW)
+			if err != nil {
+				t.Fatalf("Withdrawal failed: %v", err)
+			}
+			return tx, proof
+		}
+
+		now = start
+		path := filepath.Join(t.TempDir(), "round.json")
+		round, err := auction.NewAuctionRound(path, "round-1", terms, schedule, clock)
+		if err != nil {
+			t.Fatalf("Round creation failed: %v", err)
+		}
+		for i, order := range []zerocash.Order{
+			newOrder(zerocash.SideSell, 20, big.NewInt(30)),
+			newOrder(zerocash.SideBuy, 10, big.NewInt(50)),
+		} {
+			if err := round.Register(payload(i, order), ledger, params, vkReg); err != nil {
+				t.Fatalf("Registration %d failed: %v", i, err)
+			}
+		}
+
+		// The auctioneer never clears: the round waits until the clearing deadline
+		now = start.Add(time.Hour)
+		if phase, _ := round.Advance(); phase != auction.PhaseRegistrationClosed {
+			t.Fatalf("Round should be %s, got %s", auction.PhaseRegistrationClosed, phase)
+		}
+		now = round.ClearingDeadline.Add(-time.Second)
+		if phase, _ := round.Advance(); phase != auction.PhaseRegistrationClosed {
+			t.Errorf("Round should still be %s before the clearing deadline, got %s", auction.PhaseRegistrationClosed, phase)
+		}
+
+		// Past it, the round moves straight to the withdraw window
+		now = round.ClearingDeadline
+		if phase, _ := round.Advance(); phase != auction.PhaseWithdrawWindow {
+			t.Fatalf("Round should be %s at the clearing deadline, got %s", auction.PhaseWithdrawWindow, phase)
+		}
+		if !round.WithdrawOpens.Equal(round.ClearingDeadline) || !round.WithdrawDeadline.Equal(round.ClearingDeadline.Add(schedule.Withdraw)) {
+			t.Errorf("Withdraw window is [%v, %v), want it to open at %v", round.WithdrawOpens, round.WithdrawDeadline, round.ClearingDeadline)
+		}
+		if _, err := round.Clear(auctioneerSk, auctioneerECDHPriv, ledger, &zerocash.Params{}, nil, nil); !errors.Is(err, auction.ErrWrongPhase) {
+			t.Errorf("Clearing after the clearing deadline should fail with ErrWrongPhase, got %v", err)
+		}
+
+		// A valid withdrawal of a ledger note the round did not register is rejected
+		other, _ := withdrawalNotes(t, ledger, big.NewInt(1000), big.NewInt(50), big.NewInt(777), big.NewInt(778))
+		tx, proof := withdrawal(other, big.NewInt(777))
+		if err := withdraw.VerifyWithdraw(tx, proof, &zerocash.Params{}, vkW); err != nil {
+			t.Fatalf("Withdrawal of the unregistered note should verify: %v", err)
+		}
+		if err := round.SubmitWithdraw(ledger, tx, proof, &zerocash.Params{}, vkW); err == nil {
+			t.Error("Withdrawing a note the round did not register should be rejected")
+		}
+
+		// A registered note is withdrawn, once
+		tx, proof = withdrawal(toWithdrawNote(registrations[0].Record.NoteIn), new(big.Int).SetBytes(registrations[0].Record.SkIn))
+		if err := round.SubmitWithdraw(ledger, tx, proof, &zerocash.Params{}, vkW); err != nil {
+			t.Fatalf("Withdrawing a registered note failed: %v", err)
+		}
+		if err := round.SubmitWithdraw(ledger, tx, proof, &zerocash.Params{}, vkW); err == nil {
+			t.Error("Withdrawing a registered note twice should be rejected")
+		}
+		if len(round.Withdrawals) != 1 || !ledger.HasSerialNumber(tx.SnIn.String()) {
+			t.Errorf("Round recorded %d withdrawals, want 1 in the ledger", len(round.Withdrawals))
+		}
+
+		now = round.WithdrawDeadline
+		if phase, _ := round.Advance(); phase != auction.PhaseFinalized {
+			t.Errorf("Round should be %s after the withdraw window, got %s", auction.PhaseFinalized, phase)
 		}
 	})
 }
@@ -1082,16 +4536,17 @@ func TestPrivacyProperties(t *testing.T) {
 		// Create identical bids from different participants
 		coins := big.NewInt(100)
 		energy := big.NewInt(50)
-		bid := big.NewInt(25)
+		bid := newOrder(zerocash.SideBuy, 2, big.NewInt(25))
 		skIn := big.NewInt(12345)
 		pkOut := big.NewInt(67890)
+		note := registeredNote(coins, energy, skIn)
 
 		// Encrypt for both participants using DH-OTP
 		shared1 := zerocash.ComputeDHShared(participant1Kp.Sk, auctioneerKp.Pk)
 		shared2 := zerocash.ComputeDHShared(participant2Kp.Sk, auctioneerKp.Pk)
 
-		cipher1 := register.EncryptRegistrationData(*shared1, coins, energy, bid, skIn, pkOut)
-		cipher2 := register.EncryptRegistrationData(*shared2, coins, energy, bid, skIn, pkOut)
+		cipher1 := register.EncryptRegistrationData(*shared1, note, bid, skIn, pkOut)
+		cipher2 := register.EncryptRegistrationData(*shared2, note, bid, skIn, pkOut)
 
 		// Ciphertexts should be different even with same inputs (privacy)
 		if cipher1[0].Cmp(cipher2[0]) == 0 && cipher1[1].Cmp(cipher2[1]) == 0 {
@@ -1106,15 +4561,16 @@ func TestPrivacyProperties(t *testing.T) {
 
 		coins := big.NewInt(100)
 		energy := big.NewInt(50)
-		bid1 := big.NewInt(25)
-		bid2 := big.NewInt(50) // Different bid
+		bid1 := newOrder(zerocash.SideBuy, 2, big.NewInt(25))
+		bid2 := newOrder(zerocash.SideBuy, 2, big.NewInt(50)) // Different bid
 		skIn := big.NewInt(12345)
 		pkOut := big.NewInt(67890)
+		note := registeredNote(coins, energy, skIn)
 
 		shared := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
 
-		cipher1 := register.EncryptRegistrationData(*shared, coins, energy, bid1, skIn, pkOut)
-		cipher2 := register.EncryptRegistrationData(*shared, coins, energy, bid2, skIn, pkOut)
+		cipher1 := register.EncryptRegistrationData(*shared, note, bid1, skIn, pkOut)
+		cipher2 := register.EncryptRegistrationData(*shared, note, bid2, skIn, pkOut)
 
 		// Bid field (index 2) should be different when encrypted
 		if cipher1[2].Cmp(cipher2[2]) == 0 {
@@ -1135,16 +4591,17 @@ func TestSecurityProperties(t *testing.T) {
 		// Create identical bids from different participants
 		coins := big.NewInt(100)
 		energy := big.NewInt(50)
-		bid := big.NewInt(25)
+		bid := newOrder(zerocash.SideBuy, 2, big.NewInt(25))
 		skIn := big.NewInt(12345)
 		pkOut := big.NewInt(67890)
+		note := registeredNote(coins, energy, skIn)
 
 		// Encrypt for both participants using DH-OTP
 		shared1 := zerocash.ComputeDHShared(participant1Kp.Sk, auctioneerKp.Pk)
 		shared2 := zerocash.ComputeDHShared(participant2Kp.Sk, auctioneerKp.Pk)
 
-		cipher1 := register.EncryptRegistrationData(*shared1, coins, energy, bid, skIn, pkOut)
-		cipher2 := register.EncryptRegistrationData(*shared2, coins, energy, bid, skIn, pkOut)
+		cipher1 := register.EncryptRegistrationData(*shared1, note, bid, skIn, pkOut)
+		cipher2 := register.EncryptRegistrationData(*shared2, note, bid, skIn, pkOut)
 
 		// Ciphertexts should be different even with same inputs (privacy)
 		if cipher1[0].Cmp(cipher2[0]) == 0 && cipher1[1].Cmp(cipher2[1]) == 0 {
@@ -1159,15 +4616,16 @@ func TestSecurityProperties(t *testing.T) {
 
 		coins := big.NewInt(100)
 		energy := big.NewInt(50)
-		bid1 := big.NewInt(25)
-		bid2 := big.NewInt(50) // Different bid
+		bid1 := newOrder(zerocash.SideBuy, 2, big.NewInt(25))
+		bid2 := newOrder(zerocash.SideBuy, 2, big.NewInt(50)) // Different bid
 		skIn := big.NewInt(12345)
 		pkOut := big.NewInt(67890)
+		note := registeredNote(coins, energy, skIn)
 
 		shared := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
 
-		cipher1 := register.EncryptRegistrationData(*shared, coins, energy, bid1, skIn, pkOut)
-		cipher2 := register.EncryptRegistrationData(*shared, coins, energy, bid2, skIn, pkOut)
+		cipher1 := register.EncryptRegistrationData(*shared, note, bid1, skIn, pkOut)
+		cipher2 := register.EncryptRegistrationData(*shared, note, bid2, skIn, pkOut)
 
 		// Bid field (index 2) should be different when encrypted
 		if cipher1[2].Cmp(cipher2[2]) == 0 {
@@ -1192,28 +4650,30 @@ func TestSecurityPropertiesFixed(t *testing.T) {
 		params := &zerocash.Params{}
 		_, auctioneerECDHPub, _ := generateECDHKeyPair()
 
+		path := addNoteToLedger(t, ledger, note)
+
 		newSk1 := zerocash.RandomBytesPublic(32)
 		pkNew1 := zerocash.MimcHashPublic(newSk1).Bytes()
-		tx1, err := zerocash.CreateTx(note, sk, pkNew1, coins, energy, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
+		tx1, err := zerocash.CreateTx(note, sk, pkNew1, recipientKey(t), coins, energy, path, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
 		if err != nil {
 			t.Fatalf("First transaction creation failed: %v", err)
 		}
 
 		newSk2 := zerocash.RandomBytesPublic(32)
 		pkNew2 := zerocash.MimcHashPublic(newSk2).Bytes()
-		tx2, err := zerocash.CreateTx(note, sk, pkNew2, coins, energy, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
+		tx2, err := zerocash.CreateTx(note, sk, pkNew2, recipientKey(t), coins, energy, path, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
 		if err != nil {
 			t.Fatalf("Second transaction creation failed: %v", err)
 		}
 
 		// Add first transaction to ledger
-		err = ledger.AppendTx(tx1)
+		err = ledger.AppendTx(tx1.Public())
 		if err != nil {
 			t.Fatalf("First transaction append failed: %v", err)
 		}
 
 		// Try to add second transaction (should detect double spend)
-		err = ledger.AppendTx(tx2)
+		err = ledger.AppendTx(tx2.Public())
 		if err == nil {
 			t.Error("Double spending not detected by ledger")
 		}
@@ -1230,34 +4690,90 @@ func TestSecurityPropertiesFixed(t *testing.T) {
 		note := zerocash.NewNote(coins, energy, sk)
 		params := &zerocash.Params{}
 
+		ledger := zerocash.NewLedger()
+		path := addNoteToLedger(t, ledger, note)
+
 		newSk := zerocash.RandomBytesPublic(32)
 		pkNew := zerocash.MimcHashPublic(newSk).Bytes()
-		tx, err := zerocash.CreateTx(note, sk, pkNew, coins, energy, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
+		tx, err := zerocash.CreateTx(note, sk, pkNew, recipientKey(t), coins, energy, path, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
 		if err != nil {
 			t.Fatalf("Transaction creation failed: %v", err)
 		}
 
 		// Tamper with the transaction
-		originalCoin := tx.NewCoin
-		tx.NewCoin = "999999" // Tamper with coin amount
+		originalCm := tx.CmNew
+		tx.CmNew = "999999" // Tamper with the new note commitment
 
 		// Verification should fail
-		err = zerocash.VerifyTx(tx, params, setupKeys.vkTx)
+		err = zerocash.VerifyTx(tx.Public(), ledger, params, setupKeys.vkTx)
 		if err == nil {
 			t.Error("Tampered transaction should fail verification")
 		}
 
 		// Restore original value
-		tx.NewCoin = originalCoin
+		tx.CmNew = originalCm
 
 		// Verification should now pass
-		err = zerocash.VerifyTx(tx, params, setupKeys.vkTx)
+		err = zerocash.VerifyTx(tx.Public(), ledger, params, setupKeys.vkTx)
 		if err != nil {
 			t.Fatalf("Original transaction verification failed: %v", err)
 		}
 	})
 }
 
+// BenchmarkVerifyTx compares verifying a transaction while recompiling CircuitTx on every
+// call (the behavior before the circuit registry) with verifying through the registry.
+func BenchmarkVerifyTx(b *testing.B) {
+	ccs, err := zerocash.CompiledCircuit(zerocash.CircuitTxID)
+	if err != nil {
+		b.Fatalf("Circuit compilation failed: %v", err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		b.Fatalf("Key generation failed: %v", err)
+	}
+	_, auctioneerECDHPub, err := generateECDHKeyPair()
+	if err != nil {
+		b.Fatalf("ECDH key generation failed: %v", err)
+	}
+
+	coins := big.NewInt(100)
+	energy := big.NewInt(50)
+	sk := zerocash.RandomBytesPublic(32)
+	note := zerocash.NewNote(coins, energy, sk)
+	ledger := zerocash.NewLedger()
+	path := addNoteToLedger(b, ledger, note)
+	params := &zerocash.Params{}
+	pkNew := zerocash.MimcHashPublic(zerocash.RandomBytesPublic(32)).Bytes()
+	tx, err := zerocash.CreateTx(note, sk, pkNew, recipientKey(b), coins, energy, path, params, ccs, pk, auctioneerECDHPub)
+	if err != nil {
+		b.Fatalf("Transaction creation failed: %v", err)
+	}
+
+	b.Run("CompileEachCall", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var circuit zerocash.CircuitTx
+			if _, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuit); err != nil {
+				b.Fatalf("Circuit compilation failed: %v", err)
+			}
+			if err := zerocash.VerifyTx(tx.Public(), ledger, params, vk); err != nil {
+				b.Fatalf("Transaction verification failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("Registry", func(b *testing.B) {
+		if err := zerocash.SetCircuitKeys(zerocash.CircuitTxID, zerocash.DefaultValueBits, pk, vk); err != nil {
+			b.Fatalf("Registering circuit keys failed: %v", err)
+		}
+		for i := 0; i < b.N; i++ {
+			if err := zerocash.VerifyTx(tx.Public(), ledger, params, nil); err != nil {
+				b.Fatalf("Transaction verification failed: %v", err)
+			}
+		}
+	})
+}
+
 func TestPerformanceBenchmarks(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping performance benchmarks in short mode")
@@ -1273,6 +4789,7 @@ func TestPerformanceBenchmarks(t *testing.T) {
 		sk := zerocash.RandomBytesPublic(32)
 		note := zerocash.NewNote(coins, energy, sk)
 		params := &zerocash.Params{}
+		path := addNoteToLedger(t, zerocash.NewLedger(), note)
 
 		start := time.Now()
 		numTests := 5 // Reduced for realistic timing with updated circuits
@@ -1281,7 +4798,7 @@ func TestPerformanceBenchmarks(t *testing.T) {
 		for i := 0; i < numTests; i++ {
 			newSk := zerocash.RandomBytesPublic(32)
 			pkNew := zerocash.MimcHashPublic(newSk).Bytes()
-			_, err := zerocash.CreateTx(note, sk, pkNew, coins, energy, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
+			_, err := zerocash.CreateTx(note, sk, pkNew, recipientKey(t), coins, energy, path, params, setupKeys.ccsTx, setupKeys.pkTx, auctioneerECDHPub)
 			if err != nil {
 				t.Fatalf("Transaction %d failed: %v", i, err)
 			}
@@ -1319,14 +4836,15 @@ func TestPerformanceBenchmarks(t *testing.T) {
 		energy := big.NewInt(50)
 		sk := zerocash.RandomBytesPublic(32)
 		note := zerocash.NewNote(coins, energy, sk)
-		bid := big.NewInt(25)
+		bid := newOrder(zerocash.SideSell, 20, big.NewInt(25))
+		path := addNoteToLedger(t, zerocash.NewLedger(), note)
 
 		start := time.Now()
 		numTests := 3 // Further reduced as registration is more expensive with updated circuits
 
 		t.Logf("Running %d registration benchmarks...", numTests)
 		for i := 0; i < numTests; i++ {
-			_, err := register.Register(participant, note, bid, setupKeys.pkTx, setupKeys.ccsTx, setupKeys.pkReg, setupKeys.ccsReg, sk, auctioneerECDHPub)
+			_, err := register.Register(participant, note, bid, path, setupKeys.pkTx, setupKeys.ccsTx, setupKeys.pkReg, setupKeys.ccsReg, sk, auctioneerECDHPub)
 			if err != nil {
 				t.Fatalf("Registration %d failed: %v", i, err)
 			}
@@ -1346,12 +4864,12 @@ func TestPerformanceBenchmarks(t *testing.T) {
 	})
 
 	t.Run("Benchmark Exchange Phase", func(t *testing.T) {
-		// Test the full exchange phase performance with 10 participants
+		// Test the full exchange phase performance with a full exchange circuit
 		auctioneerKp, _ := zerocash.GenerateDHKeyPair()
 		auctioneerECDHPriv, _, _ := generateECDHKeyPair()
 
-		// Create 10 registration payloads
-		N := 10
+		N := setupKeys.sizeF
+		ledger := zerocash.NewLedger()
 		regPayloads := make([]exchange.RegistrationPayload, N)
 
 		t.Logf("Preparing %d registration payloads for exchange benchmark...", N)
@@ -1359,12 +4877,12 @@ func TestPerformanceBenchmarks(t *testing.T) {
 			participantKp, _ := zerocash.GenerateDHKeyPair()
 			coins := big.NewInt(int64(1000 + i*100))
 			energy := big.NewInt(int64(50 + i*10))
-			bid := big.NewInt(int64(25 + i*2))
+			bid := newOrder(zerocash.OrderSide(i%2), 10, big.NewInt(int64(25+i*2)))
 			skIn := big.NewInt(int64(12345 + i))
 			pkOut := big.NewInt(int64(67890 + i))
 
 			sharedKey := zerocash.ComputeDHShared(participantKp.Sk, auctioneerKp.Pk)
-			ciphertext := register.EncryptRegistrationData(*sharedKey, coins, energy, bid, skIn, pkOut)
+			ciphertext := encryptRegistration(t, ledger, *sharedKey, coins, energy, bid, skIn, pkOut)
 
 			regPayloads[i] = exchange.RegistrationPayload{
 				Ciphertext: ciphertext,
@@ -1373,13 +4891,12 @@ func TestPerformanceBenchmarks(t *testing.T) {
 			}
 		}
 
-		ledger := zerocash.NewLedger()
 		params := &zerocash.Params{}
 
 		t.Logf("Running exchange phase benchmark...")
 		start := time.Now()
 
-		_, _, proof, err := exchange.ExchangePhaseWithNotes(regPayloads, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, setupKeys.pkF10, setupKeys.ccsF10)
+		_, _, proof, err := exchange.ExchangePhaseWithNotes(regPayloads, exchange.UniformPrice{}, auctioneerKp.Sk.BigInt(new(big.Int)), auctioneerECDHPriv, ledger, params, setupKeys.pkF, setupKeys.ccsF)
 		if err != nil {
 			t.Fatalf("Exchange benchmark failed: %v", err)
 		}
@@ -1408,79 +4925,77 @@ type CircuitKeys struct {
 	pkReg       groth16.ProvingKey
 	vkReg       groth16.VerifyingKey
 	ccsReg      constraint.ConstraintSystem
-	pkF10       groth16.ProvingKey
-	vkF10       groth16.VerifyingKey
-	ccsF10      constraint.ConstraintSystem
+	sizeF       int // Size of the exchange circuit
+	pkF         groth16.ProvingKey
+	vkF         groth16.VerifyingKey
+	ccsF        constraint.ConstraintSystem
 	pkWithdraw  groth16.ProvingKey
 	vkWithdraw  groth16.VerifyingKey
 	ccsWithdraw constraint.ConstraintSystem
 }
 
+// setupAllCircuitKeys returns the keys of the protocol circuits, with the exchange circuit of size 5.
 func setupAllCircuitKeys(t *testing.T) *CircuitKeys {
-	// CircuitTx
-	var circuitTx zerocash.CircuitTx
-	ccsTx, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitTx)
-	if err != nil {
-		t.Fatalf("CircuitTx compilation failed: %v", err)
-	}
-	pkTx, vkTx, err := groth16.Setup(ccsTx)
-	if err != nil {
-		t.Fatalf("CircuitTx key generation failed: %v", err)
-	}
+	keys := &CircuitKeys{sizeF: 5}
+	keys.ccsTx, keys.pkTx, keys.vkTx = circuitTestKeys(t, zerocash.CircuitTxID)
+	keys.ccsReg, keys.pkReg, keys.vkReg = circuitTestKeys(t, zerocash.CircuitRegisterID)
+	keys.ccsF, keys.pkF, keys.vkF = circuitTestKeys(t, zerocash.ExchangeCircuitID(keys.sizeF))
+	keys.ccsWithdraw, keys.pkWithdraw, keys.vkWithdraw = circuitTestKeys(t, zerocash.CircuitWithdrawID)
+	return keys
+}
 
-	// CircuitTxRegister
-	var circuitReg register.CircuitTxRegister
-	ccsReg, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitReg)
-	if err != nil {
-		t.Fatalf("CircuitTxRegister compilation failed: %v", err)
-	}
-	pkReg, vkReg, err := groth16.Setup(ccsReg)
-	if err != nil {
-		t.Fatalf("CircuitTxRegister key generation failed: %v", err)
-	}
+// largeCircuits enables the tests of exchange circuits larger than size 5, whose key generation
+// takes tens of minutes. It is set by building the tests with -tags large (see large_test.go).
+var largeCircuits bool
 
-	// CircuitTxF10
-	var circuitF10 exchange.CircuitTxF10
-	ccsF10, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitF10)
-	if err != nil {
-		t.Fatalf("CircuitTxF10 compilation failed: %v", err)
-	}
-	pkF10, vkF10, err := groth16.Setup(ccsF10)
-	if err != nil {
-		t.Fatalf("CircuitTxF10 key generation failed: %v", err)
+// exchangeTestSizes returns the exchange circuit sizes the tests prove with: 5, and every other
+// supported size with -tags large.
+func exchangeTestSizes() []int {
+	if largeCircuits {
+		return zerocash.SupportedSizes
 	}
+	return zerocash.SupportedSizes[:1]
+}
 
-	// CircuitWithdraw
-	var circuitWithdraw withdraw.CircuitWithdraw
-	ccsWithdraw, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitWithdraw)
+// testKeys caches Groth16 keys per circuit, so each circuit goes through setup once per test binary.
+var testKeys struct {
+	sync.Mutex
+	keys map[zerocash.CircuitID]*testKeyPair
+}
+
+type testKeyPair struct {
+	ccs constraint.ConstraintSystem
+	pk  groth16.ProvingKey
+	vk  groth16.VerifyingKey
+}
+
+// circuitTestKeys returns the registry's constraint system of a circuit and Groth16 keys for it,
+// running the setup on first use.
+func circuitTestKeys(t *testing.T, id zerocash.CircuitID) (constraint.ConstraintSystem, groth16.ProvingKey, groth16.VerifyingKey) {
+	t.Helper()
+	testKeys.Lock()
+	defer testKeys.Unlock()
+	if k, ok := testKeys.keys[id]; ok {
+		return k.ccs, k.pk, k.vk
+	}
+	ccs, err := zerocash.CompiledCircuit(id)
 	if err != nil {
-		t.Fatalf("CircuitWithdraw compilation failed: %v", err)
+		t.Fatalf("%s compilation failed: %v", id, err)
 	}
-	pkWithdraw, vkWithdraw, err := groth16.Setup(ccsWithdraw)
+	pk, vk, err := groth16.Setup(ccs)
 	if err != nil {
-		t.Fatalf("CircuitWithdraw key generation failed: %v", err)
+		t.Fatalf("%s key generation failed: %v", id, err)
 	}
-
-	return &CircuitKeys{
-		pkTx:        pkTx,
-		vkTx:        vkTx,
-		ccsTx:       ccsTx,
-		pkReg:       pkReg,
-		vkReg:       vkReg,
-		ccsReg:      ccsReg,
-		pkF10:       pkF10,
-		vkF10:       vkF10,
-		ccsF10:      ccsF10,
-		pkWithdraw:  pkWithdraw,
-		vkWithdraw:  vkWithdraw,
-		ccsWithdraw: ccsWithdraw,
+	if testKeys.keys == nil {
+		testKeys.keys = make(map[zerocash.CircuitID]*testKeyPair)
 	}
+	testKeys.keys[id] = &testKeyPair{ccs: ccs, pk: pk, vk: vk}
+	return ccs, pk, vk
 }
 
 func setupWithdrawalKeys(t *testing.T) *CircuitKeys {
 	// CircuitWithdraw
-	var circuitWithdraw withdraw.CircuitWithdraw
-	ccsWithdraw, err := frontend.Compile(ecc.BW6_761.ScalarField(), r1cs.NewBuilder, &circuitWithdraw)
+	ccsWithdraw, err := zerocash.CompiledCircuit(zerocash.CircuitWithdrawID)
 	if err != nil {
 		t.Fatalf("CircuitWithdraw compilation failed: %v", err)
 	}
@@ -1499,45 +5014,12 @@ func setupWithdrawalKeys(t *testing.T) *CircuitKeys {
 }
 
 func executeParticipantWithdrawal(t *testing.T, participant *zerocash.Participant, index int, setupKeys *CircuitKeys, secretKey []byte, originalBid *big.Int) bool {
-	// Create input note with proper commitment
-	inCoins := big.NewInt(100)
-	inEnergy := big.NewInt(50)
-	inPk := big.NewInt(12345)
-	inRho := big.NewInt(111)
-	inR := big.NewInt(222)
-
-	// Compute the commitment using MiMC like the circuit does
-	inCm := computeMimcCommitment(inCoins, inEnergy, inPk, inRho, inR)
-
-	nIn := withdraw.Note{
-		Coins:  inCoins,
-		Energy: inEnergy,
-		Pk:     inPk,
-		Rho:    inRho,
-		R:      inR,
-		Cm:     inCm,
-	}
-
-	// Create output note with proper commitment
-	outCoins := big.NewInt(90)  // Reduced by fee
-	outEnergy := big.NewInt(45) // Reduced by fee
-	outPk := big.NewInt(54321)
-	outRho := big.NewInt(444)
-	outR := big.NewInt(555)
-
-	// Compute the commitment using MiMC like the circuit does
-	outCm := computeMimcCommitment(outCoins, outEnergy, outPk, outRho, outR)
-
-	nOut := withdraw.Note{
-		Coins:  outCoins,
-		Energy: outEnergy,
-		Pk:     outPk,
-		Rho:    outRho,
-		R:      outR,
-		Cm:     outCm,
-	}
-
+	// The note to withdraw is in the ledger; the output note keeps its value
+	ledger := zerocash.NewLedger()
 	skIn := big.NewInt(12345)
+	outCoins, outEnergy := big.NewInt(100), big.NewInt(50)
+	nIn, nOut := withdrawalNotes(t, ledger, outCoins, outEnergy, skIn, big.NewInt(54321))
+	outPk := nOut.Pk
 
 	// Create participant's public key
 	participantKp, err := zerocash.GenerateDHKeyPair()
@@ -1558,7 +5040,7 @@ func executeParticipantWithdrawal(t *testing.T, participant *zerocash.Participan
 	}
 
 	// Execute withdrawal with correct parameter order
-	tx, proof, err := withdraw.Withdraw(nIn, skIn, nOut, pkT, cipherAux, originalBid, setupKeys.pkWithdraw, setupKeys.ccsWithdraw)
+	tx, proof, err := withdraw.Withdraw(nIn, skIn, nOut, pkT, cipherAux, originalBid, ledger, &zerocash.Params{}, setupKeys.pkWithdraw, setupKeys.ccsWithdraw)
 	if err != nil {
 		t.Logf("Withdrawal failed: %v", err)
 		return false
@@ -1575,7 +5057,7 @@ func executeParticipantWithdrawal(t *testing.T, participant *zerocash.Participan
 	}
 
 	// Verify withdrawal proof
-	err = withdraw.VerifyWithdraw(tx, proof, setupKeys.vkWithdraw)
+	err = withdraw.VerifyWithdraw(tx, proof, &zerocash.Params{}, setupKeys.vkWithdraw)
 	if err != nil {
 		t.Logf("Withdrawal verification failed: %v", err)
 		return false
@@ -1583,7 +5065,7 @@ func executeParticipantWithdrawal(t *testing.T, participant *zerocash.Participan
 
 	// Add the withdrawal output note to participant's wallet
 	withdrawalNote := zerocash.NewNote(outCoins, outEnergy, secretKey)
-	participant.Wallet.AddNote(withdrawalNote, secretKey, []byte{}, [5]byte{}, withdrawalNote)
+	participant.Wallet.AddNote(withdrawalNote, secretKey, nil, withdrawalNote)
 
 	return true // Indicate successful withdrawal
 }
@@ -1595,80 +5077,83 @@ func convertToGnarkPoint(p *bls12377.G1Affine) *sw_bls12377.G1Affine {
 	}
 }
 
-// Helper function to generate ECDH key pair for note encryption
-func generateECDHKeyPair() (*ecdh.PrivateKey, *ecdh.PublicKey, error) {
-	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, nil, err
-	}
-	return privKey, privKey.PublicKey(), nil
+// Helper function to build an order for quantity energy at a limit price per unit
+func newOrder(side zerocash.OrderSide, quantity int64, price *big.Int) zerocash.Order {
+	return zerocash.Order{Side: side, Quantity: big.NewInt(quantity), LimitPrice: price}
 }
 
-// convertExchangeToIndividualTxs converts an ExchangeTransaction into individual zerocash.Tx transactions
-// that can be added to the ledger for participants to claim
-func convertExchangeToIndividualTxs(exchangeTx *exchange.ExchangeTransaction, proof []byte) ([]*zerocash.Tx, error) {
-	if exchangeTx == nil {
-		return nil, fmt.Errorf("exchange transaction is nil")
-	}
+// Helper function to build the tx^in note a registration opens: coins and energy owned by KeyGen(skIn)
+func registeredNote(coins, energy, skIn *big.Int) *zerocash.Note {
+	return zerocash.NewNote(coins, energy, skIn.Bytes())
+}
 
-	if len(exchangeTx.Inputs) == 0 || len(exchangeTx.Outputs) == 0 {
-		return nil, fmt.Errorf("exchange transaction has no inputs or outputs")
-	}
+// Helper function to encrypt a registration whose tx^in note, owned by KeyGen(skIn), is recorded in ledger
+func encryptRegistration(t testing.TB, ledger *zerocash.Ledger, sharedKey bls12377.G1Affine, coins, energy *big.Int,
+	order zerocash.Order, skIn, pkOut *big.Int) [zerocash.RegistrationFields]*big.Int {
+	note := registeredNote(coins, energy, skIn)
+	addNoteToLedger(t, ledger, note)
+	return register.EncryptRegistrationData(sharedKey, note, order, skIn, pkOut)
+}
 
-	// Create individual transactions for each participant
-	var individualTxs []*zerocash.Tx
+// Helper function to build the input note of a withdrawal, recorded in ledger under skIn, and an
+// output note of the same value under skOut
+func withdrawalNotes(t testing.TB, ledger *zerocash.Ledger, coins, energy, skIn, skOut *big.Int) (withdraw.Note, withdraw.Note) {
+	noteIn := zerocash.NewNote(coins, energy, skIn.Bytes())
+	addNoteToLedger(t, ledger, noteIn)
+	noteOut := zerocash.NewNote(new(big.Int).Set(coins), new(big.Int).Set(energy), skOut.Bytes())
+	return toWithdrawNote(noteIn), toWithdrawNote(noteOut)
+}
 
-	// Ensure we have the same number of inputs and outputs
-	numTxs := len(exchangeTx.Inputs)
-	if len(exchangeTx.Outputs) < numTxs {
-		numTxs = len(exchangeTx.Outputs)
+// Helper function to convert a note to the withdraw representation
+func toWithdrawNote(n *zerocash.Note) withdraw.Note {
+	return withdraw.Note{
+		Coins:  n.Value.Coins,
+		Energy: n.Value.Energy,
+		Pk:     new(big.Int).SetBytes(n.PkOwner),
+		Rho:    new(big.Int).SetBytes(n.Rho),
+		R:      new(big.Int).SetBytes(n.Rand),
+		Cm:     new(big.Int).SetBytes(n.Cm),
 	}
+}
 
-	for i := 0; i < numTxs; i++ {
-		input := exchangeTx.Inputs[i]
-		output := exchangeTx.Outputs[i]
-
-		// Create old note from input
-		oldNote := &zerocash.Note{
-			Value: zerocash.Gamma{
-				Coins:  input.Coins,
-				Energy: input.Energy,
-			},
-			PkOwner: input.PkOut.Bytes(),
-			Rho:     make([]byte, 32),
-			Rand:    make([]byte, 32),
-			Cm:      make([]byte, 32),
-		}
-
-		// Create new note from output
-		newNote := &zerocash.Note{
-			Value: zerocash.Gamma{
-				Coins:  output.Coins,
-				Energy: output.Energy,
-			},
-			PkOwner: output.PkOut.Bytes(),
-			Rho:     make([]byte, 32),
-			Rand:    make([]byte, 32),
-			Cm:      make([]byte, 32),
-		}
+// Helper function to record a note's commitment in a ledger and return its authentication path
+func addNoteToLedger(t testing.TB, ledger *zerocash.Ledger, note *zerocash.Note) *zerocash.MerklePath {
+	index, err := ledger.AppendCommitment(note.Cm)
+	if err != nil {
+		t.Fatalf("Failed to add note commitment to ledger: %v", err)
+	}
+	path, err := ledger.MerklePath(index)
+	if err != nil {
+		t.Fatalf("Failed to get merkle path: %v", err)
+	}
+	return path
+}
 
-		// Create individual transaction
-		tx := &zerocash.Tx{
-			OldNote:   oldNote,
-			NewNote:   newNote,
-			Proof:     proof, // Share the same proof across all transactions
-			OldCoin:   input.Coins.String(),
-			OldEnergy: input.Energy.String(),
-			NewCoin:   output.Coins.String(),
-			NewEnergy: output.Energy.String(),
-			CmOld:     fmt.Sprintf("exchange_input_%d", i),
-			SnOld:     fmt.Sprintf("exchange_sn_%d", i),
-			PkOld:     input.PkOut.String(),
-			CmNew:     fmt.Sprintf("exchange_output_%d", i),
-		}
+// Helper function to build a public transaction whose output note is encrypted to recipient as CreateTx does
+func publicTxTo(note *zerocash.Note, recipient *bls12377.G1Affine, snOld []byte) *zerocash.PublicTx {
+	ephemeral, _ := zerocash.GenerateDHKeyPair()
+	return &zerocash.PublicTx{
+		SnOld:       new(big.Int).SetBytes(snOld).String(),
+		CmNew:       new(big.Int).SetBytes(note.Cm).String(),
+		CNewCircuit: zerocash.EncryptNoteWithSharedKey(note, zerocash.ComputeDHShared(ephemeral.Sk, recipient)),
+		G_r:         *convertToGnarkPoint(ephemeral.Pk),
+	}
+}
 
-		individualTxs = append(individualTxs, tx)
+// Helper function to generate the DH public key a transaction's new note is encrypted to
+func recipientKey(t testing.TB) *bls12377.G1Affine {
+	kp, err := zerocash.GenerateDHKeyPair()
+	if err != nil {
+		t.Fatalf("DH key generation failed: %v", err)
 	}
+	return kp.Pk
+}
 
-	return individualTxs, nil
+// Helper function to generate ECDH key pair for note encryption
+func generateECDHKeyPair() (*ecdh.PrivateKey, *ecdh.PublicKey, error) {
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return privKey, privKey.PublicKey(), nil
 }